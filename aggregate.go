@@ -0,0 +1,348 @@
+package rmdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Aggregate 增量计算的聚合函数。每组的状态由Init创建，每一行的值交给Accumulate，
+// 分组溢出到磁盘之后读回来时同一组的多个状态用Merge合并，最后由Finalize得到结果。
+// 状态中的值只能是EncodeData支持的类型，溢出时逐个编码
+type Aggregate interface {
+	Init() []any
+	Accumulate(state []any, val any) ([]any, error)
+	Merge(state, other []any) ([]any, error)
+	Finalize(state []any) (any, error)
+}
+
+// builtinAggregates 没有注册同名的聚合函数时使用，函数名不区分大小写，count(*)计算行数
+var builtinAggregates = map[string]Aggregate{
+	"count": countAggregate{},
+	"sum":   sumAggregate{},
+	"avg":   avgAggregate{},
+	"min":   extremeAggregate{sign: -1},
+	"max":   extremeAggregate{sign: 1},
+}
+
+// aggregate 按名字找聚合函数，SetAggFunc注册的优先，然后是SetAggregate注册的，最后是内置的
+func (d *Database) aggregate(name string) (Aggregate, bool) {
+	if function, ok := d.AggFuncs[name]; ok {
+		return listAggregate{function: function}, true
+	}
+	if agg, ok := d.Aggregates[name]; ok {
+		return agg, true
+	}
+	agg, ok := builtinAggregates[strings.ToLower(name)]
+	return agg, ok
+}
+
+// isAggregate 同名的条件函数、列函数、执行函数优先
+func (d *Database) isAggregate(name string) bool {
+	if d.CondiFuncs[name] != nil || d.ColFuncs[name] != nil || d.ExecFuncs[name] != nil {
+		return false
+	}
+	_, ok := d.aggregate(name)
+	return ok
+}
+
+// countAggregate 不是NULL的值的个数
+type countAggregate struct{}
+
+func (countAggregate) Init() []any {
+	return []any{int64(0)}
+}
+
+func (countAggregate) Accumulate(state []any, val any) ([]any, error) {
+	if val != nil {
+		state[0] = state[0].(int64) + 1
+	}
+	return state, nil
+}
+
+func (countAggregate) Merge(state, other []any) ([]any, error) {
+	state[0] = state[0].(int64) + other[0].(int64)
+	return state, nil
+}
+
+func (countAggregate) Finalize(state []any) (any, error) {
+	return state[0], nil
+}
+
+// sumAggregate 忽略NULL，整数的和是整数，有小数时是小数，没有值时是NULL
+type sumAggregate struct{}
+
+func (sumAggregate) Init() []any {
+	return []any{nil}
+}
+
+func (sumAggregate) Accumulate(state []any, val any) ([]any, error) {
+	if val == nil {
+		return state, nil
+	}
+	if state[0] == nil {
+		if !isNumber(val) {
+			return nil, fmt.Errorf("cannot sum %s", typeName(GetTypeOf(val)))
+		}
+		state[0] = val
+		return state, nil
+	}
+	sum, err := arithmetic("+", state[0], val)
+	if err != nil {
+		return nil, err
+	}
+	state[0] = sum
+	return state, nil
+}
+
+func (s sumAggregate) Merge(state, other []any) ([]any, error) {
+	return s.Accumulate(state, other[0])
+}
+
+func (sumAggregate) Finalize(state []any) (any, error) {
+	return state[0], nil
+}
+
+// avgAggregate 状态是和与个数，结果总是小数
+type avgAggregate struct{}
+
+func (avgAggregate) Init() []any {
+	return []any{float64(0), int64(0)}
+}
+
+func (avgAggregate) Accumulate(state []any, val any) ([]any, error) {
+	if val == nil {
+		return state, nil
+	}
+	if !isNumber(val) {
+		return nil, fmt.Errorf("cannot average %s", typeName(GetTypeOf(val)))
+	}
+	state[0] = state[0].(float64) + toFloat(val)
+	state[1] = state[1].(int64) + 1
+	return state, nil
+}
+
+func (avgAggregate) Merge(state, other []any) ([]any, error) {
+	state[0] = state[0].(float64) + other[0].(float64)
+	state[1] = state[1].(int64) + other[1].(int64)
+	return state, nil
+}
+
+func (avgAggregate) Finalize(state []any) (any, error) {
+	if state[1].(int64) == 0 {
+		return nil, nil
+	}
+	return state[0].(float64) / float64(state[1].(int64)), nil
+}
+
+// extremeAggregate sign为-1时是min，为1时是max，比较和where中的比较一致
+type extremeAggregate struct {
+	sign int
+}
+
+func (extremeAggregate) Init() []any {
+	return []any{nil}
+}
+
+func (e extremeAggregate) Accumulate(state []any, val any) ([]any, error) {
+	if val == nil {
+		return state, nil
+	}
+	if state[0] == nil {
+		state[0] = val
+		return state, nil
+	}
+	cmp, ok, err := compareValues(val, state[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("cannot compare %s with %s", typeName(GetTypeOf(val)), typeName(GetTypeOf(state[0])))
+	}
+	if cmp*e.sign > 0 {
+		state[0] = val
+	}
+	return state, nil
+}
+
+func (e extremeAggregate) Merge(state, other []any) ([]any, error) {
+	return e.Accumulate(state, other[0])
+}
+
+func (extremeAggregate) Finalize(state []any) (any, error) {
+	return state[0], nil
+}
+
+// listAggregate SetAggFunc注册的函数要拿到一组所有的值，状态就是这些值，溢出时也要写到磁盘
+type listAggregate struct {
+	function func([]any) any
+}
+
+func (listAggregate) Init() []any {
+	return make([]any, 0, 8)
+}
+
+func (listAggregate) Accumulate(state []any, val any) ([]any, error) {
+	return append(state, val), nil
+}
+
+func (listAggregate) Merge(state, other []any) ([]any, error) {
+	return append(state, other...), nil
+}
+
+func (l listAggregate) Finalize(state []any) (any, error) {
+	return l.function(state), nil
+}
+
+// aggGroup 一组的第一行和每个聚合函数的状态，size是估算的内存
+type aggGroup struct {
+	line   *Line
+	states [][]any
+	size   int64
+}
+
+// stateSize 估算状态占用的内存
+func stateSize(state []any) int64 {
+	return int64(len(state)) * 32
+}
+
+// appendStates 每个状态的值的个数，然后是每个值的类型和编码
+func appendStates(record []byte, states [][]any) ([]byte, error) {
+	record = binary.AppendUvarint(record, uint64(len(states)))
+	for _, state := range states {
+		record = binary.AppendUvarint(record, uint64(len(state)))
+		for _, val := range state {
+			data, err := EncodeData(val)
+			if err != nil {
+				return nil, err
+			}
+			record = binary.AppendVarint(record, int64(GetTypeOf(val)))
+			record = appendKey(record, data)
+		}
+	}
+	return record, nil
+}
+
+func (r *spillReader) states() ([][]any, error) {
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	states := make([][]any, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		state := make([]any, 0, length)
+		for j := uint64(0); j < length; j++ {
+			typeOf, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			data, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			val, err := DecodeData(data, int(typeOf))
+			if err != nil {
+				return nil, err
+			}
+			state = append(state, val)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// aggPartitions 超过预算时内存中所有的组按分组key的hash写到各个分区，同一组只会在同一个分区，
+// 分区一个一个读回来合并，每次只需要一个分区的组在内存中
+const aggPartitionCount = 16
+
+type aggPartitions struct {
+	backend Backend
+	paths   []string
+	files   []FileIO
+	writers []*bufio.Writer
+}
+
+func newAggPartitions(backend Backend, dir string) (*aggPartitions, error) {
+	p := &aggPartitions{backend: backend}
+	for i := 0; i < aggPartitionCount; i++ {
+		path := spillPath(dir, "agg_")
+		_ = backend.Remove(path) // 上次崩溃时留下的同名文件
+		file, err := backend.OpenFile(path)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.paths = append(p.paths, path)
+		p.files = append(p.files, file)
+		p.writers = append(p.writers, bufio.NewWriter(file))
+	}
+	return p, nil
+}
+
+func (p *aggPartitions) spill(groups map[[32]byte]*aggGroup) error {
+	record := make([]byte, 0, 256)
+	for key, group := range groups {
+		var err error
+		if record, err = appendStates(appendLine(record[:0], group.line), group.states); err != nil {
+			return err
+		}
+		writer := p.writers[key[0]%aggPartitionCount]
+		if _, err = writer.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+			return err
+		}
+		if _, err = writer.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read 读出第i个分区中的组
+func (p *aggPartitions) read(i int, visit func(line *Line, states [][]any) error) error {
+	if err := p.writers[i].Flush(); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(p.files[i], 0, p.files[i].Size()))
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := make([]byte, length)
+		if _, err = io.ReadFull(reader, record); err != nil {
+			return err
+		}
+		r := &spillReader{data: record}
+		line, err := r.line()
+		if err != nil {
+			return err
+		}
+		states, err := r.states()
+		if err != nil {
+			return err
+		}
+		if err = visit(line, states); err != nil {
+			return err
+		}
+	}
+}
+
+// close 关闭并删掉所有分区的文件
+func (p *aggPartitions) close() {
+	for _, file := range p.files {
+		_ = file.Close()
+	}
+	for _, path := range p.paths {
+		_ = p.backend.Remove(path)
+	}
+	p.paths, p.files, p.writers = nil, nil, nil
+}
@@ -0,0 +1,173 @@
+package rmdb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// groupRows 每组一行，按展示的字符串排序
+func groupRows(t *testing.T, db *Database, sql string, cols ...string) []string {
+	res, err := db.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]string, 0, len(res.result))
+	for _, line := range res.result {
+		vals := make([]string, 0, len(cols))
+		for _, col := range cols {
+			vals = append(vals, FormatData(line.nameToVal[col].value, line.nameToVal[col].column.TypeOf))
+		}
+		rows = append(rows, strings.Join(vals, " "))
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func TestAggregateBuiltin(t *testing.T) {
+	run := func(agg Aggregate, parts ...[]any) any {
+		var state []any
+		for _, vals := range parts {
+			partial := agg.Init()
+			for _, val := range vals {
+				var err error
+				partial, err = agg.Accumulate(partial, val)
+				assert.Nil(t, err)
+			}
+			if state == nil {
+				state = partial
+				continue
+			}
+			var err error
+			state, err = agg.Merge(state, partial)
+			assert.Nil(t, err)
+		}
+		result, err := agg.Finalize(state)
+		assert.Nil(t, err)
+		return result
+	}
+	assert.Equal(t, int64(3), run(countAggregate{}, []any{int64(1), nil}, []any{"a", true}))
+	assert.Equal(t, int64(6), run(sumAggregate{}, []any{int64(1), nil}, []any{int64(5)}))
+	assert.Equal(t, 6.5, run(sumAggregate{}, []any{int64(1), 0.5}, []any{int64(5)}))
+	assert.Nil(t, run(sumAggregate{}, []any{nil}, []any{}), "sum of nothing is null")
+	assert.Equal(t, 2.0, run(avgAggregate{}, []any{int64(1), nil}, []any{int64(2), 3.0}))
+	assert.Nil(t, run(avgAggregate{}, []any{nil}))
+	assert.Equal(t, "a", run(builtinAggregates["min"], []any{"b", nil}, []any{"a", "c"}))
+	assert.Equal(t, int64(7), run(builtinAggregates["max"], []any{int64(7), 2.5}, []any{nil, int64(-1)}))
+
+	_, err := sumAggregate{}.Accumulate(sumAggregate{}.Init(), "x")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "cannot sum STRING", err.Error())
+	}
+	state, _ := builtinAggregates["max"].Accumulate([]any{nil}, true)
+	_, err = builtinAggregates["max"].Accumulate(state, int64(1))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "cannot compare INT64 with BOOL", err.Error())
+	}
+
+	record, err := appendStates(nil, [][]any{{int64(1), nil, "s"}, {2.5, true, time.Unix(0, 5)}, {}})
+	assert.Nil(t, err)
+	states, err := (&spillReader{data: record}).states()
+	if assert.Nil(t, err) {
+		assert.Equal(t, [][]any{{int64(1), nil, "s"}, {2.5, true, time.Unix(0, 5)}, {}}, states)
+	}
+}
+
+// productAggregate 测试用的增量聚合函数，状态是乘积
+type productAggregate struct{}
+
+func (productAggregate) Init() []any {
+	return []any{int64(1)}
+}
+
+func (productAggregate) Accumulate(state []any, val any) ([]any, error) {
+	if val != nil {
+		state[0] = state[0].(int64) * val.(int64)
+	}
+	return state, nil
+}
+
+func (productAggregate) Merge(state, other []any) ([]any, error) {
+	state[0] = state[0].(int64) * other[0].(int64)
+	return state, nil
+}
+
+func (productAggregate) Finalize(state []any) (any, error) {
+	return state[0], nil
+}
+
+func TestAggregation(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(db.AggFuncs, "sum") // 其它测试注册的sum会覆盖内置的
+	assert.Nil(t, db.Update("create table man (name STRING, city STRING, age INT64, score FLOAT64)"))
+	assert.Equal(t, []string{"0 NULL NULL"}, groupRows(t, db, "select count(*), sum(age), max(name) from man", "count(*)", "sum(age)", "max(name)"), "no group by has one group even without rows")
+	for _, sql := range []string{
+		`insert into man (name, city, age, score) values ("a", "bj", 9, 1.5)`,
+		`insert into man (name, city, age, score) values ("b", "bj", 12, 2)`,
+		`insert into man (name, city, age) values ("c", "bj", 5)`,
+		`insert into man (name, city, score) values ("d", "sh", 4)`,
+		`insert into man (name, age, score) values ("e", 3, 0.5)`,
+	} {
+		assert.Nil(t, db.Update(sql))
+	}
+	assert.Equal(t, []string{"NULL 1 1 3 3 0.5 e e", "bj 3 3 26 8.666666666666666 2 a c", "sh 1 0 NULL NULL 4 d d"},
+		groupRows(t, db, "select city, COUNT(*) as n, count(age) as ages, sum(age) as total, avg(age) as mean, max(score) as best, min(name) as first, max(name) as last from man group by city",
+			"city", "n", "ages", "total", "mean", "best", "first", "last"))
+	assert.Equal(t, []string{"5 34 8"}, groupRows(t, db, "select count(*), sum(age) + 5 as s, sum(score) from man", "count(*)", "s", "sum(score)"))
+	assert.Equal(t, []string{"bj 3"}, groupRows(t, db, "select city, count(*) from man group by city having count(*) > 1", "city", "count(*)"))
+
+	db.Aggregates["prod"] = productAggregate{}
+	db.AggFuncs["sum"] = func(vals []any) any { // 注册的同名函数优先
+		return int64(len(vals))
+	}
+	assert.Equal(t, []string{"NULL 3 1", "bj 540 3", "sh 1 1"}, groupRows(t, db, "select city, prod(age), sum(age) from man group by city", "city", "prod(age)", "sum(age)"))
+	delete(db.AggFuncs, "sum")
+
+	for sql, expected := range map[string]string{
+		"select avg(name) from man":                 "avg(name): cannot average STRING",
+		"select sum(*) from man":                    "sum(*) is not supported",
+		"select sum(height) from man group by city": "column height not exists",
+		"select * from man where count(*) > 1":      "aggregate function count is not allowed here",
+	} {
+		_, err = db.Query(sql)
+		if assert.NotNil(t, err, sql) {
+			assert.Equal(t, expected, err.Error(), sql)
+		}
+	}
+
+	GlobalOption.AggBufferSize = 512
+	expected := groupRows(t, db, "select city, count(*), sum(age), avg(score), max(name) from man group by city", "city", "count(*)", "sum(age)", "avg(score)", "max(name)")
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into man (name, city, age, score) values ("x%d", "c%d", %d, %d.5)`, i, i%40, i, i%7)))
+	}
+	rows := groupRows(t, db, "select city, count(*), sum(age), avg(score), max(name) from man group by city", "city", "count(*)", "sum(age)", "avg(score)", "max(name)")
+	if assert.Len(t, rows, 43) {
+		assert.Equal(t, expected, []string{rows[0], rows[1], rows[42]}, "groups spilled to partitions merge back")
+		sum, count := 0, 0
+		for i := 0; i < 300; i += 40 {
+			sum += i
+			count++
+		}
+		assert.Equal(t, fmt.Sprint("c0 ", count, " ", sum), strings.Join(strings.Fields(rows[2])[:3], " "))
+	}
+	db.AggFuncs["names"] = func(vals []any) any {
+		return int64(len(vals))
+	}
+	assert.Equal(t, []string{"305"}, groupRows(t, db, "select names(name) from man", "names(name)"), "registered functions see every value after spilling")
+	entries, err := os.ReadDir(GlobalOption.Root + string(os.PathSeparator) + "aggregation")
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasSuffix(entry.Name(), spillSuffix), entry.Name())
+	}
+	assert.Nil(t, db.Close())
+}
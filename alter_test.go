@@ -0,0 +1,140 @@
+package rmdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queryColumn(t *testing.T, db *Database, column string) map[string]string {
+	res, err := db.Query("select * from test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string, len(res.result))
+	for _, line := range res.result {
+		colVal, ok := line.nameToVal[column]
+		if !ok {
+			values[FormatData(line.nameToVal["id"].value, INT64)] = "missing"
+			continue
+		}
+		values[FormatData(line.nameToVal["id"].value, INT64)] = FormatData(colVal.value, colVal.column.TypeOf)
+	}
+	return values
+}
+
+func TestAlterTable(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.MaxLine = 2
+
+	db, err := CreateDatabase("alter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, table.SetColumn("id", INT64))
+	assert.Nil(t, table.SetColumn("name", STRING))
+	assert.Nil(t, table.SetColumn("age", INT64))
+	assert.NotNil(t, table.SetColumn("age", INT64), "duplicate column should be rejected")
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into test (id, name, age) values (%d, "n%d", %d)`, i, i, i*10)))
+	}
+	assert.Nil(t, db.Checkpoint())
+
+	assert.Nil(t, db.Alter(`alter table test add column city STRING default "x"`))
+	assert.Nil(t, db.Alter(`ALTER TABLE test ADD score INT64`))
+	assert.Nil(t, db.Update(`insert into test (id, name, age, city, score) values (3, "n3", 30, "y", 7)`))
+	assert.Equal(t, map[string]string{"0": "x", "1": "x", "2": "x", "3": "y"}, queryColumn(t, db, "city"))
+	assert.Equal(t, map[string]string{"0": "NULL", "1": "NULL", "2": "NULL", "3": "7"}, queryColumn(t, db, "score"))
+
+	assert.Nil(t, db.Alter(`alter table test drop column age`))
+	assert.Equal(t, uint64(1), table.Version)
+	assert.Equal(t, map[string]string{"0": "missing", "1": "missing", "2": "missing", "3": "missing"}, queryColumn(t, db, "age"))
+	assert.Nil(t, db.Alter(`alter table test add age STRING`)) // 同名的新列不会读到删掉的旧值
+	assert.Equal(t, map[string]string{"0": "NULL", "1": "NULL", "2": "NULL", "3": "NULL"}, queryColumn(t, db, "age"))
+
+	assert.Nil(t, db.Alter(`alter table test rename column name to title`))
+	assert.Equal(t, map[string]string{"0": "n0", "1": "n1", "2": "n2", "3": "n3"}, queryColumn(t, db, "title"))
+
+	assert.Nil(t, db.Update(`update test set score = 1 where score is null`))
+	assert.Nil(t, db.Alter(`alter table test modify score FLOAT64`))
+	assert.Nil(t, db.Update(`insert into test (id, title, city, score) values (4, "n4", "z", 2.5)`))
+	assert.Nil(t, db.Alter(`alter table test modify column score STRING`))
+	assert.Equal(t, map[string]string{"0": "1", "1": "1", "2": "1", "3": "7", "4": "2.5"}, queryColumn(t, db, "score"))
+
+	err = db.Alter(`alter table test modify city INT64`)
+	assert.NotNil(t, err, "values that cannot be converted should reject the change")
+	assert.Equal(t, STRING, table.Columns[columnIndex(table.Columns, "city")].TypeOf)
+	assert.NotNil(t, db.Alter(`alter table test drop nothing`))
+	assert.NotNil(t, db.Alter(`alter table test rename title to city`))
+	assert.NotNil(t, db.Alter(`alter table test rename title to a-b`), "new name is checked like add column")
+	assert.NotNil(t, table.RenameColumn("title", "1st"))
+	assert.NotNil(t, db.Alter(`alter table test add bad BLOB`))
+	assert.NotNil(t, db.Alter(`alter table none drop city`))
+
+	expected := map[string]map[string]string{
+		"title": {"0": "n0", "1": "n1", "2": "n2", "3": "n3", "4": "n4"},
+		"city":  {"0": "x", "1": "x", "2": "x", "3": "y", "4": "z"},
+		"score": {"0": "1", "1": "1", "2": "1", "3": "7", "4": "2.5"},
+	}
+	for column, values := range expected {
+		assert.Equal(t, values, queryColumn(t, db, column), column)
+	}
+	assert.Nil(t, db.Close())
+
+	report, err := Fsck(fmt.Sprint(GlobalOption.Root, "/alter"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.Healthy(), report.String())
+
+	db, err = UseDatabase("alter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for column, values := range expected {
+		assert.Equal(t, values, queryColumn(t, db, column), column)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestConvertData(t *testing.T) {
+	cases := []struct {
+		from   any
+		to     int
+		expect string
+	}{
+		{int64(3), FLOAT64, "3"},
+		{int64(1), BOOL, "true"},
+		{true, INT64, "1"},
+		{float64(4), INT64, "4"},
+		{"12", INT64, "12"},
+		{"2.5", FLOAT64, "2.5"},
+		{"false", BOOL, "false"},
+		{time.Unix(0, 0), STRING, time.Unix(0, 0).Format(time.RFC3339Nano)},
+		{"1970-01-01T00:00:00Z", DATE, time.Unix(0, 0).Format(time.RFC3339Nano)},
+	}
+	for _, c := range cases {
+		data, _ := EncodeData(c.from)
+		converted, err := convertData(data, GetTypeOf(c.from), c.to)
+		if assert.Nil(t, err, fmt.Sprint(c.from)) {
+			assert.Equal(t, c.expect, FormatData(converted, c.to))
+		}
+	}
+	for _, c := range []struct {
+		from any
+		to   int
+	}{{float64(2.5), INT64}, {int64(2), BOOL}, {"abc", INT64}, {true, DATE}} {
+		data, _ := EncodeData(c.from)
+		_, err := convertData(data, GetTypeOf(c.from), c.to)
+		assert.NotNil(t, err, fmt.Sprint(c.from, " to ", typeName(c.to)))
+	}
+	converted, err := convertData(nil, INT64, STRING)
+	assert.Nil(t, err)
+	assert.Nil(t, converted, "NULL stays NULL")
+}
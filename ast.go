@@ -0,0 +1,473 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 语法树，String返回等价的sql，insert分配了auto_increment的值之后按String写入wal
+
+// Statement 是*SelectStmt、*InsertStmt、*UpdateStmt或者*DeleteStmt
+type Statement interface {
+	String() string
+	statement()
+}
+
+// Expr 条件、select的列和update赋的值
+type Expr interface {
+	String() string
+	expr()
+}
+
+type SelectStmt struct {
+	Distinct bool
+	Fields   []*SelectField
+	Table    string
+	Where    []Expr // 条件之间是and的关系，最外层的and拆成多个条件
+	GroupBy  []string
+	Having   []Expr
+	OrderBy  []*OrderItem
+	Limit    *LimitClause
+}
+
+type SelectField struct {
+	Expr  Expr // *Star或者表达式
+	Alias string
+}
+
+type OrderItem struct {
+	Expr  Expr // *ColumnRef或者*FuncCall
+	Desc  bool
+	Nulls NullsOrder
+}
+
+// NullsOrder 默认NULL比其它值都小，升序时在最前面，降序时在最后面
+type NullsOrder int8
+
+const (
+	NullsDefault NullsOrder = iota
+	NullsFirst
+	NullsLast
+)
+
+type LimitClause struct {
+	Offset, Count uint64
+}
+
+type InsertStmt struct {
+	Table   string
+	Columns []string
+	Values  []*Literal
+}
+
+type UpdateStmt struct {
+	Table string
+	Set   []*Assignment
+	Where []Expr
+}
+
+type Assignment struct {
+	Column string
+	Value  Expr // 按更新前的行求值
+}
+
+type DeleteStmt struct {
+	Table string
+	Where []Expr
+}
+
+type Star struct{}
+
+type ColumnRef struct {
+	Name string
+}
+
+type LiteralKind int8
+
+const (
+	NullLiteral LiteralKind = iota
+	BoolLiteral
+	NumberLiteral
+	StringLiteral
+)
+
+// Literal 字符串的Value是去掉引号和转义之后的内容，数字的Value带符号
+type Literal struct {
+	Kind  LiteralKind
+	Value string
+}
+
+// FuncCall 注册的函数、聚合函数的结果或者内置的coalesce和match
+type FuncCall struct {
+	Name string
+	Args []Expr
+}
+
+type IsNullExpr struct {
+	Expr Expr
+	Not  bool
+}
+
+// CompareExpr Op是= != < > <= >=，<>解析成!=
+type CompareExpr struct {
+	Op          string
+	Left, Right Expr
+}
+
+type BetweenExpr struct {
+	Expr, Lower, Upper Expr
+	Not                bool
+}
+
+// BinaryExpr Op是and、or或者+ - * / %
+type BinaryExpr struct {
+	Op          string
+	Left, Right Expr
+}
+
+// UnaryExpr Op是not或者-
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+type InExpr struct {
+	Expr Expr
+	List []Expr
+	Not  bool
+}
+
+// LikeExpr %匹配任意个字符，_匹配一个字符，反斜杠转义
+type LikeExpr struct {
+	Expr, Pattern Expr
+	Not           bool
+}
+
+// CaseExpr Operand为nil时是case when 条件 then ...，否则是case 值 when 值 then ...
+type CaseExpr struct {
+	Operand Expr
+	Whens   []*WhenClause
+	Else    Expr
+}
+
+type WhenClause struct {
+	When, Then Expr
+}
+
+type CastExpr struct {
+	Expr   Expr
+	TypeOf int
+}
+
+func (*SelectStmt) statement() {}
+func (*InsertStmt) statement() {}
+func (*UpdateStmt) statement() {}
+func (*DeleteStmt) statement() {}
+
+func (*Star) expr()        {}
+func (*ColumnRef) expr()   {}
+func (*Literal) expr()     {}
+func (*FuncCall) expr()    {}
+func (*IsNullExpr) expr()  {}
+func (*CompareExpr) expr() {}
+func (*BetweenExpr) expr() {}
+func (*BinaryExpr) expr()  {}
+func (*UnaryExpr) expr()   {}
+func (*InExpr) expr()      {}
+func (*LikeExpr) expr()    {}
+func (*CaseExpr) expr()    {}
+func (*CastExpr) expr()    {}
+
+func (s *SelectStmt) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("select ")
+	if s.Distinct {
+		buf.WriteString("distinct ")
+	}
+	for i, field := range s.Fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(field.Expr.String())
+		if field.Alias != "" {
+			buf.WriteString(" as ")
+			buf.WriteString(quoteIdent(field.Alias))
+		}
+	}
+	buf.WriteString(" from ")
+	buf.WriteString(quoteIdent(s.Table))
+	writeConditions(buf, " where ", s.Where)
+	if len(s.GroupBy) != 0 {
+		buf.WriteString(" group by ")
+		buf.WriteString(joinIdents(s.GroupBy))
+	}
+	writeConditions(buf, " having ", s.Having)
+	for i, item := range s.OrderBy {
+		if i == 0 {
+			buf.WriteString(" order by ")
+		} else {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(item.Expr.String())
+		if item.Desc {
+			buf.WriteString(" desc")
+		}
+		switch item.Nulls {
+		case NullsFirst:
+			buf.WriteString(" nulls first")
+		case NullsLast:
+			buf.WriteString(" nulls last")
+		}
+	}
+	if s.Limit != nil {
+		fmt.Fprintf(buf, " limit %d, %d", s.Limit.Offset, s.Limit.Count)
+	}
+	return buf.String()
+}
+
+func writeConditions(buf *strings.Builder, keyword string, conditions []Expr) {
+	for i, condition := range conditions {
+		if i == 0 {
+			buf.WriteString(keyword)
+		} else {
+			buf.WriteString(" and ")
+		}
+		if len(conditions) > 1 {
+			buf.WriteString(wrap(condition, precAnd))
+		} else {
+			buf.WriteString(condition.String())
+		}
+	}
+}
+
+func (s *InsertStmt) String() string {
+	values := make([]string, 0, len(s.Values))
+	for _, value := range s.Values {
+		values = append(values, value.String())
+	}
+	return fmt.Sprintf("insert into %s (%s) values (%s)", quoteIdent(s.Table), joinIdents(s.Columns), strings.Join(values, ", "))
+}
+
+func joinIdents(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteIdent(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func (s *UpdateStmt) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("update ")
+	buf.WriteString(quoteIdent(s.Table))
+	for i, assignment := range s.Set {
+		if i == 0 {
+			buf.WriteString(" set ")
+		} else {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteIdent(assignment.Column))
+		buf.WriteString(" = ")
+		buf.WriteString(assignment.Value.String())
+	}
+	writeConditions(buf, " where ", s.Where)
+	return buf.String()
+}
+
+func (s *DeleteStmt) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("delete from ")
+	buf.WriteString(quoteIdent(s.Table))
+	writeConditions(buf, " where ", s.Where)
+	return buf.String()
+}
+
+func (*Star) String() string {
+	return "*"
+}
+
+func (c *ColumnRef) String() string {
+	return quoteIdent(c.Name)
+}
+
+// String 字符串用双引号和json的转义
+func (l *Literal) String() string {
+	switch l.Kind {
+	case NullLiteral:
+		return "null"
+	case StringLiteral:
+		buf := new(bytes.Buffer)
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		_ = encoder.Encode(l.Value)
+		return strings.TrimSuffix(buf.String(), "\n")
+	default:
+		return l.Value
+	}
+}
+
+// 运算符的优先级，子表达式的优先级更低时String加括号
+const (
+	precOr = iota + 1
+	precAnd
+	precNot
+	precCompare // 比较、is null、between、in和like
+	precAdd
+	precMul
+	precNeg
+	precPrimary
+)
+
+func precedence(expr Expr) int {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		switch e.Op {
+		case "or":
+			return precOr
+		case "and":
+			return precAnd
+		case "+", "-":
+			return precAdd
+		default:
+			return precMul
+		}
+	case *UnaryExpr:
+		if e.Op == "not" {
+			return precNot
+		}
+		return precNeg
+	case *CompareExpr, *IsNullExpr, *BetweenExpr, *InExpr, *LikeExpr:
+		return precCompare
+	}
+	return precPrimary
+}
+
+func wrap(expr Expr, prec int) string {
+	if precedence(expr) < prec {
+		return fmt.Sprint("(", expr.String(), ")")
+	}
+	return expr.String()
+}
+
+// String 和结果中函数列的列名一致
+func (f *FuncCall) String() string {
+	args := make([]string, 0, len(f.Args))
+	for _, arg := range f.Args {
+		args = append(args, arg.String())
+	}
+	return fmt.Sprint(f.Name, "(", strings.Join(args, ","), ")")
+}
+
+func (e *IsNullExpr) String() string {
+	if e.Not {
+		return fmt.Sprint(wrap(e.Expr, precAdd), " is not null")
+	}
+	return fmt.Sprint(wrap(e.Expr, precAdd), " is null")
+}
+
+func (e *CompareExpr) String() string {
+	return fmt.Sprint(wrap(e.Left, precAdd), " ", e.Op, " ", wrap(e.Right, precAdd))
+}
+
+func (e *BetweenExpr) String() string {
+	return fmt.Sprint(wrap(e.Expr, precAdd), notString(e.Not), " between ", wrap(e.Lower, precAdd), " and ", wrap(e.Upper, precAdd))
+}
+
+func notString(not bool) string {
+	if not {
+		return " not"
+	}
+	return ""
+}
+
+// String 左结合，右边的子表达式优先级相同时也加括号
+func (e *BinaryExpr) String() string {
+	prec := precedence(e)
+	return fmt.Sprint(wrap(e.Left, prec), " ", e.Op, " ", wrap(e.Right, prec+1))
+}
+
+func (e *UnaryExpr) String() string {
+	if e.Op == "not" {
+		return fmt.Sprint("not ", wrap(e.Expr, precNot))
+	}
+	operand := wrap(e.Expr, precNeg)
+	if strings.HasPrefix(operand, "-") { // --是注释
+		operand = fmt.Sprint("(", operand, ")")
+	}
+	return fmt.Sprint("-", operand)
+}
+
+func (e *InExpr) String() string {
+	items := make([]string, 0, len(e.List))
+	for _, item := range e.List {
+		items = append(items, item.String())
+	}
+	return fmt.Sprint(wrap(e.Expr, precAdd), notString(e.Not), " in (", strings.Join(items, ", "), ")")
+}
+
+func (e *LikeExpr) String() string {
+	return fmt.Sprint(wrap(e.Expr, precAdd), notString(e.Not), " like ", wrap(e.Pattern, precAdd))
+}
+
+func (e *CaseExpr) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("case")
+	if e.Operand != nil {
+		buf.WriteString(" ")
+		buf.WriteString(e.Operand.String())
+	}
+	for _, when := range e.Whens {
+		buf.WriteString(" when ")
+		buf.WriteString(when.When.String())
+		buf.WriteString(" then ")
+		buf.WriteString(when.Then.String())
+	}
+	if e.Else != nil {
+		buf.WriteString(" else ")
+		buf.WriteString(e.Else.String())
+	}
+	buf.WriteString(" end")
+	return buf.String()
+}
+
+func (e *CastExpr) String() string {
+	return fmt.Sprint("cast(", e.Expr.String(), " as ", typeName(e.TypeOf), ")")
+}
+
+// walkExpr 先访问expr，visit返回true时再访问子表达式
+func walkExpr(expr Expr, visit func(Expr) bool) {
+	if expr == nil || !visit(expr) {
+		return
+	}
+	var children []Expr
+	switch e := expr.(type) {
+	case *FuncCall:
+		children = e.Args
+	case *IsNullExpr:
+		children = []Expr{e.Expr}
+	case *CompareExpr:
+		children = []Expr{e.Left, e.Right}
+	case *BetweenExpr:
+		children = []Expr{e.Expr, e.Lower, e.Upper}
+	case *BinaryExpr:
+		children = []Expr{e.Left, e.Right}
+	case *UnaryExpr:
+		children = []Expr{e.Expr}
+	case *InExpr:
+		children = append([]Expr{e.Expr}, e.List...)
+	case *LikeExpr:
+		children = []Expr{e.Expr, e.Pattern}
+	case *CaseExpr:
+		children = []Expr{e.Operand, e.Else}
+		for _, when := range e.Whens {
+			children = append(children, when.When, when.Then)
+		}
+	case *CastExpr:
+		children = []Expr{e.Expr}
+	}
+	for _, child := range children {
+		walkExpr(child, visit)
+	}
+}
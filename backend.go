@@ -0,0 +1,411 @@
+package rmdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend 存储后端，数据库目录下的所有文件操作都通过它完成
+type Backend interface {
+	OpenFile(path string) (FileIO, error) // 不存在时创建，写入总是追加到文件末尾
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte) error // 覆盖写并落盘
+	Exists(path string) (bool, error)
+	Remove(path string) error
+	RemoveAll(path string) error
+	Rename(oldPath, newPath string) error
+	MkdirAll(path string) error
+	ReadDir(path string) ([]string, error)
+	SyncDir(path string) error // rename之后要fsync目录，rename才算落盘
+}
+
+var (
+	backends = map[string]Backend{
+		"standard": stdBackend{},
+		"mmap":     mmapBackend{},
+		"memory":   NewMemBackend(),
+	}
+	backendLock sync.RWMutex
+)
+
+// RegisterBackend 注册存储后端，之后可以通过GlobalOption.Backend使用，同名的会被覆盖
+func RegisterBackend(name string, backend Backend) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	backends[name] = backend
+}
+
+func GetBackend(name string) (Backend, error) {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+	backend, ok := backends[name]
+	if !ok {
+		return nil, errors.New("backend not registered")
+	}
+	return backend, nil
+}
+
+func currentBackend() (Backend, error) { // 没有设置Backend时按IOMode选择，兼容旧的配置
+	name := GlobalOption.Backend
+	if name == "" {
+		switch GlobalOption.IOMode {
+		case Standard:
+			name = "standard"
+		case MMapMode:
+			name = "mmap"
+		default:
+			return nil, errors.New("invaild io mode")
+		}
+	}
+	return GetBackend(name)
+}
+
+type stdFile struct {
+	*os.File
+	size int64 // 以追加方式打开，写入位置总是文件末尾
+}
+
+func (s *stdFile) Write(b []byte) (int, error) {
+	n, err := s.File.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *stdFile) Size() int64 {
+	return s.size
+}
+
+type stdBackend struct{}
+
+func (stdBackend) OpenFile(path string) (FileIO, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &stdFile{File: file, size: info.Size()}, nil
+}
+
+func (stdBackend) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (stdBackend) WriteFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (stdBackend) Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (stdBackend) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (stdBackend) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (stdBackend) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (stdBackend) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0644)
+}
+
+func (stdBackend) ReadDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (stdBackend) SyncDir(path string) error { // windows不支持对目录fsync
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type mmapBackend struct {
+	stdBackend
+}
+
+func (mmapBackend) OpenFile(path string) (FileIO, error) {
+	return NewMMap(path, GlobalOption.MmapSize) // 写满之后会自动扩容
+}
+
+func (b mmapBackend) ReadFile(path string) ([]byte, error) { // 打开着的和崩溃后的文件只返回尾标记之前的数据
+	data, err := b.stdBackend.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return data[:mmapLength(data)], nil
+}
+
+// MemBackend 纯内存的存储后端，进程退出后数据就没了，用于测试和临时缓存
+type MemBackend struct {
+	files map[string]*memData
+	dirs  map[string]struct{}
+	lock  sync.RWMutex
+}
+
+type memData struct {
+	buf  []byte
+	lock sync.RWMutex
+}
+
+type memFile struct {
+	name   string
+	data   *memData // rename和remove不影响已经打开的文件，和posix一致
+	closed bool
+}
+
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		files: make(map[string]*memData, 64),
+		dirs:  make(map[string]struct{}, 16),
+	}
+}
+
+func memNotExist(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+func (m *MemBackend) OpenFile(path string) (FileIO, error) {
+	path = filepath.Clean(path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.dirs[filepath.Dir(path)]; !ok {
+		return nil, memNotExist("open", path)
+	}
+	data, ok := m.files[path]
+	if !ok {
+		data = &memData{}
+		m.files[path] = data
+	}
+	return &memFile{name: path, data: data}, nil
+}
+
+func (m *MemBackend) ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	m.lock.RLock()
+	data, ok := m.files[path]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, memNotExist("open", path)
+	}
+	data.lock.RLock()
+	defer data.lock.RUnlock()
+	return append([]byte{}, data.buf...), nil
+}
+
+func (m *MemBackend) WriteFile(path string, buf []byte) error {
+	path = filepath.Clean(path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.dirs[filepath.Dir(path)]; !ok {
+		return memNotExist("open", path)
+	}
+	m.files[path] = &memData{buf: append([]byte{}, buf...)}
+	return nil
+}
+
+func (m *MemBackend) Exists(path string) (bool, error) {
+	path = filepath.Clean(path)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if _, ok := m.files[path]; ok {
+		return true, nil
+	}
+	_, ok := m.dirs[path]
+	return ok, nil
+}
+
+func (m *MemBackend) Remove(path string) error {
+	path = filepath.Clean(path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if _, ok := m.dirs[path]; ok {
+		prefix := path + string(os.PathSeparator)
+		for name := range m.files {
+			if strings.HasPrefix(name, prefix) {
+				return errors.New("directory not empty")
+			}
+		}
+		delete(m.dirs, path)
+		return nil
+	}
+	return memNotExist("remove", path)
+}
+
+func (m *MemBackend) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	prefix := path + string(os.PathSeparator)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name := range m.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	for name := range m.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (m *MemBackend) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.files[oldPath]
+	if !ok {
+		return memNotExist("rename", oldPath)
+	}
+	if _, ok := m.dirs[filepath.Dir(newPath)]; !ok {
+		return memNotExist("rename", newPath)
+	}
+	delete(m.files, oldPath)
+	m.files[newPath] = data
+	return nil
+}
+
+func (m *MemBackend) MkdirAll(path string) error {
+	path = filepath.Clean(path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for {
+		m.dirs[path] = struct{}{}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
+
+func (m *MemBackend) ReadDir(path string) ([]string, error) {
+	path = filepath.Clean(path)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if _, ok := m.dirs[path]; !ok {
+		return nil, memNotExist("open", path)
+	}
+	names := make([]string, 0, 16)
+	for name := range m.files {
+		if filepath.Dir(name) == path {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != path && filepath.Dir(name) == path {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemBackend) SyncDir(path string) error {
+	return nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.data.lock.Lock()
+	defer f.data.lock.Unlock()
+	f.data.buf = append(f.data.buf, b...)
+	return len(b), nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.data.lock.RLock()
+	defer f.data.lock.RUnlock()
+	if off < 0 || off >= int64(len(f.data.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Size() int64 {
+	f.data.lock.RLock()
+	defer f.data.lock.RUnlock()
+	return int64(len(f.data.buf))
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,80 @@
+package rmdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemBackend(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.Root = filepath.Join(GlobalOption.Root, "memory")
+	GlobalOption.Backend = "memory"
+	backend, err := GetBackend("memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, backend.MkdirAll(GlobalOption.Root))
+
+	db, err := CreateDatabase("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = db.Update(fmt.Sprintf(`insert into test (name) values ("name%d")`, i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Checkpoint())
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(GlobalOption.Root)
+	assert.True(t, os.IsNotExist(err), "memory backend should not touch disk")
+
+	names, err := backend.ReadDir(fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "mem"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cata.log", "test.data"}, names)
+
+	db, err = UseDatabase("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from test")
+	if assert.Nil(t, err) {
+		assert.Len(t, res.result, 20)
+	}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, DropDatabase("mem"))
+	_, err = UseDatabase("mem")
+	assert.NotNil(t, err)
+}
+
+func TestRegisterBackend(t *testing.T) {
+	setTestOption(t)
+	RegisterBackend("test-memory", NewMemBackend())
+	GlobalOption.Backend = "test-memory"
+	backend, err := currentBackend()
+	assert.Nil(t, err)
+	assert.Nil(t, backend.MkdirAll("dir"))
+	file, err := OpenFile(filepath.Join("dir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), file.Size())
+	assert.Nil(t, file.Close())
+
+	GlobalOption.Backend = "missing"
+	_, err = OpenFile(filepath.Join("dir", "file"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,316 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// B+tree索引，节点存在索引文件中，通过blockCache换入换出。
+// 叶子节点的项是 | 索引列的有序编码 | pageId (8) |，值是这个page中有多少行是这个键，所以lineId变了也不影响索引。
+// 内部节点的keys[i]是children[i+1]中最小的项。删除只减少计数，计数为0时删掉这一项，节点不合并
+
+const btreeMagic = "RMBT"
+
+type btreeNode struct {
+	id       uint64
+	leaf     bool
+	keys     [][]byte
+	counts   []uint64 // 叶子节点每一项的行数
+	children []uint64 // 内部节点的子节点，比keys多一个
+	next     uint64   // 叶子节点右边的叶子，0表示没有
+}
+
+func (n *btreeNode) blockId() uint64 {
+	return n.id
+}
+
+// encodeBlock | leaf (1) | next uvarint | 项数 uvarint | 每一项的长度 uvarint和内容 | 叶子节点的行数或者内部节点的子节点 uvarint |
+func (n *btreeNode) encodeBlock() []byte {
+	data := make([]byte, 0, 256)
+	if n.leaf {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = binary.AppendUvarint(data, n.next)
+	data = binary.AppendUvarint(data, uint64(len(n.keys)))
+	for _, key := range n.keys {
+		data = binary.AppendUvarint(data, uint64(len(key)))
+		data = append(data, key...)
+	}
+	if n.leaf {
+		for _, count := range n.counts {
+			data = binary.AppendUvarint(data, count)
+		}
+	} else {
+		for _, child := range n.children {
+			data = binary.AppendUvarint(data, child)
+		}
+	}
+	return data
+}
+
+func decodeBtreeNode(id uint64, data []byte) (block, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty node")
+	}
+	node := &btreeNode{id: id, leaf: data[0] == 1}
+	data = data[1:]
+	readUvarint := func() (uint64, error) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid uvarint")
+		}
+		data = data[n:]
+		return value, nil
+	}
+	var err error
+	if node.next, err = readUvarint(); err != nil {
+		return nil, err
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("key count %d exceeds node size", count)
+	}
+	node.keys = make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(len(data)) {
+			return nil, fmt.Errorf("key length %d exceeds remaining %d bytes", length, len(data))
+		}
+		node.keys = append(node.keys, append([]byte{}, data[:length]...))
+		data = data[length:]
+	}
+	values := count
+	if !node.leaf {
+		values++
+	}
+	for i := uint64(0); i < values; i++ {
+		value, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if node.leaf {
+			node.counts = append(node.counts, value)
+		} else {
+			node.children = append(node.children, value)
+		}
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(data))
+	}
+	return node, nil
+}
+
+func (i *Index) node(id uint64) (*btreeNode, error) {
+	b, err := i.cache.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return b.(*btreeNode), nil
+}
+
+func (i *Index) newNode(leaf bool) *btreeNode {
+	i.NodeId++
+	return &btreeNode{id: i.NodeId, leaf: leaf}
+}
+
+// btreeAdd 把一项的行数加上delta，没有这一项时新建，减到0时删除
+func (i *Index) btreeAdd(key []byte, delta int64) error {
+	if i.Root == 0 {
+		if delta <= 0 {
+			return nil
+		}
+		root := i.newNode(true)
+		i.Root = root.id
+		if err := i.cache.put(root); err != nil {
+			return err
+		}
+	}
+	split, right, err := i.insert(i.Root, key, delta)
+	if err != nil || split == nil {
+		return err
+	}
+	root := i.newNode(false) // 根节点分裂，树高加一
+	root.keys = [][]byte{split}
+	root.children = []uint64{i.Root, right}
+	i.Root = root.id
+	return i.cache.put(root)
+}
+
+// insert 节点分裂时返回右边节点中最小的项和右边节点的id
+func (i *Index) insert(id uint64, key []byte, delta int64) ([]byte, uint64, error) {
+	node, err := i.node(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if node.leaf {
+		pos := sort.Search(len(node.keys), func(j int) bool { return bytes.Compare(node.keys[j], key) >= 0 })
+		if pos < len(node.keys) && bytes.Equal(node.keys[pos], key) {
+			count := int64(node.counts[pos]) + delta
+			if count > 0 {
+				node.counts[pos] = uint64(count)
+			} else {
+				node.keys = append(node.keys[:pos], node.keys[pos+1:]...)
+				node.counts = append(node.counts[:pos], node.counts[pos+1:]...)
+			}
+		} else if delta > 0 {
+			node.keys = append(node.keys[:pos], append([][]byte{key}, node.keys[pos:]...)...)
+			node.counts = append(node.counts[:pos], append([]uint64{uint64(delta)}, node.counts[pos:]...)...)
+		} else {
+			return nil, 0, nil
+		}
+		if err = i.cache.put(node); err != nil {
+			return nil, 0, err
+		}
+		if uint64(len(node.keys)) <= i.fanout() {
+			return nil, 0, nil
+		}
+		mid := len(node.keys) / 2
+		right := i.newNode(true)
+		right.keys = append([][]byte{}, node.keys[mid:]...)
+		right.counts = append([]uint64{}, node.counts[mid:]...)
+		right.next = node.next
+		node.keys = node.keys[:mid:mid]
+		node.counts = node.counts[:mid:mid]
+		node.next = right.id
+		if err = i.cache.put(right); err != nil {
+			return nil, 0, err
+		}
+		return right.keys[0], right.id, i.cache.put(node)
+	}
+	pos := sort.Search(len(node.keys), func(j int) bool { return bytes.Compare(node.keys[j], key) > 0 })
+	split, child, err := i.insert(node.children[pos], key, delta)
+	if err != nil || split == nil {
+		return nil, 0, err
+	}
+	node.keys = append(node.keys[:pos], append([][]byte{split}, node.keys[pos:]...)...)
+	node.children = append(node.children[:pos+1], append([]uint64{child}, node.children[pos+1:]...)...)
+	if err = i.cache.put(node); err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(node.keys)) <= i.fanout() {
+		return nil, 0, nil
+	}
+	mid := len(node.keys) / 2
+	right := i.newNode(false)
+	split = node.keys[mid]
+	right.keys = append([][]byte{}, node.keys[mid+1:]...)
+	right.children = append([]uint64{}, node.children[mid+1:]...)
+	node.keys = node.keys[:mid:mid]
+	node.children = node.children[: mid+1 : mid+1]
+	if err = i.cache.put(right); err != nil {
+		return nil, 0, err
+	}
+	return split, right.id, i.cache.put(node)
+}
+
+// scan 从第一个不小于start的项开始按顺序遍历，fn返回false时停止
+func (i *Index) scan(start []byte, fn func(key []byte, count uint64) bool) error {
+	if i.Root == 0 {
+		return nil
+	}
+	node, err := i.node(i.Root)
+	if err != nil {
+		return err
+	}
+	for !node.leaf {
+		pos := sort.Search(len(node.keys), func(j int) bool { return bytes.Compare(node.keys[j], start) > 0 })
+		if node, err = i.node(node.children[pos]); err != nil {
+			return err
+		}
+	}
+	pos := sort.Search(len(node.keys), func(j int) bool { return bytes.Compare(node.keys[j], start) >= 0 })
+	for {
+		for ; pos < len(node.keys); pos++ {
+			if !fn(node.keys[pos], node.counts[pos]) {
+				return nil
+			}
+		}
+		if node.next == 0 {
+			return nil
+		}
+		if node, err = i.node(node.next); err != nil {
+			return err
+		}
+		pos = 0
+	}
+}
+
+// btreePages 返回索引列的值以prefix开头的行所在的page
+func (i *Index) btreePages(prefix []byte) ([]uint64, error) {
+	pageIds := make([]uint64, 0, 4)
+	err := i.scan(prefix, func(key []byte, count uint64) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		pageIds = append(pageIds, binary.BigEndian.Uint64(key[len(key)-8:]))
+		return true
+	})
+	return pageIds, err
+}
+
+func (i *Index) fanout() uint64 {
+	if GlobalOption.IndexFanout < 3 {
+		return 3
+	}
+	return GlobalOption.IndexFanout
+}
+
+// appendOrderedKey 按字节比较的顺序和值的顺序一致：NULL最小，整数和时间翻转符号位，浮点数负数全部取反，
+// 字符串中的0转义成0 0xFF，以0 1结尾，这样多列拼起来也不会有一个键是另一个的前缀
+func appendOrderedKey(key []byte, value []byte, typeOf int) ([]byte, error) {
+	if value == nil {
+		return append(key, 0), nil
+	}
+	key = append(key, 1)
+	val, err := DecodeData(value, typeOf)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case bool:
+		if v {
+			return append(key, 1), nil
+		}
+		return append(key, 0), nil
+	case int64:
+		return binary.BigEndian.AppendUint64(key, uint64(v)^1<<63), nil
+	case float64:
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(key, bits), nil
+	case string:
+		for j := 0; j < len(v); j++ {
+			if v[j] == 0 {
+				key = append(key, 0, 0xFF)
+			} else {
+				key = append(key, v[j])
+			}
+		}
+		return append(key, 0, 1), nil
+	case time.Time:
+		nano := int64(math.MinInt64)
+		if !v.IsZero() {
+			nano = v.UnixNano()
+		}
+		return binary.BigEndian.AppendUint64(key, uint64(nano)^1<<63), nil
+	default:
+		return nil, fmt.Errorf("unsupported index value %v", val)
+	}
+}
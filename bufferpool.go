@@ -2,10 +2,15 @@ package rmdb
 
 import (
 	"container/list"
-	"os"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
 )
 
+const blockVersion = 1
+
 type LruCache struct { // table和lrucache是一对一关系
 	table            *Table
 	pageList         *list.List
@@ -42,27 +47,10 @@ func (l *LruCache) RemoveOld() error {
 	if ele != nil {
 		page := ele.Value.(*Page)
 		if page.isDirty {
-			switch GlobalOption.IOMode {
-			case Standard:
-				info, err := l.table.file.(*os.File).Stat()
-				if err != nil {
-					return err
-				}
-				page.Offset = uint64(info.Size())
-			case MMapMode:
-				page.Offset = uint64(l.table.file.(*MMap).offset)
-			}
-			data := page.EncodePage()
-			page.Length = uint64(len(data))
-			_, err := l.table.file.Write(data)
+			err := l.writePage(page)
 			if err != nil {
 				return err
 			}
-			l.table.Catalog[page.Id] = Page{
-				Id:     page.Id,
-				Offset: page.Offset,
-				Length: page.Length,
-			}
 		}
 		l.pageList.Remove(ele)
 		delete(l.pageMap, ele.Value.(*Page).Id)
@@ -71,6 +59,44 @@ func (l *LruCache) RemoveOld() error {
 	return nil
 }
 
+// reset 丢掉缓存中所有的page，不写回，调用方要保证它们都已经落盘或者不再需要
+func (l *LruCache) reset(pageId uint64) {
+	l.pageList = list.New()
+	l.pageMap = make(map[uint64]*list.Element, 16)
+	l.pageNum = 0
+	l.pageId = pageId
+}
+
+func (l *LruCache) FlushDirty() error { // 把脏页写入数据文件但不换出，checkpoint时使用
+	for ele := l.pageList.Front(); ele != nil; ele = ele.Next() {
+		page := ele.Value.(*Page)
+		if page.isDirty {
+			err := l.writePage(page)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *LruCache) writePage(page *Page) error { // 追加写，旧的数据留到merge时清理
+	page.Offset = uint64(l.table.file.Size())
+	data := page.EncodePage()
+	page.Length = uint64(len(data))
+	_, err := l.table.file.Write(data)
+	if err != nil {
+		return err
+	}
+	l.table.Catalog[page.Id] = Page{
+		Id:     page.Id,
+		Offset: page.Offset,
+		Length: page.Length,
+	}
+	page.isDirty = false
+	return nil
+}
+
 func (l *LruCache) GetPage(id uint64) (*Page, error) {
 	var page *Page
 	if ele, ok := l.pageMap[id]; ok {
@@ -86,15 +112,24 @@ func (l *LruCache) GetPage(id uint64) (*Page, error) {
 			Length: l.table.Catalog[id].Length,
 		}
 		page.columns = l.table.Columns
+		page.version = l.table.Version
+		page.schemas = l.table.Schemas
+		page.legacy = l.table.Legacy
 		page.lines = make(map[uint64]Line, 64)
 		page.max = l.maxLine
 		data := make([]byte, page.Length)
 		_, err := l.table.file.ReadAt(data, int64(page.Offset))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &CorruptionError{Table: l.table.Name, PageId: id, Reason: "page is beyond the end of file"}
+		}
 		if err != nil {
 			return nil, err
 		}
-		page.DecodePage(data)
-		page.isDirty = false
+		legacy, err := page.DecodePage(data)
+		if err != nil {
+			return nil, &CorruptionError{Table: l.table.Name, PageId: id, Reason: err.Error()}
+		}
+		page.isDirty = legacy // 旧格式的page换出时按新格式重写
 		ele := l.pageList.PushFront(page)
 		l.pageMap[page.Id] = ele
 		l.pageNum++
@@ -123,3 +158,179 @@ func (l *LruCache) CopyPage(pageId uint64) (*Memtable, error) {
 	}
 	return memTable, nil
 }
+
+// block 索引文件中的一个块，由blockCache缓存和换出
+type block interface {
+	blockId() uint64
+	encodeBlock() []byte
+}
+
+type cachedBlock struct {
+	block   block
+	isDirty bool
+}
+
+// blockCache 索引文件的缓冲池，和LruCache一样按lru换出，脏块追加写到文件末尾，位置记在blocks中，checkpoint时随目录落盘。
+// 块的格式和page相同，只是magic不同，调用方持有表的cache锁
+type blockCache struct {
+	name      string // 出错时的提示
+	magic     string
+	file      FileIO
+	blocks    map[uint64]Page
+	blockList *list.List
+	blockMap  map[uint64]*list.Element
+	maxBlock  uint64
+	decode    func(id uint64, payload []byte) (block, error)
+}
+
+func newBlockCache(name, magic string, file FileIO, blocks map[uint64]Page, decode func(id uint64, payload []byte) (block, error)) *blockCache {
+	return &blockCache{
+		name:      name,
+		magic:     magic,
+		file:      file,
+		blocks:    blocks,
+		blockList: list.New(),
+		blockMap:  make(map[uint64]*list.Element, 16),
+		maxBlock:  GlobalOption.MaxPage,
+		decode:    decode,
+	}
+}
+
+func (c *blockCache) get(id uint64) (block, error) {
+	if ele, ok := c.blockMap[id]; ok {
+		c.blockList.MoveToFront(ele)
+		return ele.Value.(*cachedBlock).block, nil
+	}
+	location, ok := c.blocks[id]
+	if !ok || location.Length == 0 {
+		return nil, fmt.Errorf("block %d of %s not exists", id, c.name)
+	}
+	data := make([]byte, location.Length)
+	_, err := c.file.ReadAt(data, int64(location.Offset))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := blockPayload(c.magic, id, data)
+	if err != nil {
+		return nil, fmt.Errorf("block %d of %s is corrupted: %w", id, c.name, err)
+	}
+	b, err := c.decode(id, payload)
+	if err != nil {
+		return nil, fmt.Errorf("block %d of %s is corrupted: %w", id, c.name, err)
+	}
+	c.blockMap[id] = c.blockList.PushFront(&cachedBlock{block: b})
+	return b, c.evict()
+}
+
+// put 新建或者修改了块之后调用，块被换出过时用这一份替换
+func (c *blockCache) put(b block) error {
+	if ele, ok := c.blockMap[b.blockId()]; ok {
+		ele.Value = &cachedBlock{block: b, isDirty: true}
+		c.blockList.MoveToFront(ele)
+	} else {
+		c.blockMap[b.blockId()] = c.blockList.PushFront(&cachedBlock{block: b, isDirty: true})
+	}
+	return c.evict()
+}
+
+func (c *blockCache) evict() error {
+	for uint64(c.blockList.Len()) > c.maxBlock {
+		ele := c.blockList.Back()
+		cached := ele.Value.(*cachedBlock)
+		if cached.isDirty {
+			err := c.write(cached)
+			if err != nil {
+				return err
+			}
+		}
+		c.blockList.Remove(ele)
+		delete(c.blockMap, cached.block.blockId())
+	}
+	return nil
+}
+
+func (c *blockCache) write(cached *cachedBlock) error { // 追加写，旧的块不再引用
+	id := cached.block.blockId()
+	data := encodeBlock(c.magic, id, cached.block.encodeBlock())
+	offset := uint64(c.file.Size())
+	_, err := c.file.Write(data)
+	if err != nil {
+		return err
+	}
+	c.blocks[id] = Page{
+		Id:     id,
+		Offset: offset,
+		Length: uint64(len(data)),
+	}
+	cached.isDirty = false
+	return nil
+}
+
+// flush 写入所有脏块并fsync，checkpoint时使用
+func (c *blockCache) flush() error {
+	for ele := c.blockList.Front(); ele != nil; ele = ele.Next() {
+		cached := ele.Value.(*cachedBlock)
+		if cached.isDirty {
+			err := c.write(cached)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return c.file.Sync()
+}
+
+// exists 块在缓存中或者写入过文件
+func (c *blockCache) exists(id uint64) bool {
+	if _, ok := c.blockMap[id]; ok {
+		return true
+	}
+	_, ok := c.blocks[id]
+	return ok
+}
+
+// remove 丢掉不再使用的块，文件中的旧数据不再引用
+func (c *blockCache) remove(id uint64) {
+	if ele, ok := c.blockMap[id]; ok {
+		c.blockList.Remove(ele)
+		delete(c.blockMap, id)
+	}
+	delete(c.blocks, id)
+}
+
+// reset 丢掉缓存中所有的块，不写回
+func (c *blockCache) reset(blocks map[uint64]Page) {
+	c.blocks = blocks
+	c.blockList = list.New()
+	c.blockMap = make(map[uint64]*list.Element, 16)
+}
+
+func encodeBlock(magic string, id uint64, payload []byte) []byte {
+	data := make([]byte, pageHeaderSize, pageHeaderSize+len(payload))
+	copy(data[0:4], magic)
+	data[4] = blockVersion
+	binary.LittleEndian.PutUint64(data[5:13], id)
+	binary.LittleEndian.PutUint32(data[13:17], uint32(len(payload)))
+	data = append(data, payload...)
+	binary.LittleEndian.PutUint32(data[17:21], pageChecksum(data))
+	return data
+}
+
+func blockPayload(magic string, id uint64, data []byte) ([]byte, error) {
+	if len(data) < pageHeaderSize || string(data[:4]) != magic {
+		return nil, errors.New("invalid block header")
+	}
+	if data[4] != blockVersion {
+		return nil, fmt.Errorf("unsupported block version %d", data[4])
+	}
+	if found := binary.LittleEndian.Uint64(data[5:13]); found != id {
+		return nil, fmt.Errorf("block id mismatch, found block %d", found)
+	}
+	if length := binary.LittleEndian.Uint32(data[13:17]); int(length) != len(data)-pageHeaderSize {
+		return nil, fmt.Errorf("block length mismatch, header says %d but read %d", length, len(data)-pageHeaderSize)
+	}
+	if pageChecksum(data) != binary.LittleEndian.Uint32(data[17:21]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data[pageHeaderSize:], nil
+}
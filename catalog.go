@@ -0,0 +1,192 @@
+package rmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// 目录格式的版本号，修改Table/Column/Page的持久化字段时加一，并在migrateCatalog中补上升级逻辑
+const catalogVersion = 4
+
+type catalog struct {
+	Version int
+	Lsn     uint64 // checkpoint lsn，lsn不大于它的已提交事务都已经写入数据文件
+	Tables  map[string]Table
+	Merging []string `json:",omitempty"` // 这些表的目录对应.tmp文件，打开时要先改名为.data
+}
+
+func loadCatalog(backend Backend, dbPath string) (*catalog, error) {
+	logPath := fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log")
+	cata := &catalog{
+		Version: catalogVersion,
+		Tables:  make(map[string]Table, 16),
+	}
+	data, err := backend.ReadFile(logPath)
+	if err != nil {
+		if os.IsNotExist(err) { // 没有cata.log说明数据库创建后没有正常关闭过
+			return cata, nil
+		}
+		return nil, err
+	}
+	cata.Version = 0
+	cata.Tables = nil
+	err = json.Unmarshal(data, cata)
+	if err != nil {
+		return nil, err
+	}
+	if cata.Tables == nil { // 版本0的cata.log直接是表名到表的map
+		err = json.Unmarshal(data, &cata.Tables)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = migrateCatalog(cata)
+	if err != nil {
+		return nil, err
+	}
+	return cata, nil
+}
+
+func migrateCatalog(cata *catalog) error {
+	if cata.Version > catalogVersion {
+		return fmt.Errorf("catalog version %d is newer than supported version %d", cata.Version, catalogVersion)
+	}
+	for cata.Version < catalogVersion {
+		switch cata.Version {
+		case 0: // 0到1只是加了外层的版本号和checkpoint lsn
+		case 1: // 1到2列的默认值从json改成二进制编码，page在读出时转换
+			for name, table := range cata.Tables {
+				for i, column := range table.Columns {
+					val, err := decodeJSON(column.DefVal, column.TypeOf)
+					if err != nil {
+						return fmt.Errorf("default value of column %s.%s: %w", name, column.Name, err)
+					}
+					table.Columns[i].DefVal, err = EncodeData(val)
+					if err != nil {
+						return err
+					}
+				}
+				cata.Tables[name] = table
+			}
+		case 2: // 2到3列有了id，旧的行都属于schema版本0
+			for name, table := range cata.Tables {
+				for i := range table.Columns {
+					table.Columns[i].Id = uint64(i + 1)
+				}
+				table.ColumnId = uint64(len(table.Columns))
+				cata.Tables[name] = table
+			}
+		case 3: // 3到4只有标记过的表接受没有页头的page，之前的表都可能有
+			for name, table := range cata.Tables {
+				table.Legacy = true
+				cata.Tables[name] = table
+			}
+		}
+		cata.Version++
+	}
+	return nil
+}
+
+// saveCatalog 先写临时文件并fsync，再rename覆盖，任何时候崩溃cata.log都是完整的
+func (d *Database) saveCatalog() error {
+	cata := &catalog{
+		Version: catalogVersion,
+		Lsn:     d.checkpointLsn,
+		Tables:  make(map[string]Table, 16),
+	}
+	for tabName, table := range d.tables {
+		cata.Tables[tabName] = table.snapshot()
+		if table.merging {
+			cata.Merging = append(cata.Merging, tabName)
+		}
+	}
+	return writeCatalog(d.backend, d.dbPath, cata)
+}
+
+func writeCatalog(backend Backend, dbPath string, cata *catalog) error {
+	logPath := fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log")
+	tmpPath := logPath + ".tmp"
+	data, err := json.Marshal(cata)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteFile(tmpPath, data)
+	if err != nil {
+		_ = backend.Remove(tmpPath)
+		return err
+	}
+	err = backend.Rename(tmpPath, logPath)
+	if err != nil {
+		return err
+	}
+	return backend.SyncDir(dbPath)
+}
+
+func (t *Table) snapshot() Table { // 复制page目录，避免序列化时和换页并发读写map
+	t.cache.lock.Lock()
+	defer t.cache.lock.Unlock()
+	table := *t
+	table.Columns = append([]Column{}, t.Columns...)
+	table.Catalog = make(map[uint64]Page, len(t.Catalog))
+	for id, page := range t.Catalog {
+		table.Catalog[id] = page
+	}
+	if t.Indexes != nil {
+		table.Indexes = make(map[string]*Index, len(t.Indexes))
+		for name, index := range t.Indexes {
+			table.Indexes[name] = index.snapshot()
+		}
+	}
+	if t.Primary != nil {
+		table.Primary = t.Primary.snapshot()
+	}
+	return table
+}
+
+func (i *Index) snapshot() *Index {
+	copied := *i
+	copied.Nodes = make(map[uint64]Page, len(i.Nodes))
+	for id, node := range i.Nodes {
+		copied.Nodes[id] = node
+	}
+	return &copied
+}
+
+func nextPageId(pages map[uint64]Page) uint64 {
+	next := uint64(1) //从1开始
+	for id := range pages {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// recoverMerge 完成崩溃前已经记入目录的merge，删除没有记入目录的.tmp文件
+func recoverMerge(backend Backend, dbPath string, cata *catalog) error {
+	merging := make(map[string]bool, len(cata.Merging))
+	for _, name := range cata.Merging {
+		merging[name] = true
+	}
+	for name := range cata.Tables {
+		tabPath := fmt.Sprint(dbPath, string(os.PathSeparator), name, ".tmp")
+		exists, err := backend.Exists(tabPath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if merging[name] {
+			err = finishMerge(backend, dbPath, name)
+		} else {
+			err = backend.Remove(tabPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cata.Merging = nil
+	return nil
+}
@@ -0,0 +1,108 @@
+package rmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestCatalogCrash(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("man")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("age", INT64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateTable("thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DropTable("thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(`insert into man (name,age ) values ( "john",  8 );`)
+	assert.Nil(t, err)
+	crashDatabase(db) // 从来没有Close过
+
+	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "catalog")
+	err = os.WriteFile(fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log.tmp"), []byte("{broken"), 0644) // 写临时文件时崩溃
+	assert.Nil(t, err)
+
+	db, err = UseDatabase("catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(db.tables))
+	if assert.NotNil(t, db.tables["man"]) {
+		assert.Equal(t, 2, len(db.tables["man"].Columns))
+	}
+	res, err := db.Query("select * from man")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.result))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	cata, err := loadCatalog(stdBackend{}, dbPath)
+	assert.Nil(t, err)
+	assert.Equal(t, catalogVersion, cata.Version)
+	assert.False(t, cata.Tables["man"].Legacy, "new table only holds pages with header")
+}
+
+func TestCatalogLegacy(t *testing.T) {
+	setTestOption(t)
+
+	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "legacy")
+	err := os.MkdirAll(dbPath, 0755)
+	assert.Nil(t, err)
+	tables := map[string]Table{ // 版本0的格式：没有版本号，直接是表名到表的map，默认值是json
+		"man": {
+			Name:    "man",
+			Columns: []Column{{Name: "name", TypeOf: STRING, DefVal: []byte(`""`)}, {Name: "age", TypeOf: INT64, DefVal: []byte("0")}},
+			Catalog: map[uint64]Page{},
+		},
+	}
+	data, err := json.Marshal(tables)
+	assert.Nil(t, err)
+	err = os.WriteFile(fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log"), data, 0644)
+	assert.Nil(t, err)
+
+	db, err := UseDatabase("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, db.tables["man"])
+	err = db.Close()
+	assert.Nil(t, err)
+
+	cata, err := loadCatalog(stdBackend{}, dbPath)
+	assert.Nil(t, err)
+	assert.Equal(t, catalogVersion, cata.Version)
+	assert.Equal(t, 1, len(cata.Tables))
+	assert.True(t, cata.Tables["man"].Legacy, "old table may hold pages without header")
+	assert.Equal(t, 0, len(cata.Tables["man"].Columns[0].DefVal))
+	age, err := DecodeData(cata.Tables["man"].Columns[1].DefVal, INT64)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), age)
+
+	newer, err := json.Marshal(&catalog{Version: catalogVersion + 1, Tables: map[string]Table{}})
+	assert.Nil(t, err)
+	err = os.WriteFile(fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log"), newer, 0644)
+	assert.Nil(t, err)
+	_, err = UseDatabase("legacy")
+	assert.NotNil(t, err, "catalog written by a newer version should be rejected")
+}
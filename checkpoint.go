@@ -0,0 +1,79 @@
+package rmdb
+
+import (
+	"time"
+)
+
+// Checkpoint 把所有脏页写入数据文件并记录checkpoint lsn，之后wal可以截断到这个lsn
+func (d *Database) Checkpoint() error {
+	d.ckptLock.Lock()
+	defer d.ckptLock.Unlock()
+	return d.checkpoint()
+}
+
+func (d *Database) checkpoint() error { // 调用方持有d.ckptLock的写锁
+	if err := d.checkBroken(); err != nil {
+		return err
+	}
+	d.wal.lock.Lock()
+	lsn := d.wal.lsn - 1
+	d.wal.lock.Unlock()
+	for _, table := range d.tables {
+		table.cache.lock.Lock()
+		err := table.cache.FlushDirty()
+		if err == nil {
+			err = table.file.Sync()
+		}
+		if err == nil {
+			err = table.flushIndexes() // 索引节点和page一起落盘，目录中的根节点才和数据一致
+		}
+		table.cache.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	old := d.checkpointLsn
+	d.checkpointLsn = lsn
+	err := d.saveCatalog()
+	if err != nil {
+		d.checkpointLsn = old
+		return err
+	}
+	return d.wal.truncate(lsn) // 失败时wal会拒绝之后的写入，提交时数据库会标记为需要重新打开
+}
+
+func (d *Database) startCheckpointer() {
+	if GlobalOption.CheckpointInterval <= 0 {
+		return
+	}
+	d.stopCkpt = make(chan struct{})
+	d.ckptDone.Add(1)
+	go d.runCheckpointer(d.stopCkpt)
+}
+
+func (d *Database) runCheckpointer(stop chan struct{}) {
+	ticker := time.NewTicker(GlobalOption.CheckpointInterval)
+	defer func() {
+		ticker.Stop()
+		d.ckptDone.Done()
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := d.Checkpoint()
+			if err != nil {
+				logger.Errorf("rmdb: checkpoint database %s failed: %s\n", d.dbName, err)
+			}
+		}
+	}
+}
+
+func (d *Database) stopCheckpointer() {
+	if d.stopCkpt != nil {
+		close(d.stopCkpt)
+		d.ckptDone.Wait()
+		d.stopCkpt = nil
+	}
+}
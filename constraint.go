@@ -0,0 +1,286 @@
+package rmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 列约束：not null、default、check、unique、primary key、auto_increment，写在create table和alter table add的列定义中
+
+var (
+	notNullReg = regexp.MustCompile(`(?i)^not\s+null\b`)
+	nullReg    = regexp.MustCompile(`(?i)^null\b`)
+	uniqueReg  = regexp.MustCompile(`(?i)^unique\b`)
+	primaryReg = regexp.MustCompile(`(?i)^primary\s+key\b`)
+	autoIncReg = regexp.MustCompile(`(?i)^auto_increment\b`)
+	defaultReg = regexp.MustCompile(`(?i)^default\s+("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.|'')*'|[^\s"']+)`)
+	checkReg   = regexp.MustCompile(`(?i)^check\s*\(\s*([^\s()]+)\s*\(\s*([^\s()]+)\s*\)\s*\)`)
+)
+
+// parseConstraints 解析列定义中类型后面的约束，check的函数必须已经注册，参数只能是这一列
+func parseConstraints(column *Column, str string, condiFuncs map[string]func([]any) bool) error {
+	str = strings.TrimSpace(str)
+	for str != "" {
+		var match []string
+		if match = notNullReg.FindStringSubmatch(str); match != nil {
+			column.NotNull = true
+		} else if match = nullReg.FindStringSubmatch(str); match != nil {
+			column.NotNull = false
+		} else if match = uniqueReg.FindStringSubmatch(str); match != nil {
+			column.Unique = true
+		} else if match = primaryReg.FindStringSubmatch(str); match != nil {
+			column.PrimaryKey, column.NotNull, column.Unique = true, true, true
+		} else if match = autoIncReg.FindStringSubmatch(str); match != nil {
+			column.AutoIncrement = true
+		} else if match = defaultReg.FindStringSubmatch(str); match != nil {
+			data, err := parseDefault(match[1], column.TypeOf)
+			if err != nil {
+				return fmt.Errorf("default of column %s: %w", column.Name, err)
+			}
+			column.HasDefault = data != nil // default null和没有默认值一样
+			column.Default = data
+		} else if match = checkReg.FindStringSubmatch(str); match != nil {
+			if match[2] != column.Name {
+				return fmt.Errorf("check of column %s can only use column %s", column.Name, column.Name)
+			}
+			if _, ok := condiFuncs[match[1]]; !ok {
+				return fmt.Errorf("check of column %s: invalid function name %s", column.Name, match[1])
+			}
+			column.Check = match[1]
+		} else {
+			return fmt.Errorf("invalid constraint %s of column %s", str, column.Name)
+		}
+		str = strings.TrimSpace(str[len(match[0]):])
+	}
+	return nil
+}
+
+// parseDefault 单引号的字符串按sql的规则解析，转成双引号的json字符串
+func parseDefault(text string, typeOf int) ([]byte, error) {
+	if strings.HasPrefix(text, "'") {
+		tokens, err := lex(text)
+		if err != nil {
+			return nil, err
+		}
+		quoted, err := json.Marshal(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		text = string(quoted)
+	}
+	return ParseLiteral(text, typeOf)
+}
+
+// applyDefaults 没有给值的列使用默认值
+func applyDefaults(line *Line, given map[string]string) {
+	for name, colVal := range line.nameToVal {
+		if _, ok := given[name]; !ok && colVal.column.HasDefault {
+			colVal.value = colVal.column.Default
+			line.nameToVal[name] = colVal
+		}
+	}
+}
+
+// checkLine 检查一行的not null和check约束
+func (t *Transaction) checkLine(table *Table, line *Line) error {
+	if t.isReplay { // 重放的语句提交前已经检查过，打开数据库时check函数还没有注册
+		return nil
+	}
+	for _, column := range table.Columns {
+		if err := checkValue(column, line.nameToVal[column.Name].value, t.db.CondiFuncs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkValue check的结果是unknown时通过，和sql一致
+func checkValue(column Column, value []byte, condiFuncs map[string]func([]any) bool) error {
+	if column.NotNull && value == nil {
+		return fmt.Errorf("column %s violates not null constraint", column.Name)
+	}
+	if column.Check == "" {
+		return nil
+	}
+	function, ok := condiFuncs[column.Check]
+	if !ok {
+		return fmt.Errorf("check constraint %s of column %s: function not registered", column.Check, column.Name)
+	}
+	val, err := DecodeData(value, column.TypeOf)
+	if err != nil {
+		return err
+	}
+	if evalCondition(column.Check, function, []any{val}) == truthFalse {
+		return fmt.Errorf("column %s violates check constraint %s: %s", column.Name, column.Check, FormatData(value, column.TypeOf))
+	}
+	return nil
+}
+
+type lineKey struct {
+	pageId, lineId uint64
+}
+
+// uniqueKey 一个唯一约束：unique列或者唯一索引
+type uniqueKey struct {
+	key    func(line Line) (string, bool) // 有NULL时返回false，NULL不算重复
+	err    func(line Line) error
+	lookup func(key string) ([]uint64, error) // 按索引找page，nil时要扫描全表，调用方持有cache锁
+}
+
+func (t *Table) uniqueKeys() []uniqueKey {
+	uniques := make([]uniqueKey, 0, 4)
+	for _, column := range t.Columns {
+		if !column.Unique {
+			continue
+		}
+		column := column
+		unique := uniqueKey{
+			key: func(line Line) (string, bool) {
+				value := line.nameToVal[column.Name].value
+				return string(value), value != nil
+			},
+			err: func(line Line) error {
+				return uniqueError(column, line.nameToVal[column.Name].value)
+			},
+		}
+		if column.PrimaryKey {
+			unique.lookup = func(key string) ([]uint64, error) {
+				return t.lookupPages([][]byte{[]byte(key)})
+			}
+		}
+		uniques = append(uniques, unique)
+	}
+	for _, index := range t.Indexes {
+		if !index.Unique {
+			continue
+		}
+		index, columns := index, index.columns(t.Columns)
+		uniques = append(uniques, uniqueKey{
+			key: func(line Line) (string, bool) {
+				key, hasNull, err := index.key(line, columns)
+				return string(key), err == nil && !hasNull
+			},
+			err: func(line Line) error {
+				return indexError(index, line, columns)
+			},
+			lookup: func(key string) ([]uint64, error) {
+				return index.pages([]byte(key))
+			},
+		})
+	}
+	return uniques
+}
+
+// checkUnique 检查写入lines之后unique列和唯一索引是否有重复的值，lines中和已有行id相同的是对这一行的修改。
+// 看到的是本事务中的数据，其他事务还没有提交的修改看不到；NULL不算重复
+func (t *Transaction) checkUnique(table *Table, lines []Line) error {
+	if t.isReplay {
+		return nil
+	}
+	uniques := table.uniqueKeys()
+	if len(uniques) == 0 {
+		return nil
+	}
+	changed := make(map[lineKey]struct{}, len(lines))
+	for _, line := range lines {
+		changed[lineKey{line.pageId, line.lineId}] = struct{}{}
+	}
+	values := make([]map[string]struct{}, len(uniques))
+	indexed := true // 都有索引时只读可能重复的page
+	for i, unique := range uniques {
+		values[i] = make(map[string]struct{}, len(lines))
+		for _, line := range lines {
+			key, ok := unique.key(line)
+			if !ok {
+				continue
+			}
+			if _, ok := values[i][key]; ok {
+				return unique.err(line)
+			}
+			values[i][key] = struct{}{}
+		}
+		indexed = indexed && unique.lookup != nil
+	}
+	check := func(lines map[uint64]Line) error {
+		for _, line := range lines {
+			if _, ok := changed[lineKey{line.pageId, line.lineId}]; ok {
+				continue
+			}
+			for i, unique := range uniques {
+				key, ok := unique.key(line)
+				if _, found := values[i][key]; ok && found {
+					return unique.err(line)
+				}
+			}
+		}
+		return nil
+	}
+	subTx := t.subTxs[table.Name]
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
+	var pageIds []uint64
+	var err error
+	if indexed {
+		for i, unique := range uniques {
+			for key := range values[i] {
+				found, err := unique.lookup(key)
+				if err != nil {
+					return err
+				}
+				pageIds = append(pageIds, found...)
+			}
+		}
+		pageIds = withChangedPages(subTx, pageIds)
+	} else {
+		pageIds, err = readPageIds(table, subTx, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, i := range pageIds { // 和TableReadPlan一样，本事务复制过的page用memtable
+		if memTable := subTx.memTables[i]; memTable != nil {
+			if err := check(memTable.lines); err != nil {
+				return err
+			}
+			continue
+		}
+		page, err := table.cache.GetPage(i)
+		if err != nil {
+			return err
+		}
+		if page == nil {
+			continue
+		}
+		if err = check(page.lines); err != nil {
+			return err
+		}
+	}
+	return check(subTx.memTables[0].lines)
+}
+
+func uniqueError(column Column, value []byte) error {
+	return fmt.Errorf("column %s violates unique constraint: duplicate value %s", column.Name, FormatData(value, column.TypeOf))
+}
+
+// checkNewColumn 加列时已有的行都取默认值，检查这些行是否满足新列的约束，调用方持有cache锁
+func (t *Table) checkNewColumn(column Column) error {
+	rows := 0
+	for i := uint64(1); i < t.cache.pageId && rows < 2; i++ {
+		page, err := t.cache.GetPage(i)
+		if err != nil {
+			return err
+		}
+		if page != nil {
+			rows += len(page.lines)
+		}
+	}
+	if rows == 0 {
+		return nil
+	}
+	if column.Unique && column.DefVal != nil && rows > 1 {
+		return uniqueError(column, column.DefVal)
+	}
+	return checkValue(column, column.DefVal, t.db.CondiFuncs)
+}
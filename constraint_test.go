@@ -0,0 +1,112 @@
+package rmdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertViolation(t *testing.T, err error, constraint string) {
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), constraint), fmt.Sprint("unexpected error: ", err))
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("constraint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positive := func(vals []any) bool {
+		switch val := vals[0].(type) {
+		case int64:
+			return val > 0
+		case float64:
+			return val > 0
+		}
+		return false
+	}
+	assert.NotNil(t, db.Update("create table man (age INT64 check (positive(age)))"), "function is not registered")
+	db.CondiFuncs["positive"] = positive
+	assert.NotNil(t, db.Update("create table man (age INT64 check (positive(name)))"), "check can only use its column")
+	assert.NotNil(t, db.Update("create table man (age INT64 primary)"), "unknown constraint")
+	assert.NotNil(t, db.Update(`create table man (age INT64 default "x")`), "default does not match the type")
+	assert.Nil(t, db.Update(`create table man (name STRING NOT NULL unique, city STRING default "a, b", age INT64 null check (positive(age)), tag STRING default 'x, ''y''')`))
+
+	table := db.tables["man"]
+	assert.Equal(t, Column{Id: 1, Name: "name", TypeOf: STRING, NotNull: true, Unique: true}, table.Columns[0])
+	assert.True(t, table.Columns[1].HasDefault)
+	assert.Equal(t, "positive", table.Columns[2].Check)
+	if assert.Len(t, table.Columns, 4) {
+		assert.Equal(t, "x, 'y'", FormatData(table.Columns[3].Default, STRING), "comma in single quotes does not split columns")
+	}
+	assert.Equal(t, []string{`a 'b,c'`, " `d,e` \"f,\\\"g\"", " h (i, j)"}, splitTopLevel("a 'b,c', `d,e` \"f,\\\"g\", h (i, j)"))
+
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("a", 1)`))
+	assert.Nil(t, db.Update(`insert into man (name) values ("b")`), "null passes check")
+	assertViolation(t, db.Update(`insert into man (age) values (2)`), "column name violates not null constraint")
+	assertViolation(t, db.Update(`insert into man (name, age) values ("c", 0)`), "column age violates check constraint positive: 0")
+	assertViolation(t, db.Update(`insert into man (name, age) values ("a", 3)`), `column name violates unique constraint: duplicate value a`)
+	assertViolation(t, db.Update(`insert into man (name, age) values ("c", 3);insert into man (name, age) values ("c", 4)`), "unique")
+	assert.Equal(t, []string{"a", "b"}, queryNames(t, db, "select * from man"), "failed statements should not change the table")
+
+	res, err := db.Query(`select * from man where age is null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, res.result, 1) {
+		assert.Equal(t, "a, b", FormatData(res.result[0].nameToVal["city"].value, STRING), "default is used when the column is absent")
+	}
+
+	db.CondiFuncs["isB"] = func(vals []any) bool {
+		return vals[0] == "b"
+	}
+	assertViolation(t, db.Update(`update man set name = "a" where isB(name)`), "unique")
+	assertViolation(t, db.Update(`update man set name = null where isB(name)`), "not null")
+	assertViolation(t, db.Update(`update man set age = -1 where name is not null`), "check constraint positive")
+	assertViolation(t, db.Update(`update man set name = "c" where name is not null`), "unique")
+	assert.Nil(t, db.Update(`update man set age = 5 where name is not null`))
+	assert.Nil(t, db.Update(`update man set name = "b" where isB(name)`), "a row does not conflict with itself")
+	assert.Equal(t, []string{"a", "b"}, queryNames(t, db, "select * from man where age is not null"))
+
+	tx := db.Begin()
+	assert.Nil(t, tx.Update(`insert into man (name) values ("c")`))
+	assertViolation(t, tx.Update(`insert into man (name) values ("c")`), "unique")
+	assert.Nil(t, tx.Update(`delete from man where isB(name)`))
+	assert.Nil(t, tx.Update(`insert into man (name) values ("b")`), "deleted value can be used again")
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, []string{"a", "b", "c"}, queryNames(t, db, "select * from man"))
+
+	assertViolation(t, db.Update("alter table man add column id INT64 not null"), "not null")
+	assertViolation(t, db.Update("alter table man add column id INT64 unique default 1"), "unique")
+	assertViolation(t, db.Update("alter table man add column id INT64 default 0 check (positive(id))"), "check")
+	assert.Nil(t, db.Update("alter table man add column id INT64 not null default 1 check (positive(id))"))
+	assert.Nil(t, db.Update(`insert into man (name) values ("d")`))
+	assert.Nil(t, db.Update("alter table man modify column id FLOAT64"))
+	defVal, err := DecodeData(table.Columns[4].Default, FLOAT64)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, defVal, "default is converted with the column")
+
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("constraint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertViolation(t, db.Update(`insert into man (name, age) values ("e", 1)`), "function not registered")
+	db.CondiFuncs["positive"] = positive
+	assertViolation(t, db.Update(`insert into man (name, age) values ("a", 1)`), "unique")
+	assertViolation(t, db.Update(`insert into man (name, age) values ("e", 0)`), "check")
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("e", 1)`))
+	crashDatabase(db)
+
+	db, err = UseDatabase("constraint") // 重放wal时check函数还没有注册
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, queryNames(t, db, "select * from man"))
+	assert.Nil(t, db.Close())
+}
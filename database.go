@@ -2,7 +2,6 @@ package rmdb
 
 import (
 	"container/list"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -16,9 +15,18 @@ type Database struct {
 	CondiFuncs map[string]func([]any) bool
 	ColFuncs   map[string]func(any) any
 	AggFuncs   map[string]func([]any) any
+	Aggregates map[string]Aggregate
 	ExecFuncs  map[string]func([]any) any
-	wal        FileIO
-	walLock    sync.RWMutex
+	wal        *Wal
+	backend    Backend
+	// checkpoint时持有写锁，commit时持有读锁，保证checkpoint lsn之前的事务都已经应用到page
+	ckptLock      sync.RWMutex
+	checkpointLsn uint64
+	stopCkpt      chan struct{}
+	ckptDone      sync.WaitGroup
+	// commit应用到一半或者wal写坏之后内存中的状态不可信，只能关闭后重新打开从wal恢复
+	broken     error
+	brokenLock sync.Mutex
 }
 
 const (
@@ -31,14 +39,18 @@ const (
 func CreateDatabase(name string) (*Database, error) {
 	GlobalOption.lock.Lock()
 	defer GlobalOption.lock.Unlock()
+	backend, err := currentBackend()
+	if err != nil {
+		return nil, err
+	}
 	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), name)
-	if _, err := os.Stat(dbPath); err != nil && os.IsNotExist(err) {
-		err := os.MkdirAll(dbPath, 0644)
+	if exists, err := backend.Exists(dbPath); err == nil && !exists {
+		err := backend.MkdirAll(dbPath)
 		if err != nil {
 			return nil, err
 		}
-		walPath := fmt.Sprint(dbPath, string(os.PathSeparator), "wal.txt")
-		walFile, err := OpenFile(walPath)
+		walPath := fmt.Sprint(dbPath, string(os.PathSeparator), "wal.log")
+		walFile, err := OpenWal(backend, walPath)
 		if err != nil {
 			return nil, err
 		}
@@ -49,12 +61,22 @@ func CreateDatabase(name string) (*Database, error) {
 			CondiFuncs: make(map[string]func([]any) bool, 64),
 			ColFuncs:   make(map[string]func(any) any, 64),
 			AggFuncs:   make(map[string]func([]any) any, 64),
+			Aggregates: make(map[string]Aggregate, 64),
 			ExecFuncs:  make(map[string]func([]any) any, 64),
 			wal:        walFile,
+			backend:    backend,
 		}
 		db.setFunctions()
+		err = db.saveCatalog()
+		if err != nil {
+			return nil, err
+		}
+		db.wal.setDurability(GlobalOption.Durability)
+		db.startCheckpointer()
 		databases[name] = db
 		return db, nil
+	} else if err != nil {
+		return nil, err
 	} else {
 		return nil, errors.New("database is exists")
 	}
@@ -67,28 +89,34 @@ func UseDatabase(name string) (*Database, error) {
 	if oldDB != nil {
 		return oldDB, nil
 	}
+	backend, err := currentBackend()
+	if err != nil {
+		return nil, err
+	}
 	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), name)
-	if _, err := os.Stat(dbPath); err != nil {
+	if exists, err := backend.Exists(dbPath); err != nil || !exists {
 		return nil, errors.New("database not exists")
 	}
-	logPath := fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log")
-	data, err := os.ReadFile(logPath)
+	cata, err := loadCatalog(backend, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	err = recoverMerge(backend, dbPath, cata)
 	if err != nil {
 		return nil, err
 	}
-	var tables map[string]Table
-	err = json.Unmarshal(data, &tables)
+	err = removeSpillFiles(backend, dbPath)
 	if err != nil {
 		return nil, err
 	}
 	tabPts := make(map[string]*Table, 64)
-	for tabName, table := range tables { // TODO !!!注意
+	for tabName, table := range cata.Tables { // TODO !!!注意
 		table := table
 		tabPts[tabName] = &table
 	}
 	for tabName, table := range tabPts {
 		tabPath := fmt.Sprint(dbPath, string(os.PathSeparator), tabName, ".data")
-		tabFile, err := OpenFile(tabPath)
+		tabFile, err := backend.OpenFile(tabPath)
 		if err != nil {
 			return nil, err
 		}
@@ -96,30 +124,48 @@ func UseDatabase(name string) (*Database, error) {
 		cache := &LruCache{
 			pageList: list.New(),
 			pageMap:  make(map[uint64]*list.Element, 16),
-			pageId:   uint64(len(table.Catalog) + 1), //这里加一是因为pageId代表下一个page的id，而pageId从1开始
+			pageId:   nextPageId(table.Catalog), //pageId代表下一个page的id，merge会删掉空page，所以不能用len(Catalog)+1
 			pageNum:  0,
 			maxPage:  GlobalOption.MaxPage,
 			maxLine:  GlobalOption.MaxLine,
 		}
 		table.cache = cache
 		cache.table = table
+		err = table.openIndexes(backend, dbPath)
+		if err != nil {
+			return nil, err
+		}
 	}
-	walPath := fmt.Sprint(dbPath, string(os.PathSeparator), "wal.txt")
-	walFile, err := OpenFile(walPath)
+	walPath := fmt.Sprint(dbPath, string(os.PathSeparator), "wal.log")
+	walFile, err := OpenWal(backend, walPath)
 	if err != nil {
 		return nil, err
 	}
 	db := &Database{
-		dbName:     name,
-		dbPath:     dbPath,
-		tables:     tabPts,
-		CondiFuncs: make(map[string]func([]any) bool, 64),
-		ColFuncs:   make(map[string]func(any) any, 64),
-		AggFuncs:   make(map[string]func([]any) any, 64),
-		ExecFuncs:  make(map[string]func([]any) any, 64),
-		wal:        walFile,
+		dbName:        name,
+		dbPath:        dbPath,
+		tables:        tabPts,
+		CondiFuncs:    make(map[string]func([]any) bool, 64),
+		ColFuncs:      make(map[string]func(any) any, 64),
+		AggFuncs:      make(map[string]func([]any) any, 64),
+		Aggregates:    make(map[string]Aggregate, 64),
+		ExecFuncs:     make(map[string]func([]any) any, 64),
+		wal:           walFile,
+		checkpointLsn: cata.Lsn,
+		backend:       backend,
+	}
+	db.wal.lsn = cata.Lsn + 1 // lsn在wal清空后也要继续递增
+	for _, table := range tabPts {
+		table.db = db
 	}
 	db.setFunctions()
+	err = db.recover()
+	if err != nil { // wal没有清空，释放文件之后可以再次打开重放
+		db.release()
+		return nil, err
+	}
+	db.wal.setDurability(GlobalOption.Durability)
+	db.startCheckpointer()
 	databases[name] = db
 	return db, nil
 }
@@ -127,74 +173,101 @@ func UseDatabase(name string) (*Database, error) {
 func DropDatabase(name string) error {
 	GlobalOption.lock.Lock()
 	defer GlobalOption.lock.Unlock()
+	backend, err := currentBackend()
+	if err != nil {
+		return err
+	}
 	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), name)
-	if _, err := os.Stat(dbPath); err != nil && os.IsNotExist(err) {
+	if exists, err := backend.Exists(dbPath); err == nil && !exists {
 		return errors.New("database not exists")
+	} else if err != nil {
+		return err
 	} else {
-		delete(databases, name)
-		return os.RemoveAll(dbPath)
+		if db := databases[name]; db != nil { // 还打开着的数据库先释放文件，后台checkpoint也要停掉
+			db.stopCheckpointer()
+			db.release()
+		}
+		return backend.RemoveAll(dbPath)
 	}
 }
 
 func (d *Database) Close() error {
 	GlobalOption.lock.Lock()
 	defer GlobalOption.lock.Unlock()
+	d.stopCheckpointer()
+	if err := d.checkBroken(); err != nil {
+		d.release()
+		return err
+	}
+	err := d.close()
+	if err != nil { // 关闭到一半失败，磁盘上的目录和wal仍然可以恢复，放弃内存中的状态
+		err = d.setBroken(err)
+		d.release()
+		return err
+	}
+	delete(databases, d.dbName)
+	return nil
+}
+
+func (d *Database) close() error {
+	err := d.Checkpoint() // 所有已提交的事务都写入数据文件
+	if err != nil {
+		return err
+	}
 	for _, table := range d.tables {
-		var err error
 		err = table.Close()
 		if err != nil {
 			return err
 		}
 		if table.updated {
 			err = table.Merge(d.dbPath)
-			if err != nil {
-				return err
-			}
 		} else {
 			err = table.file.Close()
-			if err != nil {
-				return err
-			}
 		}
-	}
-
-	err := d.wal.Close()
-	if err != nil {
-		return err
-	}
-	err = os.Remove(d.wal.Name())
-	if err != nil {
-		return err
-	}
-
-	logPath := fmt.Sprint(d.dbPath, string(os.PathSeparator), "cata.log")
-	if _, err = os.Stat(logPath); err == nil {
-		err = os.Remove(logPath)
+		if err == nil {
+			err = table.closeIndexes()
+		}
 		if err != nil {
 			return err
 		}
 	}
-	tables := make(map[string]Table, 16)
-	for tabName, table := range d.tables { // !!!
-		tables[tabName] = *table
-	}
-	date, err := json.Marshal(tables)
+	err = d.wal.Close() // 数据和目录都已经落盘，wal可以删除了
 	if err != nil {
 		return err
 	}
-	logFile, err := OpenFile(logPath)
-	if err != nil {
-		return err
+	return d.backend.Remove(d.wal.Name())
+}
+
+// release 只释放文件句柄，不刷脏页也不写目录，下次打开时从wal恢复
+func (d *Database) release() {
+	for _, table := range d.tables {
+		_ = table.file.Close()
+		_ = table.closeIndexes()
 	}
-	_, err = logFile.Write(date)
-	if err != nil {
-		return err
+	_ = d.wal.Close()
+	delete(databases, d.dbName)
+}
+
+func (d *Database) setBroken(err error) error {
+	d.brokenLock.Lock()
+	defer d.brokenLock.Unlock()
+	if d.broken == nil {
+		d.broken = fmt.Errorf("database %s must be reopened: %w", d.dbName, err)
 	}
-	err = logFile.Close()
-	if err != nil {
-		return err
+	return d.broken
+}
+
+func (d *Database) checkBroken() error {
+	d.brokenLock.Lock()
+	defer d.brokenLock.Unlock()
+	return d.broken
+}
+
+func (d *Database) SetDurability(durability int) error {
+	if durability < SyncCommit || durability > AsyncCommit {
+		return errors.New("invalid durability")
 	}
-	delete(databases, d.dbName)
+	d.wal.setDurability(durability)
 	return nil
 }
 
@@ -208,6 +281,9 @@ func (d *Database) setFunctions() { // 深拷贝 不需要加锁，create和use
 	for name, method := range GlobalOption.AggFuncs {
 		d.AggFuncs[name] = method
 	}
+	for name, aggregate := range GlobalOption.Aggregates {
+		d.Aggregates[name] = aggregate
+	}
 	for name, method := range GlobalOption.ExecFuncs {
 		d.ExecFuncs[name] = method
 	}
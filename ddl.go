@@ -0,0 +1,313 @@
+package rmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ddl不在事务中执行，直接生效，通过checkpoint把目录落盘
+
+var (
+	identReg          = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`) // 库名和表名会拼进路径，只允许这些字符
+	createDatabaseReg = regexp.MustCompile(`(?is)^create\s+database\s+(if\s+not\s+exists\s+)?(\S+)$`)
+	dropDatabaseReg   = regexp.MustCompile(`(?is)^drop\s+database\s+(if\s+exists\s+)?(\S+)$`)
+	createTableReg    = regexp.MustCompile(`(?is)^create\s+table\s+(if\s+not\s+exists\s+)?([^\s(]+)\s*\((.*)\)$`)
+	dropTableReg      = regexp.MustCompile(`(?is)^drop\s+table\s+(if\s+exists\s+)?(\S+)$`)
+	truncateTableReg  = regexp.MustCompile(`(?is)^truncate\s+(?:table\s+)?(\S+)$`)
+	createIndexReg    = regexp.MustCompile(`(?is)^create\s+(unique\s+)?index\s+(if\s+not\s+exists\s+)?(\S+)\s+on\s+([^\s(]+)\s*\((.*)\)(?:\s+using\s+(\S+))?$`)
+	dropIndexReg      = regexp.MustCompile(`(?is)^drop\s+index\s+(if\s+exists\s+)?(\S+)(?:\s+on\s+(\S+))?$`)
+	ddlReg            = regexp.MustCompile(`(?i)^\s*(create|drop|truncate|alter)\s`)
+	checkpointReg     = regexp.MustCompile(`(?i)^checkpoint$`)
+)
+
+// isDDL checkpoint也和ddl一样不在事务中执行
+func isDDL(sql string) bool {
+	return ddlReg.MatchString(sql) || isCheckpoint(sql)
+}
+
+func isCheckpoint(sql string) bool {
+	return checkpointReg.MatchString(trimStatement(sql))
+}
+
+func trimStatement(sql string) string {
+	return strings.Trim(sql, "; \t\r\n")
+}
+
+// ParseDatabaseDDL 解析create database和drop database，不是这两种语句时ok为false
+func ParseDatabaseDDL(sql string) (create bool, name string, ok bool) {
+	sql = trimStatement(sql)
+	if match := createDatabaseReg.FindStringSubmatch(sql); match != nil {
+		return true, match[2], true
+	}
+	if match := dropDatabaseReg.FindStringSubmatch(sql); match != nil {
+		return false, match[2], true
+	}
+	return false, "", false
+}
+
+func databaseExists(name string) (bool, error) {
+	GlobalOption.lock.RLock()
+	defer GlobalOption.lock.RUnlock()
+	backend, err := currentBackend()
+	if err != nil {
+		return false, err
+	}
+	return backend.Exists(fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), name))
+}
+
+// ExecDDL 执行create database [if not exists]和drop database [if exists]，新建的数据库保持打开，use时直接返回
+func ExecDDL(sql string) error {
+	sql = trimStatement(sql)
+	if match := createDatabaseReg.FindStringSubmatch(sql); match != nil {
+		if !identReg.MatchString(match[2]) {
+			return fmt.Errorf("invalid database name %s", match[2])
+		}
+		if match[1] != "" {
+			exists, err := databaseExists(match[2])
+			if err != nil || exists {
+				return err
+			}
+		}
+		_, err := CreateDatabase(match[2])
+		return err
+	}
+	if match := dropDatabaseReg.FindStringSubmatch(sql); match != nil {
+		if !identReg.MatchString(match[2]) {
+			return fmt.Errorf("invalid database name %s", match[2])
+		}
+		if match[1] != "" {
+			exists, err := databaseExists(match[2])
+			if err != nil || !exists {
+				return err
+			}
+		}
+		return DropDatabase(match[2])
+	}
+	return errors.New("invalid ddl statement")
+}
+
+// execDDL 执行表相关的ddl，create database和drop database也可以通过数据库执行
+func (d *Database) execDDL(sql string) error {
+	sql = trimStatement(sql)
+	if _, _, ok := ParseDatabaseDDL(sql); ok {
+		return ExecDDL(sql)
+	}
+	if checkpointReg.MatchString(sql) {
+		return d.Checkpoint()
+	}
+	if alterReg.MatchString(sql) {
+		return d.Alter(sql)
+	}
+	if match := createTableReg.FindStringSubmatch(sql); match != nil {
+		columns, err := d.parseColumnDefs(match[3])
+		if err != nil {
+			return err
+		}
+		if !identReg.MatchString(match[2]) {
+			return fmt.Errorf("invalid table name %s", match[2])
+		}
+		if _, ok := d.tables[match[2]]; ok && match[1] != "" {
+			return nil
+		}
+		_, err = d.createTable(match[2], columns)
+		return err
+	}
+	if match := dropTableReg.FindStringSubmatch(sql); match != nil {
+		if _, ok := d.tables[match[2]]; !ok && match[1] != "" {
+			return nil
+		}
+		return d.DropTable(match[2])
+	}
+	if match := truncateTableReg.FindStringSubmatch(sql); match != nil {
+		return d.TruncateTable(match[1])
+	}
+	if match := createIndexReg.FindStringSubmatch(sql); match != nil {
+		if table, ok := d.tables[match[4]]; ok && match[2] != "" {
+			if _, ok := table.Indexes[match[3]]; ok {
+				return nil
+			}
+		}
+		return d.CreateIndex(match[4], match[3], strings.Split(match[5], ","), match[1] != "", match[6])
+	}
+	if match := dropIndexReg.FindStringSubmatch(sql); match != nil {
+		if table, err := d.findIndex(match[3], match[2]); err == nil && table == nil && match[1] != "" {
+			return nil
+		}
+		return d.DropIndex(match[3], match[2])
+	}
+	return errors.New("invalid ddl statement")
+}
+
+var (
+	columnDefReg  = regexp.MustCompile(`(?s)^\s*(\S+)\s+([^\s(]+)(.*)$`)
+	primaryDefReg = regexp.MustCompile(`(?is)^\s*primary\s+key\s*\(\s*([^\s()]+)\s*\)\s*$`)
+)
+
+// parseColumnDefs 解析create table括号中的列定义：name TYPE [not null] [default 值] [check (函数(name))] [unique]
+// [primary key] [auto_increment], ...，主键也可以单独写成primary key (name)
+func (d *Database) parseColumnDefs(defs string) ([]Column, error) {
+	columns := make([]Column, 0, 16)
+	primaryKeys := make([]string, 0, 1)
+	for _, def := range splitTopLevel(defs) {
+		if match := primaryDefReg.FindStringSubmatch(def); match != nil {
+			primaryKeys = append(primaryKeys, match[1])
+			continue
+		}
+		column, err := d.parseColumnDef(def)
+		if err != nil {
+			return nil, err
+		}
+		if columnIndex(columns, column.Name) >= 0 {
+			return nil, fmt.Errorf("duplicate column %s", column.Name)
+		}
+		if column.PrimaryKey {
+			primaryKeys = append(primaryKeys, column.Name)
+		}
+		column.Id = uint64(len(columns) + 1)
+		columns = append(columns, column)
+	}
+	if len(primaryKeys) > 1 {
+		return nil, errors.New("multiple primary keys")
+	}
+	for _, name := range primaryKeys {
+		index := columnIndex(columns, name)
+		if index < 0 {
+			return nil, fmt.Errorf("primary key column %s not exists", name)
+		}
+		columns[index].PrimaryKey, columns[index].NotNull, columns[index].Unique = true, true, true
+	}
+	for _, column := range columns {
+		if column.AutoIncrement && (!column.PrimaryKey || column.TypeOf != INT64) {
+			return nil, fmt.Errorf("auto_increment column %s must be an INT64 primary key", column.Name)
+		}
+	}
+	return columns, nil
+}
+
+func (d *Database) parseColumnDef(def string) (Column, error) {
+	if strings.TrimSpace(def) == "" {
+		return Column{}, errors.New("empty column definition")
+	}
+	match := columnDefReg.FindStringSubmatch(def)
+	if match == nil {
+		return Column{}, fmt.Errorf("invalid column definition %s", strings.TrimSpace(def))
+	}
+	if !identReg.MatchString(match[1]) {
+		return Column{}, fmt.Errorf("invalid column name %s", match[1])
+	}
+	typeOf, err := parseType(match[2])
+	if err != nil {
+		return Column{}, err
+	}
+	column := Column{
+		Name:   match[1],
+		TypeOf: typeOf,
+	}
+	err = parseConstraints(&column, match[3], d.CondiFuncs)
+	if err != nil {
+		return Column{}, err
+	}
+	return column, nil
+}
+
+// splitTopLevel 按不在括号和引号中的逗号切分，引号可以是双引号、单引号和反引号
+func splitTopLevel(str string) []string {
+	parts := make([]string, 0, 16)
+	depth, start := 0, 0
+	var quote byte // 当前所在的引号，0表示不在引号中
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// TruncateTable 删除表中所有的行，表结构不变
+func (d *Database) TruncateTable(name string) error {
+	GlobalOption.lock.Lock()
+	defer GlobalOption.lock.Unlock()
+	d.ckptLock.Lock()
+	defer d.ckptLock.Unlock()
+	table, ok := d.tables[name]
+	if !ok {
+		return errors.New("table not exists")
+	}
+	err := d.checkpoint() // 先让缓存中的page都落盘，清空缓存时不会丢掉还没写的修改
+	if err != nil {
+		return err
+	}
+	table.cache.lock.Lock()
+	oldCatalog, oldPageId, oldSequence := table.Catalog, table.cache.pageId, table.Sequence
+	table.Catalog = make(map[uint64]Page, 64)
+	table.Sequence = 0 // auto_increment重新从1开始
+	table.cache.reset(1)
+	indexes := table.allIndexes()
+	oldIndexes := make([]Index, 0, len(indexes))
+	for _, index := range indexes { // 索引变成空树，缓存中的节点都已经落盘
+		oldIndexes = append(oldIndexes, *index)
+		index.reset()
+	}
+	table.cache.lock.Unlock()
+	err = d.checkpoint()
+	if err != nil {
+		table.cache.lock.Lock()
+		table.Catalog, table.Sequence = oldCatalog, oldSequence
+		table.cache.reset(oldPageId)
+		for i, index := range indexes {
+			index.restore(oldIndexes[i])
+		}
+		table.cache.lock.Unlock()
+		return err
+	}
+	table.updated = false
+	err = table.file.Close() // 目录已经不引用任何page，数据文件可以直接清空，失败时只留下merge能清理的旧数据
+	if err != nil {
+		return d.setBroken(err)
+	}
+	tabPath := fmt.Sprint(d.dbPath, string(os.PathSeparator), name, ".data")
+	err = d.backend.Remove(tabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return d.setBroken(err)
+	}
+	table.file, err = d.backend.OpenFile(tabPath)
+	if err != nil {
+		return d.setBroken(err)
+	}
+	for _, index := range indexes {
+		path := index.cache.file.Name()
+		err = index.cache.file.Close()
+		if err == nil {
+			err = d.backend.Remove(path)
+		}
+		if err == nil {
+			err = index.open(d.backend, path)
+		}
+		if err != nil {
+			return d.setBroken(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package rmdb
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDDL(t *testing.T) {
+	setTestOption(t)
+
+	assert.Nil(t, ExecDDL("create database ddl;"))
+	assert.NotNil(t, ExecDDL("create database ddl"), "database already exists")
+	assert.Nil(t, ExecDDL("CREATE DATABASE IF NOT EXISTS ddl"))
+	assert.NotNil(t, ExecDDL("create database ../ddl"), "database name is part of a path")
+	db, err := UseDatabase("ddl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.Update("create table man (name STRING, age int64)"))
+	assert.NotNil(t, db.Update("create table man (name STRING)"), "table already exists")
+	assert.Nil(t, db.Update("create table if not exists man (name STRING)"))
+	assert.NotNil(t, db.Update("create table bad (name TEXT)"), "unknown type")
+	assert.NotNil(t, db.Update("create table bad (name STRING, name INT64)"), "duplicate column")
+	assert.NotNil(t, db.Update("create table bad (name)"), "column without type")
+	assert.NotNil(t, db.Update("create table bad/x (name STRING)"), "table name is part of a path")
+	_, ok := db.tables["bad"]
+	assert.False(t, ok)
+
+	table := db.tables["man"]
+	if assert.Len(t, table.Columns, 2) {
+		assert.Equal(t, Column{Id: 2, Name: "age", TypeOf: INT64}, table.Columns[1])
+	}
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("a", 1)`))
+	assert.Nil(t, db.Update(`insert into man (name) values ("b")`))
+	assert.Equal(t, []string{"a", "b"}, queryNames(t, db, "select * from man"))
+	assert.Equal(t, []string{"b"}, queryNames(t, db, "select * from man where age is null"))
+
+	tx := db.Begin()
+	assert.NotNil(t, tx.Update("truncate table man"), "ddl is not allowed in a transaction")
+	assert.Nil(t, tx.Rollback())
+
+	assert.Nil(t, db.Update("truncate table man"))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from man")))
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("c", 3)`))
+	assert.Equal(t, []string{"c"}, queryNames(t, db, "select * from man"))
+	assert.NotNil(t, db.Update("truncate table nobody"))
+
+	assert.Nil(t, db.Update("create table tmp (id INT64)"))
+	assert.Nil(t, db.Update("drop table tmp"))
+	assert.NotNil(t, db.Update("drop table tmp"))
+	assert.Nil(t, db.Update("drop table if exists tmp"))
+
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("ddl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"c"}, queryNames(t, db, "select * from man"), "truncate should survive reopen")
+	_, ok = db.tables["tmp"]
+	assert.False(t, ok)
+
+	assert.Nil(t, db.Update("drop database ddl"), "open database can be dropped")
+	exists, err := databaseExists("ddl")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.NotNil(t, ExecDDL("drop database ddl"))
+	assert.Nil(t, ExecDDL("drop database if exists ddl"))
+}
+
+func TestDDLServer(t *testing.T) {
+	setTestOption(t)
+
+	server, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	server.wg.Add(1)
+	go server.handleConn(conn)
+	buf := make([]byte, 1024)
+	send := func(cmd string) string {
+		_, err := client.Write([]byte(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	assert.Equal(t, "Query OK", send("create database web"))
+	assert.Equal(t, "Query OK", send("use web"))
+	assert.Equal(t, "Query OK", send("create table man (name STRING, age INT64)"))
+	assert.Equal(t, "Query OK", send(`insert into man (name, age) values ("a", 1)`))
+	assert.Equal(t, "Query OK", send("CHECKPOINT"))
+	assert.Equal(t, "Query OK", send("begin"))
+	assert.Equal(t, "Query OK", send("Checkpoint;"), "checkpoint is allowed in a transaction")
+	assert.Equal(t, "Query OK", send("commit"))
+	assert.Equal(t, "Query OK", send("truncate table man"))
+	assert.Equal(t, "Query OK", send("drop table man"))
+	assert.Equal(t, "ddl failed: table not exists", send("drop table man"))
+	assert.Equal(t, "Query OK", send("drop database web"))
+	assert.Equal(t, "please use database", send("showtables"), "dropped database should not be used any more")
+
+	server.cancel()
+	assert.Nil(t, client.Close())
+	server.wg.Wait()
+}
@@ -1,9 +1,11 @@
 package rmdb
 
 import (
+	"errors"
 	"fmt"
 	"github.com/liushuochen/gotable"
-	"os"
+	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -12,9 +14,9 @@ type ResultSet struct {
 	outOuder []string
 }
 
-func execute(logicalPlans map[int]Plan, outOuder []string, wg *sync.WaitGroup) *ResultSet {
+func execute(logicalPlans map[int]Plan, outOuder []string, wg *sync.WaitGroup) (*ResultSet, error) {
 	physicalPlans := make([]Plan, 0, 16)
-	for symbol := 0; symbol < 11; symbol++ {
+	for symbol := TableRead; symbol <= Limit; symbol++ {
 		if plan, ok := logicalPlans[symbol]; ok && plan.getConfig() {
 			physicalPlans = append(physicalPlans, plan)
 		}
@@ -38,13 +40,23 @@ func execute(logicalPlans map[int]Plan, outOuder []string, wg *sync.WaitGroup) *
 		}
 	}()
 	wg.Wait()
-	return resultSet
+	for _, plan := range physicalPlans {
+		if err := plan.getErr(); err != nil {
+			return nil, err
+		}
+	}
+	return resultSet, nil
 }
 
+// Update 执行insert、update、delete，也可以执行create、drop、truncate、alter这些ddl，ddl直接生效不进入事务
 func (d *Database) Update(sql string) error {
+	if isDDL(sql) {
+		return d.execDDL(sql)
+	}
 	tx := d.Begin()
 	err := tx.Update(sql)
-	if err != nil { // TODO 这里没有commit应该不用回滚
+	if err != nil { // 还没有commit，回滚只是在wal中标记事务已放弃
+		_ = tx.Rollback()
 		return err
 	}
 	err = tx.Commit()
@@ -55,13 +67,69 @@ func (d *Database) Update(sql string) error {
 	return nil
 }
 
+var (
+	alterReg  = regexp.MustCompile(`(?is)^alter\s+table\s+(\S+)\s+(.+)$`)
+	addReg    = regexp.MustCompile(`(?is)^add\s+(?:column\s+)?(.+)$`)
+	dropReg   = regexp.MustCompile(`(?is)^drop\s+(?:column\s+)?(\S+)$`)
+	renameReg = regexp.MustCompile(`(?is)^rename\s+(?:column\s+)?(\S+)\s+to\s+(\S+)$`)
+	modifyReg = regexp.MustCompile(`(?is)^(?:modify|alter)\s+(?:column\s+)?(\S+)\s+(?:type\s+)?(\S+)$`)
+)
+
+// Alter 执行alter table，ddl不在事务中，直接生效
+//
+//	alter table test add [column] age INT64 [default 0]
+//	alter table test drop [column] age
+//	alter table test rename [column] age to years
+//	alter table test modify [column] age STRING
+func (d *Database) Alter(sql string) error {
+	match := alterReg.FindStringSubmatch(trimStatement(sql))
+	if match == nil {
+		return errors.New("invalid alter statement")
+	}
+	table := d.tables[match[1]]
+	if table == nil {
+		return errors.New("invalid table name")
+	}
+	action := strings.TrimSpace(match[2])
+	if match := addReg.FindStringSubmatch(action); match != nil {
+		column, err := d.parseColumnDef(match[1])
+		if err != nil {
+			return err
+		}
+		if column.PrimaryKey || column.AutoIncrement { // 已有的行没有主键的值
+			return errors.New("primary key can only be declared in create table")
+		}
+		column.DefVal = column.Default // 旧的行取默认值，没有default时是NULL
+		return table.addColumn(column)
+	}
+	if match := dropReg.FindStringSubmatch(action); match != nil {
+		return table.DropColumn(match[1])
+	}
+	if match := renameReg.FindStringSubmatch(action); match != nil {
+		return table.RenameColumn(match[1], match[2])
+	}
+	if match := modifyReg.FindStringSubmatch(action); match != nil {
+		typeOf, err := parseType(match[2])
+		if err != nil {
+			return err
+		}
+		return table.ModifyColumn(match[1], typeOf)
+	}
+	return errors.New("invalid alter statement")
+}
+
 func (d *Database) Query(sql string) (*ResultSet, error) {
 	tx := d.Begin()
 	return tx.Query(sql) // query事务可以不commit，因为进入commit方法后直接返回
 }
 
 func ShowDatabase() string {
-	dirEns, err := os.ReadDir(GlobalOption.Root)
+	backend, err := currentBackend()
+	if err != nil {
+		logger.Error(err)
+		return ""
+	}
+	dirEns, err := backend.ReadDir(GlobalOption.Root)
 	if err != nil {
 		logger.Error(err)
 		return ""
@@ -72,7 +140,7 @@ func ShowDatabase() string {
 		return ""
 	}
 	for _, dirEn := range dirEns {
-		row := map[string]string{"Database": dirEn.Name()}
+		row := map[string]string{"Database": dirEn}
 		err = table.AddRow(row)
 		if err != nil {
 			logger.Error(err)
@@ -107,7 +175,8 @@ func (r *ResultSet) ToString() string {
 	for _, line := range r.result {
 		row := make(map[string]string, 64)
 		for _, colName := range r.outOuder {
-			row[colName] = string(line.nameToVal[colName].value)
+			colVal := line.nameToVal[colName]
+			row[colName] = FormatData(colVal.value, colVal.column.TypeOf)
 		}
 		err = table.AddRow(row)
 		if err != nil {
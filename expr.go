@@ -0,0 +1,705 @@
+package rmdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 表达式编译成求值函数，值和DecodeData的结果一样：nil表示NULL，其余是bool、int64、float64、string或者time.Time。
+// 条件的结果是bool或者NULL，按三值逻辑计算
+
+type evalFunc func(line *Line) (any, error)
+
+// exprCompiler columns不为nil时检查列名，aggregates为true时可以引用聚合函数的结果
+type exprCompiler struct {
+	db         *Database
+	columns    []Column
+	aggregates bool
+}
+
+func (c *exprCompiler) compile(expr Expr) (evalFunc, error) {
+	switch e := expr.(type) {
+	case *Literal:
+		val, err := literalValue(e)
+		if err != nil {
+			return nil, err
+		}
+		return func(*Line) (any, error) { return val, nil }, nil
+	case *ColumnRef:
+		if c.columns != nil && columnIndex(c.columns, e.Name) < 0 {
+			return nil, fmt.Errorf("column %s not exists", e.Name)
+		}
+		return columnValue(e.Name), nil
+	case *FuncCall:
+		return c.call(e)
+	case *UnaryExpr:
+		operand, err := c.compile(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "not" {
+			return func(line *Line) (any, error) {
+				t, err := truthOf(operand(line))
+				return t.not().value(), err
+			}, nil
+		}
+		return func(line *Line) (any, error) {
+			val, err := operand(line)
+			if err != nil || val == nil {
+				return nil, err
+			}
+			return arithmetic("-", int64(0), val)
+		}, nil
+	case *BinaryExpr:
+		return c.binary(e)
+	case *CompareExpr:
+		left, right, err := c.compilePair(e.Left, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return func(line *Line) (any, error) {
+			return compareWith(e.Op, left, right, line)
+		}, nil
+	case *IsNullExpr:
+		operand, err := c.compile(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(line *Line) (any, error) {
+			val, err := operand(line)
+			return (val == nil) != e.Not, err
+		}, nil
+	case *BetweenExpr:
+		return c.between(e)
+	case *InExpr:
+		return c.in(e)
+	case *LikeExpr:
+		return c.like(e)
+	case *CaseExpr:
+		return c.caseWhen(e)
+	case *CastExpr:
+		operand, err := c.compile(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(line *Line) (any, error) {
+			val, err := operand(line)
+			if err != nil {
+				return nil, err
+			}
+			return castValue(val, e.TypeOf)
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid expression %s", expr.String())
+}
+
+func (c *exprCompiler) compilePair(left, right Expr) (evalFunc, evalFunc, error) {
+	l, err := c.compile(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := c.compile(right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, r, nil
+}
+
+func (c *exprCompiler) compileAll(exprs []Expr) ([]evalFunc, error) {
+	funcs := make([]evalFunc, 0, len(exprs))
+	for _, expr := range exprs {
+		f, err := c.compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, f)
+	}
+	return funcs, nil
+}
+
+func literalValue(literal *Literal) (any, error) {
+	switch literal.Kind {
+	case BoolLiteral:
+		return literal.Value == "true", nil
+	case StringLiteral:
+		return literal.Value, nil
+	case NumberLiteral:
+		if val, err := strconv.ParseInt(literal.Value, 10, 64); err == nil {
+			return val, nil
+		}
+		val, err := strconv.ParseFloat(literal.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", literal.Value)
+		}
+		return val, nil
+	}
+	return nil, nil
+}
+
+// columnValue 行中没有的列是NULL
+func columnValue(name string) evalFunc {
+	return func(line *Line) (any, error) {
+		colVal := line.nameToVal[name]
+		return DecodeData(colVal.value, colVal.column.TypeOf)
+	}
+}
+
+func (c *exprCompiler) binary(e *BinaryExpr) (evalFunc, error) {
+	left, right, err := c.compilePair(e.Left, e.Right)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case "and", "or": // 左边已经能决定结果时不再计算右边
+		decided := truthFalse
+		if e.Op == "or" {
+			decided = truthTrue
+		}
+		return func(line *Line) (any, error) {
+			l, err := truthOf(left(line))
+			if err != nil || l == decided {
+				return l.value(), err
+			}
+			r, err := truthOf(right(line))
+			if err != nil {
+				return nil, err
+			}
+			if e.Op == "or" {
+				return l.or(r).value(), nil
+			}
+			return l.and(r).value(), nil
+		}, nil
+	}
+	return func(line *Line) (any, error) {
+		l, err := left(line)
+		if err != nil || l == nil {
+			return nil, err
+		}
+		r, err := right(line)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		return arithmetic(e.Op, l, r)
+	}, nil
+}
+
+func (c *exprCompiler) between(e *BetweenExpr) (evalFunc, error) {
+	funcs, err := c.compileAll([]Expr{e.Expr, e.Lower, e.Upper})
+	if err != nil {
+		return nil, err
+	}
+	return func(line *Line) (any, error) {
+		lower, err := compareWith(">=", funcs[0], funcs[1], line)
+		if err != nil {
+			return nil, err
+		}
+		upper, err := compareWith("<=", funcs[0], funcs[2], line)
+		if err != nil {
+			return nil, err
+		}
+		result := truthFromValue(lower).and(truthFromValue(upper))
+		if e.Not {
+			result = result.not()
+		}
+		return result.value(), nil
+	}, nil
+}
+
+// in 有相等的值时成立，没有相等的值但是有NULL时是unknown
+func (c *exprCompiler) in(e *InExpr) (evalFunc, error) {
+	operand, err := c.compile(e.Expr)
+	if err != nil {
+		return nil, err
+	}
+	items, err := c.compileAll(e.List)
+	if err != nil {
+		return nil, err
+	}
+	return func(line *Line) (any, error) {
+		result := truthFalse
+		for _, item := range items {
+			equal, err := compareWith("=", operand, item, line)
+			if err != nil {
+				return nil, err
+			}
+			result = result.or(truthFromValue(equal))
+			if result == truthTrue {
+				break
+			}
+		}
+		if e.Not {
+			result = result.not()
+		}
+		return result.value(), nil
+	}, nil
+}
+
+func (c *exprCompiler) like(e *LikeExpr) (evalFunc, error) {
+	operand, pattern, err := c.compilePair(e.Expr, e.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	var compiled []likeToken
+	if literal, ok := e.Pattern.(*Literal); ok && literal.Kind == StringLiteral { // 模式是字面量时只编译一次
+		compiled = compileLike(literal.Value)
+	}
+	return func(line *Line) (any, error) {
+		val, err := operand(line)
+		if err != nil || val == nil {
+			return nil, err
+		}
+		text, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("like needs a string, got %s", typeName(GetTypeOf(val)))
+		}
+		tokens := compiled
+		if tokens == nil {
+			val, err = pattern(line)
+			if err != nil || val == nil {
+				return nil, err
+			}
+			p, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("like pattern must be a string, got %s", typeName(GetTypeOf(val)))
+			}
+			tokens = compileLike(p)
+		}
+		return likeMatch([]rune(text), tokens) != e.Not, nil
+	}, nil
+}
+
+func (c *exprCompiler) caseWhen(e *CaseExpr) (evalFunc, error) {
+	var operand, otherwise evalFunc
+	var err error
+	if e.Operand != nil {
+		if operand, err = c.compile(e.Operand); err != nil {
+			return nil, err
+		}
+	}
+	if e.Else != nil {
+		if otherwise, err = c.compile(e.Else); err != nil {
+			return nil, err
+		}
+	}
+	whens := make([]evalFunc, 0, len(e.Whens))
+	thens := make([]evalFunc, 0, len(e.Whens))
+	for _, clause := range e.Whens {
+		when, then, err := c.compilePair(clause.When, clause.Then)
+		if err != nil {
+			return nil, err
+		}
+		whens, thens = append(whens, when), append(thens, then)
+	}
+	return func(line *Line) (any, error) {
+		for i, when := range whens {
+			var matched any
+			var err error
+			if operand != nil {
+				matched, err = compareWith("=", operand, when, line)
+			} else {
+				matched, err = when(line)
+			}
+			t, err := truthOf(matched, err)
+			if err != nil {
+				return nil, err
+			}
+			if t == truthTrue {
+				return thens[i](line)
+			}
+		}
+		if otherwise == nil {
+			return nil, nil
+		}
+		return otherwise(line)
+	}, nil
+}
+
+// call 行中已经有同名的列时直接取值，聚合函数的结果和match的相关度都是这样的列。
+// 否则调用内置的coalesce、match或者注册的条件函数、列函数、多列函数
+func (c *exprCompiler) call(e *FuncCall) (evalFunc, error) {
+	name := e.String()
+	var f evalFunc
+	switch {
+	case strings.EqualFold(e.Name, "coalesce"):
+		args, err := c.compileAll(e.Args)
+		if err != nil {
+			return nil, err
+		}
+		f = func(line *Line) (any, error) {
+			for _, arg := range args {
+				val, err := arg(line)
+				if err != nil || val != nil {
+					return val, err
+				}
+			}
+			return nil, nil
+		}
+	case strings.EqualFold(e.Name, "match") && len(e.Args) == 1: // 相关度，没有match条件时是NULL
+		f = func(*Line) (any, error) { return nil, nil }
+	case strings.EqualFold(e.Name, "match"):
+		m, ok := matchOf(e)
+		if !ok {
+			return nil, errors.New("match needs a column and a string")
+		}
+		text, err := c.compile(e.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		condition := m.condition()
+		f = func(line *Line) (any, error) {
+			val, err := text(line)
+			if err != nil || val == nil {
+				return nil, err
+			}
+			return condition([]any{val}), nil
+		}
+	case c.db.isAggregate(e.Name):
+		if !c.aggregates {
+			return nil, fmt.Errorf("aggregate function %s is not allowed here", e.Name)
+		}
+		for _, arg := range e.Args { // 参数中的列名也要检查
+			if _, ok := arg.(*Star); ok {
+				continue
+			}
+			if _, err := c.compile(arg); err != nil {
+				return nil, err
+			}
+		}
+		f = func(*Line) (any, error) { return nil, nil } // 结果由AggregationPlan放在行中
+	default:
+		args, err := c.compileAll(e.Args)
+		if err != nil {
+			return nil, err
+		}
+		if f, err = c.registered(e.Name, args); err != nil {
+			return nil, err
+		}
+	}
+	return func(line *Line) (any, error) {
+		if colVal, ok := line.nameToVal[name]; ok {
+			return DecodeData(colVal.value, colVal.column.TypeOf)
+		}
+		return f(line)
+	}, nil
+}
+
+// registered 注册的函数，条件函数按evalCondition的三值逻辑，返回值统一成DecodeData的类型
+func (c *exprCompiler) registered(funcName string, args []evalFunc) (evalFunc, error) {
+	values := func(line *Line) ([]any, error) {
+		vals := make([]any, 0, len(args))
+		for _, arg := range args {
+			val, err := arg(line)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		return vals, nil
+	}
+	if function, ok := c.db.CondiFuncs[funcName]; ok {
+		return func(line *Line) (any, error) {
+			vals, err := values(line)
+			if err != nil {
+				return nil, err
+			}
+			return evalCondition(funcName, function, vals).value(), nil
+		}, nil
+	}
+	if function, ok := c.db.ColFuncs[funcName]; ok {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s needs one argument", funcName)
+		}
+		return func(line *Line) (any, error) {
+			val, err := args[0](line)
+			if err != nil {
+				return nil, err
+			}
+			return normalizeValue(function(val))
+		}, nil
+	}
+	if function, ok := c.db.ExecFuncs[funcName]; ok {
+		return func(line *Line) (any, error) {
+			vals, err := values(line)
+			if err != nil {
+				return nil, err
+			}
+			return normalizeValue(function(vals))
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid function name %s", funcName)
+}
+
+// normalizeValue 注册的函数可能返回int、float32这样的类型
+func normalizeValue(val any) (any, error) {
+	switch v := val.(type) {
+	case nil, bool, int64, float64, string, time.Time:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case *time.Time:
+		if v == nil {
+			return nil, nil
+		}
+		return *v, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", val)
+}
+
+// truthOf 条件的值只能是bool或者NULL
+func truthOf(val any, err error) (truth, error) {
+	if err != nil {
+		return truthUnknown, err
+	}
+	switch v := val.(type) {
+	case nil:
+		return truthUnknown, nil
+	case bool:
+		if v {
+			return truthTrue, nil
+		}
+		return truthFalse, nil
+	}
+	return truthUnknown, fmt.Errorf("condition must be a bool, got %s", typeName(GetTypeOf(val)))
+}
+
+// truthFromValue 比较的结果一定是bool或者NULL
+func truthFromValue(val any) truth {
+	t, _ := truthOf(val, nil)
+	return t
+}
+
+// compareWith 有NULL时是unknown
+func compareWith(op string, left, right evalFunc, line *Line) (any, error) {
+	l, err := left(line)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	r, err := right(line)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	cmp, ok, err := compareValues(l, r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	switch op {
+	case "=":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// compareValues 比较两个不是NULL的值。整数和小数按数值比较，字符串和其它类型比较时把字符串转换成那个类型，
+// 转换失败时ok为false，比较的结果是unknown，和字面量解析失败时的条件一致。其余类型不同时返回错误
+func compareValues(a, b any) (int, bool, error) {
+	typeA, typeB := GetTypeOf(a), GetTypeOf(b)
+	if typeA != typeB {
+		switch {
+		case isNumber(a) && isNumber(b):
+			return compareFloat(toFloat(a), toFloat(b)), true, nil
+		case typeA == STRING:
+			converted, err := castValue(a, typeB)
+			if err != nil {
+				return 0, false, nil
+			}
+			a = converted
+		case typeB == STRING:
+			converted, err := castValue(b, typeA)
+			if err != nil {
+				return 0, false, nil
+			}
+			b = converted
+		default:
+			return 0, false, fmt.Errorf("cannot compare %s with %s", typeName(typeA), typeName(typeB))
+		}
+	}
+	switch v := a.(type) {
+	case bool:
+		w := b.(bool)
+		switch {
+		case v == w:
+			return 0, true, nil
+		case w:
+			return -1, true, nil
+		}
+		return 1, true, nil
+	case int64:
+		w := b.(int64)
+		switch {
+		case v < w:
+			return -1, true, nil
+		case v > w:
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case float64:
+		return compareFloat(v, b.(float64)), true, nil
+	case string:
+		return strings.Compare(v, b.(string)), true, nil
+	case time.Time:
+		return v.Compare(b.(time.Time)), true, nil
+	}
+	return 0, false, fmt.Errorf("cannot compare %s", typeName(typeA))
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func isNumber(val any) bool {
+	switch val.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(val any) float64 {
+	if v, ok := val.(int64); ok {
+		return float64(v)
+	}
+	return val.(float64)
+}
+
+// arithmetic 两个整数的结果是整数，除法向零取整，有小数时按小数计算
+func arithmetic(op string, a, b any) (any, error) {
+	if !isNumber(a) || !isNumber(b) {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(GetTypeOf(a)), typeName(GetTypeOf(b)))
+	}
+	x, xInt := a.(int64)
+	y, yInt := b.(int64)
+	if xInt && yInt {
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	}
+	f, g := toFloat(a), toFloat(b)
+	switch op {
+	case "+":
+		return f + g, nil
+	case "-":
+		return f - g, nil
+	case "*":
+		return f * g, nil
+	}
+	if g == 0 {
+		return nil, errors.New("division by zero")
+	}
+	if op == "/" {
+		return f / g, nil
+	}
+	return math.Mod(f, g), nil
+}
+
+// castValue 按convertData的规则转换类型，不能无损转换时返回错误
+func castValue(val any, typeOf int) (any, error) {
+	if val == nil || GetTypeOf(val) == typeOf {
+		return val, nil
+	}
+	data, err := EncodeData(val)
+	if err != nil {
+		return nil, err
+	}
+	data, err = convertData(data, GetTypeOf(val), typeOf)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeData(data, typeOf)
+}
+
+type likeToken struct {
+	r    rune
+	kind byte // 0是普通字符，'%'和'_'是通配符
+}
+
+// compileLike 反斜杠之后的字符按普通字符匹配
+func compileLike(pattern string) []likeToken {
+	runes := []rune(pattern)
+	tokens := make([]likeToken, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case runes[i] == '\\' && i+1 < len(runes):
+			i++
+			tokens = append(tokens, likeToken{r: runes[i]})
+		case runes[i] == '%' || runes[i] == '_':
+			tokens = append(tokens, likeToken{kind: byte(runes[i])})
+		default:
+			tokens = append(tokens, likeToken{r: runes[i]})
+		}
+	}
+	return tokens
+}
+
+// likeMatch %匹配失败时回到上一个%多吃一个字符再试
+func likeMatch(text []rune, pattern []likeToken) bool {
+	t, p, star, mark := 0, 0, -1, 0
+	for t < len(text) {
+		switch {
+		case p < len(pattern) && (pattern[p].kind == '_' || pattern[p].kind == 0 && pattern[p].r == text[t]):
+			t, p = t+1, p+1
+		case p < len(pattern) && pattern[p].kind == '%':
+			star, mark = p, t
+			p++
+		case star >= 0:
+			mark++
+			t, p = mark, star+1
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p].kind == '%' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// evalTruth where和having中的条件之间是and的关系
+func evalTruth(line *Line, conditions []evalFunc) (truth, error) {
+	result := truthTrue
+	for _, condition := range conditions {
+		t, err := truthOf(condition(line))
+		if err != nil {
+			return truthUnknown, err
+		}
+		result = result.and(t)
+		if result == truthFalse {
+			break
+		}
+	}
+	return result, nil
+}
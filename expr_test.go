@@ -0,0 +1,211 @@
+package rmdb
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExprParse(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"select * from t where a = 1 or b = 2 and not c like 'x%'":                         `select * from t where a = 1 or b = 2 and not c like "x%"`,
+		"select * from t where (a = 1 or b = 2) and c not in (1, 'y', d)":                  `select * from t where (a = 1 or b = 2) and c not in (1, "y", d)`,
+		"select (a + b) * -c % 2, a - (b - c), - -a, -(-1) from t":                         "select (a + b) * -c % 2, a - (b - c), -(-a), -(-1) from t",
+		"select a from t where not (a between 1 + 1 and 5) and b not between 1 and 2":      "select a from t where not a between 1 + 1 and 5 and b not between 1 and 2",
+		"select CASE WHEN a > 1 THEN 'big' ELSE 'small' END as size from t":                `select case when a > 1 then "big" else "small" end as size from t`,
+		"select case a when 1 then true end, cast(a as float64), coalesce(a, b, 0) from t": "select case a when 1 then true end, cast(a as FLOAT64), coalesce(a,b,0) from t",
+		"update t set a = a + 1, b = case when b is null then 0 else b * 2 end":            "update t set a = a + 1, b = case when b is null then 0 else b * 2 end",
+		"delete from t where (a = 1) = (b = 2)":                                            "delete from t where (a = 1) = (b = 2)",
+	} {
+		stmt, err := parseStatement(sql)
+		if assert.Nil(t, err, sql) {
+			assert.Equal(t, expected, stmt.String(), sql)
+			again, err := parseStatement(stmt.String())
+			assert.Nil(t, err, "output parses again")
+			assert.Equal(t, expected, again.String())
+		}
+	}
+	where := mustSelect(t, "select * from t where a = 1 and (b = 2 and c = 3), d = 4 or e = 5").Where
+	assert.Equal(t, 4, len(where), "top level and is split into conditions")
+
+	for sql, expected := range map[string]string{
+		"select * from t where a in 1":              `syntax error at line 1 column 28 near "1": expected (`,
+		"select * from t where case a end":          `syntax error at line 1 column 30 near "end": expected when`,
+		"select cast(a as number) from t":           `syntax error at line 1 column 18 near "number": unsupported type number`,
+		"select * from t where (a = 1":              "syntax error at line 1 column 29: expected )",
+		"select * from t order by a + 1":            `syntax error at line 1 column 28 near "+": unexpected token after statement`,
+		"select * from t where a = 1 and b not = 2": `syntax error at line 1 column 39 near "=": expected between, in or like`,
+	} {
+		_, err := parseStatement(sql)
+		if assert.NotNil(t, err, sql) {
+			assert.Equal(t, expected, err.Error(), sql)
+		}
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	created := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	line := &Line{nameToVal: map[string]ColVal{}}
+	for name, val := range map[string]any{"age": int64(9), "price": 2.5, "name": "john", "created": created, "ok": true, "none": nil} {
+		data, err := EncodeData(val)
+		assert.Nil(t, err)
+		typeOf := GetTypeOf(val)
+		if val == nil {
+			typeOf = INT64
+		}
+		line.nameToVal[name] = ColVal{column: Column{Name: name, TypeOf: typeOf}, value: data}
+	}
+	db := &Database{
+		ColFuncs:  map[string]func(any) any{"twice": func(val any) any { return int(val.(int64) * 2) }},
+		ExecFuncs: map[string]func([]any) any{"sum2": func(vals []any) any { return vals[0].(int64) + vals[1].(int64) }},
+		AggFuncs:  map[string]func([]any) any{"total": func(vals []any) any { return nil }},
+	}
+	eval := func(sql string) (any, error) {
+		f, err := (&exprCompiler{db: db}).compile(mustSelect(t, "select "+sql+" from t").Fields[0].Expr)
+		if err != nil {
+			return nil, err
+		}
+		return f(line)
+	}
+	for sql, expected := range map[string]any{
+		"age + 1":                          int64(10),
+		"age / 2":                          int64(4),
+		"-age % 4":                         int64(-1),
+		"age * price":                      22.5,
+		"age / 2.0":                        4.5,
+		"age + none":                       nil,
+		"age > 8 and name like 'j%'":       true,
+		"name like 'J%'":                   false,
+		"name like '_o_n'":                 true,
+		"name like '%h%n'":                 true,
+		"'50%' like '50\\\\%'":             true,
+		"'500' like '50\\\\%'":             false,
+		"name not like '%x%'":              true,
+		"none like '%'":                    nil,
+		"age in (1, 9.0)":                  true,
+		"age between 9 and 10":             true,
+		"price not between 1 and 2":        true,
+		"none is null or age < 0":          true,
+		"age < 0 and none = 1":             false,
+		"created > '2024-04-30T00:00:00Z'": true,
+		"created = 'yesterday'":            nil,
+		"age = '9'":                        true,
+		"case when age > 10 then 'old' when age > 5 then 'mid' end": "mid",
+		"case age when 1 then 'one' else 'other' end":               "other",
+		"case when none > 1 then 1 end":                             nil,
+		"coalesce(none, age, 1)":                                    int64(9),
+		"cast(age as STRING)":                                       "9",
+		"cast('2.5' as FLOAT64) + 1":                                3.5,
+		"cast(ok as INT64)":                                         int64(1),
+		"twice(age) + sum2(age, 1)":                                 int64(28),
+		"not ok":                                                    false,
+	} {
+		val, err := eval(sql)
+		if assert.Nil(t, err, sql) {
+			assert.Equal(t, expected, val, sql)
+		}
+	}
+	for sql, expected := range map[string]string{
+		"age / 0":              "division by zero",
+		"name + 1":             "cannot apply + to STRING and INT64",
+		"ok = 1":               "cannot compare BOOL with INT64",
+		"age and ok":           "condition must be a bool, got INT64",
+		"cast(price as INT64)": "cannot convert 2.5 to INT64",
+		"name like 1":          "like pattern must be a string, got INT64",
+		"nothing(age)":         "invalid function name nothing",
+		"total(age) > 1":       "aggregate function total is not allowed here",
+		"twice(age, age)":      "twice needs one argument",
+		"match(name, age)":     "match needs a column and a string",
+	} {
+		_, err := eval(sql)
+		if assert.NotNil(t, err, sql) {
+			assert.Equal(t, expected, err.Error(), sql)
+		}
+	}
+	f, err := (&exprCompiler{db: db, columns: []Column{{Name: "age"}}}).compile(mustSelect(t, "select height from t").Fields[0].Expr)
+	assert.Nil(t, f)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "column height not exists", err.Error())
+	}
+}
+
+func TestExprSql(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("expr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, city STRING, age INT64, score FLOAT64)"))
+	for _, sql := range []string{
+		`insert into man (name, city, age, score) values ("jack", "bj", 9, 1.5)`,
+		`insert into man (name, city, age, score) values ("jill", "sh", 12, 2)`,
+		`insert into man (name, city, age) values ("john", "bj", 5)`,
+		`insert into man (name, city, score) values ("mary", "sh", 4)`,
+	} {
+		assert.Nil(t, db.Update(sql))
+	}
+	assert.Equal(t, []string{"jack", "jill"}, queryNames(t, db, "select * from man where age > 8 and name like 'j%'"))
+	assert.Equal(t, []string{"john", "mary"}, queryNames(t, db, "select * from man where age < 8 or age is null"))
+	assert.Equal(t, []string{"jill", "mary"}, queryNames(t, db, "select * from man where city in ('sh', 'gz') and not name = 'x'"))
+	assert.Equal(t, []string{"jack"}, queryNames(t, db, "select * from man where age * score between 10 and 14"))
+	db.CondiFuncs["adult"] = func(vals []any) bool {
+		age, ok := vals[0].(int64)
+		return ok && age >= 10
+	}
+	assert.Equal(t, []string{"jill", "john"}, queryNames(t, db, "select * from man where adult(age) or score is null"), "custom functions mix with operators")
+	_, err = db.Query("select * from man where age / (age - 9) > 1")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "division by zero", err.Error())
+	}
+	_, err = db.Query("select * from man where height > 1")
+	assert.NotNil(t, err, "unknown column")
+
+	res, err := db.Query("select name, age + 1 as next, coalesce(score, 0) * 2 as double, case when age >= 10 then 'old' else 'young' end from man where name != 'mary'")
+	if assert.Nil(t, err) && assert.Len(t, res.result, 3) {
+		rows := make([]string, 0, 3)
+		for _, line := range res.result {
+			rows = append(rows, FormatData(line.nameToVal["name"].value, STRING)+" "+
+				FormatData(line.nameToVal["next"].value, line.nameToVal["next"].column.TypeOf)+" "+
+				FormatData(line.nameToVal["double"].value, line.nameToVal["double"].column.TypeOf)+" "+
+				FormatData(line.nameToVal[`case when age >= 10 then "old" else "young" end`].value, STRING))
+		}
+		sort.Strings(rows)
+		assert.Equal(t, []string{"jack 10 3 young", "jill 13 4 old", "john 6 0 young"}, rows)
+	}
+
+	db.AggFuncs["total"] = func(vals []any) any {
+		sum := 0.0
+		for _, val := range vals {
+			if val != nil {
+				sum += val.(float64)
+			}
+		}
+		return sum
+	}
+	res, err = db.Query("select city, total(score) * 10 as t from man group by city having total(score) > 5")
+	if assert.Nil(t, err) && assert.Len(t, res.result, 1) {
+		assert.Equal(t, "sh", FormatData(res.result[0].nameToVal["city"].value, STRING))
+		assert.Equal(t, "60", FormatData(res.result[0].nameToVal["t"].value, FLOAT64))
+	}
+
+	assert.Nil(t, db.Update("update man set age = age + 1, score = case when score is null then age else score end where city = 'bj'"))
+	res, err = db.Query("select name, age, score from man where city = 'bj' and age = 6")
+	if assert.Nil(t, err) && assert.Len(t, res.result, 1) {
+		assert.Equal(t, "5", FormatData(res.result[0].nameToVal["score"].value, FLOAT64), "assignments see the old row, int64 is cast to the float64 column")
+	}
+	assertViolation(t, db.Update("update man set age = score where name = 'jack'"), "column age: cannot convert 1.5 to INT64")
+	assertViolation(t, db.Update("update man set age = name"), "column age: cannot convert")
+	assertViolation(t, db.Update("update man set age = height + 1"), "column height not exists")
+	assert.Equal(t, []string{"jack", "john"}, queryNames(t, db, "select * from man where age in (10, 6)"))
+
+	crashDatabase(db)
+	db, err = UseDatabase("expr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"jack", "john"}, queryNames(t, db, "select * from man where age in (10, 6)"), "replay applies age + 1 once")
+	assert.Nil(t, db.Close())
+}
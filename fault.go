@@ -0,0 +1,295 @@
+package rmdb
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FaultBackend 包装另一个存储后端，按脚本注入写失败、半截写、fsync失败、读到坏数据和崩溃，用于测试恢复逻辑。
+// 崩溃只丢弃文件中没有fsync的数据，创建、删除和改名视为立即落盘
+type FaultBackend struct {
+	Backend
+	Match                 func(path string) bool             // 只对返回true的文件注入故障，为空时对所有文件注入
+	Hook                  func(op string, path string) error // 每次文件操作前持锁调用，返回错误时操作直接失败，不能在里面再调用FaultBackend
+	failWrite, shortWrite int                                // 倒数第几次write出错，0表示不注入
+	failSync, corruptRead int
+	synced                map[string]int64 // 文件已经fsync的长度
+	generation            int              // 每次崩溃加一，之前打开的文件全部失效
+	lock                  sync.Mutex
+}
+
+type FaultFile struct {
+	FileIO
+	backend    *FaultBackend
+	path       string
+	generation int
+}
+
+var (
+	ErrInjected = errors.New("injected fault")
+	ErrCrashed  = errors.New("file is lost in simulated crash")
+)
+
+func NewFaultBackend(backend Backend) *FaultBackend {
+	return &FaultBackend{
+		Backend: backend,
+		synced:  make(map[string]int64, 16),
+	}
+}
+
+// FailWrite 之后第n次write返回错误，什么都不写
+func (f *FaultBackend) FailWrite(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failWrite = n
+}
+
+// ShortWrite 之后第n次write只写入一半就返回错误
+func (f *FaultBackend) ShortWrite(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.shortWrite = n
+}
+
+// FailSync 之后第n次fsync返回错误
+func (f *FaultBackend) FailSync(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failSync = n
+}
+
+// CorruptRead 之后第n次ReadAt读到的数据中有一个字节被翻转
+func (f *FaultBackend) CorruptRead(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.corruptRead = n
+}
+
+// Reset 清除所有还没有触发的故障
+func (f *FaultBackend) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failWrite, f.shortWrite, f.failSync, f.corruptRead = 0, 0, 0, 0
+	f.Hook = nil
+}
+
+// Crash 模拟掉电：截掉所有文件中没有fsync的数据，之前打开的文件之后的操作都返回ErrCrashed
+func (f *FaultBackend) Crash() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.generation++
+	for path, size := range f.synced {
+		data, err := f.Backend.ReadFile(path)
+		if err != nil {
+			continue // 已经被删掉了
+		}
+		if int64(len(data)) > size {
+			err = f.Backend.WriteFile(path, data[:size])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FaultBackend) match(path string) bool {
+	return f.Match == nil || f.Match(path)
+}
+
+func countdown(n *int) bool { // 倒数到0时触发
+	if *n <= 0 {
+		return false
+	}
+	*n--
+	return *n == 0
+}
+
+func (f *FaultBackend) hook(op, path string) error {
+	if f.Hook != nil && f.match(path) {
+		return f.Hook(op, path)
+	}
+	return nil
+}
+
+func (f *FaultBackend) OpenFile(path string) (FileIO, error) {
+	path = filepath.Clean(path)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("open", path); err != nil {
+		return nil, err
+	}
+	file, err := f.Backend.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.synced[path]; !ok { // 打开前已有的数据视为已经落盘
+		f.synced[path] = file.Size()
+	}
+	return &FaultFile{
+		FileIO:     file,
+		backend:    f,
+		path:       path,
+		generation: f.generation,
+	}, nil
+}
+
+func (f *FaultBackend) WriteFile(path string, data []byte) error {
+	path = filepath.Clean(path)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("write", path); err != nil {
+		return err
+	}
+	if f.match(path) && countdown(&f.failWrite) {
+		return ErrInjected
+	}
+	if f.match(path) && countdown(&f.shortWrite) { // 覆盖写到一半
+		err := f.Backend.WriteFile(path, data[:len(data)/2])
+		if err != nil {
+			return err
+		}
+		f.synced[path] = int64(len(data) / 2)
+		return io.ErrShortWrite
+	}
+	err := f.Backend.WriteFile(path, data)
+	if err != nil {
+		return err
+	}
+	f.synced[path] = int64(len(data))
+	return nil
+}
+
+func (f *FaultBackend) Remove(path string) error {
+	path = filepath.Clean(path)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("remove", path); err != nil {
+		return err
+	}
+	err := f.Backend.Remove(path)
+	if err == nil {
+		delete(f.synced, path)
+	}
+	return err
+}
+
+func (f *FaultBackend) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("remove", path); err != nil {
+		return err
+	}
+	err := f.Backend.RemoveAll(path)
+	if err == nil {
+		for name := range f.synced {
+			if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+				delete(f.synced, name)
+			}
+		}
+	}
+	return err
+}
+
+func (f *FaultBackend) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("rename", oldPath); err != nil {
+		return err
+	}
+	err := f.Backend.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	if size, ok := f.synced[oldPath]; ok {
+		f.synced[newPath] = size
+		delete(f.synced, oldPath)
+	} else { // 没有fsync过的文件，崩溃后改名得到的文件是空的
+		f.synced[newPath] = 0
+	}
+	return nil
+}
+
+func (f *FaultBackend) SyncDir(path string) error {
+	path = filepath.Clean(path)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.hook("syncdir", path); err != nil {
+		return err
+	}
+	if f.match(path) && countdown(&f.failSync) {
+		return ErrInjected
+	}
+	return f.Backend.SyncDir(path)
+}
+
+func (f *FaultFile) check(op string) error { // 调用方持有backend.lock
+	if f.generation != f.backend.generation {
+		return ErrCrashed
+	}
+	return f.backend.hook(op, f.path)
+}
+
+func (f *FaultFile) Write(b []byte) (int, error) {
+	f.backend.lock.Lock()
+	defer f.backend.lock.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.backend.match(f.path) && countdown(&f.backend.failWrite) {
+		return 0, ErrInjected
+	}
+	if f.backend.match(f.path) && countdown(&f.backend.shortWrite) {
+		n, err := f.FileIO.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+	return f.FileIO.Write(b)
+}
+
+func (f *FaultFile) ReadAt(b []byte, off int64) (int, error) {
+	f.backend.lock.Lock()
+	defer f.backend.lock.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	n, err := f.FileIO.ReadAt(b, off)
+	if n > 0 && f.backend.match(f.path) && countdown(&f.backend.corruptRead) {
+		b[n/2] ^= 0xff
+	}
+	return n, err
+}
+
+func (f *FaultFile) Sync() error {
+	f.backend.lock.Lock()
+	defer f.backend.lock.Unlock()
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	if f.backend.match(f.path) && countdown(&f.backend.failSync) {
+		return ErrInjected
+	}
+	err := f.FileIO.Sync()
+	if err != nil {
+		return err
+	}
+	f.backend.synced[f.path] = f.FileIO.Size()
+	return nil
+}
+
+func (f *FaultFile) Close() error {
+	f.backend.lock.Lock()
+	defer f.backend.lock.Unlock()
+	err := f.FileIO.Close() // 崩溃后也要释放被包装的文件
+	if f.generation != f.backend.generation {
+		return ErrCrashed
+	}
+	return err
+}
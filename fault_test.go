@@ -0,0 +1,186 @@
+package rmdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setFaultOption(t *testing.T, fb *FaultBackend) {
+	root, backend, interval := GlobalOption.Root, GlobalOption.Backend, GlobalOption.CheckpointInterval
+	maxPage, maxLine := GlobalOption.MaxPage, GlobalOption.MaxLine
+	t.Cleanup(func() {
+		GlobalOption.Root, GlobalOption.Backend, GlobalOption.CheckpointInterval = root, backend, interval
+		GlobalOption.MaxPage, GlobalOption.MaxLine = maxPage, maxLine
+	})
+	RegisterBackend("fault", fb)
+	GlobalOption.Root = "fault"
+	GlobalOption.Backend = "fault"
+	GlobalOption.CheckpointInterval = 0
+	GlobalOption.MaxPage = 2 // page很少，插入时会频繁换页
+	GlobalOption.MaxLine = 2
+}
+
+func createFaultTable(t *testing.T) *Database {
+	db, err := CreateDatabase("fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("age", INT64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func queryAges(db *Database) (map[int64]int, error) {
+	res, err := db.Query("select * from test")
+	if err != nil {
+		return nil, err
+	}
+	ages := make(map[int64]int, len(res.result))
+	for _, line := range res.result {
+		age, err := DecodeData(line.nameToVal["age"].value, INT64)
+		if err != nil {
+			return nil, err
+		}
+		ages[age.(int64)]++
+	}
+	return ages, nil
+}
+
+func TestFaultInjection(t *testing.T) {
+	faults := []struct {
+		name   string
+		inject func(fb *FaultBackend, n int)
+		armed  func(fb *FaultBackend) bool
+	}{
+		{"fail write", (*FaultBackend).FailWrite, func(fb *FaultBackend) bool { return fb.failWrite > 0 }},
+		{"short write", (*FaultBackend).ShortWrite, func(fb *FaultBackend) bool { return fb.shortWrite > 0 }},
+		{"fail sync", (*FaultBackend).FailSync, func(fb *FaultBackend) bool { return fb.failSync > 0 }},
+	}
+	for _, fault := range faults {
+		for n := 1; ; n++ { // 依次让第n次操作失败，直到整个流程都不再触发故障
+			fb := NewFaultBackend(NewMemBackend())
+			setFaultOption(t, fb)
+			db := createFaultTable(t)
+
+			fault.inject(fb, n)
+			acked := make(map[int64]bool, 16)
+			for i := 0; i < 16; i++ {
+				err := db.Update(fmt.Sprintf("insert into test (age) values (%d)", i))
+				if err == nil {
+					acked[int64(i)] = true
+				}
+				if i%5 == 4 {
+					_ = db.Checkpoint()
+				}
+			}
+			closeErr := db.Close()
+			fb.lock.Lock()
+			triggered := !fault.armed(fb)
+			fb.lock.Unlock()
+			if closeErr != nil {
+				assert.Nil(t, databases["fault"], "failed close should release database")
+			}
+			assert.Nil(t, fb.Crash())
+			fb.Reset()
+
+			db, err := UseDatabase("fault")
+			if !assert.Nil(t, err, fmt.Sprint(fault.name, " ", n, ": reopen failed")) {
+				return
+			}
+			ages, err := queryAges(db)
+			assert.Nil(t, err)
+			for age := range acked {
+				assert.Equal(t, 1, ages[age], fmt.Sprint(fault.name, " ", n, ": acknowledged insert ", age, " should be recovered once"))
+			}
+			for age, count := range ages {
+				assert.True(t, age >= 0 && age < 16 && count == 1, fmt.Sprint(fault.name, " ", n, ": unexpected line ", age))
+			}
+			assert.Nil(t, db.Close())
+			if !triggered {
+				t.Log(fault.name, " injected at ", n-1, " positions")
+				break
+			}
+		}
+	}
+}
+
+func TestFaultCrash(t *testing.T) {
+	fb := NewFaultBackend(NewMemBackend())
+	setFaultOption(t, fb)
+	db := createFaultTable(t)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf("insert into test (age) values (%d)", i)))
+	}
+	assert.Nil(t, fb.Crash()) // 没有checkpoint，数据只在wal中
+	_, err := db.Query("select * from test")
+	assert.True(t, err == nil || errors.Is(err, ErrCrashed))
+	assert.True(t, errors.Is(db.Update("insert into test (age) values (10)"), ErrCrashed))
+	assert.True(t, errors.Is(db.Close(), ErrCrashed), "close should report the lost files")
+
+	db, err = UseDatabase("fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages, err := queryAges(db)
+	assert.Nil(t, err)
+	assert.Len(t, ages, 10)
+	assert.Nil(t, db.Close())
+
+	db, err = UseDatabase("fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.CorruptRead(1)
+	_, err = db.Query("select * from test")
+	var corruption *CorruptionError
+	assert.True(t, errors.As(err, &corruption))
+	ages, err = queryAges(db)
+	assert.Nil(t, err)
+	assert.Len(t, ages, 10)
+	assert.Nil(t, db.Close())
+}
+
+func TestFaultRename(t *testing.T) {
+	mem := NewMemBackend()
+	fb := NewFaultBackend(mem)
+	assert.Nil(t, mem.MkdirAll("dir"))
+	assert.Nil(t, fb.WriteFile("dir/synced", []byte("abc")))
+	assert.Nil(t, mem.WriteFile("dir/unsynced", []byte("abc"))) // 绕过FaultBackend，没有fsync记录
+	assert.Nil(t, fb.Rename("dir/synced", "dir/a"))
+	assert.Nil(t, fb.Rename("dir/unsynced", "dir/b"))
+	assert.Nil(t, fb.Crash())
+	data, err := fb.ReadFile("dir/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(data))
+	data, err = fb.ReadFile("dir/b")
+	assert.Nil(t, err)
+	assert.Len(t, data, 0, "renamed file that was never synced is lost in a crash")
+}
+
+func TestFaultRollback(t *testing.T) {
+	fb := NewFaultBackend(NewMemBackend())
+	setFaultOption(t, fb)
+	db := createFaultTable(t)
+	tx := db.Begin()
+	assert.Nil(t, tx.Update("insert into test (age) values (1)"))
+	assert.Nil(t, tx.Rollback()) // 插入还没有提交，回滚不能panic
+	assert.Nil(t, db.Update("insert into test (age) values (2)"))
+	ages, err := queryAges(db)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{2: 1}, ages)
+
+	tx = db.Begin()
+	assert.Nil(t, tx.Update("insert into test (age) values (3)"))
+	assert.Nil(t, tx.Commit())
+	assert.NotNil(t, tx.Rollback(), "committed transaction can not be rolled back")
+	assert.Nil(t, db.Close())
+}
@@ -1,38 +1,44 @@
 package rmdb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"golangProject/kvdb/rmdb_beta/mmap"
 	"io"
 	"os"
+	"sync"
 )
 
 type FileIO interface {
 	Write(b []byte) (n int, err error)
 	ReadAt(b []byte, off int64) (n int, err error)
 	Name() string
+	Size() int64 // 下一次写入的位置
 	Sync() error
 	Close() error
 }
 
+// mmap文件预分配的空间里，数据后面紧跟着尾标记 | 数据长度 (8) | magic (8) |，崩溃后打开时据此找到追加写的位置，Close时截掉
+const (
+	mmapTrailerMagic = "RMMAPEND"
+	mmapTrailerSize  = 16
+)
+
 type MMap struct {
 	fd             *os.File
 	buf            []byte // a buffer of mmap
 	bufLen, offset int64
+	lock           sync.RWMutex // 扩容会重新映射，期间不能读写buf
 }
 
-func OpenFile(path string) (FileIO, error) {
-	switch GlobalOption.IOMode {
-	case Standard:
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
-		if err != nil {
-			return nil, err
-		}
-		return file, nil
-	case MMapMode:
-		return NewMMap(path, GlobalOption.MmapSize) // 这里的size取决于最后的数据库文件大小
+func OpenFile(path string) (FileIO, error) { // 用当前配置的存储后端打开文件
+	backend, err := currentBackend()
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("invaild io mode")
+	return backend.OpenFile(path)
 }
 
 func NewMMap(path string, size int64) (FileIO, error) {
@@ -47,6 +53,9 @@ func NewMMap(path string, size int64) (FileIO, error) {
 	if err != nil {
 		return nil, err
 	}
+	if stat.Size() > size { // 文件比默认大小大时要映射整个文件
+		size = stat.Size()
+	}
 	if stat.Size() < size {
 		if err := file.Truncate(size); err != nil {
 			return nil, err
@@ -56,49 +65,142 @@ func NewMMap(path string, size int64) (FileIO, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MMap{
+	m := &MMap{
 		fd:     file,
 		buf:    buf,
 		bufLen: int64(len(buf)),
-		offset: int64(0),
-	}, nil
+		offset: mmapLength(buf[:stat.Size()]), // 追加写要从原来的数据末尾开始，崩溃后文件还是预分配的大小，不能从文件末尾开始
+	}
+	if m.offset+mmapTrailerSize > m.bufLen {
+		if err := m.grow(m.offset + mmapTrailerSize); err != nil {
+			return nil, err
+		}
+	}
+	m.putTrailer()
+	return m, nil
+}
+
+// mmapLength 按尾标记返回数据的长度，没有尾标记的文件（正常关闭的或者不是mmap写的）整个都是数据
+func mmapLength(data []byte) int64 {
+	end := len(bytes.TrimRight(data, "\x00")) // 尾标记之后都是预分配的0
+	if end < mmapTrailerSize || string(data[end-len(mmapTrailerMagic):end]) != mmapTrailerMagic {
+		return int64(len(data))
+	}
+	length := binary.LittleEndian.Uint64(data[end-mmapTrailerSize:])
+	if length != uint64(end-mmapTrailerSize) {
+		return int64(len(data))
+	}
+	return int64(length)
+}
+
+// putTrailer 在数据后面写上尾标记，调用方持有lock并保证映射中有空间
+func (m *MMap) putTrailer() {
+	binary.LittleEndian.PutUint64(m.buf[m.offset:], uint64(m.offset))
+	copy(m.buf[m.offset+8:], mmapTrailerMagic)
 }
 
 func (m *MMap) Write(b []byte) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	length := int64(len(b))
 	if length <= 0 {
 		return 0, nil
 	}
+	if m.offset+length+mmapTrailerSize > m.bufLen {
+		if err := m.grow(m.offset + length + mmapTrailerSize); err != nil {
+			return 0, err
+		}
+	}
 	n := copy(m.buf[m.offset:], b)
-	m.offset += int64(len(b))
+	m.offset += int64(n)
+	m.putTrailer()
 	return n, nil
 }
 
+// grow 把映射扩大到至少need字节，1GiB以内翻倍，之后每次加1GiB，避免大文件翻倍浪费太多磁盘
+func (m *MMap) grow(need int64) error {
+	size := m.bufLen
+	if size <= 0 {
+		size = GlobalOption.MmapSize
+	}
+	for size < need {
+		if size < GIB {
+			size *= 2
+		} else {
+			size += GIB
+		}
+	}
+	if m.buf != nil {
+		if err := mmap.Msync(m.buf); err != nil {
+			return err
+		}
+		if err := mmap.Munmap(m.buf); err != nil {
+			return err
+		}
+		m.buf = nil
+		m.bufLen = 0
+	}
+	if err := m.fd.Truncate(size); err != nil {
+		return fmt.Errorf("grow mmap file %s to %d bytes: %w", m.fd.Name(), size, err)
+	}
+	buf, err := mmap.Mmap(m.fd, true, size)
+	if err != nil {
+		return fmt.Errorf("remap file %s with %d bytes: %w", m.fd.Name(), size, err)
+	}
+	m.buf = buf
+	m.bufLen = int64(len(buf))
+	return nil
+}
+
 func (m *MMap) ReadAt(b []byte, offset int64) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	if offset < 0 || offset >= m.bufLen {
 		return 0, io.EOF
 	}
-	if offset+int64(len(b)) >= m.bufLen {
+	if offset+int64(len(b)) > m.bufLen { // 正好读到buf末尾是合法的
 		return 0, io.EOF
 	}
 	return copy(b, m.buf[offset:]), nil
 }
 
+func (m *MMap) Size() int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.offset
+}
+
 func (m *MMap) Name() string {
 	return m.fd.Name()
 }
 
 func (m *MMap) Sync() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.buf == nil {
+		return nil
+	}
 	return mmap.Msync(m.buf)
 }
 
 func (m *MMap) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.buf == nil { // 扩容失败时已经解除了映射
+		err := m.fd.Truncate(m.offset)
+		if err != nil {
+			return err
+		}
+		return m.fd.Close()
+	}
 	if err := mmap.Msync(m.buf); err != nil {
 		return err
 	}
 	if err := mmap.Munmap(m.buf); err != nil {
 		return err
 	}
+	m.buf = nil
+	m.bufLen = 0
 	err := m.fd.Truncate(m.offset)
 	if err != nil {
 		return err
@@ -107,8 +209,12 @@ func (m *MMap) Close() error {
 }
 
 func (m *MMap) Delete() error {
-	if err := mmap.Munmap(m.buf); err != nil {
-		return err
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.buf != nil {
+		if err := mmap.Munmap(m.buf); err != nil {
+			return err
+		}
 	}
 	m.buf = nil
 
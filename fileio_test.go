@@ -0,0 +1,97 @@
+package rmdb
+
+import (
+	"bytes"
+	"fmt"
+	"golangProject/kvdb/rmdb_beta/mmap"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMapGrow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grow.data")
+	size := int64(os.Getpagesize())
+	file, err := NewMMap(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := new(bytes.Buffer)
+	for i := 0; expect.Len() < int(size)*5; i++ { // 写满映射后要扩容而不是截断
+		data := []byte(fmt.Sprint("line", i, ";"))
+		n, err := file.Write(data)
+		assert.Nil(t, err)
+		assert.Equal(t, len(data), n)
+		expect.Write(data)
+	}
+	mm := file.(*MMap)
+	assert.True(t, mm.bufLen >= int64(expect.Len()))
+
+	buf := make([]byte, expect.Len())
+	_, err = file.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, expect.Bytes(), buf)
+
+	tail := make([]byte, 8) // 正好读到映射末尾
+	_, err = file.ReadAt(tail, mm.bufLen-8)
+	assert.Nil(t, err)
+	_, err = file.ReadAt(tail, mm.bufLen-7)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, file.Close())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(expect.Len()), info.Size())
+
+	file, err = NewMMap(path, size) // 文件比默认映射大时映射整个文件
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, expect.Len())
+	_, err = file.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, expect.Bytes(), buf)
+	_, err = file.Write([]byte("more"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, append(expect.Bytes(), "more"...), data)
+}
+
+func TestMMapCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crash.data")
+	size := int64(os.Getpagesize())
+	file, err := NewMMap(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []byte("line\x00\x00") // 数据本身以0结尾
+	_, err = file.Write(expect)
+	assert.Nil(t, err)
+	data, err := mmapBackend{}.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expect, data, "open file only reads the data before the trailer")
+	mm := file.(*MMap)
+	assert.Nil(t, mm.Sync())
+	assert.Nil(t, mmap.Munmap(mm.buf)) // 崩溃，Close中的截断没有执行
+	assert.Nil(t, mm.fd.Close())
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+
+	file, err = NewMMap(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(expect)), file.Size(), "append should continue after the data instead of the preallocated zeros")
+	_, err = file.Write([]byte("more"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	data, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, append(expect, "more"...), data)
+}
@@ -0,0 +1,386 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// fsck 离线检查数据库目录，只读打开所有文件，检查时不能有进程正在使用这个数据库
+
+type FsckIssue struct {
+	File    string
+	PageId  uint64
+	Offset  uint64
+	Length  uint64
+	Problem string
+	Warning bool // 警告不影响数据正确性，比如等待merge回收的旧page
+}
+
+type FsckReport struct {
+	DbPath   string
+	Tables   int
+	Pages    int
+	Lines    int
+	Records  int
+	Issues   []FsckIssue
+	Repaired []string
+}
+
+func (r *FsckReport) Healthy() bool {
+	for _, issue := range r.Issues {
+		if !issue.Warning {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FsckReport) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "fsck %s: %d tables, %d pages, %d lines, %d wal records\n", r.DbPath, r.Tables, r.Pages, r.Lines, r.Records)
+	for _, issue := range r.Issues {
+		level := "error"
+		if issue.Warning {
+			level = "warning"
+		}
+		fmt.Fprintf(buf, "  [%s] %s", level, issue.File)
+		if issue.PageId != 0 {
+			fmt.Fprintf(buf, " page %d", issue.PageId)
+		}
+		if issue.Length != 0 {
+			fmt.Fprintf(buf, " bytes [%d, %d)", issue.Offset, issue.Offset+issue.Length)
+		}
+		fmt.Fprintf(buf, ": %s\n", issue.Problem)
+	}
+	for _, repair := range r.Repaired {
+		fmt.Fprintf(buf, "  [repaired] %s\n", repair)
+	}
+	if r.Healthy() {
+		buf.WriteString("no errors found\n")
+	}
+	return buf.String()
+}
+
+func (r *FsckReport) add(issue FsckIssue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+func RunFsck() {
+	var (
+		dbPath string
+		repair bool
+	)
+	flag.StringVar(&dbPath, "path", "", "set database directory to check")
+	flag.BoolVar(&repair, "repair", false, "rebuild catalog from data files")
+	flag.Parse()
+	if dbPath == "" {
+		dbPath = flag.Arg(0)
+	}
+	if dbPath == "" {
+		logger.Fatal("rmdb: fsck needs a database directory")
+		return
+	}
+	report, err := Fsck(dbPath, repair)
+	if err != nil {
+		logger.Fatal("rmdb: fsck failed: ", err)
+		return
+	}
+	fmt.Print(report)
+	if !report.Healthy() && len(report.Repaired) == 0 {
+		os.Exit(1)
+	}
+}
+
+// Fsck 检查目录、数据文件和wal，repair为true时根据数据文件中的page重建目录
+func Fsck(dbPath string, repair bool) (*FsckReport, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	report := &FsckReport{DbPath: dbPath}
+	cata, err := loadCatalog(stdBackend{}, dbPath)
+	if err != nil {
+		report.add(FsckIssue{File: "cata.log", Problem: err.Error()})
+		if repair {
+			return report, fmt.Errorf("catalog is unreadable, columns can not be recovered: %w", err)
+		}
+		cata = &catalog{Tables: make(map[string]Table)}
+	}
+	report.Tables = len(cata.Tables)
+
+	pending, err := fsckWal(dbPath, cata.Lsn, report)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".data") {
+			if _, ok := cata.Tables[strings.TrimSuffix(name, ".data")]; !ok {
+				report.add(FsckIssue{File: name, Problem: "data file has no table in catalog"})
+			}
+		}
+	}
+
+	tabNames := make([]string, 0, len(cata.Tables))
+	for tabName := range cata.Tables {
+		tabNames = append(tabNames, tabName)
+	}
+	sort.Strings(tabNames)
+	changed := false
+	dropped := make([]string, 0, 4)
+	for _, tabName := range tabNames {
+		table := cata.Tables[tabName]
+		fileName := fmt.Sprint(tabName, ".data")
+		data, err := os.ReadFile(fmt.Sprint(dbPath, string(os.PathSeparator), fileName))
+		if err != nil {
+			report.add(FsckIssue{File: fileName, Problem: err.Error()})
+			continue
+		}
+		broken := fsckTable(fileName, &table, data, report)
+		if !repair {
+			continue
+		}
+		repaired := repairTable(fileName, &table, data, broken)
+		if len(repaired) == 0 {
+			continue
+		}
+		if pending { // checkpoint之后换出的page会和wal重放的修改重复
+			return report, errors.New("wal has committed transactions after the checkpoint, open and close the database before repairing")
+		}
+		report.Repaired = append(report.Repaired, repaired...)
+		for name := range table.Indexes { // 丢掉的page还在索引中，索引要重新建立
+			dropped = append(dropped, indexPath(dbPath, tabName, name))
+			report.Repaired = append(report.Repaired, fmt.Sprint("index ", name, " of table ", tabName, " dropped, create it again"))
+		}
+		table.Indexes = nil
+		if table.Primary != nil { // 主键索引用到时会重新建立
+			dropped = append(dropped, primaryPath(dbPath, tabName))
+			table.Primary = nil
+		}
+		cata.Tables[tabName] = table
+		changed = true
+	}
+
+	if changed {
+		cata.Version = catalogVersion
+		err = writeCatalog(stdBackend{}, dbPath, cata)
+		if err != nil {
+			return report, err
+		}
+		report.Repaired = append(report.Repaired, "cata.log rewritten")
+		for _, path := range dropped { // 目录已经不引用这些索引
+			_ = os.Remove(path)
+		}
+	}
+	return report, nil
+}
+
+// fsckTable 检查一张表的page目录，返回目录中无法使用的page
+func fsckTable(fileName string, table *Table, data []byte, report *FsckReport) map[uint64]bool {
+	broken := make(map[uint64]bool)
+	pages := make([]Page, 0, len(table.Catalog))
+	for id, page := range table.Catalog {
+		if page.Id != id {
+			report.add(FsckIssue{File: fileName, PageId: id, Problem: fmt.Sprintf("catalog entry holds page id %d", page.Id)})
+			broken[id] = true
+			continue
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Offset == pages[j].Offset {
+			return pages[i].Id < pages[j].Id
+		}
+		return pages[i].Offset < pages[j].Offset
+	})
+	report.Pages += len(pages)
+
+	covered := uint64(0) // 已经被目录覆盖到的位置，用来找重叠和孤立的字节
+	for _, page := range pages {
+		if page.Length == 0 { // 空page不占空间，merge时删除
+			continue
+		}
+		end := page.Offset + page.Length
+		if end > uint64(len(data)) || end < page.Offset {
+			report.add(FsckIssue{File: fileName, PageId: page.Id, Offset: page.Offset, Length: page.Length, Problem: fmt.Sprintf("page is beyond the end of file (%d bytes)", len(data))})
+			broken[page.Id] = true
+			continue
+		}
+		if page.Offset < covered {
+			report.add(FsckIssue{File: fileName, PageId: page.Id, Offset: page.Offset, Length: page.Length, Problem: "page overlaps with another page"})
+			broken[page.Id] = true
+		} else if page.Offset > covered {
+			fsckOrphan(fileName, data, covered, page.Offset, report)
+		}
+		if end > covered {
+			covered = end
+		}
+		if !fsckPage(fileName, table, page, data[page.Offset:end], report) {
+			broken[page.Id] = true
+		}
+	}
+	used := uint64(len(bytes.TrimRight(data[:mmapLength(data)], "\x00"))) // mmap模式的尾标记和预分配的0不算孤立数据
+	if used > covered {
+		fsckOrphan(fileName, data, covered, used, report)
+	}
+	return broken
+}
+
+func fsckOrphan(fileName string, data []byte, start, end uint64, report *FsckReport) {
+	problem := "orphaned bytes, reclaimable by merge"
+	if !bytes.Contains(data[start:end], []byte(pageMagic)) && len(bytes.Trim(data[start:end], "\x00")) != 0 {
+		problem = "orphaned bytes that hold no page frame"
+	}
+	report.add(FsckIssue{File: fileName, Offset: start, Length: end - start, Problem: problem, Warning: true})
+}
+
+func fsckPage(fileName string, table *Table, page Page, data []byte, report *FsckReport) bool {
+	issue := FsckIssue{File: fileName, PageId: page.Id, Offset: page.Offset, Length: page.Length}
+	version, payload, err := pagePayload(page.Id, data, table.Legacy)
+	if err != nil {
+		issue.Problem = err.Error()
+		report.add(issue)
+		return false
+	}
+	if version != pageVersion {
+		warning := issue
+		warning.Warning = true
+		warning.Problem = fmt.Sprintf("page format version %d will be rewritten on next write", version)
+		report.add(warning)
+	}
+	lines, err := splitLines(version, payload)
+	if err != nil {
+		issue.Problem = fmt.Sprint("undecodable lines: ", err)
+		report.add(issue)
+		return false
+	}
+	ok := true
+	for index, line := range lines {
+		report.Lines++
+		schema, line, err := rowSchema(version, line)
+		var columns []Column
+		if err == nil {
+			columns, err = schemaColumns(table.Columns, table.Version, table.Schemas, schema)
+		}
+		var vals [][]byte
+		if err == nil {
+			vals, err = lineValues(version, line, columns) // 同时检查每个值能否按列类型解析
+		}
+		if err != nil {
+			issue.Problem = fmt.Sprintf("line %d is undecodable: %s", index, err)
+			report.add(issue)
+			ok = false
+			continue
+		}
+		if len(vals) < len(columns) { // 加列之前写入的行，读取时用默认值补齐
+			warning := issue
+			warning.Warning = true
+			warning.Problem = fmt.Sprintf("line %d has %d values but table has %d columns, defaults will be used", index, len(vals), len(columns))
+			report.add(warning)
+		}
+		for i, val := range vals {
+			column := columns[i]
+			if _, err := DecodeData(val, column.TypeOf); err != nil {
+				issue.Problem = fmt.Sprintf("line %d column %s does not decode as type %d: %s", index, column.Name, column.TypeOf, err)
+				report.add(issue)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// fsckWal 检查wal，返回wal中是否还有checkpoint之后提交的事务
+func fsckWal(dbPath string, checkpointLsn uint64, report *FsckReport) (bool, error) {
+	if _, err := os.Stat(fmt.Sprint(dbPath, string(os.PathSeparator), "wal.txt")); err == nil {
+		report.add(FsckIssue{File: "wal.txt", Problem: "legacy wal will be replayed on next open", Warning: true})
+	}
+	data, err := os.ReadFile(fmt.Sprint(dbPath, string(os.PathSeparator), "wal.log"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	records, size := DecodeRecords(data)
+	report.Records = len(records)
+	if size < len(data) && len(bytes.Trim(data[size:], "\x00")) != 0 {
+		report.add(FsckIssue{File: "wal.log", Offset: uint64(size), Length: uint64(len(data) - size), Problem: "torn records at the end of wal are ignored", Warning: true})
+	}
+	pending := false
+	last := uint64(0)
+	for _, record := range records {
+		if record.Lsn <= last {
+			report.add(FsckIssue{File: "wal.log", Problem: fmt.Sprintf("lsn %d is not greater than previous lsn %d", record.Lsn, last)})
+		}
+		last = record.Lsn
+		if record.Type == walCommit && record.Lsn > checkpointLsn {
+			pending = true
+		}
+	}
+	return pending, nil
+}
+
+// repairTable 扫描数据文件中所有校验通过的page，用每个page最后写入的版本替换目录中坏掉的项，并补上目录中缺失的page
+func repairTable(fileName string, table *Table, data []byte, broken map[uint64]bool) []string {
+	repaired := make([]string, 0, len(broken))
+	found := scanPages(data)
+	pages := make(map[uint64]Page, len(table.Catalog)+len(found))
+	for id, page := range table.Catalog {
+		if !broken[id] {
+			pages[id] = page
+		}
+	}
+	for id := range broken {
+		if page, ok := found[id]; ok {
+			pages[id] = page
+			repaired = append(repaired, fmt.Sprintf("%s page %d restored from bytes [%d, %d)", fileName, id, page.Offset, page.Offset+page.Length))
+		} else {
+			repaired = append(repaired, fmt.Sprintf("%s page %d dropped, no intact copy found", fileName, id))
+		}
+	}
+	for id, page := range found {
+		if _, ok := pages[id]; !ok && !broken[id] {
+			pages[id] = page
+			repaired = append(repaired, fmt.Sprintf("%s page %d added from bytes [%d, %d)", fileName, id, page.Offset, page.Offset+page.Length))
+		}
+	}
+	sort.Strings(repaired)
+	table.Catalog = pages
+	return repaired
+}
+
+func scanPages(data []byte) map[uint64]Page {
+	pages := make(map[uint64]Page, 16)
+	offset := 0
+	for {
+		index := bytes.Index(data[offset:], []byte(pageMagic))
+		if index < 0 {
+			return pages
+		}
+		offset += index
+		if len(data)-offset >= pageHeaderSize {
+			id := binary.LittleEndian.Uint64(data[offset+5 : offset+13])
+			length := int(binary.LittleEndian.Uint32(data[offset+13 : offset+17]))
+			end := offset + pageHeaderSize + length
+			if end <= len(data) && end > offset {
+				if _, _, err := pagePayload(id, data[offset:end], false); err == nil {
+					pages[id] = Page{Id: id, Offset: uint64(offset), Length: uint64(end - offset)} // 追加写，后面的版本覆盖前面的
+					offset = end
+					continue
+				}
+			}
+		}
+		offset++
+	}
+}
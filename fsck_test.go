@@ -0,0 +1,100 @@
+package rmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.MaxLine = 4
+
+	db, err := CreateDatabase("fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Update(fmt.Sprintf(`insert into test (name) values ("name%d")`, i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "fsck")
+
+	report, err := Fsck(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.Healthy(), report.String())
+	assert.Equal(t, 3, report.Pages)
+	assert.Equal(t, 10, report.Lines)
+
+	cata, err := loadCatalog(stdBackend{}, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := fmt.Sprint(dbPath, string(os.PathSeparator), "test.data")
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := cata.Tables["test"].Catalog[2]
+	data = append(data, data[page.Offset:page.Offset+page.Length]...) // 页2的完整副本
+	data[page.Offset+page.Length-1] ^= 0xff
+	first := cata.Tables["test"].Catalog[1]
+	data[first.Offset] = 'X' // 页1的magic被改掉
+	assert.Nil(t, os.WriteFile(dataPath, data, 0644))
+	wrong := cata.Tables["test"].Catalog[3]
+	wrong.Offset = page.Offset // 和页2重叠
+	cata.Tables["test"].Catalog[3] = wrong
+	raw, err := json.Marshal(cata)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(fmt.Sprint(dbPath, string(os.PathSeparator), "cata.log"), raw, 0644))
+
+	report, err = Fsck(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, report.Healthy())
+	problems := make(map[uint64]string)
+	for _, issue := range report.Issues {
+		if !issue.Warning {
+			problems[issue.PageId] = issue.Problem
+		}
+	}
+	assert.Equal(t, "missing page header", problems[1])
+	assert.Equal(t, "checksum mismatch", problems[2])
+	assert.NotEqual(t, "", problems[3])
+
+	report, err = Fsck(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, 0, len(report.Repaired))
+	report, err = Fsck(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.Healthy(), report.String())
+
+	db, err = UseDatabase("fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from test")
+	if assert.Nil(t, err) {
+		assert.Len(t, res.result, 6, "page 1 has no intact copy and is dropped")
+	}
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,239 @@
+package rmdb
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// 全文索引：STRING列的文本切成词，倒排索引用B+tree保存，项是 | 词的有序编码 | pageId (8) |，值是这个page中有多少行包含这个词。
+// where中的match(col, 'terms')要求文本包含所有的词，结果中match(col)列是相关度，可以select和order by
+
+const fulltextIndex = "fulltext"
+
+// tokenize 把文本切成小写的词，连续的字母和数字是一个词，汉字一个字是一个词，重复的词都保留
+func tokenize(text string) []string {
+	terms := make([]string, 0, 16)
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if start >= 0 && (!word || unicode.Is(unicode.Han, r)) {
+			terms = append(terms, strings.ToLower(text[start:i]))
+			start = -1
+		}
+		if unicode.Is(unicode.Han, r) {
+			terms = append(terms, string(r))
+		} else if word && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		terms = append(terms, strings.ToLower(text[start:]))
+	}
+	return terms
+}
+
+// uniqueTerms 去掉重复的词，保持第一次出现的顺序
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]struct{}, len(terms))
+	unique := terms[:0:0]
+	for _, term := range terms {
+		if _, ok := seen[term]; !ok {
+			seen[term] = struct{}{}
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+// termFrequency 每个词在文本中出现的次数
+func termFrequency(text string) map[string]int {
+	freq := make(map[string]int, 16)
+	for _, term := range tokenize(text) {
+		freq[term]++
+	}
+	return freq
+}
+
+// termKey 词按STRING的有序编码，前缀扫描时不会匹配到更长的词
+func termKey(term string) []byte {
+	data, _ := EncodeData(term)
+	key, _ := appendOrderedKey(make([]byte, 0, len(term)+3), data, STRING)
+	return key
+}
+
+// termKeys 一行文本中所有的词，NULL没有词
+func termKeys(value []byte) ([][]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	text, err := DecodeData(value, STRING)
+	if err != nil {
+		return nil, err
+	}
+	terms := uniqueTerms(tokenize(text.(string)))
+	keys := make([][]byte, 0, len(terms))
+	for _, term := range terms {
+		keys = append(keys, termKey(term))
+	}
+	return keys, nil
+}
+
+type matchPredicate struct {
+	colName string
+	terms   []string
+	weights []float64 // 每个词的idf，没有全文索引时都是1
+}
+
+func newMatch(colName, text string) *matchPredicate {
+	m := &matchPredicate{colName: colName, terms: uniqueTerms(tokenize(text))}
+	m.weights = make([]float64, len(m.terms))
+	for i := range m.weights {
+		m.weights[i] = 1
+	}
+	return m
+}
+
+// matchOf 条件是match(col, '文本')时返回对应的matchPredicate
+func matchOf(condition Expr) (*matchPredicate, bool) {
+	call, ok := condition.(*FuncCall)
+	if !ok || !strings.EqualFold(call.Name, "match") || len(call.Args) != 2 {
+		return nil, false
+	}
+	column, ok := call.Args[0].(*ColumnRef)
+	text, isLiteral := call.Args[1].(*Literal)
+	if !ok || !isLiteral || text.Kind != StringLiteral {
+		return nil, false
+	}
+	return newMatch(column.Name, text.Value), true
+}
+
+// scoreName 相关度列的列名
+func (m *matchPredicate) scoreName() string {
+	return NewColName("match", m.colName)
+}
+
+// condition 文本包含所有的词时成立，没有词时不成立
+func (m *matchPredicate) condition() func([]any) bool {
+	return func(vals []any) bool {
+		text, ok := vals[0].(string)
+		if !ok || len(m.terms) == 0 {
+			return false
+		}
+		freq := termFrequency(text)
+		for _, term := range m.terms {
+			if freq[term] == 0 {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// setScore 相关度是每个词的 tf/(tf+1) * idf 之和，词出现得越多、越少见，相关度越高
+func (m *matchPredicate) setScore(line *Line) {
+	score := 0.0
+	if value := line.nameToVal[m.colName].value; value != nil {
+		if text, err := DecodeData(value, STRING); err == nil {
+			freq := termFrequency(text.(string))
+			for i, term := range m.terms {
+				tf := float64(freq[term])
+				score += tf / (tf + 1) * m.weights[i]
+			}
+		}
+	}
+	data, _ := EncodeData(score)
+	line.nameToVal[m.scoreName()] = ColVal{
+		column: Column{Name: m.scoreName(), TypeOf: FLOAT64},
+		value:  data,
+	}
+}
+
+// fulltextOn 返回这一列上的全文索引
+func (t *Table) fulltextOn(colName string) (string, *Index) {
+	names := make([]string, 0, len(t.Indexes))
+	for name := range t.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		index := t.Indexes[name]
+		if index.Type != fulltextIndex {
+			continue
+		}
+		columns := index.columns(t.Columns)
+		if len(columns) == 1 && columns[0].Name == colName {
+			return name, index
+		}
+	}
+	return "", nil
+}
+
+// weigh 有全文索引时按包含每个词的行数计算idf
+func (t *Table) weigh(m *matchPredicate) error {
+	_, index := t.fulltextOn(m.colName)
+	if index == nil {
+		return nil
+	}
+	t.cache.lock.Lock()
+	defer t.cache.lock.Unlock()
+	for i, term := range m.terms {
+		rows := uint64(0)
+		prefix := termKey(term)
+		err := index.scan(prefix, func(key []byte, count uint64) bool {
+			if len(key) != len(prefix)+8 || !bytes.HasPrefix(key, prefix) {
+				return false
+			}
+			rows += count
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		m.weights[i] = math.Log(1 + float64(index.Entries+1)/float64(rows+1))
+	}
+	return nil
+}
+
+// FullTextPlan where中有match(col, 'terms')并且列上有全文索引时，只读包含所有词的page和本事务修改过的page
+type FullTextPlan struct {
+	TableReadPlan
+	indexName string
+	terms     []string
+}
+
+func (f *FullTextPlan) process() {
+	f.read(f.pageIds)
+}
+
+func (f *FullTextPlan) pageIds(table *Table, subTx *SubTx) ([]uint64, error) {
+	index := table.Indexes[f.indexName]
+	if index == nil {
+		return readPageIds(table, subTx, nil)
+	}
+	var pageIds []uint64
+	for i, term := range f.terms {
+		found, err := index.btreePages(termKey(term))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			pageIds = found
+			continue
+		}
+		set := make(map[uint64]struct{}, len(found))
+		for _, pageId := range found {
+			set[pageId] = struct{}{}
+		}
+		both := pageIds[:0]
+		for _, pageId := range pageIds {
+			if _, ok := set[pageId]; ok {
+				both = append(both, pageId)
+			}
+		}
+		pageIds = both
+	}
+	return withChangedPages(subTx, pageIds), nil
+}
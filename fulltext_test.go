@@ -0,0 +1,146 @@
+package rmdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFullTextTokenize(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "数", "据", "库", "v2", "x", "y", "hello"}, tokenize("Hello, World! 数据库v2 x_y HELLO"))
+	assert.Equal(t, []string{"hello", "world"}, uniqueTerms(tokenize("hello world Hello")))
+	assert.Equal(t, 0, len(tokenize(" ,.! ")))
+	stmt, err := parseStatement(`select * from docs where match( body , "Quick  Brown quick")`)
+	assert.Nil(t, err)
+	m, ok := matchOf(stmt.(*SelectStmt).Where[0])
+	if assert.True(t, ok) {
+		assert.Equal(t, "body", m.colName)
+		assert.Equal(t, []string{"quick", "brown"}, m.terms)
+		assert.Equal(t, "match(body)", m.scoreName())
+	}
+	_, ok = matchOf(&FuncCall{Name: "match", Args: []Expr{&ColumnRef{Name: "body"}}})
+	assert.False(t, ok)
+}
+
+// queryScores 按结果的顺序返回name和相关度
+func queryScores(t *testing.T, db *Database, sql string) ([]string, []float64) {
+	res, err := db.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(res.result))
+	scores := make([]float64, 0, len(res.result))
+	for _, line := range res.result {
+		names = append(names, FormatData(line.nameToVal["name"].value, STRING))
+		score, err := DecodeData(line.nameToVal["match(body)"].value, FLOAT64)
+		assert.Nil(t, err)
+		if score == nil {
+			score = 0.0
+		}
+		scores = append(scores, score.(float64))
+	}
+	return names, scores
+}
+
+func TestFullText(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 4
+
+	db, err := CreateDatabase("fulltext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table docs (name STRING, body STRING, age INT64)"))
+	for _, sql := range []string{
+		`insert into docs (name, body) values ("d1", "The-quick-brown-fox")`,
+		`insert into docs (name, body) values ("d2", "quick/quick/rabbit")`,
+		`insert into docs (name, body) values ("d3", "lazy.BROWN.dog")`,
+		`insert into docs (name, body) values ("d4", "数据库的索引")`,
+		`insert into docs (name) values ("d5")`,
+	} {
+		assert.Nil(t, db.Update(sql))
+	}
+	for i := 0; i < 60; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into docs (name, body) values ("f%02d", "filler-text-%d")`, i, i)))
+	}
+	search := func(terms string) []string {
+		return queryNames(t, db, fmt.Sprintf("select * from docs where match(body, '%s')", terms))
+	}
+	check := func() {
+		assert.Equal(t, []string{"d1", "d3"}, search("brown"))
+		assert.Equal(t, []string{"d1"}, search("Quick, BROWN"), "all terms must match")
+		assert.Equal(t, []string{"d4"}, search("索引"))
+		assert.Equal(t, 60, len(search("filler")))
+		assert.Equal(t, 0, len(search("fox rabbit")))
+		assert.Equal(t, 0, len(search("")), "no term matches nothing")
+	}
+	check()
+	_, ok := accessPlan(t, db, "select * from docs where match(body, 'brown')").(*TableReadPlan)
+	assert.True(t, ok, "no fulltext index yet")
+
+	assertViolation(t, db.Update("create unique index idx_body on docs (body) using fulltext"), "can not be unique")
+	assertViolation(t, db.Update("create index idx_age on docs (age) using fulltext"), "one string column")
+	assertViolation(t, db.Update("create index idx_two on docs (name, body) using fulltext"), "one string column")
+	assert.Nil(t, db.Update("create index idx_body on docs (body) using FULLTEXT"))
+	table := db.tables["docs"]
+	assert.Equal(t, uint64(64), table.Indexes["idx_body"].Entries, "rows with a null body are not counted")
+	assertViolation(t, db.Update("alter table docs drop column body"), "column is used by index idx_body")
+
+	plan, ok := accessPlan(t, db, "select * from docs where match(body, 'quick brown')").(*FullTextPlan)
+	if assert.True(t, ok) {
+		assert.Equal(t, "idx_body", plan.indexName)
+		table.cache.lock.Lock()
+		pageIds, err := plan.pageIds(table, db.Begin().subTxs["docs"])
+		table.cache.lock.Unlock()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(pageIds), "only the page holding d1")
+	}
+	check()
+
+	m := newMatch("body", "filler brown")
+	assert.Nil(t, table.weigh(m))
+	assert.True(t, m.weights[1] > m.weights[0], "rare terms weigh more")
+	names, scores := queryScores(t, db, "select name, match(body) from docs where match(body, 'quick') order by match(body) desc")
+	assert.Equal(t, []string{"d2", "d1"}, names, "more occurrences rank higher")
+	if assert.Len(t, scores, 2) {
+		assert.True(t, scores[0] > scores[1] && scores[1] > 0)
+	}
+	names, _ = queryScores(t, db, "select name, match(body) from docs where match(body, 'brown') order by match(body) asc")
+	assert.Equal(t, 2, len(names))
+
+	assert.Nil(t, db.Update(`update docs set body = "brown" where name = "d2"`))
+	assert.Nil(t, db.Update(`delete from docs where name = "d1"`))
+	assert.Nil(t, db.Update(`update docs set body = null where name = "f00"`))
+	assert.Equal(t, []string{"d2", "d3"}, search("brown"))
+	assert.Equal(t, 0, len(search("rabbit")), "old terms are removed")
+	assert.Equal(t, 59, len(search("filler")))
+	assert.Equal(t, uint64(62), table.Indexes["idx_body"].Entries)
+
+	tx := db.Begin()
+	assert.Nil(t, tx.Update(`insert into docs (name, body) values ("d6", "brown-bear")`))
+	res, err := tx.Query("select * from docs where match(body, 'brown bear')")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.result), "uncommitted rows are searched too")
+	assert.Nil(t, tx.Commit())
+
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("fulltext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"d2", "d3", "d6"}, search("brown"))
+	assert.Nil(t, db.Update(`insert into docs (name, body) values ("d7", "brown-owl")`))
+	crashDatabase(db)
+	db, err = UseDatabase("fulltext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"d7"}, search("owl"), "replay updates the fulltext index")
+	assert.Equal(t, uint64(64), db.tables["docs"].Indexes["idx_body"].Entries)
+	assert.Nil(t, db.Update("truncate table docs"))
+	assert.Equal(t, uint64(0), db.tables["docs"].Indexes["idx_body"].Entries)
+	assert.Equal(t, 0, len(search("brown")))
+	assert.Nil(t, db.Update("drop index idx_body"))
+	assert.Nil(t, db.Close())
+}
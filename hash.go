@@ -0,0 +1,233 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// 线性哈希索引，只能按所有索引列 = 值查找。桶b的第一个块id是b+1，满了之后接溢出块，溢出块的id最高位是1。
+// 项数超过桶数乘以每块的项数时分裂Split指向的桶，桶中的项按多一位的哈希值分到原来的桶和新桶，Split走完一轮后Level加一。
+// 块中的项和B+tree叶子节点一样是 | 索引列的有序编码 | pageId (8) |，值是行数，哈希只用索引列的部分
+
+const (
+	hashIndex   = "hash"
+	hashMagic   = "RMHX"
+	overflowBit = 1 << 63
+)
+
+type hashBucket struct {
+	id       uint64
+	keys     [][]byte
+	counts   []uint64
+	overflow uint64 // 下一个溢出块，0表示没有
+}
+
+func (b *hashBucket) blockId() uint64 {
+	return b.id
+}
+
+// encodeBlock | overflow uvarint | 项数 uvarint | 每一项的长度 uvarint、内容和行数 uvarint |
+func (b *hashBucket) encodeBlock() []byte {
+	data := make([]byte, 0, 256)
+	data = binary.AppendUvarint(data, b.overflow)
+	data = binary.AppendUvarint(data, uint64(len(b.keys)))
+	for j, key := range b.keys {
+		data = binary.AppendUvarint(data, uint64(len(key)))
+		data = append(data, key...)
+		data = binary.AppendUvarint(data, b.counts[j])
+	}
+	return data
+}
+
+func decodeHashBucket(id uint64, data []byte) (block, error) {
+	bucket := &hashBucket{id: id}
+	readUvarint := func() (uint64, error) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid uvarint")
+		}
+		data = data[n:]
+		return value, nil
+	}
+	var err error
+	if bucket.overflow, err = readUvarint(); err != nil {
+		return nil, err
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("key count %d exceeds bucket size", count)
+	}
+	for j := uint64(0); j < count; j++ {
+		length, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(len(data)) {
+			return nil, fmt.Errorf("key length %d exceeds remaining %d bytes", length, len(data))
+		}
+		bucket.keys = append(bucket.keys, append([]byte{}, data[:length]...))
+		data = data[length:]
+		value, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		bucket.counts = append(bucket.counts, value)
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(data))
+	}
+	return bucket, nil
+}
+
+// bucket 没有写过的桶是空的
+func (i *Index) bucket(id uint64) (*hashBucket, error) {
+	if !i.cache.exists(id) {
+		return &hashBucket{id: id}, nil
+	}
+	b, err := i.cache.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return b.(*hashBucket), nil
+}
+
+// bucketOf 返回这个值所在的桶的第一个块
+func (i *Index) bucketOf(value []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(value)
+	sum := h.Sum64()
+	b := sum % (1 << i.Level)
+	if b < i.Split { // 已经分裂过的桶按多一位分
+		b = sum % (1 << (i.Level + 1))
+	}
+	return b + 1
+}
+
+// hashAdd 把一项的行数加上delta，没有这一项时新建，减到0时删除
+func (i *Index) hashAdd(key []byte, delta int64) error {
+	head := i.bucketOf(key[:len(key)-8])
+	var free *hashBucket // 链上第一个有空位的块
+	var last *hashBucket
+	for id := head; id != 0; {
+		bucket, err := i.bucket(id)
+		if err != nil {
+			return err
+		}
+		for j := range bucket.keys {
+			if !bytes.Equal(bucket.keys[j], key) {
+				continue
+			}
+			count := int64(bucket.counts[j]) + delta
+			if count > 0 {
+				bucket.counts[j] = uint64(count)
+			} else {
+				bucket.keys = append(bucket.keys[:j], bucket.keys[j+1:]...)
+				bucket.counts = append(bucket.counts[:j], bucket.counts[j+1:]...)
+				i.Entries--
+			}
+			return i.cache.put(bucket)
+		}
+		if free == nil && uint64(len(bucket.keys)) < i.fanout() {
+			free = bucket
+		}
+		last = bucket
+		id = bucket.overflow
+	}
+	if delta <= 0 {
+		return nil
+	}
+	if free == nil { // 链上都满了，接一个溢出块
+		i.NodeId++
+		free = &hashBucket{id: overflowBit | i.NodeId}
+		last.overflow = free.id
+		if err := i.cache.put(last); err != nil {
+			return err
+		}
+	}
+	free.keys = append(free.keys, key)
+	free.counts = append(free.counts, uint64(delta))
+	if err := i.cache.put(free); err != nil {
+		return err
+	}
+	i.Entries++
+	if i.Entries > i.buckets()*i.fanout() {
+		return i.split()
+	}
+	return nil
+}
+
+func (i *Index) buckets() uint64 {
+	return 1<<i.Level + i.Split
+}
+
+// split 分裂Split指向的桶，原来的溢出块不再使用
+func (i *Index) split() error {
+	head := i.Split + 1
+	keys := make([][]byte, 0, i.fanout())
+	counts := make([]uint64, 0, i.fanout())
+	for id := head; id != 0; {
+		bucket, err := i.bucket(id)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, bucket.keys...)
+		counts = append(counts, bucket.counts...)
+		if id != head {
+			i.cache.remove(id)
+		}
+		id = bucket.overflow
+	}
+	newHead := head + 1<<i.Level // 新桶的编号是Split + 2^Level
+	i.Split++
+	if i.Split == 1<<i.Level {
+		i.Level++
+		i.Split = 0
+	}
+	tails := map[uint64]*hashBucket{head: {id: head}, newHead: {id: newHead}} // 每条链最后一个块
+	for j, key := range keys {
+		b := i.bucketOf(key[:len(key)-8])
+		tail := tails[b]
+		if uint64(len(tail.keys)) == i.fanout() {
+			i.NodeId++
+			next := &hashBucket{id: overflowBit | i.NodeId}
+			tail.overflow = next.id
+			if err := i.cache.put(tail); err != nil {
+				return err
+			}
+			tail = next
+			tails[b] = tail
+		}
+		tail.keys = append(tail.keys, key)
+		tail.counts = append(tail.counts, counts[j])
+	}
+	for _, tail := range tails {
+		if err := i.cache.put(tail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPages 返回索引列的值是value的行所在的page，value要包含所有的索引列
+func (i *Index) hashPages(value []byte) ([]uint64, error) {
+	pageIds := make([]uint64, 0, 4)
+	for id := i.bucketOf(value); id != 0; {
+		bucket, err := i.bucket(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range bucket.keys {
+			if len(key) == len(value)+8 && bytes.HasPrefix(key, value) {
+				pageIds = append(pageIds, binary.BigEndian.Uint64(key[len(value):]))
+			}
+		}
+		id = bucket.overflow
+	}
+	return pageIds, nil
+}
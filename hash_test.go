@@ -0,0 +1,148 @@
+package rmdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashBuckets(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 3
+	GlobalOption.MaxPage = 4
+
+	path := fmt.Sprint(t.TempDir(), string(os.PathSeparator), "t.idx")
+	index := &Index{Name: "t", Type: hashIndex}
+	assert.Nil(t, index.open(stdBackend{}, path))
+	values := make([][]byte, 0, 200)
+	for i := 0; i < 200; i++ {
+		value, err := appendOrderedKey(nil, mustEncode(t, fmt.Sprint("v", i)), STRING)
+		assert.Nil(t, err)
+		values = append(values, value)
+		assert.Nil(t, index.add(entryKey(value, uint64(i%5)), 1))
+		assert.Nil(t, index.add(entryKey(value, 9), 1), "another page of the same value")
+	}
+	assert.True(t, index.buckets() > 64, "buckets are split as entries grow")
+	for _, value := range values[:50] {
+		assert.Nil(t, index.add(entryKey(value, 9), -1))
+	}
+	check := func() {
+		assert.Equal(t, uint64(350), index.Entries)
+		for i, value := range values {
+			pageIds, err := index.pages(value)
+			assert.Nil(t, err)
+			expected := []uint64{uint64(i % 5)}
+			if i >= 50 {
+				expected = append(expected, 9)
+			}
+			if len(pageIds) == 2 && pageIds[0] == 9 {
+				pageIds[0], pageIds[1] = pageIds[1], pageIds[0]
+			}
+			assert.Equal(t, expected, pageIds, fmt.Sprint("value ", i))
+		}
+		missing, err := appendOrderedKey(nil, mustEncode(t, "v"), STRING)
+		assert.Nil(t, err)
+		pageIds, err := index.pages(missing)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(pageIds))
+	}
+	check()
+
+	assert.Nil(t, index.cache.flush())
+	for id := range index.Nodes {
+		if id&overflowBit == 0 {
+			assert.True(t, id <= index.buckets(), "bucket block ids follow the bucket numbers")
+		}
+	}
+	assert.Nil(t, index.cache.file.Close())
+	reopened := *index
+	reopened.Nodes = make(map[uint64]Page, len(index.Nodes))
+	for id, node := range index.Nodes {
+		reopened.Nodes[id] = node
+	}
+	index = &reopened
+	assert.Nil(t, index.open(stdBackend{}, path))
+	check()
+	assert.Nil(t, index.cache.file.Close())
+}
+
+func TestHashIndex(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 4
+
+	db, err := CreateDatabase("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table kv (name STRING, age INT64)"))
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into kv (name, age) values ("k%d", %d)`, i, i%7)))
+	}
+	assertViolation(t, db.Update("create index idx on kv (name) using bitmap"), "unsupported index type bitmap")
+	assert.Nil(t, db.Update("create unique index idx_name on kv (name) USING HASH"))
+	assert.Nil(t, db.Update("create index idx_age on kv (age) using hash"))
+	table := db.tables["kv"]
+	assert.Equal(t, hashIndex, table.Indexes["idx_name"].Type)
+
+	lookup, ok := accessPlan(t, db, `select * from kv where name = "k7"`).(*IndexLookupPlan)
+	if assert.True(t, ok) {
+		assert.Equal(t, "idx_name", lookup.indexName)
+		table.cache.lock.Lock()
+		pageIds, err := lookup.pageIds(table, db.Begin().subTxs["kv"])
+		table.cache.lock.Unlock()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(pageIds), "hash lookup reads one page")
+	}
+	_, ok = accessPlan(t, db, "select * from kv where age > 3").(*TableReadPlan)
+	assert.True(t, ok, "hash index can not scan a range")
+	assert.Equal(t, []string{"k7"}, queryNames(t, db, `select * from kv where name = "k7"`))
+	assert.Equal(t, []string{"k12", "k19", "k26", "k33", "k40", "k47", "k5"}, queryNames(t, db, "select * from kv where age = 5"))
+	assert.Equal(t, []string{"k12", "k19", "k26", "k33", "k40", "k47", "k5"}, queryNames(t, db, "select * from kv where age = 5.0"), "same rows as the hash lookup")
+	assert.Equal(t, 0, len(queryNames(t, db, `select * from kv where name = "k99"`)))
+
+	assertViolation(t, db.Update(`insert into kv (name, age) values ("k3", 1)`), "duplicate key (k3) for unique index idx_name")
+	assert.Nil(t, db.Update(`update kv set name = "x" where name = "k3"`))
+	assert.Nil(t, db.Update(`insert into kv (name, age) values ("k3", 1)`), "old value was moved away")
+	assert.Nil(t, db.Update(`delete from kv where age = 5`))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from kv where age = 5")))
+	tx1, tx2 := db.Begin(), db.Begin()
+	assert.Nil(t, tx1.Update(`insert into kv (name) values ("y")`))
+	assert.Nil(t, tx2.Update(`insert into kv (name) values ("y")`))
+	assert.Nil(t, tx1.Commit())
+	assertViolation(t, tx2.Commit(), "unique index idx_name")
+	assert.Nil(t, tx2.Rollback())
+
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"x"}, queryNames(t, db, `select * from kv where name = "x"`))
+	for i := 50; i < 80; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into kv (name, age) values ("k%d", 100)`, i)))
+	}
+	crashDatabase(db)
+	db, err = UseDatabase("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 30, len(queryNames(t, db, "select * from kv where age = 100")), "replay updates the hash index")
+	assertViolation(t, db.Update(`insert into kv (name) values ("k60")`), "unique index idx_name")
+	assert.Nil(t, db.Update("truncate table kv"))
+	assert.Equal(t, uint64(0), db.tables["kv"].Indexes["idx_name"].Entries)
+	assert.Nil(t, db.Update(`insert into kv (name) values ("k60")`))
+	assert.Equal(t, []string{"k60"}, queryNames(t, db, `select * from kv where name = "k60"`))
+	assert.Nil(t, db.Close())
+}
+
+func TestHashBucketEncoding(t *testing.T) {
+	bucket := &hashBucket{id: overflowBit | 3, keys: [][]byte{{1, 2}, {}}, counts: []uint64{5, 1}, overflow: overflowBit | 4}
+	decoded, err := decodeHashBucket(bucket.id, bucket.encodeBlock())
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.encodeBlock(), decoded.encodeBlock())
+	_, err = decodeHashBucket(1, binary.AppendUvarint(bucket.encodeBlock(), 1))
+	assert.NotNil(t, err, "trailing bytes")
+}
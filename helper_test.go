@@ -0,0 +1,20 @@
+package rmdb
+
+import (
+	"testing"
+)
+
+// setTestOption 测试使用临时目录、标准IO，不启动后台checkpoint，结束时恢复GlobalOption中测试会改的配置
+func setTestOption(t *testing.T) {
+	root, backend, ioMode, interval := GlobalOption.Root, GlobalOption.Backend, GlobalOption.IOMode, GlobalOption.CheckpointInterval
+	maxPage, maxLine, fanout, window := GlobalOption.MaxPage, GlobalOption.MaxLine, GlobalOption.IndexFanout, GlobalOption.GroupCommitWindow
+	sortSize, aggSize := GlobalOption.SortBufferSize, GlobalOption.AggBufferSize
+	t.Cleanup(func() {
+		GlobalOption.Root, GlobalOption.Backend, GlobalOption.IOMode, GlobalOption.CheckpointInterval = root, backend, ioMode, interval
+		GlobalOption.MaxPage, GlobalOption.MaxLine, GlobalOption.IndexFanout, GlobalOption.GroupCommitWindow = maxPage, maxLine, fanout, window
+		GlobalOption.SortBufferSize, GlobalOption.AggBufferSize = sortSize, aggSize
+	})
+	GlobalOption.Root = t.TempDir()
+	GlobalOption.IOMode = Standard
+	GlobalOption.CheckpointInterval = 0
+}
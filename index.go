@@ -0,0 +1,460 @@
+package rmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 二级索引，每个索引一个文件：表名.索引名.idx，节点的位置和根节点记在目录中，和数据page一起在checkpoint时落盘，
+// checkpoint之后的修改由wal重放时重新应用到索引
+
+type Index struct {
+	Name    string
+	Columns []uint64        // 列id，改列名不影响索引
+	Unique  bool            `json:",omitempty"`
+	Type    string          `json:",omitempty"` // 空字符串是B+tree，hash是线性哈希，fulltext是全文索引
+	Root    uint64          `json:",omitempty"` // 根节点id，0表示空树
+	NodeId  uint64          `json:",omitempty"` // 最后分配的节点id，哈希索引只给溢出块分配
+	Nodes   map[uint64]Page `json:",omitempty"` // 节点在索引文件中的位置
+	Level   uint64          `json:",omitempty"` // 哈希索引这一轮开始时有2^Level个桶
+	Split   uint64          `json:",omitempty"` // 哈希索引下一个要分裂的桶
+	Entries uint64          `json:",omitempty"` // 哈希索引的项数，全文索引中文本不是NULL的行数
+	cache   *blockCache
+}
+
+func indexPath(dbPath, tableName, name string) string {
+	return fmt.Sprint(dbPath, string(os.PathSeparator), tableName, ".", name, ".idx")
+}
+
+func (i *Index) open(backend Backend, path string) error {
+	file, err := backend.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	if i.Nodes == nil {
+		i.Nodes = make(map[uint64]Page, 16)
+	}
+	if i.Type == hashIndex {
+		i.cache = newBlockCache(fmt.Sprint("index ", i.Name), hashMagic, file, i.Nodes, decodeHashBucket)
+	} else {
+		i.cache = newBlockCache(fmt.Sprint("index ", i.Name), btreeMagic, file, i.Nodes, decodeBtreeNode)
+	}
+	return nil
+}
+
+// add 把一项的行数加上delta，项是 | 索引列的有序编码 | pageId (8) |
+func (i *Index) add(key []byte, delta int64) error {
+	if i.Type == hashIndex {
+		return i.hashAdd(key, delta)
+	}
+	return i.btreeAdd(key, delta)
+}
+
+// pages 返回索引列的值是key的行所在的page，B+tree索引的key可以只有前几列
+func (i *Index) pages(key []byte) ([]uint64, error) {
+	if i.Type == hashIndex {
+		return i.hashPages(key)
+	}
+	return i.btreePages(key)
+}
+
+// columns 按id找到索引列
+func (i *Index) columns(columns []Column) []Column {
+	indexed := make([]Column, 0, len(i.Columns))
+	for _, id := range i.Columns {
+		for _, column := range columns {
+			if column.Id == id {
+				indexed = append(indexed, column)
+			}
+		}
+	}
+	return indexed
+}
+
+func (i *Index) usesColumn(column Column) bool {
+	for _, id := range i.Columns {
+		if id == column.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// key 返回一行索引列的有序编码，hasNull表示其中有NULL，唯一索引不检查这样的行
+func (i *Index) key(line Line, columns []Column) ([]byte, bool, error) {
+	key := make([]byte, 0, 32)
+	hasNull := false
+	for _, column := range columns {
+		value := line.nameToVal[column.Name].value
+		hasNull = hasNull || value == nil
+		var err error
+		key, err = appendOrderedKey(key, value, column.TypeOf)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return key, hasNull, nil
+}
+
+// keys 返回一行在索引中的所有键，全文索引每个词一个键，其他索引只有一个键
+func (i *Index) keys(line Line, columns []Column) ([][]byte, error) {
+	if i.Type == fulltextIndex {
+		return termKeys(line.nameToVal[columns[0].Name].value)
+	}
+	key, _, err := i.key(line, columns)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{key}, nil
+}
+
+// textRows 全文索引中文本不是NULL的行数
+func (i *Index) textRows(lines map[uint64]Line, columns []Column) int64 {
+	if i.Type != fulltextIndex {
+		return 0
+	}
+	rows := int64(0)
+	for _, line := range lines {
+		if line.nameToVal[columns[0].Name].value != nil {
+			rows++
+		}
+	}
+	return rows
+}
+
+// formatKey 错误信息中显示索引列的值
+func formatKey(line Line, columns []Column) string {
+	vals := make([]string, 0, len(columns))
+	for _, column := range columns {
+		vals = append(vals, FormatData(line.nameToVal[column.Name].value, column.TypeOf))
+	}
+	return strings.Join(vals, ", ")
+}
+
+func entryKey(key []byte, pageId uint64) []byte {
+	return binary.BigEndian.AppendUint64(append(make([]byte, 0, len(key)+8), key...), pageId)
+}
+
+// reset 变成空树，缓存中的块不写回
+func (i *Index) reset() {
+	*i = Index{Name: i.Name, Columns: i.Columns, Unique: i.Unique, Type: i.Type, cache: i.cache}
+	i.Nodes = make(map[uint64]Page, 16)
+	i.cache.reset(i.Nodes)
+}
+
+// restore 恢复到reset之前的样子
+func (i *Index) restore(saved Index) {
+	*i = saved
+	i.cache.reset(i.Nodes)
+}
+
+// allIndexes 二级索引和已经建立的主键索引，调用方持有cache锁
+func (t *Table) allIndexes() []*Index {
+	indexes := make([]*Index, 0, len(t.Indexes)+1)
+	if t.Primary != nil {
+		indexes = append(indexes, t.Primary)
+	}
+	for _, index := range t.Indexes {
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+// updateIndexes page中的行从old变成lines，按差值修改每个索引，调用方持有cache锁
+func (t *Table) updateIndexes(pageId uint64, old, lines map[uint64]Line) error {
+	for _, index := range t.allIndexes() {
+		columns := index.columns(t.Columns)
+		deltas := make(map[string]int64, len(old)+len(lines))
+		for _, line := range old {
+			keys, err := index.keys(line, columns)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				deltas[string(key)]--
+			}
+		}
+		for _, line := range lines {
+			keys, err := index.keys(line, columns)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				deltas[string(key)]++
+			}
+		}
+		index.Entries = uint64(int64(index.Entries) + index.textRows(lines, columns) - index.textRows(old, columns))
+		for key, delta := range deltas {
+			if delta == 0 {
+				continue
+			}
+			if err := index.add(entryKey([]byte(key), pageId), delta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndex 扫描所有page建立索引，调用方持有cache锁
+func (t *Table) buildIndex(index *Index) error {
+	columns := index.columns(t.Columns)
+	for i := uint64(1); i < t.cache.pageId; i++ {
+		page, err := t.cache.GetPage(i)
+		if err != nil {
+			return err
+		}
+		if page == nil {
+			continue
+		}
+		index.Entries += uint64(index.textRows(page.lines, columns))
+		for _, line := range page.lines {
+			if index.Unique {
+				key, hasNull, err := index.key(line, columns)
+				if err != nil {
+					return err
+				}
+				pageIds, err := index.pages(key)
+				if err != nil {
+					return err
+				}
+				if !hasNull && len(pageIds) != 0 {
+					return indexError(index, line, columns)
+				}
+			}
+			keys, err := index.keys(line, columns)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err = index.add(entryKey(key, page.Id), 1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func indexError(index *Index, line Line, columns []Column) error {
+	return fmt.Errorf("duplicate key (%s) for unique index %s", formatKey(line, columns), index.Name)
+}
+
+// indexKeys 返回唯一索引要占用的键，调用方持有cache锁
+func (s *SubTx) indexKeys(index *Index, lines []Line) ([]string, error) {
+	columns := index.columns(s.table.Columns)
+	seen := make(map[string]struct{}, len(lines))
+	keys := make([]string, 0, len(lines))
+	for _, line := range lines {
+		key, hasNull, err := index.key(line, columns)
+		if err != nil {
+			return nil, err
+		}
+		if hasNull {
+			continue
+		}
+		reserved := fmt.Sprint(index.Name, "\x00", string(key))
+		if _, ok := seen[reserved]; ok || s.table.reserved[reserved] {
+			return nil, indexError(index, line, columns)
+		}
+		seen[reserved] = struct{}{}
+		pageIds, err := index.pages(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, pageId := range pageIds {
+			if !s.replaced(pageId) {
+				return nil, indexError(index, line, columns)
+			}
+		}
+		keys = append(keys, reserved)
+	}
+	return keys, nil
+}
+
+func (t *Table) flushIndexes() error {
+	for _, index := range t.allIndexes() {
+		if err := index.cache.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Table) openIndexes(backend Backend, dbPath string) error {
+	for name, index := range t.Indexes {
+		if err := index.open(backend, indexPath(dbPath, t.Name, name)); err != nil {
+			return err
+		}
+	}
+	if t.Primary != nil {
+		return t.Primary.open(backend, primaryPath(dbPath, t.Name))
+	}
+	return nil
+}
+
+func (t *Table) closeIndexes() error {
+	var err error
+	for _, index := range t.allIndexes() {
+		if closeErr := index.cache.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// indexOn 返回用到这一列的索引名，没有时返回空字符串
+func (t *Table) indexOn(column Column) string {
+	for name, index := range t.Indexes {
+		if index.usesColumn(column) {
+			return name
+		}
+	}
+	return ""
+}
+
+// CreateIndex 在表的一列或多列上建索引，using是btree、hash或者fulltext，为空时是B+tree。唯一索引建立时已有的行不能重复，
+// 全文索引只能建在一个STRING列上
+func (d *Database) CreateIndex(tableName, name string, colNames []string, unique bool, using string) error {
+	GlobalOption.lock.Lock()
+	defer GlobalOption.lock.Unlock()
+	d.ckptLock.Lock() // 建索引时不能有事务提交
+	defer d.ckptLock.Unlock()
+	if err := d.checkBroken(); err != nil {
+		return err
+	}
+	table, ok := d.tables[tableName]
+	if !ok {
+		return errors.New("table not exists")
+	}
+	if !identReg.MatchString(name) {
+		return fmt.Errorf("invalid index name %s", name)
+	}
+	if _, ok := table.Indexes[name]; ok {
+		return errors.New("index is exists")
+	}
+	index := &Index{
+		Name:    name,
+		Columns: make([]uint64, 0, len(colNames)),
+		Unique:  unique,
+	}
+	switch strings.ToLower(using) {
+	case "", "btree":
+	case hashIndex:
+		index.Type = hashIndex
+	case fulltextIndex:
+		index.Type = fulltextIndex
+	default:
+		return fmt.Errorf("unsupported index type %s", using)
+	}
+	for _, colName := range colNames {
+		colName = strings.TrimSpace(colName)
+		pos := columnIndex(table.Columns, colName)
+		if pos < 0 {
+			return fmt.Errorf("column %s not exists", colName)
+		}
+		if index.usesColumn(table.Columns[pos]) {
+			return fmt.Errorf("duplicate column %s", colName)
+		}
+		index.Columns = append(index.Columns, table.Columns[pos].Id)
+	}
+	if len(index.Columns) == 0 {
+		return errors.New("index has no column")
+	}
+	if index.Type == fulltextIndex {
+		columns := index.columns(table.Columns)
+		if len(columns) != 1 || columns[0].TypeOf != STRING {
+			return errors.New("fulltext index must be on one string column")
+		}
+		if unique {
+			return errors.New("fulltext index can not be unique")
+		}
+	}
+	path := indexPath(d.dbPath, tableName, name)
+	err := d.backend.Remove(path) // 之前建索引失败留下的
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = index.open(d.backend, path)
+	if err != nil {
+		return err
+	}
+	table.cache.lock.Lock()
+	err = table.buildIndex(index)
+	if err == nil {
+		if table.Indexes == nil {
+			table.Indexes = make(map[string]*Index, 4)
+		}
+		table.Indexes[name] = index
+	}
+	table.cache.lock.Unlock()
+	if err == nil {
+		err = d.checkpoint() // 索引文件和目录一起落盘
+	}
+	if err != nil { // 目录可能已经写入，留下文件，下次建同名索引时删除
+		table.cache.lock.Lock()
+		delete(table.Indexes, name)
+		table.cache.lock.Unlock()
+		_ = index.cache.file.Close()
+		return err
+	}
+	return nil
+}
+
+// DropIndex 删除索引，tableName为空时在所有表中找这个名字的索引
+func (d *Database) DropIndex(tableName, name string) error {
+	GlobalOption.lock.Lock()
+	defer GlobalOption.lock.Unlock()
+	d.ckptLock.Lock()
+	defer d.ckptLock.Unlock()
+	table, err := d.findIndex(tableName, name)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return errors.New("index not exists")
+	}
+	table.cache.lock.Lock()
+	index := table.Indexes[name]
+	delete(table.Indexes, name)
+	table.cache.lock.Unlock()
+	err = d.checkpoint() // 先把不含这个索引的目录落盘再删文件
+	if err != nil {
+		table.cache.lock.Lock()
+		table.Indexes[name] = index
+		table.cache.lock.Unlock()
+		return err
+	}
+	err = index.cache.file.Close()
+	if err != nil {
+		return err
+	}
+	return d.backend.Remove(index.cache.file.Name())
+}
+
+// findIndex 找到索引所在的表，索引不存在时返回nil
+func (d *Database) findIndex(tableName, name string) (*Table, error) {
+	if tableName != "" {
+		table, ok := d.tables[tableName]
+		if !ok {
+			return nil, errors.New("table not exists")
+		}
+		if _, ok := table.Indexes[name]; !ok {
+			return nil, nil
+		}
+		return table, nil
+	}
+	var found *Table
+	for _, table := range d.tables {
+		if _, ok := table.Indexes[name]; ok {
+			if found != nil {
+				return nil, fmt.Errorf("index %s exists in more than one table, use drop index %s on table", name, name)
+			}
+			found = table
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,355 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBtree(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 4
+	GlobalOption.MaxPage = 3 // 节点会被换出再读入
+
+	path := fmt.Sprint(t.TempDir(), string(os.PathSeparator), "t.idx")
+	index := &Index{Name: "t"}
+	assert.Nil(t, index.open(stdBackend{}, path))
+	keys := make([][]byte, 0, 300)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(300) {
+		key, err := appendOrderedKey(nil, mustEncode(t, int64(i-150)), INT64)
+		assert.Nil(t, err)
+		keys = append(keys, entryKey(key, uint64(i%7)))
+		assert.Nil(t, index.add(keys[len(keys)-1], 2))
+	}
+	for _, key := range keys[:100] {
+		assert.Nil(t, index.add(key, -1))
+		assert.Nil(t, index.add(key, -1), "count 0 removes the entry")
+	}
+	assert.Nil(t, index.add(keys[0], -1), "removing a missing entry does nothing")
+
+	check := func() {
+		var last []byte
+		entries := 0
+		assert.Nil(t, index.scan(nil, func(key []byte, count uint64) bool {
+			assert.True(t, last == nil || bytes.Compare(last, key) < 0, "keys are ordered")
+			assert.Equal(t, uint64(2), count)
+			last = key
+			entries++
+			return true
+		}))
+		assert.Equal(t, 200, entries)
+		for _, key := range keys[100:] {
+			pageIds, err := index.pages(key[:len(key)-8])
+			assert.Nil(t, err)
+			assert.Equal(t, []uint64{binary.BigEndian.Uint64(key[len(key)-8:])}, pageIds)
+		}
+		pageIds, err := index.pages(keys[0][:len(keys[0])-8])
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(pageIds))
+	}
+	check()
+	root, ok := index.cache.blockMap[index.Root]
+	if ok {
+		assert.False(t, root.Value.(*cachedBlock).block.(*btreeNode).leaf, "tree has grown")
+	}
+
+	assert.Nil(t, index.cache.flush())
+	nodes := make(map[uint64]Page, len(index.Nodes))
+	for id, node := range index.Nodes {
+		nodes[id] = node
+	}
+	assert.Nil(t, index.cache.file.Close())
+	reopened := &Index{Name: "t", Root: index.Root, NodeId: index.NodeId, Nodes: nodes}
+	assert.Nil(t, reopened.open(stdBackend{}, path))
+	index = reopened
+	check()
+	assert.Nil(t, index.cache.file.Close())
+}
+
+func mustEncode(t *testing.T, value any) []byte {
+	data, err := EncodeData(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestOrderedKey(t *testing.T) {
+	values := []struct {
+		value  any
+		typeOf int
+	}{
+		{int64(-5), INT64}, {int64(0), INT64}, {int64(7), INT64},
+		{-1.5, FLOAT64}, {0.0, FLOAT64}, {2.25, FLOAT64},
+		{"a", STRING}, {"a\x00b", STRING}, {"ab", STRING},
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i].typeOf != values[i-1].typeOf {
+			continue
+		}
+		prev, err := appendOrderedKey(nil, mustEncode(t, values[i-1].value), values[i-1].typeOf)
+		assert.Nil(t, err)
+		next, err := appendOrderedKey(nil, mustEncode(t, values[i].value), values[i].typeOf)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Compare(prev, next) < 0, fmt.Sprint(values[i-1].value, " < ", values[i].value))
+		null, err := appendOrderedKey(nil, nil, values[i].typeOf)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Compare(null, prev) < 0, "null is the smallest")
+	}
+}
+
+// indexedRows 索引中这些值的行数
+func indexedRows(t *testing.T, table *Table, name string, values ...any) uint64 {
+	index := table.Indexes[name]
+	columns := index.columns(table.Columns)
+	prefix := make([]byte, 0, 32)
+	for i, value := range values {
+		var data []byte
+		if value != nil {
+			data = mustEncode(t, value)
+		}
+		var err error
+		prefix, err = appendOrderedKey(prefix, data, columns[i].TypeOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := uint64(0)
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
+	assert.Nil(t, index.scan(prefix, func(key []byte, count uint64) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		rows += count
+		return true
+	}))
+	return rows
+}
+
+func TestIndex(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 4
+
+	db, err := CreateDatabase("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, age INT64, city STRING)"))
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into man (name, age, city) values ("n%d", %d, "c%d")`, i, i%5, i%3)))
+	}
+	table := db.tables["man"]
+	assert.NotNil(t, db.Update("create index idx on man (height)"), "column not exists")
+	assert.NotNil(t, db.Update("create index idx on man (age, age)"))
+	assert.NotNil(t, db.Update("create index idx on nobody (age)"))
+	assertViolation(t, db.Update("create unique index u_age on man (age)"), "for unique index u_age")
+	assert.Equal(t, 0, len(table.Indexes), "failed index is not added")
+
+	assert.Nil(t, db.Update("create index idx_age on man (age)"))
+	assert.NotNil(t, db.Update("create index idx_age on man (city)"), "index is exists")
+	assert.Nil(t, db.Update("create index if not exists idx_age on man (city)"))
+	assert.Equal(t, uint64(8), indexedRows(t, table, "idx_age", int64(3)))
+	assert.Nil(t, db.Update("CREATE UNIQUE INDEX u_name ON man (name, city)"))
+	assert.True(t, table.Indexes["u_name"].Unique)
+	assert.Equal(t, uint64(1), indexedRows(t, table, "u_name", "n7", "c1"))
+
+	assert.Nil(t, db.Update(`update man set age = 9 where age = 3`))
+	assert.Equal(t, uint64(0), indexedRows(t, table, "idx_age", int64(3)))
+	assert.Equal(t, uint64(8), indexedRows(t, table, "idx_age", int64(9)))
+	assert.Nil(t, db.Update(`delete from man where age = 9`))
+	assert.Equal(t, uint64(0), indexedRows(t, table, "idx_age", int64(9)))
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("n1", 1)`), "null is not a duplicate")
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("n1", 1)`))
+	assert.Equal(t, uint64(10), indexedRows(t, table, "idx_age", int64(1)))
+	assert.Equal(t, uint64(2), indexedRows(t, table, "u_name", "n1", nil))
+
+	assertViolation(t, db.Update(`insert into man (name, city) values ("n2", "c2")`), "duplicate key (n2, c2) for unique index u_name")
+	assertViolation(t, db.Update(`update man set name = "n7" where name = "n4"`), "duplicate key (n7, c1) for unique index u_name")
+	assert.Nil(t, db.Update(`update man set city = "c9" where name = "n4"`))
+	tx1, tx2 := db.Begin(), db.Begin()
+	assert.Nil(t, tx1.Update(`insert into man (name, city) values ("x", "y")`))
+	assert.Nil(t, tx2.Update(`insert into man (name, city) values ("x", "y")`))
+	assert.Nil(t, tx1.Commit())
+	assertViolation(t, tx2.Commit(), "unique index u_name")
+	assert.Nil(t, tx2.Rollback())
+	assert.Equal(t, uint64(1), indexedRows(t, table, "u_name", "x", "y"))
+
+	assertViolation(t, db.Update("alter table man drop column age"), "column is used by index idx_age")
+	assertViolation(t, db.Update("alter table man modify column age FLOAT64"), "column is used by index idx_age")
+	assert.Nil(t, db.Update("alter table man rename column age to years"))
+	assert.Nil(t, db.Update(`insert into man (name, years) values ("z", 4)`))
+	assert.Equal(t, uint64(9), indexedRows(t, table, "idx_age", int64(4)), "index follows the renamed column")
+
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table = db.tables["man"]
+	assert.Equal(t, uint64(9), indexedRows(t, table, "idx_age", int64(4)), "index is saved with the catalog")
+	assertViolation(t, db.Update(`insert into man (name, city) values ("n5", "c2")`), "unique index u_name")
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into man (name, years) values ("w%d", 7)`, i)))
+	}
+	assert.Nil(t, db.Update(`delete from man where years = 0`))
+	crashDatabase(db)
+
+	db, err = UseDatabase("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table = db.tables["man"]
+	assert.Equal(t, uint64(20), indexedRows(t, table, "idx_age", int64(7)), "replay updates the index")
+	assert.Equal(t, uint64(0), indexedRows(t, table, "idx_age", int64(0)))
+	assert.Nil(t, db.Update(`insert into man (name, city) values ("w3", null);insert into man (name, city) values ("w3", null)`))
+
+	assert.Nil(t, db.Update("truncate table man"))
+	assert.Equal(t, uint64(0), indexedRows(t, table, "idx_age", int64(4)))
+	assert.Nil(t, db.Update(`insert into man (name, years, city) values ("n2", 4, "c2")`))
+	assert.Equal(t, uint64(1), indexedRows(t, table, "idx_age", int64(4)))
+
+	assert.Nil(t, db.Update("create table code (name STRING)"))
+	assert.Nil(t, db.Update("create index idx_age on code (name)"))
+	assertViolation(t, db.Update("drop index idx_age"), "more than one table")
+	assert.Nil(t, db.Update("drop index idx_age on code"))
+	idxPath := indexPath(db.dbPath, "man", "idx_age")
+	assert.Nil(t, db.Update("drop index idx_age"))
+	_, err = os.Stat(idxPath)
+	assert.True(t, os.IsNotExist(err), "index file is removed")
+	assert.NotNil(t, db.Update("drop index idx_age"))
+	assert.Nil(t, db.Update("drop index if exists idx_age"))
+	idxPath = indexPath(db.dbPath, "man", "u_name")
+	assert.Nil(t, db.Update("drop table man"))
+	_, err = os.Stat(idxPath)
+	assert.True(t, os.IsNotExist(err), "index files are removed with the table")
+	assert.Nil(t, db.Close())
+}
+
+func accessPlan(t *testing.T, db *Database, sql string) Plan {
+	var wg sync.WaitGroup
+	plans, _, _, err := db.Begin().CompileQuery(mustSelect(t, sql), &wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plans[TableRead]
+}
+
+func TestAccessPath(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.IndexFanout = 4
+
+	db, err := CreateDatabase("access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, age INT64, city STRING, score FLOAT64)"))
+	for i := 0; i < 60; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into man (name, age, city, score) values ("n%02d", %d, "c%d", %d.5)`, i, i%10-3, i%3, i)))
+	}
+	assert.Nil(t, db.Update(`insert into man (name) values ("null")`))
+	queries := []string{
+		"select * from man where age = 2",
+		"select * from man where age < 0",
+		"select * from man where age > 4",
+		"select * from man where age <= -3",
+		"select * from man where age >= 6",
+		"select * from man where age BETWEEN -1 AND 1",
+		"select * from man where age between 3 and 1",
+		"select * from man where age not between -2 and 5",
+		"select * from man where age > 0, age < 3",
+		`select * from man where age < "x"`,
+		"select * from man where age > null",
+		`select * from man where city = "c1"`,
+		`select * from man where city = "c1", age between 1 and 3`,
+		`select * from man where city = "c1", age > 5`,
+		`select * from man where city = "c2", age = 0`,
+		`select * from man where city > "c0", age < 0`,
+		`select * from man where name < "n05"`,
+		`select * from man where name between "n10" and "n12"`,
+		"select * from man where score > 55.1",
+		"select * from man where score < -1",
+		"select * from man where age = 2.0",
+		"select * from man where age > 2.5",
+		"select * from man where age = '2'",
+		"select * from man where age between 1.5 and 3",
+		`select * from man where city = "c1", age = 1.0`,
+	}
+	expected := make([][]string, 0, len(queries))
+	for _, sql := range queries {
+		_, ok := accessPlan(t, db, sql).(*TableReadPlan)
+		assert.True(t, ok, "no index, read the whole table")
+		expected = append(expected, queryNames(t, db, sql))
+	}
+	assert.Equal(t, []string{"n09", "n19", "n29", "n39", "n49", "n59"}, expected[4])
+	assert.Equal(t, 0, len(expected[6]))
+	assert.Equal(t, 0, len(expected[9]), "literal can not be parsed, no row matches")
+	assert.Equal(t, 0, len(expected[10]), "comparing with null is unknown")
+	assert.Equal(t, []string{"n00", "n01", "n02", "n03", "n04"}, expected[16])
+	assert.Equal(t, 12, len(expected[7]), "-3 and 6 are outside the range")
+	assert.Equal(t, expected[0], expected[len(queries)-5], "int column equals a float literal")
+	assert.Equal(t, expected[0], expected[len(queries)-3], "string literal is cast to the column type")
+	assert.Equal(t, 24, len(expected[len(queries)-4]), "3 to 6 are greater than 2.5")
+
+	assert.Nil(t, db.Update("create index idx_age on man (age)"))
+	assert.Nil(t, db.Update("create index idx_city_age on man (city, age)"))
+	assert.Nil(t, db.Update("create index idx_score on man (score)"))
+	for i, sql := range queries {
+		assert.Equal(t, expected[i], queryNames(t, db, sql), sql)
+	}
+	_, ok := accessPlan(t, db, "select * from man where age = 2").(*IndexLookupPlan)
+	assert.True(t, ok)
+	scan, ok := accessPlan(t, db, "select * from man where age > 0, age < 3").(*IndexScanPlan)
+	if assert.True(t, ok) {
+		assert.Equal(t, "idx_age", scan.indexName)
+		assert.True(t, scan.lowerOpen && scan.upperOpen)
+	}
+	scan, ok = accessPlan(t, db, `select * from man where city = "c1", age between 1 and 3`).(*IndexScanPlan)
+	if assert.True(t, ok) {
+		assert.Equal(t, "idx_city_age", scan.indexName, "more columns of the index are used")
+	}
+	lookup, ok := accessPlan(t, db, `select * from man where city = "c2", age = 0`).(*IndexLookupPlan)
+	if assert.True(t, ok) {
+		assert.Equal(t, "idx_city_age", lookup.indexName)
+	}
+	_, ok = accessPlan(t, db, `select * from man where name < "n05"`).(*TableReadPlan)
+	assert.True(t, ok, "name has no index")
+	_, ok = accessPlan(t, db, "select * from man where age > 2.5").(*TableReadPlan)
+	assert.True(t, ok, "the literal does not encode as INT64, compare while scanning")
+	_, ok = accessPlan(t, db, "select * from man where age not between -2 and 5").(*TableReadPlan)
+	assert.True(t, ok, "not between can not use the index")
+
+	table := db.tables["man"]
+	tx := db.Begin()
+	table.cache.lock.Lock()
+	pageIds, err := scan.pageIds(table, tx.subTxs["man"])
+	table.cache.lock.Unlock()
+	assert.Nil(t, err)
+	assert.True(t, len(pageIds) < int(table.cache.pageId-1), fmt.Sprint("index scan reads ", len(pageIds), " of ", table.cache.pageId-1, " pages"))
+
+	assert.Nil(t, tx.Update(`update man set age = 100 where name = "n07"`))
+	assert.Equal(t, []string{"n07"}, namesOf(queryTx(t, tx, "select * from man where age > 50")), "transaction sees its own changes")
+	assert.Equal(t, []string{"n17", "n27", "n37", "n47", "n57"}, namesOf(queryTx(t, tx, "select * from man where age = 4")))
+	assert.Nil(t, tx.Commit())
+	assert.Nil(t, db.Update("delete from man where age between 5 and 200"))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from man where age >= 5")))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from man where age > 50")))
+	assert.Equal(t, 47, len(queryNames(t, db, "select * from man where age < 5")))
+	assert.Nil(t, db.Close())
+}
+
+func namesOf(lines []*Line) []string {
+	names := make([]string, 0, len(lines))
+	for _, line := range lines {
+		names = append(names, FormatData(line.nameToVal["name"].value, STRING))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,274 @@
+package rmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 词法分析：把sql切成token。字符串可以用双引号（json的写法和转义）或者单引号（''或者反斜杠转义），
+// 反引号括起来的是标识符，支持 -- 到行尾和 /* */ 的注释
+
+type tokenKind int8
+
+const (
+	tokEOF     tokenKind = iota
+	tokIdent             // 标识符
+	tokKeyword           // 保留字，text是小写
+	tokString            // 字符串，text是去掉引号和转义之后的内容
+	tokNumber            // 数字，不带符号
+	tokSymbol            // ( ) , ; * = < > <= >= != <> . + - / %
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // 在sql中的字节偏移
+	end  int // token之后的字节偏移
+}
+
+var keywords = map[string]struct{}{
+	"select": {}, "distinct": {}, "from": {}, "where": {}, "group": {}, "by": {}, "having": {},
+	"order": {}, "asc": {}, "desc": {}, "limit": {}, "offset": {}, "as": {},
+	"insert": {}, "into": {}, "values": {}, "update": {}, "set": {}, "delete": {},
+	"and": {}, "or": {}, "is": {}, "not": {}, "null": {}, "between": {}, "in": {}, "like": {}, "true": {}, "false": {},
+	"case": {}, "when": {}, "then": {}, "else": {}, "end": {}, "cast": {},
+}
+
+// quoteIdent 关键字和不是普通标识符的名字加反引号，String()的结果要能再解析，wal中记的就是这个
+func quoteIdent(name string) string {
+	if _, ok := keywords[strings.ToLower(name)]; ok || !plainIdent(name) {
+		return "`" + name + "`"
+	}
+	return name
+}
+
+func plainIdent(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// SyntaxError 带位置的语法错误，行和列从1开始，列按字符计算
+type SyntaxError struct {
+	Line   int
+	Column int
+	Near   string // 出错位置的token，到结尾时为空
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Near == "" {
+		return fmt.Sprintf("syntax error at line %d column %d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("syntax error at line %d column %d near %q: %s", e.Line, e.Column, e.Near, e.Msg)
+}
+
+func syntaxError(sql string, pos int, near string, format string, args ...any) *SyntaxError {
+	line, column := 1, 1
+	for _, r := range sql[:pos] {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return &SyntaxError{Line: line, Column: column, Near: near, Msg: fmt.Sprintf(format, args...)}
+}
+
+type lexer struct {
+	sql string
+	pos int
+}
+
+// lex 把sql切成token，最后一个是tokEOF
+func lex(sql string) ([]token, error) {
+	l := &lexer{sql: sql}
+	tokens := make([]token, 0, 32)
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tok.end = l.pos
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < len(l.sql) {
+		return l.sql[l.pos+offset]
+	}
+	return 0
+}
+
+// skip 跳过空白和注释
+func (l *lexer) skip() error {
+	for l.pos < len(l.sql) {
+		r, size := utf8.DecodeRuneInString(l.sql[l.pos:])
+		switch {
+		case unicode.IsSpace(r):
+			l.pos += size
+		case r == '-' && l.peek(1) == '-':
+			end := strings.IndexByte(l.sql[l.pos:], '\n')
+			if end < 0 {
+				l.pos = len(l.sql)
+			} else {
+				l.pos += end + 1
+			}
+		case r == '/' && l.peek(1) == '*':
+			end := strings.Index(l.sql[l.pos+2:], "*/")
+			if end < 0 {
+				return syntaxError(l.sql, l.pos, "/*", "unterminated comment")
+			}
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	start := l.pos
+	if l.pos >= len(l.sql) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	r, size := utf8.DecodeRuneInString(l.sql[l.pos:])
+	switch {
+	case r == '"':
+		return l.doubleQuoted()
+	case r == '\'':
+		return l.singleQuoted()
+	case r == '`':
+		end := strings.IndexByte(l.sql[l.pos+1:], '`')
+		if end < 0 {
+			return token{}, syntaxError(l.sql, start, "`", "unterminated identifier")
+		}
+		l.pos += end + 2
+		return token{kind: tokIdent, text: l.sql[start+1 : l.pos-1], pos: start}, nil
+	case isDigit(r) || r == '.' && isDigit(rune(l.peek(1))):
+		return l.number()
+	case unicode.IsLetter(r) || r == '_':
+		for l.pos < len(l.sql) {
+			r, size = utf8.DecodeRuneInString(l.sql[l.pos:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+				break
+			}
+			l.pos += size
+		}
+		text := l.sql[start:l.pos]
+		if _, ok := keywords[strings.ToLower(text)]; ok {
+			return token{kind: tokKeyword, text: strings.ToLower(text), pos: start}, nil
+		}
+		return token{kind: tokIdent, text: text, pos: start}, nil
+	}
+	for _, symbol := range []string{"<=", ">=", "!=", "<>"} {
+		if strings.HasPrefix(l.sql[l.pos:], symbol) {
+			l.pos += 2
+			return token{kind: tokSymbol, text: symbol, pos: start}, nil
+		}
+	}
+	if strings.ContainsRune("(),;*=<>.+-/%", r) {
+		l.pos += size
+		return token{kind: tokSymbol, text: string(r), pos: start}, nil
+	}
+	return token{}, syntaxError(l.sql, start, string(r), "unexpected character")
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// number 整数、小数和科学计数法，符号由parser处理
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	digits := func() {
+		for isDigit(rune(l.peek(0))) {
+			l.pos++
+		}
+	}
+	digits()
+	if l.peek(0) == '.' {
+		l.pos++
+		digits()
+	}
+	if c := l.peek(0); c == 'e' || c == 'E' {
+		l.pos++
+		if c = l.peek(0); c == '+' || c == '-' {
+			l.pos++
+		}
+		if !isDigit(rune(l.peek(0))) {
+			return token{}, syntaxError(l.sql, start, l.sql[start:l.pos], "invalid number")
+		}
+		digits()
+	}
+	if r, _ := utf8.DecodeRuneInString(l.sql[l.pos:]); unicode.IsLetter(r) || r == '_' {
+		return token{}, syntaxError(l.sql, start, l.sql[start:l.pos+1], "invalid number")
+	}
+	return token{kind: tokNumber, text: l.sql[start:l.pos], pos: start}, nil
+}
+
+// doubleQuoted 双引号字符串按json解码
+func (l *lexer) doubleQuoted() (token, error) {
+	start := l.pos
+	for i := start + 1; i < len(l.sql); i++ {
+		switch l.sql[i] {
+		case '\\':
+			i++
+		case '"':
+			var text string
+			if err := json.Unmarshal([]byte(l.sql[start:i+1]), &text); err != nil {
+				return token{}, syntaxError(l.sql, start, l.sql[start:i+1], "invalid escape in string")
+			}
+			l.pos = i + 1
+			return token{kind: tokString, text: text, pos: start}, nil
+		}
+	}
+	return token{}, syntaxError(l.sql, start, `"`, "unterminated string")
+}
+
+// singleQuoted 单引号字符串中两个连续的单引号表示一个单引号，也可以用反斜杠转义
+func (l *lexer) singleQuoted() (token, error) {
+	start := l.pos
+	buf := new(strings.Builder)
+	for i := start + 1; i < len(l.sql); i++ {
+		c := l.sql[i]
+		switch {
+		case c == '\'' && i+1 < len(l.sql) && l.sql[i+1] == '\'':
+			buf.WriteByte('\'')
+			i++
+		case c == '\'':
+			l.pos = i + 1
+			return token{kind: tokString, text: buf.String(), pos: start}, nil
+		case c == '\\' && i+1 < len(l.sql):
+			i++
+			switch l.sql[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'r':
+				buf.WriteByte('\r')
+			case '0':
+				buf.WriteByte(0)
+			default:
+				buf.WriteByte(l.sql[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return token{}, syntaxError(l.sql, start, "'", "unterminated string")
+}
@@ -1,6 +1,8 @@
 package rmdb
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,13 +13,23 @@ type Line struct { //tuple代表一行记录
 
 type ColVal struct {
 	column Column
-	value  []byte
+	value  []byte // nil表示NULL
 }
 
 type Column struct {
+	Id     uint64 `json:",omitempty"` // 改名和改类型不变，删掉再加的同名列是新的id
 	Name   string
 	TypeOf int
-	DefVal []byte
+	DefVal []byte // 加列之前写入的行没有这一列，读出来是这个值
+	// 约束，insert和update时检查
+	NotNull    bool   `json:",omitempty"`
+	HasDefault bool   `json:",omitempty"` // 默认值可以是空字符串，不能用Default是否为nil判断
+	Default    []byte `json:",omitempty"` // insert没有给这一列的值时使用
+	Check      string `json:",omitempty"` // 注册的条件函数名，参数是这一列的值
+	Unique     bool   `json:",omitempty"`
+	PrimaryKey bool   `json:",omitempty"` // 主键也是not null和unique
+	// 只能用在INT64的主键上，insert没有给值或者给了NULL时取下一个序列值
+	AutoIncrement bool `json:",omitempty"`
 }
 
 const (
@@ -28,6 +40,25 @@ const (
 	DATE
 )
 
+var typeNames = []string{"BOOL", "INT64", "FLOAT64", "STRING", "DATE"}
+
+func typeName(typeOf int) string {
+	if typeOf < BOOL || typeOf > DATE {
+		return fmt.Sprint("type ", typeOf)
+	}
+	return typeNames[typeOf]
+}
+
+// parseType 把sql中的类型名转换成类型，不区分大小写
+func parseType(name string) (int, error) {
+	for typeOf, typeName := range typeNames {
+		if strings.EqualFold(name, typeName) {
+			return typeOf, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported type %s", name)
+}
+
 func CopyLine(line Line) Line { // TODO 好像可以直接 newLine := line
 	newLine := Line{
 		nameToVal: make(map[string]ColVal, 16),
@@ -43,18 +74,22 @@ func CopyLine(line Line) Line { // TODO 好像可以直接 newLine := line
 	return newLine
 }
 
+func (c ColVal) IsNull() bool {
+	return c.value == nil
+}
+
 func defaultValue(typeOf int) ([]byte, error) {
 	switch typeOf {
 	case BOOL:
 		return EncodeData(false)
 	case INT64:
-		return EncodeData(0)
+		return EncodeData(int64(0))
 	case FLOAT64:
-		return EncodeData(0)
+		return EncodeData(float64(0))
 	case STRING:
 		return EncodeData("")
 	case DATE:
-		return EncodeData(new(time.Time))
+		return EncodeData(time.Time{})
 	default:
 		return nil, nil
 	}
@@ -64,7 +99,7 @@ func GetTypeOf(value any) int {
 	switch value.(type) {
 	case bool:
 		return BOOL
-	case int64:
+	case int64, int:
 		return INT64
 	case float64:
 		return FLOAT64
@@ -0,0 +1,149 @@
+package rmdb
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queryNames(t *testing.T, db *Database, sql string) []string {
+	res, err := db.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(res.result))
+	for _, line := range res.result {
+		names = append(names, FormatData(line.nameToVal["name"].value, STRING))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestNull(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, table.SetColumn("name", STRING))
+	assert.Nil(t, table.SetColumn("city", STRING))
+	assert.Nil(t, table.SetColumn("age", INT64))
+	assert.Nil(t, db.Update(`insert into test (name, city, age) values ("a", "x", 1)`))
+	assert.Nil(t, db.Update(`insert into test (name, city) values ("b", "x")`)) // 没有给值的列是NULL
+	assert.Nil(t, db.Update(`insert into test (name, city, age) values ("c", null, NULL)`))
+	assert.Nil(t, db.Update(`insert into test (name, city, age) values ("d", "", 4)`))
+
+	assert.Equal(t, []string{"b", "c"}, queryNames(t, db, "select * from test where age is null"))
+	assert.Equal(t, []string{"a", "d"}, queryNames(t, db, "select * from test where age IS NOT NULL"))
+	assert.Equal(t, []string{"c"}, queryNames(t, db, "select * from test where age is null, city is null"))
+
+	gotNil := false
+	db.CondiFuncs["young"] = func(vals []any) bool {
+		gotNil = gotNil || vals[0] == nil
+		age, ok := vals[0].(int64)
+		return ok && age < 3
+	}
+	db.CondiFuncs["unknownAge"] = func(vals []any) bool { // 把NULL当成true的函数
+		return vals[0] == nil
+	}
+	assert.Equal(t, []string{"a"}, queryNames(t, db, "select * from test where young(age)"))
+	assert.True(t, gotNil, "null should be passed to functions as nil")
+	assert.Equal(t, []string{"b", "c"}, queryNames(t, db, "select * from test where unknownAge(age)"))
+
+	assert.Nil(t, db.Update(`update test set age = null where name is not null`))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, queryNames(t, db, "select * from test where age is null"))
+	assert.Nil(t, db.Update(`update test set age = 7 where age is null`))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from test where age is null")))
+	assert.Nil(t, db.Update(`update test set age = null where unknownAge(city)`))
+
+	db.AggFuncs["count"] = func(vals []any) any {
+		count := int64(0)
+		for _, val := range vals {
+			if val != nil {
+				count++
+			}
+		}
+		return count
+	}
+	db.AggFuncs["nothing"] = func(vals []any) any {
+		return nil
+	}
+	res, err := db.Query("select city, count(age) as cnt, nothing(name) as none from test group by city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make(map[string]string, 4)
+	for _, line := range res.result {
+		city := FormatData(line.nameToVal["city"].value, STRING)
+		groups[city] = FormatData(line.nameToVal["cnt"].value, line.nameToVal["cnt"].column.TypeOf)
+		assert.True(t, line.nameToVal["none"].IsNull(), "aggregation returning nil should be NULL")
+	}
+	assert.Equal(t, map[string]string{"x": "2", "": "1", "NULL": "0"}, groups, "NULL and empty string should be different groups")
+
+	checkStored := func() {
+		res, err := db.Query("select * from test where city is null")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, res.result, 1) {
+			line := res.result[0]
+			assert.Equal(t, "c", FormatData(line.nameToVal["name"].value, STRING))
+			assert.True(t, line.nameToVal["age"].IsNull())
+		}
+		assert.Equal(t, []string{"a", "b", "d"}, queryNames(t, db, "select * from test where city is not null, age is not null"))
+	}
+	checkStored()
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CondiFuncs["unknownAge"] = func(vals []any) bool {
+		return vals[0] == nil
+	}
+	checkStored() // 换出到文件再读回来，NULL仍然是NULL
+	assert.Nil(t, db.Close())
+}
+
+func TestNullTruth(t *testing.T) {
+	line := &Line{nameToVal: map[string]ColVal{
+		"age": {column: Column{Name: "age", TypeOf: INT64}},
+	}}
+	compiler := &exprCompiler{db: &Database{CondiFuncs: map[string]func([]any) bool{
+		"never": func(vals []any) bool { return false },
+	}}}
+	conditions := func(sqls ...string) []evalFunc {
+		funcs := make([]evalFunc, 0, len(sqls))
+		for _, sql := range sqls {
+			where := mustSelect(t, "select * from t where "+sql).Where
+			f, err := compiler.compile(where[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			funcs = append(funcs, f)
+		}
+		return funcs
+	}
+	eval := func(sqls ...string) truth {
+		result, err := evalTruth(line, conditions(sqls...))
+		assert.Nil(t, err)
+		return result
+	}
+	assert.Equal(t, truthUnknown, eval("never(age)"), "comparison with NULL is unknown")
+	assert.Equal(t, truthFalse, eval("age is not null"), "is not null is never unknown")
+	assert.Equal(t, truthTrue, eval("age is null"))
+	assert.Equal(t, truthFalse, eval("never(age)", "age is not null"), "unknown and false is false")
+	assert.Equal(t, truthUnknown, eval("age is null", "never(age)"), "true and unknown is unknown")
+	assert.Equal(t, truthTrue, eval("age > 1 or age is null"), "unknown or true is true")
+	assert.Equal(t, truthUnknown, eval("not age = 1"), "not unknown is unknown")
+	assert.Equal(t, truthUnknown, eval("age in (1, 2)"))
+	assert.Equal(t, truthUnknown, eval("1 in (2, age)"), "no match with a NULL in the list is unknown")
+	assert.Equal(t, truthTrue, eval("1 in (age, 1)"))
+	assert.Equal(t, "NULL", FormatData(nil, INT64))
+}
@@ -3,18 +3,28 @@ package rmdb
 import (
 	"os"
 	"sync"
+	"time"
 )
 
 type Option struct {
-	Root             string
-	IOMode           int
-	CondiFuncs       map[string]func([]any) bool
-	ColFuncs         map[string]func(any) any
-	AggFuncs         map[string]func([]any) any
-	ExecFuncs        map[string]func([]any) any
-	MmapSize         int64
-	MaxPage, MaxLine uint64
-	lock             sync.RWMutex // 全局锁，意味着要想并发安全，全局必须之使用一个数据库变量
+	Root               string
+	IOMode             int
+	Backend            string // 存储后端的名字，为空时按IOMode选择standard或mmap
+	CondiFuncs         map[string]func([]any) bool
+	ColFuncs           map[string]func(any) any
+	AggFuncs           map[string]func([]any) any
+	Aggregates         map[string]Aggregate // 增量计算的聚合函数，同名时AggFuncs优先
+	ExecFuncs          map[string]func([]any) any
+	MmapSize           int64
+	MaxPage, MaxLine   uint64
+	IndexFanout        uint64        // B+tree节点最多的项数
+	Durability         int           // 新建和打开数据库时默认的持久化模式
+	GroupCommitWindow  time.Duration // group commit时leader等待其它事务的时间
+	FlushInterval      time.Duration // async commit时后台fsync的间隔
+	CheckpointInterval time.Duration // 后台checkpoint的间隔，小于等于0时不启动
+	SortBufferSize     int64         // order by在内存中最多缓存的字节数，超过时排好序的行写到临时文件，小于等于0时不限制
+	AggBufferSize      int64         // group by在内存中最多缓存的字节数，超过时各组的状态写到分区文件，小于等于0时不限制
+	lock               sync.RWMutex  // 全局锁，意味着要想并发安全，全局必须之使用一个数据库变量
 }
 
 const (
@@ -22,17 +32,31 @@ const (
 	MMapMode
 )
 
+const (
+	SyncCommit  = iota // 每次commit都fsync
+	GroupCommit        // 并发commit的事务合并成一次fsync
+	AsyncCommit        // commit不等待，后台定期fsync
+)
+
 var (
 	GlobalOption = &Option{
-		Root:       "E:\\golangProject\\demo2\\dbtest",
-		IOMode:     Standard,
-		CondiFuncs: make(map[string]func([]any) bool, 64),
-		ColFuncs:   make(map[string]func(any) any, 64),
-		AggFuncs:   make(map[string]func([]any) any, 64),
-		ExecFuncs:  make(map[string]func([]any) any, 64),
-		MmapSize:   16 * MIB,
-		MaxPage:    4,
-		MaxLine:    4,
+		Root:               "E:\\golangProject\\demo2\\dbtest",
+		IOMode:             Standard,
+		CondiFuncs:         make(map[string]func([]any) bool, 64),
+		ColFuncs:           make(map[string]func(any) any, 64),
+		AggFuncs:           make(map[string]func([]any) any, 64),
+		Aggregates:         make(map[string]Aggregate, 64),
+		ExecFuncs:          make(map[string]func([]any) any, 64),
+		MmapSize:           16 * MIB,
+		MaxPage:            4,
+		MaxLine:            4,
+		IndexFanout:        64,
+		Durability:         SyncCommit,
+		GroupCommitWindow:  2 * time.Millisecond,
+		FlushInterval:      100 * time.Millisecond,
+		CheckpointInterval: time.Minute,
+		SortBufferSize:     32 * MIB,
+		AggBufferSize:      32 * MIB,
 	}
 	databases = make(map[string]*Database, 128)
 	logger    = NewLogger(os.Stderr, "")
@@ -50,6 +74,10 @@ func (o *Option) SetAggFunc(name string, function func([]any) any) {
 	o.AggFuncs[name] = function
 }
 
+func (o *Option) SetAggregate(name string, aggregate Aggregate) {
+	o.Aggregates[name] = aggregate
+}
+
 func (o *Option) SetExecFunc(name string, function func([]any) any) {
 	o.ExecFuncs[name] = function
 }
@@ -1,17 +1,45 @@
 package rmdb
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 )
 
+// page在文件中的格式，小端序：
+// | magic "RMPG" (4) | version (1) | pageId (8) | length (4) | crc32 (4) | lines (length) |
+// crc32覆盖version到length以及全部line，没有magic的是加校验之前写入的旧page，只有目录中标记为Legacy的表才有
+// 版本3的每一行是 | line长度 uvarint | schema版本 uvarint | 列数 uvarint | null位图 | 非null的值 |，STRING值前面有uvarint长度
+// 版本2的行没有schema版本，按表的第0个版本解码
+// 版本1和没有magic的旧page每一行和每个值都有8字节长度前缀，值是json，读出来之后会标记为脏页，换出时按新格式重写
+
+const (
+	pageMagic      = "RMPG"
+	pageVersion    = 3
+	pageHeaderSize = 21
+)
+
+type CorruptionError struct {
+	Table  string
+	PageId uint64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("page %d of table %s is corrupted: %s", e.PageId, e.Table, e.Reason)
+}
+
 type Page struct {
 	Id             uint64
 	columns        []Column
+	version        uint64              // columns的schema版本，新写入的行记录这个版本
+	schemas        map[uint64][]Column // 表的旧版本，旧的行按写入时的列解码
 	lines          map[uint64]Line
 	max            uint64
 	Offset, Length uint64
 	isDirty        bool
+	legacy         bool // 接受没有页头的旧page
 }
 
 type Memtable struct {
@@ -23,6 +51,8 @@ func (l *LruCache) NewPage() (*Page, error) {
 	page := &Page{
 		Id:      l.pageId,
 		columns: l.table.Columns,
+		version: l.table.Version,
+		schemas: l.table.Schemas,
 		lines:   make(map[uint64]Line, 16),
 		max:     l.maxLine,
 		Length:  0,
@@ -56,63 +86,322 @@ func (p *Page) EncodePage() []byte {
 	if len(p.lines) == 0 {
 		return []byte{}
 	}
-	buf := new(bytes.Buffer)
+	data := make([]byte, pageHeaderSize, 256)
 	for i := uint64(0); i < p.max; i++ {
 		if line, ok := p.lines[i]; ok {
-			data := p.EncodeLine(line)
-			length := make([]byte, 8)
-			binary.LittleEndian.PutUint64(length, uint64(len(data)))
-			buf.Write(length)
-			buf.Write(data)
+			encoded := p.EncodeLine(line)
+			data = binary.AppendUvarint(data, uint64(len(encoded)))
+			data = append(data, encoded...)
 		}
 	}
-	return buf.Bytes()
+	copy(data[0:4], pageMagic)
+	data[4] = pageVersion
+	binary.LittleEndian.PutUint64(data[5:13], p.Id)
+	binary.LittleEndian.PutUint32(data[13:17], uint32(len(data)-pageHeaderSize))
+	binary.LittleEndian.PutUint32(data[17:21], pageChecksum(data))
+	return data
 }
 
-func (p *Page) DecodePage(data []byte) {
-	offset := uint64(0)
-	for offset < uint64(len(data)) {
-		lendata := data[offset : offset+8]
-		length := binary.LittleEndian.Uint64(lendata)
-		offset += 8
-		lineData := data[offset : offset+length]
-		line := p.DecodeLine(lineData)
-		p.InsertLine(line)
-		offset += length
+func pageChecksum(data []byte) uint32 {
+	crc := crc32.ChecksumIEEE(data[4:17])
+	return crc32.Update(crc, crc32.IEEETable, data[pageHeaderSize:])
+}
+
+// DecodePage 返回page是否是旧格式，旧格式的page需要重写
+func (p *Page) DecodePage(data []byte) (bool, error) {
+	version, payload, err := pagePayload(p.Id, data, p.legacy)
+	if err != nil {
+		return false, err
+	}
+	lines, err := splitLines(version, payload)
+	if err != nil {
+		return false, err
+	}
+	for _, data := range lines {
+		vals, err := p.rowValues(version, data)
+		if err != nil {
+			return false, err
+		}
+		line := p.newLine(vals)
+		for !p.InsertLine(line) { // maxLine调小之后旧page的行数可能超过max
+			p.max++
+		}
 	}
+	return version != pageVersion, nil
 }
 
-func (p *Page) EncodeLine(line Line) []byte {
-	buf := new(bytes.Buffer)
-	for _, column := range p.columns {
-		length := make([]byte, 8)
-		val := line.nameToVal[column.Name].value
-		binary.LittleEndian.PutUint64(length, uint64(len(val)))
-		buf.Write(length)
-		buf.Write(val)
+// pagePayload 校验页头并返回版本号和line部分，legacy时接受没有页头的旧page，版本号为0
+func pagePayload(id uint64, data []byte, legacy bool) (byte, []byte, error) {
+	if len(data) < len(pageMagic) || string(data[:len(pageMagic)]) != pageMagic {
+		if !legacy {
+			return 0, nil, errors.New("missing page header")
+		}
+		return 0, data, nil
+	}
+	if len(data) < pageHeaderSize {
+		return 0, nil, errors.New("truncated page header")
+	}
+	version := data[4]
+	if version == 0 || version > pageVersion {
+		return 0, nil, fmt.Errorf("unsupported page version %d", version)
 	}
-	return buf.Bytes()
+	if found := binary.LittleEndian.Uint64(data[5:13]); found != id {
+		return 0, nil, fmt.Errorf("page id mismatch, found page %d", found)
+	}
+	if length := binary.LittleEndian.Uint32(data[13:17]); int(length) != len(data)-pageHeaderSize {
+		return 0, nil, fmt.Errorf("page length mismatch, header says %d but read %d", length, len(data)-pageHeaderSize)
+	}
+	if pageChecksum(data) != binary.LittleEndian.Uint32(data[17:21]) {
+		return 0, nil, errors.New("checksum mismatch")
+	}
+	return version, data[pageHeaderSize:], nil
+}
+
+// splitLines 把page切成line，版本2用uvarint长度前缀，之前的版本用8字节长度前缀
+func splitLines(version byte, payload []byte) ([][]byte, error) {
+	if version < 2 {
+		return splitBlocks(payload)
+	}
+	lines := make([][]byte, 0, 16)
+	for len(payload) > 0 {
+		length, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, errors.New("invalid line length")
+		}
+		payload = payload[n:]
+		if length > uint64(len(payload)) {
+			return nil, fmt.Errorf("line length %d exceeds remaining %d bytes", length, len(payload))
+		}
+		lines = append(lines, payload[:length])
+		payload = payload[length:]
+	}
+	return lines, nil
 }
 
-func (p *Page) DecodeLine(data []byte) Line {
-	vals := make([][]byte, 0, 16)
+// splitBlocks 按8字节长度前缀切分，旧格式的page切成line，line切成列值
+func splitBlocks(data []byte) ([][]byte, error) {
+	blocks := make([][]byte, 0, 16)
 	offset := uint64(0)
 	for offset < uint64(len(data)) {
-		lendata := data[offset : offset+8]
-		length := binary.LittleEndian.Uint64(lendata)
+		if uint64(len(data))-offset < 8 {
+			return nil, errors.New("truncated length prefix")
+		}
+		length := binary.LittleEndian.Uint64(data[offset : offset+8])
 		offset += 8
-		val := data[offset : offset+length]
-		vals = append(vals, val)
+		if length > uint64(len(data))-offset {
+			return nil, fmt.Errorf("length %d exceeds remaining %d bytes", length, uint64(len(data))-offset)
+		}
+		blocks = append(blocks, data[offset:offset+length])
 		offset += length
 	}
+	return blocks, nil
+}
+
+// rowSchema 返回行写入时的schema版本和之后的部分，版本3之前的行没有记录版本
+func rowSchema(version byte, data []byte) (uint64, []byte, error) {
+	if version < 3 {
+		return 0, data, nil
+	}
+	schema, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid schema version")
+	}
+	return schema, data[n:], nil
+}
+
+// schemaColumns 返回某个schema版本的列，current是version版本的列
+func schemaColumns(current []Column, version uint64, schemas map[uint64][]Column, schema uint64) ([]Column, error) {
+	if schema == version {
+		return current, nil
+	}
+	columns, ok := schemas[schema]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema version %d", schema)
+	}
+	return columns, nil
+}
+
+// rowValues 解析一行，旧版本的行逐个版本按列id映射到当前的列
+func (p *Page) rowValues(version byte, data []byte) ([][]byte, error) {
+	schema, data, err := rowSchema(version, data)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := schemaColumns(p.columns, p.version, p.schemas, schema)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := lineValues(version, data, columns)
+	if err != nil {
+		return nil, err
+	}
+	for ; schema < p.version; schema++ { // 类型可能改过多次，每次只按那一次的修改转换
+		next, err := schemaColumns(p.columns, p.version, p.schemas, schema+1)
+		if err != nil {
+			return nil, err
+		}
+		vals, err = mapColumns(vals, columns, next)
+		if err != nil {
+			return nil, err
+		}
+		columns = next
+	}
+	return vals, nil
+}
+
+// mapColumns 把按from解码的值映射到to，删掉的列丢弃，新加的列用默认值，改了类型的列转换类型
+func mapColumns(vals [][]byte, from, to []Column) ([][]byte, error) {
+	mapped := make([][]byte, len(to))
+	for i, column := range to {
+		mapped[i] = column.DefVal
+		for j, old := range from {
+			if old.Id != column.Id {
+				continue
+			}
+			value := old.DefVal
+			if j < len(vals) {
+				value = vals[j]
+			}
+			var err error
+			mapped[i], err = convertData(value, old.TypeOf, column.TypeOf)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			break
+		}
+	}
+	return mapped, nil
+}
+
+// lineValues 按列类型解析一行，返回每一列编码后的值，旧格式的json值会被转换成新的编码
+// 返回的值可能比列少，说明这一行是加列之前写入的
+func lineValues(version byte, data []byte, columns []Column) ([][]byte, error) {
+	if version < 2 {
+		vals, err := splitBlocks(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) > len(columns) {
+			return nil, fmt.Errorf("line has %d values but table has %d columns", len(vals), len(columns))
+		}
+		for i, val := range vals {
+			decoded, err := decodeJSON(val, columns[i].TypeOf)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", columns[i].Name, err)
+			}
+			vals[i], err = EncodeData(decoded)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	}
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid column count")
+	}
+	if count > uint64(len(columns)) {
+		return nil, fmt.Errorf("line has %d values but table has %d columns", count, len(columns))
+	}
+	data = data[n:]
+	bitmap := int(count+7) / 8
+	if len(data) < bitmap {
+		return nil, errors.New("truncated null bitmap")
+	}
+	nulls := data[:bitmap]
+	data = data[bitmap:]
+	vals := make([][]byte, count)
+	for i := 0; i < int(count); i++ {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		size, err := valueSize(data, columns[i].TypeOf)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", columns[i].Name, err)
+		}
+		if columns[i].TypeOf == STRING { // 跳过长度前缀
+			_, n := binary.Uvarint(data)
+			vals[i] = data[n:size]
+		} else {
+			vals[i] = data[:size]
+		}
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after values", len(data))
+	}
+	return vals, nil
+}
+
+func valueSize(data []byte, typeOf int) (int, error) { // 值在page中占用的字节数
+	switch typeOf {
+	case BOOL:
+		if len(data) < 1 {
+			return 0, errors.New("truncated bool value")
+		}
+		return 1, nil
+	case INT64, DATE:
+		_, n := binary.Varint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid varint value")
+		}
+		return n, nil
+	case FLOAT64:
+		if len(data) < 8 {
+			return 0, errors.New("truncated float64 value")
+		}
+		return 8, nil
+	case STRING:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return 0, errors.New("invalid string length")
+		}
+		return n + int(length), nil
+	default:
+		return 0, fmt.Errorf("unsupported type %d", typeOf)
+	}
+}
+
+func (p *Page) newLine(vals [][]byte) Line {
 	line := Line{
 		nameToVal: make(map[string]ColVal, 16), //pageid和lineid会在insert page时设置
 	}
 	for index, column := range p.columns {
+		value := column.DefVal // 加列之前写入的行没有新列的值
+		if index < len(vals) {
+			value = vals[index]
+		}
 		line.nameToVal[column.Name] = ColVal{
 			column: column,
-			value:  vals[index],
+			value:  value,
 		}
 	}
 	return line
 }
+
+func (p *Page) EncodeLine(line Line) []byte {
+	data := binary.AppendUvarint(make([]byte, 0, 64), p.version)
+	data = binary.AppendUvarint(data, uint64(len(p.columns)))
+	bitmap := len(data)
+	data = append(data, make([]byte, (len(p.columns)+7)/8)...)
+	for i, column := range p.columns {
+		val := line.nameToVal[column.Name].value
+		if val == nil { // NULL只在位图中记一位，不写值
+			data[bitmap+i/8] |= 1 << (i % 8)
+			continue
+		}
+		if column.TypeOf == STRING {
+			data = binary.AppendUvarint(data, uint64(len(val)))
+		}
+		data = append(data, val...)
+	}
+	return data
+}
+
+func (p *Page) DecodeLine(data []byte) (Line, error) {
+	vals, err := p.rowValues(pageVersion, data)
+	if err != nil {
+		return Line{}, err
+	}
+	return p.newLine(vals), nil
+}
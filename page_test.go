@@ -0,0 +1,182 @@
+package rmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPage(id uint64, columns []Column) *Page {
+	return &Page{Id: id, columns: columns, lines: make(map[uint64]Line, 16), max: 4}
+}
+
+func TestPageEncode(t *testing.T) {
+	columns := []Column{{Name: "name", TypeOf: STRING}, {Name: "age", TypeOf: INT64}}
+	page := newTestPage(3, columns)
+	for i := 0; i < 3; i++ {
+		name, _ := EncodeData(fmt.Sprint("name", i))
+		age, _ := EncodeData(int64(i))
+		page.InsertLine(Line{nameToVal: map[string]ColVal{
+			"name": {column: columns[0], value: name},
+			"age":  {column: columns[1], value: age},
+		}})
+	}
+	data := page.EncodePage()
+	assert.Equal(t, pageMagic, string(data[:4]))
+	assert.Equal(t, byte(pageVersion), data[4])
+	// 每行：长度1 + schema版本1 + 列数1 + 位图1 + 字符串长度1 + "nameN"5 + varint 1
+	assert.Equal(t, pageHeaderSize+3*11, len(data))
+
+	decoded := newTestPage(3, columns)
+	legacy, err := decoded.DecodePage(data)
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+	assert.Len(t, decoded.lines, 3)
+	assert.Equal(t, []byte("name2"), decoded.lines[2].nameToVal["name"].value)
+	age, err := DecodeData(decoded.lines[2].nameToVal["age"].value, INT64)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), age)
+
+	_, err = newTestPage(4, columns).DecodePage(data)
+	assert.NotNil(t, err, "page written for another id should be rejected")
+
+	for _, index := range []int{4, 10, 15, 19, pageHeaderSize + 3, len(data) - 1} {
+		broken := append([]byte{}, data...)
+		broken[index] ^= 0xff
+		_, err = newTestPage(3, columns).DecodePage(broken)
+		assert.NotNil(t, err, fmt.Sprint("flipped byte ", index, " should be detected"))
+	}
+	_, err = newTestPage(3, columns).DecodePage(data[:len(data)-2])
+	assert.NotNil(t, err, "truncated page should be detected")
+}
+
+func TestPageLegacy(t *testing.T) {
+	columns := []Column{{Name: "name", TypeOf: STRING}, {Name: "age", TypeOf: INT64}, {Name: "born", TypeOf: DATE}}
+	for i := range columns {
+		columns[i].DefVal, _ = defaultValue(columns[i].TypeOf)
+	}
+	born := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	bornJSON, _ := born.MarshalJSON()
+	block := func(data []byte) []byte { // 旧格式的8字节长度前缀
+		return append(binary.LittleEndian.AppendUint64(nil, uint64(len(data))), data...)
+	}
+	payload := make([]byte, 0, 256)
+	for i := 0; i < 3; i++ {
+		line := block([]byte(fmt.Sprintf(`"name%d"`, i)))
+		line = append(line, block([]byte(fmt.Sprint(i*10)))...)
+		line = append(line, block(bornJSON)...)
+		payload = append(payload, block(line)...)
+	}
+	shortLine := block(block([]byte(`"old"`))) // 加列之前写入的行
+	payload = append(payload, shortLine...)
+
+	v1 := make([]byte, pageHeaderSize, pageHeaderSize+len(payload))
+	v1 = append(v1, payload...)
+	copy(v1[0:4], pageMagic)
+	v1[4] = 1
+	binary.LittleEndian.PutUint64(v1[5:13], 7)
+	binary.LittleEndian.PutUint32(v1[13:17], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(v1[17:21], pageChecksum(v1))
+
+	_, err := newTestPage(7, columns).DecodePage(payload)
+	if assert.NotNil(t, err, "table created after checksums must not hold pages without header") {
+		assert.Equal(t, "missing page header", err.Error())
+	}
+	for _, data := range [][]byte{payload, v1} { // 没有页头的和版本1的page
+		page := newTestPage(7, columns)
+		page.legacy = true
+		legacy, err := page.DecodePage(data)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.True(t, legacy, "json page should be rewritten")
+		assert.Len(t, page.lines, 4)
+		assert.Equal(t, "name1", FormatData(page.lines[1].nameToVal["name"].value, STRING))
+		assert.Equal(t, "10", FormatData(page.lines[1].nameToVal["age"].value, INT64))
+		val, err := DecodeData(page.lines[1].nameToVal["born"].value, DATE)
+		assert.Nil(t, err)
+		assert.True(t, born.Equal(val.(time.Time)))
+		assert.Equal(t, "old", FormatData(page.lines[3].nameToVal["name"].value, STRING))
+		assert.Equal(t, "0", FormatData(page.lines[3].nameToVal["age"].value, INT64), "missing column should use default value")
+
+		migrated := newTestPage(7, columns)
+		legacy, err = migrated.DecodePage(page.EncodePage())
+		assert.Nil(t, err)
+		assert.False(t, legacy)
+		assert.Equal(t, page.lines[1].nameToVal["born"].value, migrated.lines[1].nameToVal["born"].value)
+		assert.True(t, len(page.EncodePage()) < len(v1), "binary page should be smaller than json page")
+	}
+
+	broken := append([]byte{}, payload...)
+	binary.LittleEndian.PutUint64(broken[0:8], uint64(len(payload))) // 行长度越界不能panic
+	page := newTestPage(7, columns)
+	page.legacy = true
+	_, err = page.DecodePage(broken)
+	assert.NotNil(t, err)
+	broken = block(append(block([]byte(`"x"`)), block([]byte(`"not a number"`))...))
+	page = newTestPage(7, columns)
+	page.legacy = true
+	_, err = page.DecodePage(broken)
+	assert.NotNil(t, err, "json value of the wrong type should be rejected")
+}
+
+func TestPageCorruption(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = db.Update(fmt.Sprintf(`insert into test (name) values ("name%d")`, i))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	table.cache.lock.Lock()
+	err = table.Close() // 清空缓存，之后的查询要从文件读page
+	table.cache.lock.Unlock()
+	assert.Nil(t, err)
+	res, err := db.Query("select * from test")
+	if assert.Nil(t, err) {
+		assert.Len(t, res.result, 5)
+	}
+
+	page := table.Catalog[1]
+	file, err := os.OpenFile(table.file.Name(), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	offset := int64(page.Offset + page.Length - 1)
+	_, err = file.ReadAt(buf, offset)
+	assert.Nil(t, err)
+	buf[0] ^= 0xff
+	_, err = file.WriteAt(buf, offset)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	table.cache.lock.Lock()
+	err = table.Close()
+	table.cache.lock.Unlock()
+	assert.Nil(t, err)
+
+	_, err = db.Query("select * from test")
+	var corruption *CorruptionError
+	if assert.True(t, errors.As(err, &corruption), fmt.Sprint("query should fail with corruption error, got ", err)) {
+		assert.Equal(t, "test", corruption.Table)
+		assert.Equal(t, uint64(1), corruption.PageId)
+	}
+}
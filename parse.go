@@ -1,52 +1,23 @@
 package rmdb
 
 import (
-	"bytes"
 	"errors"
-	"regexp"
-	"sort"
-	"strconv"
-	"strings"
+	"fmt"
 	"sync"
 )
 
-func ConvertQuery(sql string) []string {
-
-	tokens := []string{"select", "distinct", "from", "where", "group by", "having", "order by", "limit"} //group by和order by中间只能有一个空格
-
-	pattern := "(?i)\\b(" + strings.Join(tokens, "|") + ")\\b"
-	reg := regexp.MustCompile(pattern)
-	newsql := reg.ReplaceAllStringFunc(sql, func(match string) string {
-		return strings.ToLower(match)
-	})
-	indexs := make([]int, 0, 64)
-	for _, token := range tokens {
-		reg = regexp.MustCompile(token)
-		matches := reg.FindAllStringIndex(newsql, -1)
-		for _, match := range matches {
-			indexs = append(indexs, match[0])
-			indexs = append(indexs, match[0]+len(token))
-		}
+func newBasePlan(wg *sync.WaitGroup) basePlan {
+	return basePlan{
+		wg:          wg,
+		parentlines: make(chan *Line, 64),
+		isConfig:    true,
 	}
-	indexs = append(indexs, len(newsql))
-	sort.Ints(indexs)
-	slice := make([]string, 0, 16)
-	for i := 0; i < len(indexs)-1; i++ {
-		part := strings.TrimSpace(newsql[indexs[i]:indexs[i+1]])
-		if part != "" {
-			slice = append(slice, part)
-		}
-	}
-	return slice
 }
 
-func (t *Transaction) CompileQuery(slice []string, wg *sync.WaitGroup) (map[int]Plan, []string, string, error) {
+// CompileQuery 把select语句编译成各个plan，返回输出列的顺序和表名
+func (t *Transaction) CompileQuery(stmt *SelectStmt, wg *sync.WaitGroup) (map[int]Plan, []string, string, error) {
 	pjp := &ProjectionPlan{
-		basePlan: basePlan{
-			wg:          wg,
-			parentlines: make(chan *Line, 64),
-			isConfig:    true,
-		},
+		basePlan: newBasePlan(wg),
 		colNames: make(map[string]struct{}, 64),
 	}
 	agp := &AggregationPlan{
@@ -54,453 +25,641 @@ func (t *Transaction) CompileQuery(slice []string, wg *sync.WaitGroup) (map[int]
 			wg:          wg,
 			parentlines: make(chan *Line, 64),
 		},
-		aggFuncs: make(map[string]func([]any) any, 64),
+		aggFuncs: make(map[string]Aggregate, 8),
+		backend:  t.db.backend,
+		dir:      t.db.dbPath,
+		budget:   GlobalOption.AggBufferSize,
 	}
 
 	plans := make(map[int]Plan, 16)
 	outOuder := make([]string, 0, 16)
-	var tableName string
+	tableName := stmt.Table
+	var columns []Column // 为nil时不检查表达式中的列名，读表时也读不到行
+	if table := t.db.tables[tableName]; table != nil {
+		columns = table.Columns
+	}
 
-	for i := 0; i < len(slice); i += 2 {
-		switch slice[i] {
-		case "select":
-			if slice[i+1] == "distinct" {
-				dtp := &DistinctPlan{
-					basePlan: basePlan{
-						wg:          wg,
-						parentlines: make(chan *Line, 64),
-						isConfig:    true,
-					},
-				}
-				plans[Distinct] = dtp
-				i += 1
+	if stmt.Distinct {
+		plans[Distinct] = &DistinctPlan{basePlan: newBasePlan(wg)}
+	}
+	rnp := &RenamePlan{
+		basePlan: newBasePlan(wg),
+		oldToNew: make(map[string]string),
+	}
+	fcp := &FuncColPlan{basePlan: newBasePlan(wg)}
+	computed := make(map[string]struct{}, 8)
+	for _, field := range stmt.Fields {
+		switch expr := field.Expr.(type) {
+		case *Star:
+			if columns == nil {
+				return nil, nil, "", errors.New("invalid table name")
 			}
-			reg := regexp.MustCompile(`(?:[^,(]|\([^)]*\))+`)
-			parts := reg.FindAllString(slice[i+1], -1)
-			rnp := &RenamePlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-					isConfig:    true,
-				},
-				oldToNew: make(map[string]string),
+			for _, column := range columns {
+				pjp.colNames[column.Name] = struct{}{}
+				outOuder = append(outOuder, column.Name)
 			}
-			for _, part := range parts {
-				part = TrimSpace(part)
-				if strings.Contains(part, "(") {
-					var funcName string
-					var colNames []string
-					if strings.Contains(part, "as") {
-						split := strings.Split(part, "as")
-						openIndex := strings.IndexByte(split[0], '(')
-						closeIndex := strings.LastIndexByte(split[0], ')')
-						funcName = split[0][:openIndex]
-						args := split[0][openIndex+1 : closeIndex]
-						colNames = strings.Split(args, ",")
-						oldName := NewColName(funcName, colNames...)
-						rnp.oldToNew[oldName] = split[1]
-						outOuder = append(outOuder, split[1])
-					} else {
-						openIndex := strings.IndexByte(part, '(')
-						closeIndex := strings.LastIndexByte(part, ')')
-						funcName = part[:openIndex]
-						args := part[openIndex+1 : closeIndex]
-						colNames = strings.Split(args, ",")
-						outOuder = append(outOuder, NewColName(funcName, colNames...))
-					}
-					if _, ok := t.db.ColFuncs[funcName]; ok {
-						fcp := &FuncColPlan{
-							basePlan: basePlan{
-								wg:          wg,
-								parentlines: make(chan *Line, 64),
-								isConfig:    true,
-							},
-							colFuncs: make(map[string]func(any) any, 64),
-						}
-						fcp.colToFuncs = append(fcp.colToFuncs, struct {
-							colName, funcName string
-						}{colName: colNames[0], funcName: funcName})
-						fcp.colFuncs[funcName] = t.db.ColFuncs[funcName]
-						plans[FuncCol] = fcp
-					}
-					if _, ok := t.db.AggFuncs[funcName]; ok {
-						agp.colToFuncs = append(agp.colToFuncs, struct {
-							colName, funcName string
-						}{colName: colNames[0], funcName: funcName})
-						agp.aggFuncs[funcName] = t.db.AggFuncs[funcName]
-					}
-					if _, ok := t.db.ExecFuncs[funcName]; ok {
-						etp := &ExecutePlan{
-							basePlan: basePlan{
-								wg:          wg,
-								parentlines: make(chan *Line, 64),
-								isConfig:    true,
-							},
-							execFuncs: make(map[string]func([]any) any, 64),
-						}
-						etp.colToFuncs = append(etp.colToFuncs, struct {
-							colNames []string
-							funcName string
-						}{colNames: colNames, funcName: funcName})
-						etp.execFuncs[funcName] = t.db.ExecFuncs[funcName]
-						plans[Execute] = etp
-					}
-					for _, val := range colNames {
-						pjp.colNames[val] = struct{}{}
-					}
-				} else if part == "*" {
-					tableName := strings.TrimSpace(slice[i+3])
-					table := t.db.tables[tableName]
-					if table == nil {
-						return nil, nil, "", errors.New("invalid table name")
-					}
-					for _, column := range table.Columns {
-						pjp.colNames[column.Name] = struct{}{}
-						outOuder = append(outOuder, column.Name)
-					}
-				} else {
-					pjp.colNames[part] = struct{}{}
-					outOuder = append(outOuder, part)
-				}
+		case *ColumnRef:
+			pjp.colNames[expr.Name] = struct{}{}
+			if field.Alias != "" {
+				rnp.oldToNew[expr.Name] = field.Alias
+				outOuder = append(outOuder, field.Alias)
+			} else {
+				outOuder = append(outOuder, expr.Name)
 			}
-			if len(rnp.oldToNew) != 0 {
-				plans[Rename] = rnp
+		default: // 聚合函数由AggregationPlan计算，其余的表达式由FuncColPlan计算
+			colName := expr.String()
+			if field.Alias != "" {
+				rnp.oldToNew[colName] = field.Alias
+				outOuder = append(outOuder, field.Alias)
+			} else {
+				outOuder = append(outOuder, colName)
 			}
-		case "from": //beta版本只支持单表操作
-			tableName = strings.TrimSpace(slice[i+1])
-			trp := &TableReadPlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-					isConfig:    true,
-				},
-				tx:        t,
-				tableName: tableName,
+			if err := t.addAggregates(agp, pjp, expr); err != nil {
+				return nil, nil, "", err
 			}
-			plans[TableRead] = trp
-		case "where":
-			str := TrimSpace(slice[i+1])
-			reg := regexp.MustCompile(`(?:[^,(]|\([^)]*\))+`)
-			parts := reg.FindAllString(str, -1)
-			slp := &SelectionPlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-					isConfig:    true,
-				},
-				selFuncs: make(map[string]func([]any) bool, 64),
+			if _, ok := computed[colName]; ok {
+				continue
 			}
-			for _, part := range parts {
-
-				openIndex := strings.IndexByte(part, '(')
-				closeIndex := strings.LastIndexByte(part, ')')
-				funcName := part[:openIndex]
-				args := part[openIndex+1 : closeIndex]
-				colNames := strings.Split(args, ",")
-				if _, ok := t.db.CondiFuncs[funcName]; ok {
-					slp.colToFuncs = append(slp.colToFuncs, struct {
-						colNames []string
-						funcName string
-					}{colNames: colNames, funcName: funcName})
-					slp.selFuncs[funcName] = t.db.CondiFuncs[funcName]
-					for _, val := range colNames {
-						pjp.colNames[val] = struct{}{}
-					}
-				} else {
-					return nil, nil, "", errors.New("invalid function name")
-				}
-			}
-			plans[Selection] = slp
-		case "group by":
-			parts := strings.Split(slice[i+1], ",")
-			colNames := make([]string, 0, 8)
-			for _, part := range parts {
-				val := strings.TrimSpace(part)
-				colNames = append(colNames, val)
-				pjp.colNames[val] = struct{}{}
+			compiler := &exprCompiler{db: t.db, columns: columns, aggregates: true}
+			eval, err := compiler.compile(expr)
+			if err != nil {
+				return nil, nil, "", err
 			}
-			agp.byCols = colNames
-			agp.isConfig = true
-			plans[Aggregation] = agp
-		case "having":
-
-			str := TrimSpace(slice[i+1])
-
-			reg := regexp.MustCompile(`(?:[^,(]|\([^)]*\))+`)
-			parts := reg.FindAllString(str, -1)
-
-			hvp := &HavingPlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-				},
-				havFuncs: make(map[string]func([]any) bool, 64),
+			if call, ok := expr.(*FuncCall); ok && t.db.isAggregate(call.Name) {
+				continue
 			}
+			computed[colName] = struct{}{}
+			fcp.fields = append(fcp.fields, computedField{name: colName, eval: eval})
+			addColumnRefs(pjp, expr)
+		}
+	}
+	if len(rnp.oldToNew) != 0 {
+		plans[Rename] = rnp
+	}
+	if len(fcp.fields) != 0 {
+		plans[FuncCol] = fcp
+	}
 
-			for _, part := range parts {
-
-				openIndex := strings.IndexByte(part, '(')
-				closeIndex := strings.LastIndexByte(part, ')')
-				funcName := part[:openIndex]
-				args := part[openIndex+1 : closeIndex]
-				colNames := strings.Split(args, ",")
+	trp := &TableReadPlan{ //beta版本只支持单表操作
+		basePlan:  newBasePlan(wg),
+		tx:        t,
+		tableName: tableName,
+	}
+	plans[TableRead] = trp
 
-				if _, ok := t.db.CondiFuncs[funcName]; ok {
-					hvp.colToFuncs = append(hvp.colToFuncs, struct {
-						colNames []string
-						funcName string
-					}{colNames: colNames, funcName: funcName})
-					hvp.havFuncs[funcName] = t.db.CondiFuncs[funcName]
-					hvp.isConfig = true
-				}
-			}
-			plans[Having] = hvp
-		case "order by":
-			stp := &SortingPlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-					isConfig:    true,
-				},
-				colNames: make([]string, 0, 64),
-			}
-			var str string
-			if strings.Contains(slice[i+1], "asc") {
-				stp.isAsc = true
-				str = "asc"
-			} else if strings.Contains(slice[i+1], "desc") {
-				stp.isAsc = false
-				str = "desc"
+	if len(stmt.Where) != 0 {
+		slp := &SelectionPlan{basePlan: newBasePlan(wg)}
+		compiler := &exprCompiler{db: t.db, columns: columns}
+		for _, condition := range stmt.Where {
+			eval, err := compiler.compile(condition)
+			if err != nil {
+				return nil, nil, "", err
 			}
-			split := strings.Split(slice[i+1], str)
-			parts := strings.Split(split[0], ",")
-			colNames := make([]string, 0, 8)
-			for _, part := range parts {
-				val := strings.TrimSpace(part)
-				colNames = append(colNames, val)
-				pjp.colNames[val] = struct{}{}
+			slp.conditions = append(slp.conditions, eval)
+			if pred, ok := predicateOf(condition); ok {
+				slp.predicates = append(slp.predicates, pred)
 			}
-			stp.colNames = colNames
-			plans[Sorting] = stp
-		case "limit":
-			parts := strings.Split(slice[i+1], ",")
-			if len(parts) != 2 {
-				return nil, nil, "", errors.New("invalid args")
+			if m, ok := matchOf(condition); ok {
+				if table := t.db.tables[tableName]; table != nil {
+					if err = table.weigh(m); err != nil {
+						return nil, nil, "", err
+					}
+				}
+				slp.matches = append(slp.matches, m)
 			}
-			offset, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+			addColumnRefs(pjp, condition)
+		}
+		plans[Selection] = slp
+		plans[TableRead] = t.accessPath(trp, slp.predicates, slp.matches)
+	}
+
+	if len(stmt.GroupBy) != 0 {
+		for _, colName := range stmt.GroupBy {
+			pjp.colNames[colName] = struct{}{}
+		}
+		agp.byCols = stmt.GroupBy
+		agp.isConfig = true
+		plans[Aggregation] = agp
+	}
+
+	if len(stmt.Having) != 0 {
+		hvp := &HavingPlan{
+			basePlan: basePlan{
+				wg:          wg,
+				parentlines: make(chan *Line, 64),
+			},
+		}
+		compiler := &exprCompiler{db: t.db, aggregates: true} // 可以用select中的别名，不检查列名
+		for _, condition := range stmt.Having {
+			eval, err := compiler.compile(condition)
 			if err != nil {
-				return nil, nil, "", errors.New("invalid offset")
+				continue // having中不认识的函数忽略，和之前一致
 			}
-			count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-			if err != nil {
-				return nil, nil, "", errors.New("invalid count")
+			if err = t.addAggregates(agp, pjp, condition); err != nil {
+				return nil, nil, "", err
 			}
-			ltp := &LimitPlan{
-				basePlan: basePlan{
-					wg:          wg,
-					parentlines: make(chan *Line, 64),
-					isConfig:    true,
-				},
-				offset: uint64(offset),
-				count:  uint64(count),
+			hvp.conditions = append(hvp.conditions, eval)
+			addColumnRefs(pjp, condition)
+			hvp.isConfig = true
+		}
+		plans[Having] = hvp
+	}
+	if len(agp.colToFuncs) != 0 && !agp.isConfig { // 没有group by的聚合，整张表是一组
+		agp.isConfig = true
+		plans[Aggregation] = agp
+	}
+
+	if len(stmt.OrderBy) != 0 {
+		stp := &SortingPlan{
+			basePlan: newBasePlan(wg),
+			keys:     make([]sortKey, 0, len(stmt.OrderBy)),
+			backend:  t.db.backend,
+			dir:      t.db.dbPath,
+			budget:   GlobalOption.SortBufferSize,
+		}
+		if stmt.Limit != nil && stmt.Limit.Count > 0 {
+			stp.topN = stmt.Limit.Offset + stmt.Limit.Count
+		}
+		for _, item := range stmt.OrderBy {
+			colName := item.Expr.String()
+			if column, ok := item.Expr.(*ColumnRef); ok { // 行中的列名不带反引号
+				colName = column.Name
 			}
-			plans[Limit] = ltp
-		default:
+			stp.keys = append(stp.keys, sortKey{
+				colName:    colName,
+				desc:       item.Desc,
+				nullsFirst: item.Nulls == NullsFirst || item.Nulls == NullsDefault && !item.Desc,
+			})
+			pjp.colNames[colName] = struct{}{}
+		}
+		plans[Sorting] = stp
+	}
+
+	if stmt.Limit != nil {
+		plans[Limit] = &LimitPlan{
+			basePlan: newBasePlan(wg),
+			offset:   stmt.Limit.Offset,
+			count:    stmt.Limit.Count,
 		}
 	}
 	plans[Projection] = pjp
 	return plans, outOuder, tableName, nil
 }
 
-func (t *Transaction) CompileUpdate(sql string) error {
-
-	if strings.HasPrefix(sql, "insert") { //`insert into test (name, age , id,price ) values  ( "aaa", 12,8, 3.14)`
-
-		slice := strings.SplitN(sql, "into", 2)
-		str := strings.TrimSpace(slice[1])
-
-		buf := new(bytes.Buffer)
-		var tableEnd int
-		for i := 0; i < len(str); i++ {
-			if str[i] == 0x20 {
-				tableEnd = i
-				break
+// addAggregates 表达式中的聚合函数加到AggregationPlan，结果是以函数调用为名的列，同一个函数调用只算一次
+func (t *Transaction) addAggregates(agp *AggregationPlan, pjp *ProjectionPlan, expr Expr) error {
+	var err error
+	walkExpr(expr, func(e Expr) bool {
+		call, ok := e.(*FuncCall)
+		if !ok || err != nil {
+			return err == nil
+		}
+		if !t.db.isAggregate(call.Name) {
+			return true
+		}
+		function, _ := t.db.aggregate(call.Name)
+		var colNames []string
+		if colNames, err = argNames(call); err != nil {
+			return false
+		}
+		if _, isCount := function.(countAggregate); colNames[0] == "*" && !isCount {
+			err = fmt.Errorf("%s(*) is not supported", call.Name)
+			return false
+		}
+		for _, colToFunc := range agp.colToFuncs {
+			if colToFunc.funcName == call.Name && colToFunc.colName == colNames[0] {
+				return false
 			}
-			buf.WriteByte(str[i])
 		}
-
-		tableName := str[:tableEnd]
-		table := t.db.tables[tableName]
-		table.updated = true
-
-		str = strings.TrimSpace(str[tableEnd:]) //`(name, age , id,price ) values  ( "aaa", 12,8, 3.14)`
-
-		buf = new(bytes.Buffer)
-		var valBegin int
-		for i := 1; i < len(str); i++ { //从1开始跳过(
-			if str[i] == 0x29 {
-				valBegin = i + 1
-				break
+		agp.colToFuncs = append(agp.colToFuncs, struct {
+			colName, funcName, name string
+		}{colName: colNames[0], funcName: call.Name, name: call.String()})
+		agp.aggFuncs[call.Name] = function
+		for _, val := range colNames {
+			if val != "*" {
+				pjp.colNames[val] = struct{}{}
 			}
-			buf.WriteByte(str[i])
 		}
+		return false
+	})
+	return err
+}
 
-		colStr := TrimSpace(buf.String()) //`name, age , id,price `
-		columns := strings.Split(colStr, ",")
+// addColumnRefs 表达式用到的列要经过ProjectionPlan
+func addColumnRefs(pjp *ProjectionPlan, expr Expr) {
+	walkExpr(expr, func(e Expr) bool {
+		if column, ok := e.(*ColumnRef); ok {
+			pjp.colNames[column.Name] = struct{}{}
+		}
+		return true
+	})
+}
 
-		str = str[valBegin:]
-		slice = strings.SplitN(str, "values", 2)
-		str = TrimSpace(slice[1])
-		valStr := str[1 : len(str)-1] //` "aaa", 12,8, 3.14`
-		valStr = TrimSpace(valStr)
-		values := strings.Split(valStr, ",")
-		if len(columns) != len(values) {
-			return errors.New("column names and values cannot match")
+// argNames 聚合函数的参数只能是列名，count(*)的参数是*
+func argNames(call *FuncCall) ([]string, error) {
+	colNames := make([]string, 0, len(call.Args))
+	for _, arg := range call.Args {
+		if _, ok := arg.(*Star); ok {
+			colNames = append(colNames, "*")
+			continue
+		}
+		column, ok := arg.(*ColumnRef)
+		if !ok {
+			return nil, fmt.Errorf("arguments of %s must be columns", call.Name)
 		}
+		colNames = append(colNames, column.Name)
+	}
+	if len(colNames) == 0 {
+		return nil, fmt.Errorf("%s needs at least one column", call.Name)
+	}
+	return colNames, nil
+}
 
-		colToVals := make(map[string]string, 64)
-		for index, colName := range columns {
-			colToVals[colName] = values[index]
+// predicateOf 列和字面量比较的条件是内置的比较条件，字面量按json的写法保存
+func predicateOf(condition Expr) (*predicate, bool) {
+	switch e := condition.(type) {
+	case *CompareExpr:
+		column, ok := e.Left.(*ColumnRef)
+		literal, isLiteral := e.Right.(*Literal)
+		if ok && isLiteral {
+			return &predicate{colName: column.Name, op: e.Op, literals: []string{literal.String()}}, true
 		}
-		line := Line{
-			nameToVal: make(map[string]ColVal, 16),
+	case *BetweenExpr:
+		column, ok := e.Expr.(*ColumnRef)
+		lower, isLower := e.Lower.(*Literal)
+		upper, isUpper := e.Upper.(*Literal)
+		if ok && isLower && isUpper && !e.Not { // not between是两段范围，用不上索引
+			return &predicate{colName: column.Name, op: "between", literals: []string{lower.String(), upper.String()}}, true
 		}
-		for _, column := range table.Columns {
-			if value, ok := colToVals[column.Name]; ok {
-				line.nameToVal[column.Name] = ColVal{
-					column: column,
-					value:  []byte(value),
+	}
+	return nil, false
+}
+
+// accessPath 根据where中的比较条件选择读表的方式：有主键 = 值时按主键查找，有索引前几列 = 值时按索引查找，
+// 接着的一列有范围条件时按索引扫描，有match并且列上有全文索引时按全文索引查找，用不上索引时读全表。读出的行还要经过SelectionPlan
+func (t *Transaction) accessPath(trp *TableReadPlan, predicates []*predicate, matches []*matchPredicate) Plan {
+	table := t.db.tables[trp.tableName]
+	if table == nil || len(predicates) == 0 && len(matches) == 0 {
+		return trp
+	}
+	equals := make(map[string]*predicate, len(predicates))
+	ranges := make(map[string][]*predicate, len(predicates))
+	for _, pred := range predicates {
+		if pred.op == "!=" { // 不等于用不上索引
+			continue
+		} else if pred.op != "=" {
+			ranges[pred.colName] = append(ranges[pred.colName], pred)
+		} else if _, ok := equals[pred.colName]; !ok {
+			equals[pred.colName] = pred
+		}
+	}
+	if column, ok := primaryColumn(table.Columns); ok {
+		// 不能按列的类型编码的值（比如整数列 = 5.0）由SelectionPlan按表达式的规则比较，不能当作没有行
+		if pred, ok := equals[column.Name]; ok {
+			if data, err := ParseLiteral(pred.literals[0], column.TypeOf); err == nil {
+				keys := make([][]byte, 0, 1)
+				if data != nil { // 和null比较没有行能满足条件
+					keys = append(keys, data)
 				}
-			} else {
-				defVal, err := defaultValue(column.TypeOf)
+				return &IndexLookupPlan{TableReadPlan: *trp, keys: keys}
+			}
+		}
+	}
+	var best Plan = trp
+	bestScore, bestName := 0, ""
+	for _, m := range matches { // 一个全文索引和索引一列 = 值一样算二
+		if name, _ := table.fulltextOn(m.colName); name != "" && (bestScore < 2 || bestScore == 2 && name < bestName) {
+			best, bestScore, bestName = &FullTextPlan{TableReadPlan: *trp, indexName: name, terms: m.terms}, 2, name
+		}
+	}
+	for name, index := range table.Indexes {
+		if index.Type == fulltextIndex {
+			continue
+		}
+		plan, score := indexAccess(trp, name, index, index.columns(table.Columns), equals, ranges)
+		if score > bestScore || score == bestScore && score > 0 && name < bestName {
+			best, bestScore, bestName = plan, score, name
+		}
+	}
+	return best
+}
+
+// indexAccess 用一个索引读表的方式，score是用上的列数的两倍，有范围条件的列算一，0表示用不上这个索引。
+// 哈希索引只能在所有列都是 = 值时使用，这时比同样列数的B+tree多算一。不能按列的类型编码的值不用索引，由SelectionPlan比较
+func indexAccess(trp *TableReadPlan, name string, index *Index, columns []Column, equals map[string]*predicate, ranges map[string][]*predicate) (Plan, int) {
+	prefix := make([]byte, 0, 32)
+	matched := 0
+	for _, column := range columns {
+		pred, ok := equals[column.Name]
+		if !ok {
+			break
+		}
+		key, err := orderedLiteral(pred.literals[0], column.TypeOf)
+		if err != nil {
+			break
+		}
+		if key == nil {
+			return &IndexLookupPlan{TableReadPlan: *trp, indexName: name, keys: [][]byte{}}, 2 * len(columns)
+		}
+		prefix = append(prefix, key...)
+		matched++
+	}
+	if index.Type == hashIndex {
+		if matched < len(columns) {
+			return nil, 0
+		}
+		return &IndexLookupPlan{TableReadPlan: *trp, indexName: name, keys: [][]byte{prefix}}, 2*matched + 1
+	}
+	if matched < len(columns) && len(ranges[columns[matched].Name]) != 0 {
+		scan := &IndexScanPlan{TableReadPlan: *trp, indexName: name, prefix: prefix}
+		column := columns[matched]
+		bounded := false
+		for _, pred := range ranges[column.Name] {
+			bounds := make([][]byte, 0, 2)
+			for _, literal := range pred.literals {
+				bound, err := orderedLiteral(literal, column.TypeOf)
 				if err != nil {
-					return errors.New("get default value error")
+					bounds = nil
+					break
 				}
-				line.nameToVal[column.Name] = ColVal{
-					column: column,
-					value:  defVal,
+				if bound == nil {
+					return &IndexLookupPlan{TableReadPlan: *trp, indexName: name, keys: [][]byte{}}, 2 * len(columns)
 				}
+				bounds = append(bounds, bound)
 			}
-		}
-		subTx := t.subTxs[tableName]
-		memTable := subTx.memTables[0]
-		lineId := uint64(len(memTable.lines))
-		line.pageId = 0
-		line.lineId = lineId
-		memTable.lines[lineId] = line
-
-	} else if strings.HasPrefix(sql, "update") { //`update  test set  name =" xxx" ,age= 9 where  nameEql(name)`
-
-		slice := strings.SplitN(sql, "update", 2)
-		str := strings.TrimSpace(slice[1]) //`test set  name =" xxx" ,age= 9 where  nameEql(name)`
-
-		buf := new(bytes.Buffer)
-		var tableEnd int
-		for i := 0; i < len(str); i++ {
-			if str[i] == 0x20 {
-				tableEnd = i
-				break
+			if bounds == nil {
+				continue
+			}
+			bounded = true
+			switch pred.op { // 同一边有多个条件时用第一个，其余的由SelectionPlan过滤
+			case ">", ">=":
+				if scan.lower == nil {
+					scan.lower, scan.lowerOpen = bounds[0], pred.op == ">"
+				}
+			case "<", "<=":
+				if scan.upper == nil {
+					scan.upper, scan.upperOpen = bounds[0], pred.op == "<"
+				}
+			case "between":
+				if scan.lower == nil {
+					scan.lower = bounds[0]
+				}
+				if scan.upper == nil {
+					scan.upper = bounds[1]
+				}
 			}
-			buf.WriteByte(str[i])
 		}
+		if bounded {
+			return scan, 2*matched + 1
+		}
+	}
+	if matched == 0 {
+		return nil, 0
+	}
+	return &IndexLookupPlan{TableReadPlan: *trp, indexName: name, keys: [][]byte{prefix}}, 2 * matched
+}
 
-		tableName := str[:tableEnd] //`test`
-		table := t.db.tables[tableName]
-		table.updated = true
-
-		str = strings.TrimSpace(str[tableEnd:]) //`set  name =" xxx" ,age= 9 where  nameEql(name)`
+func (t *Transaction) CompileUpdate(sql string) error {
+	_, err := t.compileUpdate(sql)
+	return err
+}
 
-		slice = strings.SplitN(str, "set", 2)
-		str = strings.TrimSpace(slice[1]) //`name =" xxx" ,age= 9 where  nameEql(name)`
+// compileUpdate 解析并执行一条insert、update或者delete，返回写入wal的语句
+func (t *Transaction) compileUpdate(sql string) (string, error) {
+	stmt, err := parseStatement(sql)
+	if err != nil {
+		return "", err
+	}
+	return t.compileStatement(stmt)
+}
 
-		slice = strings.SplitN(str, "where", 2)
-		colValStr := TrimSpace(slice[0]) //`name="xxx",age=9`
-		condition := TrimSpace(slice[1]) //`  nameEql(name)`
+// compileStatement 返回写入wal的语句，insert分配了auto_increment的值时把值写进语句，重放时得到同样的主键
+func (t *Transaction) compileStatement(stmt Statement) (string, error) {
+	var err error
+	switch stmt := stmt.(type) {
+	case *InsertStmt:
+		err = t.compileInsert(stmt)
+	case *UpdateStmt:
+		err = t.compileUpdateStmt(stmt)
+	case *DeleteStmt:
+		err = t.compileDelete(stmt)
+	default:
+		return "", errors.New("invalid sql")
+	}
+	if err != nil {
+		return "", err
+	}
+	return stmt.String(), nil
+}
 
-		query := make([]string, 0, 64)
-		query = append(query, "select", "*", "from", tableName, "where", condition)
-		var wg sync.WaitGroup
-		logicalPlans, outOuder, _, err := t.CompileQuery(query, &wg)
+func (t *Transaction) compileInsert(stmt *InsertStmt) error {
+	table := t.db.tables[stmt.Table]
+	if table == nil {
+		return errors.New("invalid table name")
+	}
+	table.updated = true
+	if len(stmt.Columns) != len(stmt.Values) {
+		return errors.New("column names and values cannot match")
+	}
+	colToVals := make(map[string]string, len(stmt.Columns))
+	for index, colName := range stmt.Columns {
+		if columnIndex(table.Columns, colName) < 0 {
+			return fmt.Errorf("column %s not exists", colName)
+		}
+		if _, ok := colToVals[colName]; ok {
+			return fmt.Errorf("duplicate column %s", colName)
+		}
+		colToVals[colName] = stmt.Values[index].String()
+	}
+	line := Line{
+		nameToVal: make(map[string]ColVal, 16),
+	}
+	for _, column := range table.Columns {
+		if value, ok := colToVals[column.Name]; ok {
+			data, err := ParseLiteral(value, column.TypeOf)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			line.nameToVal[column.Name] = ColVal{
+				column: column,
+				value:  data,
+			}
+		} else { // 没有给值的列是NULL
+			line.nameToVal[column.Name] = ColVal{
+				column: column,
+			}
+		}
+	}
+	applyDefaults(&line, colToVals)
+	if column, ok := primaryColumn(table.Columns); ok && column.AutoIncrement {
+		colVal := line.nameToVal[column.Name]
+		table.cache.lock.Lock()
+		data, err := table.nextSequence(colVal.value)
+		table.cache.lock.Unlock()
 		if err != nil {
 			return err
 		}
-		resultSet := execute(logicalPlans, outOuder, &wg)
-
-		colToVals := strings.Split(colValStr, ",")
-
-		subTx := t.subTxs[tableName]
-		table.cache.lock.Lock()
-		for _, line := range resultSet.result {
+		if colVal.value == nil { // 分配的值写进语句
+			literal := &Literal{Kind: NumberLiteral, Value: FormatData(data, INT64)}
+			if _, ok := colToVals[column.Name]; ok {
+				stmt.Values[columnPosition(stmt.Columns, column.Name)] = literal
+			} else {
+				stmt.Columns = append(stmt.Columns, column.Name)
+				stmt.Values = append(stmt.Values, literal)
+			}
+		}
+		colVal.value = data
+		line.nameToVal[column.Name] = colVal
+	}
+	subTx := t.subTxs[stmt.Table]
+	memTable := subTx.memTables[0]
+	line.pageId = 0
+	line.lineId = uint64(len(memTable.lines))
+	err := t.checkLine(table, &line) // 先检查约束，违反时事务不变
+	if err != nil {
+		return err
+	}
+	err = t.checkUnique(table, []Line{line})
+	if err != nil {
+		return err
+	}
+	memTable.lines[line.lineId] = line
+	return nil
+}
 
-			newLine := *line
+func columnPosition(colNames []string, name string) int {
+	for i, colName := range colNames {
+		if colName == name {
+			return i
+		}
+	}
+	return -1
+}
 
-			for _, colToVal := range colToVals {
-				kv := strings.Split(colToVal, "=")
-				column := strings.TrimSpace(kv[0])
-				value := strings.TrimSpace(kv[1])
+// selectLines 读出满足条件的行，没有条件时是所有行
+func (t *Transaction) selectLines(tableName string, where []Expr) ([]*Line, error) {
+	query := &SelectStmt{
+		Fields: []*SelectField{{Expr: &Star{}}},
+		Table:  tableName,
+		Where:  where,
+	}
+	var wg sync.WaitGroup
+	logicalPlans, outOuder, _, err := t.CompileQuery(query, &wg)
+	if err != nil {
+		return nil, err
+	}
+	resultSet, err := execute(logicalPlans, outOuder, &wg)
+	if err != nil {
+		return nil, err
+	}
+	return resultSet.result, nil
+}
 
-				newLine.nameToVal[column] = ColVal{
-					column: line.nameToVal[column].column,
-					value:  []byte(value),
-				}
+func (t *Transaction) compileUpdateStmt(stmt *UpdateStmt) error {
+	table := t.db.tables[stmt.Table]
+	if table == nil {
+		return errors.New("invalid table name")
+	}
+	table.updated = true
+	compiler := &exprCompiler{db: t.db, columns: table.Columns}
+	values := make([]evalFunc, 0, len(stmt.Set))
+	for _, assignment := range stmt.Set {
+		if columnIndex(table.Columns, assignment.Column) < 0 {
+			return fmt.Errorf("column %s not exists", assignment.Column)
+		}
+		value, err := compiler.compile(assignment.Value)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+	lines, err := t.selectLines(stmt.Table, stmt.Where)
+	if err != nil {
+		return err
+	}
 
+	newLines := make([]Line, 0, len(lines))
+	for _, line := range lines {
+		newLine := Line{ // 不能改到page中的行，结果中相关度这样的列也不要
+			nameToVal: make(map[string]ColVal, len(table.Columns)),
+			pageId:    line.pageId,
+			lineId:    line.lineId,
+		}
+		for _, column := range table.Columns {
+			newLine.nameToVal[column.Name] = line.nameToVal[column.Name]
+		}
+		for i, assignment := range stmt.Set { // 按更新前的行求值，转换成列的类型
+			column := table.Columns[columnIndex(table.Columns, assignment.Column)]
+			val, err := values[i](line)
+			if err == nil {
+				val, err = castValue(val, column.TypeOf)
 			}
-			memTable := subTx.memTables[newLine.pageId]
-			if memTable == nil {
-				memTable, err = table.cache.CopyPage(newLine.pageId)
-				if err != nil {
-					return err
-				}
-				subTx.memTables[newLine.pageId] = memTable
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			data, err := EncodeData(val)
+			if err != nil {
+				return err
+			}
+			newLine.nameToVal[column.Name] = ColVal{
+				column: column,
+				value:  data,
 			}
-			memTable.lines[newLine.lineId] = newLine
-			memTable.isOrigin = false
-
 		}
-		table.cache.lock.Unlock()
-	} else if strings.HasPrefix(sql, "delete") {
-
-		slice := strings.SplitN(sql, "from", 2) //`delete from  test where  othfloat( price) `
-		str := strings.TrimSpace(slice[1])      //`test where  othfloat( price)`
-
-		slice = strings.SplitN(str, "where", 2)
-
-		tableName := strings.TrimSpace(slice[0]) //`test`
-		table := t.db.tables[tableName]
-		table.updated = true
-
-		condition := strings.TrimSpace(slice[1]) //`othfloat( price)`
-
-		query := make([]string, 0, 64)
-		query = append(query, "select", "*", "from", tableName, "where", condition)
-		var wg sync.WaitGroup
-		logicalPlans, outOuder, _, err := t.CompileQuery(query, &wg)
+		err = t.checkLine(table, &newLine)
 		if err != nil {
 			return err
 		}
-		resultSet := execute(logicalPlans, outOuder, &wg)
-
-		subTx := t.subTxs[tableName]
-
-		table.cache.lock.Lock()
+		newLines = append(newLines, newLine)
+	}
+	err = t.checkUnique(table, newLines) // 所有行都满足约束之后再写入memtable
+	if err != nil {
+		return err
+	}
 
-		for _, line := range resultSet.result {
-			memTable := subTx.memTables[line.pageId]
-			if memTable == nil {
-				memTable, err = table.cache.CopyPage(line.pageId)
-				if err != nil {
-					return err
-				}
-				subTx.memTables[line.pageId] = memTable
+	subTx := t.subTxs[stmt.Table]
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
+	for _, newLine := range newLines {
+		memTable := subTx.memTables[newLine.pageId]
+		if memTable == nil {
+			memTable, err = table.cache.CopyPage(newLine.pageId)
+			if err != nil {
+				return err
 			}
-			delete(memTable.lines, line.lineId)
-			memTable.isOrigin = false
+			subTx.memTables[newLine.pageId] = memTable
 		}
+		memTable.lines[newLine.lineId] = newLine
+		memTable.isOrigin = false
+	}
+	return nil
+}
 
-		table.cache.lock.Unlock()
+func (t *Transaction) compileDelete(stmt *DeleteStmt) error {
+	table := t.db.tables[stmt.Table]
+	if table == nil {
+		return errors.New("invalid table name")
+	}
+	table.updated = true
+	lines, err := t.selectLines(stmt.Table, stmt.Where)
+	if err != nil {
+		return err
+	}
 
-	} else {
-		return errors.New("invalid sql")
+	subTx := t.subTxs[stmt.Table]
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
+	for _, line := range lines {
+		memTable := subTx.memTables[line.pageId]
+		if memTable == nil {
+			memTable, err = table.cache.CopyPage(line.pageId)
+			if err != nil {
+				return err
+			}
+			subTx.memTables[line.pageId] = memTable
+		}
+		delete(memTable.lines, line.lineId)
+		memTable.isOrigin = false
 	}
 	return nil
 }
@@ -0,0 +1,725 @@
+package rmdb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 递归下降的语法分析，select、insert、update、delete生成语法树，ddl还是由ddl.go中的正则解析。
+// 表达式按优先级逐层解析，见expr
+
+type parser struct {
+	sql    string
+	tokens []token
+	i      int
+}
+
+// Parse 解析用分号分开的多条语句，空语句忽略
+func Parse(sql string) ([]Statement, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{sql: sql, tokens: tokens}
+	stmts := make([]Statement, 0, 1)
+	for {
+		for p.acceptSymbol(";") {
+		}
+		if p.peek().kind == tokEOF {
+			return stmts, nil
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if p.peek().kind != tokEOF && !p.acceptSymbol(";") {
+			return nil, p.errorf("unexpected token after statement")
+		}
+	}
+}
+
+// parseStatement 解析一条语句
+func parseStatement(sql string) (Statement, error) {
+	stmts, err := Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) != 1 {
+		return nil, &SyntaxError{Line: 1, Column: 1, Msg: "expected one statement"}
+	}
+	return stmts[0], nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+// errorf 在当前token的位置报错
+func (p *parser) errorf(format string, args ...any) error {
+	tok := p.peek()
+	return syntaxError(p.sql, tok.pos, p.sql[tok.pos:tok.end], format, args...)
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokKeyword && tok.text == keyword
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.errorf("expected %s", keyword)
+	}
+	return nil
+}
+
+// acceptWord nulls first这样只在一个位置有意义的词不是保留字，可以用作列名
+func (p *parser) acceptWord(word string) bool {
+	if tok := p.peek(); tok.kind == tokIdent && strings.EqualFold(tok.text, word) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	tok := p.peek()
+	return tok.kind == tokSymbol && tok.text == symbol
+}
+
+func (p *parser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorf("expected %s", symbol)
+	}
+	return nil
+}
+
+func (p *parser) ident(what string) (string, error) {
+	if p.peek().kind != tokIdent {
+		return "", p.errorf("expected %s", what)
+	}
+	return p.advance().text, nil
+}
+
+func (p *parser) statement() (Statement, error) {
+	switch {
+	case p.acceptKeyword("select"):
+		return p.selectStmt()
+	case p.acceptKeyword("insert"):
+		return p.insertStmt()
+	case p.acceptKeyword("update"):
+		return p.updateStmt()
+	case p.acceptKeyword("delete"):
+		return p.deleteStmt()
+	}
+	return nil, p.errorf("expected select, insert, update or delete")
+}
+
+// selectStmt select [distinct] fields from table [where] [group by] [having] [order by] [limit]，
+// order by的每一列可以有自己的asc、desc和nulls first、nulls last
+func (p *parser) selectStmt() (*SelectStmt, error) {
+	stmt := &SelectStmt{Distinct: p.acceptKeyword("distinct")}
+	for {
+		field, err := p.selectField()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Fields = append(stmt.Fields, field)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	var err error
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.conditions(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("group") {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			name, err := p.ident("column name")
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, name)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("having") {
+		if stmt.Having, err = p.conditions(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order") {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			tok := p.peek()
+			expr, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			switch expr.(type) {
+			case *ColumnRef, *FuncCall:
+			default:
+				return nil, syntaxError(p.sql, tok.pos, p.sql[tok.pos:tok.end], "expected column or function")
+			}
+			item := &OrderItem{Expr: expr}
+			if p.acceptKeyword("desc") {
+				item.Desc = true
+			} else {
+				p.acceptKeyword("asc")
+			}
+			if p.acceptWord("nulls") {
+				switch {
+				case p.acceptWord("first"):
+					item.Nulls = NullsFirst
+				case p.acceptWord("last"):
+					item.Nulls = NullsLast
+				default:
+					return nil, p.errorf("expected first or last")
+				}
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("limit") {
+		if stmt.Limit, err = p.limit(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) selectField() (*SelectField, error) {
+	if p.acceptSymbol("*") {
+		return &SelectField{Expr: &Star{}}, nil
+	}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	field := &SelectField{Expr: expr}
+	if p.acceptKeyword("as") {
+		if field.Alias, err = p.ident("alias"); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+// limit limit count、limit offset, count或者limit count offset offset
+func (p *parser) limit() (*LimitClause, error) {
+	first, err := p.unsigned()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptSymbol(",") {
+		count, err := p.unsigned()
+		if err != nil {
+			return nil, err
+		}
+		return &LimitClause{Offset: first, Count: count}, nil
+	}
+	if p.acceptKeyword("offset") {
+		offset, err := p.unsigned()
+		if err != nil {
+			return nil, err
+		}
+		return &LimitClause{Offset: offset, Count: first}, nil
+	}
+	return &LimitClause{Count: first}, nil
+}
+
+func (p *parser) unsigned() (uint64, error) {
+	if p.peek().kind != tokNumber {
+		return 0, p.errorf("expected number")
+	}
+	value, err := strconv.ParseUint(p.peek().text, 10, 64)
+	if err != nil {
+		return 0, p.errorf("expected unsigned integer")
+	}
+	p.advance()
+	return value, nil
+}
+
+// insertStmt insert into table (columns) values (literals)
+func (p *parser) insertStmt() (*InsertStmt, error) {
+	stmt := &InsertStmt{}
+	var err error
+	if err = p.expectKeyword("into"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		name, err := p.ident("column name")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, name)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("values"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, value)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// updateStmt update table set column = 表达式, ... [where]
+func (p *parser) updateStmt() (*UpdateStmt, error) {
+	stmt := &UpdateStmt{}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	for {
+		assignment := &Assignment{}
+		if assignment.Column, err = p.ident("column name"); err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		if assignment.Value, err = p.expr(); err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, assignment)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.conditions(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// deleteStmt delete from table [where]
+func (p *parser) deleteStmt() (*DeleteStmt, error) {
+	stmt := &DeleteStmt{}
+	var err error
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.conditions(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// conditions 条件之间用逗号或者and分开，最外层的and拆成多个条件
+func (p *parser) conditions() ([]Expr, error) {
+	conditions := make([]Expr, 0, 4)
+	for {
+		condition, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		conditions = appendConjuncts(conditions, condition)
+		if !p.acceptSymbol(",") {
+			return conditions, nil
+		}
+	}
+}
+
+func appendConjuncts(conditions []Expr, condition Expr) []Expr {
+	if e, ok := condition.(*BinaryExpr); ok && e.Op == "and" {
+		return appendConjuncts(appendConjuncts(conditions, e.Left), e.Right)
+	}
+	return append(conditions, condition)
+}
+
+// expr 优先级从低到高：or、and、not、比较、+ -、* / %、负号
+func (p *parser) expr() (Expr, error) {
+	left, err := p.andExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.andExpr()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) andExpr() (Expr, error) {
+	left, err := p.notExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) notExpr() (Expr, error) {
+	if p.acceptKeyword("not") {
+		operand, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "not", Expr: operand}, nil
+	}
+	return p.comparison()
+}
+
+// comparison x op y、x is [not] null、x [not] between y and z、x [not] in (...)或者x [not] like y
+func (p *parser) comparison() (Expr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("is") {
+		not := p.acceptKeyword("not")
+		if err = p.expectKeyword("null"); err != nil {
+			return nil, err
+		}
+		return &IsNullExpr{Expr: left, Not: not}, nil
+	}
+	if tok := p.peek(); tok.kind == tokSymbol {
+		switch tok.text {
+		case "=", "!=", "<>", "<", ">", "<=", ">=":
+			p.advance()
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			op := tok.text
+			if op == "<>" {
+				op = "!="
+			}
+			return &CompareExpr{Op: op, Left: left, Right: right}, nil
+		}
+	}
+	not := p.acceptKeyword("not")
+	switch {
+	case p.acceptKeyword("between"):
+		lower, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectKeyword("and"); err != nil {
+			return nil, err
+		}
+		upper, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return &BetweenExpr{Expr: left, Lower: lower, Upper: upper, Not: not}, nil
+	case p.acceptKeyword("in"):
+		if err = p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		list, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		return &InExpr{Expr: left, List: list, Not: not}, nil
+	case p.acceptKeyword("like"):
+		pattern, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return &LikeExpr{Expr: left, Pattern: pattern, Not: not}, nil
+	case not:
+		return nil, p.errorf("expected between, in or like")
+	}
+	return left, nil
+}
+
+// exprList 逗号分开的表达式，直到右括号
+func (p *parser) exprList() ([]Expr, error) {
+	list := make([]Expr, 0, 4)
+	for {
+		item, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (p *parser) additive() (Expr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("+") || p.isSymbol("-") {
+		op := p.advance().text
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) multiplicative() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%") {
+		op := p.advance().text
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// unary 带符号的数字是字面量，其余的负号是UnaryExpr
+func (p *parser) unary() (Expr, error) {
+	if (p.isSymbol("-") || p.isSymbol("+")) && p.tokens[p.i+1].kind != tokNumber {
+		op := p.advance().text
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return operand, nil
+		}
+		return &UnaryExpr{Op: "-", Expr: operand}, nil
+	}
+	return p.primary()
+}
+
+// primary 字面量、列名、函数调用、括号、case或者cast
+func (p *parser) primary() (Expr, error) {
+	tok := p.peek()
+	switch {
+	case p.acceptSymbol("("):
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case p.acceptKeyword("case"):
+		return p.caseExpr()
+	case p.acceptKeyword("cast"):
+		return p.castExpr()
+	case tok.kind != tokIdent:
+		literal, err := p.literal()
+		if err != nil {
+			return nil, p.errorf("expected expression")
+		}
+		return literal, nil
+	}
+	p.advance()
+	if !p.acceptSymbol("(") {
+		return &ColumnRef{Name: tok.text}, nil
+	}
+	call := &FuncCall{Name: tok.text}
+	if p.acceptSymbol(")") {
+		return call, nil
+	}
+	if p.acceptSymbol("*") { // count(*)
+		call.Args = []Expr{&Star{}}
+		return call, p.expectSymbol(")")
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	call.Args = args
+	return call, nil
+}
+
+// caseExpr case [值] when ... then ... [else ...] end
+func (p *parser) caseExpr() (Expr, error) {
+	e := &CaseExpr{}
+	var err error
+	if !p.isKeyword("when") {
+		if e.Operand, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.acceptKeyword("when") {
+		when := &WhenClause{}
+		if when.When, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err = p.expectKeyword("then"); err != nil {
+			return nil, err
+		}
+		if when.Then, err = p.expr(); err != nil {
+			return nil, err
+		}
+		e.Whens = append(e.Whens, when)
+	}
+	if len(e.Whens) == 0 {
+		return nil, p.errorf("expected when")
+	}
+	if p.acceptKeyword("else") {
+		if e.Else, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectKeyword("end"); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// castExpr cast(x as 类型)
+func (p *parser) castExpr() (Expr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	operand, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("as"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokIdent {
+		return nil, p.errorf("expected type")
+	}
+	typeOf, err := parseType(p.peek().text)
+	if err != nil {
+		return nil, p.errorf("%s", err.Error())
+	}
+	p.advance()
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return &CastExpr{Expr: operand, TypeOf: typeOf}, nil
+}
+
+// literal 字符串、可以带符号的数字、true、false或者null
+func (p *parser) literal() (*Literal, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokString:
+		p.advance()
+		return &Literal{Kind: StringLiteral, Value: tok.text}, nil
+	case tok.kind == tokKeyword && tok.text == "null":
+		p.advance()
+		return &Literal{Kind: NullLiteral}, nil
+	case tok.kind == tokKeyword && (tok.text == "true" || tok.text == "false"):
+		p.advance()
+		return &Literal{Kind: BoolLiteral, Value: tok.text}, nil
+	case tok.kind == tokNumber:
+		p.advance()
+		return &Literal{Kind: NumberLiteral, Value: normalizeNumber(tok.text)}, nil
+	case tok.kind == tokSymbol && (tok.text == "-" || tok.text == "+"):
+		if next := p.tokens[p.i+1]; next.kind == tokNumber {
+			p.advance()
+			p.advance()
+			value := normalizeNumber(next.text)
+			if tok.text == "-" {
+				value = "-" + value
+			}
+			return &Literal{Kind: NumberLiteral, Value: value}, nil
+		}
+	}
+	return nil, p.errorf("expected literal")
+}
+
+// normalizeNumber 补全.5和5.这样的写法，字面量按json解析
+func normalizeNumber(text string) string {
+	if strings.HasPrefix(text, ".") {
+		text = "0" + text
+	}
+	if dot := strings.IndexByte(text, '.'); dot >= 0 && (dot == len(text)-1 || !isDigit(rune(text[dot+1]))) {
+		text = text[:dot] + text[dot+1:]
+	}
+	return text
+}
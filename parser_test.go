@@ -0,0 +1,151 @@
+package rmdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustSelect(t *testing.T, sql string) *SelectStmt {
+	stmt, err := parseStatement(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, ok := stmt.(*SelectStmt)
+	if !ok {
+		t.Fatalf("%s is not a query", sql)
+	}
+	return query
+}
+
+func TestLexer(t *testing.T) {
+	tokens, err := lex("SELECT `from`, \"a\\\"b\\u00e9\", 'it''s\\n' -- comment\n /* block\n comment */ 1.5e3 .5 <> <=;")
+	assert.Nil(t, err)
+	kinds := make([]tokenKind, 0, len(tokens))
+	texts := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		kinds = append(kinds, tok.kind)
+		texts = append(texts, tok.text)
+	}
+	assert.Equal(t, []tokenKind{tokKeyword, tokIdent, tokSymbol, tokString, tokSymbol, tokString, tokNumber, tokNumber, tokSymbol, tokSymbol, tokSymbol, tokEOF}, kinds)
+	assert.Equal(t, []string{"select", "from", ",", "a\"bé", ",", "it's\n", "1.5e3", ".5", "<>", "<=", ";", ""}, texts)
+
+	for sql, expected := range map[string]string{
+		`select "abc`:         `syntax error at line 1 column 8 near "\"": unterminated string`,
+		"select 'a\nb":        `syntax error at line 1 column 8 near "'": unterminated string`,
+		"select *\n/* x":      `syntax error at line 2 column 1 near "/*": unterminated comment`,
+		"select 12ab from t":  `syntax error at line 1 column 8 near "12a": invalid number`,
+		"select # from t":     `syntax error at line 1 column 8 near "#": unexpected character`,
+		`select "\x" from t`:  `syntax error at line 1 column 8 near "\"\\x\"": invalid escape in string`,
+		"select\n  `a from t": "syntax error at line 2 column 3 near \"`\": unterminated identifier",
+	} {
+		_, err := lex(sql)
+		if assert.NotNil(t, err, sql) {
+			assert.Equal(t, expected, err.Error(), sql)
+		}
+	}
+}
+
+func TestParser(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"  select *  from test;":                       "select * from test",
+		"SELECT DISTINCT name, age AS years FROM test": "select distinct name, age as years from test",
+		"select addstr( name) as new_name, product(age, id) from test where great(age)":                                    "select addstr(name) as new_name, product(age,id) from test where great(age)",
+		`select * from man where age between -5 and +2.5, name = 'o''k' and city is not null`:                              `select * from man where age between -5 and 2.5 and name = "o'k" and city is not null`,
+		"select * from man where age <> 3 and age != .5 and age >= 1e3":                                                    "select * from man where age != 3 and age != 0.5 and age >= 1e3",
+		"select name, sum(price) as s from test group by age, city having great(s) order by name desc, age DESC limit 2,4": "select name, sum(price) as s from test group by age, city having great(s) order by name desc, age desc limit 2, 4",
+		"select * from test order by name asc limit 3":                                                                     "select * from test order by name limit 0, 3",
+		"select * from test limit 3 offset 7":                                                                              "select * from test limit 7, 3",
+		"select * from docs where match(body, 'from limit')":                                                               `select * from docs where match(body,"from limit")`,
+		"insert into test (name, age) values ('john smith', -1)":                                                           `insert into test (name, age) values ("john smith", -1)`,
+		"insert into test (a, b, c) values (null, TRUE, 5.)":                                                               "insert into test (a, b, c) values (null, true, 5)",
+		`update test set name = "a, b where c", age = 9 where name = "x"`:                                                  `update test set name = "a, b where c", age = 9 where name = "x"`,
+		"update test set age = null":                                                                                       "update test set age = null",
+		"delete from test where strEql(name) ;":                                                                            "delete from test where strEql(name)",
+		"delete from test":                                                                                                 "delete from test",
+	} {
+		stmt, err := parseStatement(sql)
+		if assert.Nil(t, err, sql) {
+			assert.Equal(t, expected, stmt.String(), sql)
+			again, err := parseStatement(stmt.String())
+			assert.Nil(t, err, "output parses again")
+			assert.Equal(t, expected, again.String())
+		}
+	}
+
+	stmts, err := Parse(`insert into t (a) values ("x;y"); ; delete from t where a = ";"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stmts), "semicolons in strings do not split statements")
+	stmts, err = Parse(" ; -- nothing\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(stmts))
+
+	for sql, expected := range map[string]string{
+		"select from test":                         `syntax error at line 1 column 8 near "from": expected expression`,
+		"select * form test":                       `syntax error at line 1 column 10 near "form": expected from`,
+		"select *\nfrom test\nwhere age >":         "syntax error at line 3 column 12: expected expression",
+		"select * from test where age not null":    `syntax error at line 1 column 34 near "null": expected between, in or like`,
+		"select * from test where great(age":       "syntax error at line 1 column 35: expected )",
+		"select * from test limit -1":              `syntax error at line 1 column 26 near "-": expected number`,
+		"select * from test extra":                 `syntax error at line 1 column 20 near "extra": unexpected token after statement`,
+		"insert into test name values (1)":         `syntax error at line 1 column 18 near "name": expected (`,
+		"insert into test (name) values (name)":    `syntax error at line 1 column 33 near "name": expected literal`,
+		"update test set name = 1 +":               "syntax error at line 1 column 27: expected expression",
+		"drop table test":                          `syntax error at line 1 column 1 near "drop": expected select, insert, update or delete`,
+		"select * from test; select * from test":   "syntax error at line 1 column 1: expected one statement",
+		"select name, 数据 from 表 where 名字 = '张三' x": `syntax error at line 1 column 40 near "x": unexpected token after statement`,
+	} {
+		_, err := parseStatement(sql)
+		var syntaxErr *SyntaxError
+		if assert.True(t, errors.As(err, &syntaxErr), sql) {
+			assert.Equal(t, expected, err.Error(), sql)
+		}
+	}
+}
+
+func TestParserSql(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, note STRING, age INT64)"))
+	assert.Nil(t, db.Update(`insert into man (name, note, age) values ("john smith", 'select * from t limit 1', 3)`))
+	assert.Nil(t, db.Update(`
+		-- two statements, the first string has a semicolon
+		insert into man (name, note) values ("a;b", "x\ty"); /* comment */
+		insert into man (name, age) values ('it''s', -2)`))
+	assert.Equal(t, []string{"a;b", "it's", "john smith"}, queryNames(t, db, "select * from man"))
+	assert.Equal(t, []string{"john smith"}, queryNames(t, db, `select name from man where note = "select * from t limit 1"`))
+	assert.Equal(t, []string{"it's"}, queryNames(t, db, "select * from man where age < 0 and name != 'a;b'"))
+	assert.Equal(t, []string{"john smith"}, queryNames(t, db, "select * from man where age != -2"), "null is never unequal")
+
+	assert.Nil(t, db.Update(`update man set note = "where from", age = 7 where name = "john smith"`))
+	res, err := db.Query(`select note, age from man where name = 'john smith'`)
+	assert.Nil(t, err)
+	if assert.Len(t, res.result, 1) {
+		assert.Equal(t, "where from", FormatData(res.result[0].nameToVal["note"].value, STRING))
+		assert.Equal(t, "7", FormatData(res.result[0].nameToVal["age"].value, INT64))
+	}
+	assertViolation(t, db.Update(`update man set height = 1`), "column height not exists")
+	assertViolation(t, db.Update(`insert into man (name, name) values ("a", "b")`), "duplicate column name")
+	assertViolation(t, db.Update(`insert into man (name) values ("a", "b")`), "cannot match")
+	_, err = db.Query(`select * from man where name = "x`)
+	var syntaxErr *SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr))
+	_, err = db.Query(`delete from man`)
+	assert.NotNil(t, err, "not a query")
+
+	crashDatabase(db)
+	db, err = UseDatabase("parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"john smith"}, queryNames(t, db, `select * from man where note = "where from"`), "logged statements replay")
+	assert.Equal(t, []string{"a;b"}, queryNames(t, db, `select * from man where note = "x\ty"`))
+	assert.Nil(t, db.Update("delete from man"))
+	assert.Equal(t, 0, len(queryNames(t, db, "select * from man")))
+	assert.Nil(t, db.Close())
+}
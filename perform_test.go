@@ -22,10 +22,10 @@ func GetName() string {
 }
 
 func GetSql() string {
-	name, _ := EncodeData(GetName())
-	age, _ := EncodeData(int64(rand.Int()))
-	id, _ := EncodeData(int64(rand.Int()))
-	price, _ := EncodeData(rand.Float64())
+	name, _ := json.Marshal(GetName()) // sql中的字面量是json写法
+	age, _ := json.Marshal(int64(rand.Int()))
+	id, _ := json.Marshal(int64(rand.Int()))
+	price, _ := json.Marshal(rand.Float64())
 	sql := fmt.Sprint("insert into test (name, age, id, price) values (", string(name), ", ", string(age), ", ", string(id), ", ", string(price), ");")
 	return sql
 }
@@ -1,8 +1,10 @@
 package rmdb
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"sort"
+	"encoding/binary"
+	"fmt"
 	"strings"
 	"sync"
 )
@@ -12,12 +14,18 @@ type Plan interface {
 	setChild(childline chan *Line)
 	getParent() chan *Line
 	getConfig() bool //判断是否配置
+	getErr() error
 }
 
 type basePlan struct {
 	wg                      *sync.WaitGroup
 	childlines, parentlines chan *Line
 	isConfig                bool
+	err                     error // 执行中遇到的错误，执行结束后由execute返回
+}
+
+func (b *basePlan) getErr() error {
+	return b.err
 }
 
 const (
@@ -26,7 +34,6 @@ const (
 	Selection
 	Aggregation
 	FuncCol
-	Execute
 	Rename
 	Having
 	Distinct
@@ -41,6 +48,16 @@ type TableReadPlan struct {
 }
 
 func (t *TableReadPlan) process() {
+	t.read(t.pageIds)
+}
+
+// pageIds 要读的page，调用方持有cache锁
+func (t *TableReadPlan) pageIds(table *Table, subTx *SubTx) ([]uint64, error) {
+	return readPageIds(table, subTx, nil)
+}
+
+// read 读出pageIds返回的page中的行和本事务新插入的行，调用pageIds时持有cache锁
+func (t *TableReadPlan) read(pageIds func(table *Table, subTx *SubTx) ([]uint64, error)) {
 	defer func() {
 		close(t.parentlines)
 		t.wg.Done()
@@ -56,7 +73,11 @@ func (t *TableReadPlan) process() {
 
 	table.cache.lock.Lock()
 
-	for i := uint64(1); i < table.cache.pageId; i++ {
+	ids, err := pageIds(table, subTx)
+	if err != nil {
+		t.err = err
+	}
+	for _, i := range ids {
 
 		memTable := subTx.memTables[i]
 		var lines map[uint64]Line
@@ -65,7 +86,7 @@ func (t *TableReadPlan) process() {
 		} else {
 			page, err := table.cache.GetPage(i)
 			if err != nil {
-				logger.Error(err)
+				t.err = err
 				break
 			}
 			if page == nil {
@@ -90,6 +111,84 @@ func (t *TableReadPlan) process() {
 
 }
 
+// IndexLookupPlan where中有索引列 = 值时只读索引中这些值所在的page和本事务修改过的page，
+// 读出的行还要经过SelectionPlan，索引只用来少读page
+type IndexLookupPlan struct {
+	TableReadPlan
+	indexName string   // 为空时按主键查找
+	keys      [][]byte // 主键的值，或者索引前几列的有序编码
+}
+
+func (i *IndexLookupPlan) process() {
+	i.read(i.pageIds)
+}
+
+func (i *IndexLookupPlan) pageIds(table *Table, subTx *SubTx) ([]uint64, error) {
+	if i.indexName == "" {
+		return readPageIds(table, subTx, i.keys)
+	}
+	index := table.Indexes[i.indexName]
+	if index == nil { // 编译之后索引被删掉了
+		return readPageIds(table, subTx, nil)
+	}
+	pageIds := make([]uint64, 0, 16)
+	for _, key := range i.keys {
+		found, err := index.pages(key)
+		if err != nil {
+			return nil, err
+		}
+		pageIds = append(pageIds, found...)
+	}
+	return withChangedPages(subTx, pageIds), nil
+}
+
+// IndexScanPlan where中有索引列的范围条件时按顺序扫描索引，只读范围内的行所在的page和本事务修改过的page
+type IndexScanPlan struct {
+	TableReadPlan
+	indexName    string
+	prefix       []byte // 前几列 = 值的有序编码
+	lower, upper []byte // 范围列的边界，nil表示没有这一边的边界
+	lowerOpen    bool   // 不包含下界
+	upperOpen    bool   // 不包含上界
+}
+
+func (i *IndexScanPlan) process() {
+	i.read(i.pageIds)
+}
+
+func (i *IndexScanPlan) pageIds(table *Table, subTx *SubTx) ([]uint64, error) {
+	index := table.Indexes[i.indexName]
+	if index == nil {
+		return readPageIds(table, subTx, nil)
+	}
+	pageIds := make([]uint64, 0, 16)
+	start := append(append([]byte{}, i.prefix...), 1) // NULL编码为0，不满足任何范围条件
+	if i.lower != nil {
+		start = append(append([]byte{}, i.prefix...), i.lower...)
+	}
+	err := index.scan(start, func(key []byte, count uint64) bool {
+		if !bytes.HasPrefix(key, i.prefix) {
+			return false
+		}
+		rest := key[len(i.prefix):]
+		if i.lower != nil && i.lowerOpen && bytes.HasPrefix(rest, i.lower) {
+			return true
+		}
+		if i.upper != nil && !bytes.HasPrefix(rest, i.upper) && bytes.Compare(rest, i.upper) > 0 {
+			return false
+		}
+		if i.upper != nil && i.upperOpen && bytes.HasPrefix(rest, i.upper) {
+			return false
+		}
+		pageIds = append(pageIds, binary.BigEndian.Uint64(key[len(key)-8:]))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withChangedPages(subTx, pageIds), nil
+}
+
 func (t *TableReadPlan) setChild(childline chan *Line) {
 	// no child
 }
@@ -104,11 +203,9 @@ func (t *TableReadPlan) getConfig() bool {
 
 type SelectionPlan struct {
 	basePlan
-	colToFuncs []struct {
-		colNames []string
-		funcName string
-	}
-	selFuncs map[string]func([]any) bool
+	conditions []evalFunc
+	predicates []*predicate      // 列和字面量比较的条件，用来选择索引
+	matches    []*matchPredicate // match条件，满足条件的行加上相关度列
 }
 
 func (s *SelectionPlan) process() {
@@ -117,27 +214,108 @@ func (s *SelectionPlan) process() {
 		s.wg.Done()
 	}()
 	for line := range s.childlines {
-		pass := true
-		oldVals := make([]any, 0, 64)
-		for _, colToFunc := range s.colToFuncs {
-			for _, colName := range colToFunc.colNames {
-				oldVal, err := DecodeData(line.nameToVal[colName].value, line.nameToVal[colName].column.TypeOf)
-				if err != nil {
-					logger.Error(err)
-				}
-				oldVals = append(oldVals, oldVal)
-			}
-			if !s.selFuncs[colToFunc.funcName](oldVals) {
-				pass = false
-				break
-			}
+		if s.err != nil { // 出错之后读完剩下的行，不让前面的plan阻塞
+			continue
+		}
+		result, err := evalTruth(line, s.conditions)
+		if err != nil {
+			s.err = err
+			continue
 		}
-		if pass {
+		if result == truthTrue {
+			for _, m := range s.matches {
+				m.setScore(line)
+			}
 			s.parentlines <- line
 		}
 	}
 }
 
+// 三值逻辑，where和having只保留结果为true的行
+type truth int8
+
+const (
+	truthFalse truth = iota
+	truthTrue
+	truthUnknown
+)
+
+func (t truth) and(other truth) truth {
+	if t == truthFalse || other == truthFalse {
+		return truthFalse
+	}
+	if t == truthUnknown || other == truthUnknown {
+		return truthUnknown
+	}
+	return truthTrue
+}
+
+func (t truth) or(other truth) truth {
+	if t == truthTrue || other == truthTrue {
+		return truthTrue
+	}
+	if t == truthUnknown || other == truthUnknown {
+		return truthUnknown
+	}
+	return truthFalse
+}
+
+func (t truth) not() truth {
+	switch t {
+	case truthTrue:
+		return truthFalse
+	case truthFalse:
+		return truthTrue
+	}
+	return truthUnknown
+}
+
+// value 表达式中的值，unknown是NULL
+func (t truth) value() any {
+	if t == truthUnknown {
+		return nil
+	}
+	return t == truthTrue
+}
+
+// predicate where中列和字面量比较的条件：col = 值、col != 值、col < 值、col > 值、col <= 值、col >= 值、col between 值 and 值。
+// planner知道它比较的是哪一列，可以用索引只读可能满足条件的page，条件本身由SelectionPlan中的表达式计算
+type predicate struct {
+	colName  string
+	op       string   // = != < > <= >= between
+	literals []string // between有两个值
+}
+
+// orderedLiteral 把值按列的类型解析成索引中的有序编码，null返回nil
+func orderedLiteral(literal string, typeOf int) ([]byte, error) {
+	data, err := ParseLiteral(literal, typeOf)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return appendOrderedKey(nil, data, typeOf)
+}
+
+var nullConditions = map[string]func([]any) bool{ // 名字里有空格，不会和注册的函数重名
+	"is null":     func(vals []any) bool { return vals[0] == nil },
+	"is not null": func(vals []any) bool { return vals[0] != nil },
+}
+
+// evalCondition NULL以nil传给条件函数，函数返回false并且参数中有NULL时结果是unknown，和sql中与NULL比较一致
+func evalCondition(funcName string, function func([]any) bool, vals []any) truth {
+	if function(vals) {
+		return truthTrue
+	}
+	if _, ok := nullConditions[funcName]; ok {
+		return truthFalse
+	}
+	for _, val := range vals {
+		if val == nil {
+			return truthUnknown
+		}
+	}
+	return truthFalse
+}
+
 func (s *SelectionPlan) setChild(childline chan *Line) {
 	s.childlines = childline
 }
@@ -239,22 +417,8 @@ func (d *DistinctPlan) process() {
 		}
 		lineBytes := make([]byte, 0, 64)
 		for _, colName := range colNames {
-			name, err := EncodeData(line.nameToVal[colName].column.Name)
-			if err != nil {
-				logger.Error(err)
-			}
-			typeOf, err := EncodeData(line.nameToVal[colName].column.TypeOf)
-			if err != nil {
-				logger.Error(err)
-			}
-			defVal, err := EncodeData(line.nameToVal[colName].column.DefVal)
-			if err != nil {
-				logger.Error(err)
-			}
-			lineBytes = append(lineBytes, name...)
-			lineBytes = append(lineBytes, typeOf...)
-			lineBytes = append(lineBytes, defVal...)
-			lineBytes = append(lineBytes, line.nameToVal[colName].value...)
+			lineBytes = appendKey(lineBytes, []byte(colName))
+			lineBytes = appendKey(lineBytes, line.nameToVal[colName].value)
 		}
 		hash := sha256.Sum256(lineBytes)
 		if _, ok := hashs[hash]; !ok {
@@ -276,13 +440,18 @@ func (d *DistinctPlan) getConfig() bool {
 	return d.isConfig
 }
 
+// AggregationPlan 按byCols分组，每组只保存第一行和聚合函数的状态。估算的内存超过budget时，
+// 所有的组写到dir下的分区文件，最后逐个分区读回来合并。没有group by时整张表是一组
 type AggregationPlan struct {
 	basePlan
 	byCols     []string
 	colToFuncs []struct {
-		colName, funcName string
+		colName, funcName, name string // name是结果的列名，和函数调用的String()一致
 	}
-	aggFuncs map[string]func([]any) any
+	aggFuncs map[string]Aggregate
+	backend  Backend
+	dir      string
+	budget   int64
 }
 
 func (a *AggregationPlan) process() {
@@ -290,41 +459,161 @@ func (a *AggregationPlan) process() {
 		close(a.parentlines)
 		a.wg.Done()
 	}()
-	aggMap := make(map[[32]byte][]*Line, 64)
+	groups := make(map[[32]byte]*aggGroup, 64)
+	size := int64(0)
+	var parts *aggPartitions
+	defer func() {
+		if parts != nil {
+			parts.close()
+		}
+	}()
 	for line := range a.childlines {
-		valsBytes := make([]byte, 0, 64)
-		for _, byCol := range a.byCols {
-			valsBytes = append(valsBytes, line.nameToVal[byCol].value...)
-		}
-		hash := sha256.Sum256(valsBytes)
-		aggMap[hash] = append(aggMap[hash], line)
-	}
-	for _, lines := range aggMap {
-		newLine := lines[0]
-		for _, colToFunc := range a.colToFuncs {
-			oldVals := make([]any, 0, 64)
-			for _, line := range lines {
-				oldVal, err := DecodeData(line.nameToVal[colToFunc.colName].value, line.nameToVal[colToFunc.colName].column.TypeOf)
+		if a.err != nil { // 出错之后读完剩下的行，不让前面的plan阻塞
+			continue
+		}
+		key := a.groupKey(line)
+		group, ok := groups[key]
+		if !ok {
+			group = a.newGroup(line)
+			groups[key] = group
+			size += group.size
+		}
+		grown, err := a.accumulate(group, line)
+		if err != nil {
+			a.err = err
+			continue
+		}
+		size += grown
+		if a.budget <= 0 || size <= a.budget || a.backend == nil {
+			continue
+		}
+		if parts == nil {
+			if parts, a.err = newAggPartitions(a.backend, a.dir); a.err != nil {
+				continue
+			}
+		}
+		a.err = parts.spill(groups)
+		groups, size = make(map[[32]byte]*aggGroup, 64), 0
+	}
+	if a.err != nil {
+		return
+	}
+	if parts == nil {
+		if len(groups) == 0 && len(a.byCols) == 0 { // 没有group by时即使没有行也有一组
+			groups[[32]byte{}] = a.newGroup(&Line{nameToVal: make(map[string]ColVal, 8)})
+		}
+		a.err = a.emit(groups)
+		return
+	}
+	if a.err = parts.spill(groups); a.err != nil {
+		return
+	}
+	for i := 0; i < aggPartitionCount; i++ {
+		groups = make(map[[32]byte]*aggGroup, 64)
+		a.err = parts.read(i, func(line *Line, states [][]any) error {
+			key := a.groupKey(line)
+			group, ok := groups[key]
+			if !ok {
+				groups[key] = &aggGroup{line: line, states: states}
+				return nil
+			}
+			for j, agg := range a.aggregates() {
+				merged, err := agg.Merge(group.states[j], states[j])
 				if err != nil {
-					logger.Error(err)
+					return err
 				}
-				oldVals = append(oldVals, oldVal)
+				group.states[j] = merged
 			}
-			newVal := a.aggFuncs[colToFunc.funcName](oldVals)
-			newData, err := EncodeData(newVal)
-			if err != nil {
-				logger.Error(err)
+			return nil
+		})
+		if a.err == nil {
+			a.err = a.emit(groups)
+		}
+		if a.err != nil {
+			return
+		}
+	}
+}
+
+// groupKey NULL分在同一组
+func (a *AggregationPlan) groupKey(line *Line) [32]byte {
+	valsBytes := make([]byte, 0, 64)
+	for _, byCol := range a.byCols {
+		valsBytes = appendKey(valsBytes, line.nameToVal[byCol].value)
+	}
+	return sha256.Sum256(valsBytes)
+}
+
+func (a *AggregationPlan) aggregates() []Aggregate {
+	aggs := make([]Aggregate, 0, len(a.colToFuncs))
+	for _, colToFunc := range a.colToFuncs {
+		aggs = append(aggs, a.aggFuncs[colToFunc.funcName])
+	}
+	return aggs
+}
+
+func (a *AggregationPlan) newGroup(line *Line) *aggGroup {
+	group := &aggGroup{line: line, states: make([][]any, 0, len(a.colToFuncs)), size: lineSize(line)}
+	for _, colToFunc := range a.colToFuncs {
+		state := a.aggFuncs[colToFunc.funcName].Init()
+		group.states = append(group.states, state)
+		group.size += stateSize(state)
+	}
+	return group
+}
+
+// accumulate 把一行的值加到组的状态，返回增加的内存，count(*)的每一行都算一个值
+func (a *AggregationPlan) accumulate(group *aggGroup, line *Line) (int64, error) {
+	grown := int64(0)
+	for i, colToFunc := range a.colToFuncs {
+		var val any = true
+		if colToFunc.colName != "*" {
+			colVal := line.nameToVal[colToFunc.colName]
+			var err error
+			if val, err = DecodeData(colVal.value, colVal.column.TypeOf); err != nil {
+				return 0, err
 			}
-			newColName := NewColName(colToFunc.funcName, colToFunc.colName)
+		}
+		state, err := a.aggFuncs[colToFunc.funcName].Accumulate(group.states[i], val)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", colToFunc.name, err)
+		}
+		grown += stateSize(state) - stateSize(group.states[i])
+		group.states[i] = state
+	}
+	group.size += grown
+	return grown, nil
+}
 
+// emit 每组的结果是第一行加上以函数调用为名的列
+func (a *AggregationPlan) emit(groups map[[32]byte]*aggGroup) error {
+	for _, group := range groups {
+		newLine := group.line
+		for i, colToFunc := range a.colToFuncs {
+			result, err := a.aggFuncs[colToFunc.funcName].Finalize(group.states[i])
+			if err != nil {
+				return err
+			}
+			if result, err = normalizeValue(result); err != nil {
+				return err
+			}
+			newData, err := EncodeData(result)
+			if err != nil {
+				return err
+			}
+			newColName := colToFunc.name
+			column := newLine.nameToVal[colToFunc.colName].column
+			if colToFunc.colName == "*" {
+				column = Column{Name: newColName, TypeOf: INT64}
+			}
 			newLine.nameToVal[newColName] = ColVal{
-				column: newLine.nameToVal[colToFunc.colName].column,
+				column: derivedColumn(column, result),
 				value:  newData,
 			}
-
 		}
 		a.parentlines <- newLine
 	}
+	return nil
 }
 
 func (a *AggregationPlan) setChild(childline chan *Line) {
@@ -341,11 +630,7 @@ func (a *AggregationPlan) getConfig() bool {
 
 type HavingPlan struct { //必须和as结合使用
 	basePlan
-	colToFuncs []struct {
-		colNames []string
-		funcName string
-	}
-	havFuncs map[string]func([]any) bool
+	conditions []evalFunc
 }
 
 func (h *HavingPlan) process() {
@@ -354,22 +639,15 @@ func (h *HavingPlan) process() {
 		h.wg.Done()
 	}()
 	for line := range h.childlines {
-		pass := true
-		oldVals := make([]any, 0, 64)
-		for _, colToFunc := range h.colToFuncs {
-			for _, colName := range colToFunc.colNames {
-				oldVal, err := DecodeData(line.nameToVal[colName].value, line.nameToVal[colName].column.TypeOf)
-				if err != nil {
-					logger.Error(err)
-				}
-				oldVals = append(oldVals, oldVal)
-			}
-			if !h.havFuncs[colToFunc.funcName](oldVals) {
-				pass = false
-				break
-			}
+		if h.err != nil {
+			continue
 		}
-		if pass {
+		result, err := evalTruth(line, h.conditions)
+		if err != nil {
+			h.err = err
+			continue
+		}
+		if result == truthTrue {
 			h.parentlines <- line
 		}
 	}
@@ -387,12 +665,15 @@ func (h *HavingPlan) getConfig() bool {
 	return h.isConfig
 }
 
+// FuncColPlan 计算select中不是列名也不是聚合函数的表达式，结果以表达式的String为列名
 type FuncColPlan struct {
 	basePlan
-	colToFuncs []struct {
-		colName, funcName string
-	}
-	colFuncs map[string]func(any) any
+	fields []computedField
+}
+
+type computedField struct {
+	name string
+	eval evalFunc
 }
 
 func (f *FuncColPlan) process() {
@@ -401,27 +682,36 @@ func (f *FuncColPlan) process() {
 		f.wg.Done()
 	}()
 	for line := range f.childlines {
-		for _, colToFunc := range f.colToFuncs {
-			newColName := NewColName(colToFunc.funcName, colToFunc.colName)
-			oldVal, err := DecodeData(line.nameToVal[colToFunc.colName].value, line.nameToVal[colToFunc.colName].column.TypeOf)
-			if err != nil {
-				logger.Error(err)
-			}
-			newVal := f.colFuncs[colToFunc.funcName](oldVal)
-			newData, err := EncodeData(newVal)
-			if err != nil {
-				logger.Error(err)
-			}
-
-			line.nameToVal[newColName] = ColVal{
-				column: line.nameToVal[colToFunc.colName].column,
-				value:  newData,
+		if f.err != nil {
+			continue
+		}
+		for _, field := range f.fields {
+			if err := field.set(line); err != nil {
+				f.err = err
+				break
 			}
-
 		}
-		f.parentlines <- line
+		if f.err == nil {
+			f.parentlines <- line
+		}
+	}
+}
 
+func (c computedField) set(line *Line) error {
+	newVal, err := c.eval(line)
+	if err != nil {
+		return err
+	}
+	newData, err := EncodeData(newVal)
+	if err != nil {
+		return err
 	}
+	column := Column{Name: c.name, TypeOf: GetTypeOf(newVal)}
+	if newVal == nil { // NULL沿用原来的类型
+		column.TypeOf = line.nameToVal[c.name].column.TypeOf
+	}
+	line.nameToVal[c.name] = ColVal{column: column, value: newData}
+	return nil
 }
 
 func (f *FuncColPlan) setChild(childline chan *Line) {
@@ -436,64 +726,21 @@ func (f *FuncColPlan) getConfig() bool {
 	return f.isConfig
 }
 
-type ExecutePlan struct {
+// SortingPlan 按order by的各列依次比较，值按列的类型解码之后比较，相等的行保持原来的顺序。
+// 缓存的行超过budget时写到dir下的临时文件再归并，topN不为0时只保留前topN行
+type SortingPlan struct {
 	basePlan
-	colToFuncs []struct {
-		colNames []string
-		funcName string
-	}
-	execFuncs map[string]func([]any) any
-}
-
-func (e *ExecutePlan) process() {
-	defer func() {
-		close(e.parentlines)
-		e.wg.Done()
-	}()
-	for line := range e.childlines {
-		for _, colToFunc := range e.colToFuncs {
-			newColName := NewColName(colToFunc.funcName, colToFunc.colNames...)
-
-			oldVals := make([]any, 0, 64)
-			for _, colName := range colToFunc.colNames {
-				oldVal, err := DecodeData(line.nameToVal[colName].value, line.nameToVal[colName].column.TypeOf)
-				if err != nil {
-					logger.Error(err)
-				}
-				oldVals = append(oldVals, oldVal)
-			}
-			newVal := e.execFuncs[colToFunc.funcName](oldVals)
-			newData, err := EncodeData(newVal)
-			if err != nil {
-				logger.Error(err)
-			}
-
-			line.nameToVal[newColName] = ColVal{
-				column: line.nameToVal[colToFunc.colNames[0]].column,
-				value:  newData,
-			}
-
-		}
-		e.parentlines <- line
-	}
+	keys    []sortKey
+	backend Backend
+	dir     string
+	budget  int64
+	topN    uint64
 }
 
-func (e *ExecutePlan) setChild(childline chan *Line) {
-	e.childlines = childline
-}
-
-func (e *ExecutePlan) getParent() chan *Line {
-	return e.parentlines
-}
-
-func (e *ExecutePlan) getConfig() bool {
-	return e.isConfig
-}
-
-type SortingPlan struct {
-	basePlan
-	colNames []string
-	isAsc    bool
+type sortKey struct {
+	colName    string
+	desc       bool
+	nullsFirst bool
 }
 
 func (s *SortingPlan) process() {
@@ -501,34 +748,90 @@ func (s *SortingPlan) process() {
 		close(s.parentlines)
 		s.wg.Done()
 	}()
-	sortArr := make([]string, 0, 64)
-	sortMap := make(map[string][]*Line, 64)
+	st := &sorter{compare: s.compare, backend: s.backend, dir: s.dir, budget: s.budget, limit: s.topN}
+	defer st.close()
+	var top *topHeap
+	if s.topN > 0 {
+		top = &topHeap{sorter: st}
+	}
+	seq := uint64(0)
 	for line := range s.childlines {
-		valsBytes := make([]byte, 0, 64)
-		for _, colName := range s.colNames {
-			valsBytes = append(valsBytes, line.nameToVal[colName].value...)
+		if s.err != nil { // 出错之后读完剩下的行，不让前面的plan阻塞
+			continue
 		}
-		if _, ok := sortMap[string(valsBytes)]; !ok {
-			sortArr = append(sortArr, string(valsBytes))
+		row := s.row(line, seq)
+		seq++
+		if top == nil {
+			s.err = st.add(row)
+			continue
 		}
-		sortMap[string(valsBytes)] = append(sortMap[string(valsBytes)], line)
+		top.offer(row)
+		if st.budget > 0 && top.size > st.budget { // 前topN行也放不下，交给外部排序
+			for _, row := range top.rows {
+				if s.err = st.add(row); s.err != nil {
+					break
+				}
+			}
+			top = nil
+		}
+	}
+	if s.err != nil {
+		return
 	}
-	sort.Strings(sortArr)
-	if s.isAsc {
-		for _, val := range sortArr {
-			lines := sortMap[val]
-			for _, line := range lines {
-				s.parentlines <- line
+	if top != nil {
+		st.rows = top.rows
+	}
+	s.err = st.each(s.row, func(line *Line) {
+		s.parentlines <- line
+	})
+}
+
+// row 解码失败的值按原始的字节比较
+func (s *SortingPlan) row(line *Line, seq uint64) *sortRow {
+	vals := make([]any, 0, len(s.keys))
+	for _, key := range s.keys {
+		colVal := line.nameToVal[key.colName]
+		val, err := DecodeData(colVal.value, colVal.column.TypeOf)
+		if err != nil {
+			val = colVal.value
+		}
+		vals = append(vals, val)
+	}
+	return &sortRow{line: line, vals: vals, seq: seq, size: lineSize(line)}
+}
+
+func (s *SortingPlan) compare(a, b []any) int {
+	for i, key := range s.keys {
+		x, y := a[i], b[i]
+		if x == nil || y == nil {
+			if x == nil && y == nil {
+				continue
 			}
+			if (x == nil) == key.nullsFirst {
+				return -1
+			}
+			return 1
 		}
-	} else {
-		for i := len(sortArr) - 1; i >= 0; i-- {
-			lines := sortMap[sortArr[i]]
-			for _, line := range lines {
-				s.parentlines <- line
+		cmp := compareSortValues(x, y)
+		if cmp != 0 {
+			if key.desc {
+				return -cmp
 			}
+			return cmp
 		}
 	}
+	return 0
+}
+
+// compareSortValues 和where中的比较一致，不能比较的值先按类型再按展示的字符串比较，保证顺序是确定的
+func compareSortValues(x, y any) int {
+	if cmp, ok, err := compareValues(x, y); ok && err == nil {
+		return cmp
+	}
+	if typeX, typeY := GetTypeOf(x), GetTypeOf(y); typeX != typeY {
+		return typeX - typeY
+	}
+	return strings.Compare(fmt.Sprint(x), fmt.Sprint(y))
 }
 
 func (s *SortingPlan) setChild(childline chan *Line) {
@@ -558,8 +861,8 @@ func (l *LimitPlan) process() {
 			l.offset -= 1
 			continue
 		}
-		if l.count == 0 {
-			break
+		if l.count == 0 { // 读完剩下的行，不让前面的plan阻塞
+			continue
 		}
 		l.parentlines <- line
 		l.count -= 1
@@ -577,3 +880,20 @@ func (l *LimitPlan) getParent() chan *Line {
 func (l *LimitPlan) getConfig() bool {
 	return l.isConfig
 }
+
+func derivedColumn(column Column, value any) Column { // 函数的返回值类型可能和原来的列不同，解码时要按返回值的类型
+	if value != nil { // 返回NULL时沿用原来的类型
+		column.TypeOf = GetTypeOf(value)
+	}
+	return column
+}
+
+// appendKey 把值拼进分组和去重用的key，值的长度不固定要加长度前缀，NULL和空字符串要区分开
+func appendKey(key []byte, value []byte) []byte {
+	if value == nil {
+		return append(key, 0)
+	}
+	key = append(key, 1)
+	key = binary.AppendUvarint(key, uint64(len(value)))
+	return append(key, value...)
+}
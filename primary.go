@@ -0,0 +1,261 @@
+package rmdb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// 主键：每张表最多一个主键列，非空且唯一，可以auto_increment。
+// 主键到pageId的索引是一棵B+tree，存在表名.pk文件中，和二级索引一样在checkpoint时落盘，按主键查找时只读一个page；
+// lineId在page换出再读入后会变，所以索引只记到page。merge不改变pageId，索引不受影响
+
+func primaryColumn(columns []Column) (Column, bool) {
+	for _, column := range columns {
+		if column.PrimaryKey {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
+
+func primaryPath(dbPath, tableName string) string {
+	return fmt.Sprint(dbPath, string(os.PathSeparator), tableName, ".pk")
+}
+
+// primaryIndex 返回主键索引。目录中还没有时（旧版本的目录或者fsck修复后）扫描所有page建立，下次checkpoint落盘，调用方持有cache锁
+func (t *Table) primaryIndex() (*Index, error) {
+	if t.Primary != nil {
+		return t.Primary, nil
+	}
+	column, ok := primaryColumn(t.Columns)
+	if !ok {
+		return nil, nil
+	}
+	path := primaryPath(t.db.dbPath, t.Name)
+	err := t.db.backend.Remove(path) // 目录不引用的旧文件
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	index := &Index{Name: "primary", Columns: []uint64{column.Id}}
+	if err = index.open(t.db.backend, path); err != nil {
+		return nil, err
+	}
+	if err = t.buildIndex(index); err != nil {
+		_ = index.cache.file.Close()
+		return nil, err
+	}
+	t.Primary = index
+	return index, nil
+}
+
+// primaryPages 返回主键是value的行所在的page，调用方持有cache锁
+func (t *Table) primaryPages(index *Index, column Column, value []byte) ([]uint64, error) {
+	key, err := appendOrderedKey(make([]byte, 0, len(value)+2), value, column.TypeOf)
+	if err != nil {
+		return nil, err
+	}
+	return index.pages(key)
+}
+
+// rebuildPrimary 主键列的类型变了时，索引中的键按新的类型重新建立。节点追加写在文件末尾，新目录落盘前崩溃时旧的树还是完整的。
+// 返回重建前的索引用于恢复，没有重建时返回nil，调用方持有cache锁
+func (t *Table) rebuildPrimary(oldColumns []Column) (*Index, error) {
+	column, ok := primaryColumn(t.Columns)
+	old, _ := primaryColumn(oldColumns)
+	if t.Primary == nil || !ok || old.TypeOf == column.TypeOf {
+		return nil, nil
+	}
+	saved := *t.Primary
+	t.Primary.reset()
+	if err := t.buildIndex(t.Primary); err != nil {
+		t.Primary.restore(saved)
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// lookupPages 返回可能包含这些主键的page，调用方持有cache锁
+func (t *Table) lookupPages(keys [][]byte) ([]uint64, error) {
+	index, err := t.primaryIndex()
+	if err != nil || index == nil {
+		return nil, err
+	}
+	column, _ := primaryColumn(t.Columns)
+	pageIds := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		found, err := t.primaryPages(index, column, key)
+		if err != nil {
+			return nil, err
+		}
+		pageIds = append(pageIds, found...)
+	}
+	return pageIds, nil
+}
+
+// readPageIds 返回要读的page，keys为nil时读所有page，否则只读这些主键所在的page和本事务修改过的page，调用方持有cache锁
+func readPageIds(table *Table, subTx *SubTx, keys [][]byte) ([]uint64, error) {
+	if keys == nil {
+		pageIds := make([]uint64, 0, table.cache.pageId)
+		for i := uint64(1); i < table.cache.pageId; i++ {
+			pageIds = append(pageIds, i)
+		}
+		return pageIds, nil
+	}
+	pageIds, err := table.lookupPages(keys)
+	if err != nil {
+		return nil, err
+	}
+	return withChangedPages(subTx, pageIds), nil
+}
+
+// withChangedPages 加上本事务修改过的page，排序去重。修改过的行可能改了索引列，索引中还没有
+func withChangedPages(subTx *SubTx, pageIds []uint64) []uint64 {
+	for pageId := range subTx.memTables {
+		if pageId != 0 {
+			pageIds = append(pageIds, pageId)
+		}
+	}
+	sort.Slice(pageIds, func(i, j int) bool { return pageIds[i] < pageIds[j] })
+	unique := pageIds[:0]
+	for i, pageId := range pageIds {
+		if i == 0 || pageId != pageIds[i-1] {
+			unique = append(unique, pageId)
+		}
+	}
+	return unique
+}
+
+// changedLines 事务写入的行：新插入的行和修改过的page中的所有行
+func (s *SubTx) changedLines() []Line {
+	lines := make([]Line, 0, len(s.memTables[0].lines))
+	for pageId, memTable := range s.memTables {
+		if pageId == 0 || !memTable.isOrigin {
+			for _, line := range memTable.lines {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// reserveKeys 提交前检查新的主键和唯一索引的键是否和已提交的行或者正在提交的事务重复，不重复时占用这些键直到应用完成。
+// 事务替换的page中原有的键不算重复，修改已有的行不会和自己冲突
+func (t *Transaction) reserveKeys() (map[*Table][]string, error) {
+	reserved := make(map[*Table][]string, len(t.subTxs))
+	if t.isReplay {
+		return reserved, nil
+	}
+	for _, subTx := range t.subTxs {
+		keys, err := subTx.reserveKeys()
+		if err != nil {
+			t.releaseKeys(reserved)
+			return nil, err
+		}
+		if len(keys) != 0 {
+			reserved[subTx.table] = keys
+		}
+	}
+	return reserved, nil
+}
+
+func (s *SubTx) reserveKeys() ([]string, error) {
+	table := s.table
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
+	lines := s.changedLines()
+	keys := make([]string, 0, len(lines))
+	if column, ok := primaryColumn(table.Columns); ok {
+		primaryKeys, err := s.primaryKeys(column, lines)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, primaryKeys...)
+	}
+	for _, index := range table.Indexes {
+		if !index.Unique {
+			continue
+		}
+		indexKeys, err := s.indexKeys(index, lines)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, indexKeys...)
+	}
+	if table.reserved == nil {
+		table.reserved = make(map[string]bool, len(keys))
+	}
+	for _, key := range keys {
+		table.reserved[key] = true
+	}
+	return keys, nil
+}
+
+// replaced 这个page会被本事务替换
+func (s *SubTx) replaced(pageId uint64) bool {
+	memTable := s.memTables[pageId]
+	return pageId != 0 && memTable != nil && !memTable.isOrigin
+}
+
+// primaryKeys 返回要占用的主键，占用的键以索引名和0开头，主键的索引名为空
+func (s *SubTx) primaryKeys(column Column, lines []Line) ([]string, error) {
+	table := s.table
+	index, err := table.primaryIndex()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(lines))
+	keys := make([]string, 0, len(lines))
+	for _, line := range lines {
+		value := line.nameToVal[column.Name].value
+		if value == nil { // 写入时已经检查过not null
+			continue
+		}
+		key := fmt.Sprint("\x00", string(value))
+		if _, ok := seen[key]; ok || table.reserved[key] {
+			return nil, duplicateKeyError(table, column, value)
+		}
+		seen[key] = struct{}{}
+		pageIds, err := table.primaryPages(index, column, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, pageId := range pageIds {
+			if !s.replaced(pageId) {
+				return nil, duplicateKeyError(table, column, value)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (t *Transaction) releaseKeys(reserved map[*Table][]string) {
+	for table, keys := range reserved {
+		table.cache.lock.Lock()
+		for _, key := range keys {
+			delete(table.reserved, key)
+		}
+		table.cache.lock.Unlock()
+	}
+}
+
+func duplicateKeyError(table *Table, column Column, value []byte) error {
+	return fmt.Errorf("duplicate primary key %s of table %s", FormatData(value, column.TypeOf), table.Name)
+}
+
+// nextSequence 分配auto_increment的值，显式给出的更大的值也会推进序列，调用方持有cache锁
+func (t *Table) nextSequence(value []byte) ([]byte, error) {
+	if value == nil {
+		t.Sequence++
+		return EncodeData(int64(t.Sequence))
+	}
+	val, err := DecodeData(value, INT64)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := val.(int64); ok && id > 0 && uint64(id) > t.Sequence {
+		t.Sequence = uint64(id)
+	}
+	return value, nil
+}
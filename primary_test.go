@@ -0,0 +1,190 @@
+package rmdb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queryIds(t *testing.T, db *Database, sql string) map[string]string {
+	res, err := db.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string, len(res.result))
+	for _, line := range res.result {
+		ids[FormatData(line.nameToVal["name"].value, STRING)] = FormatData(line.nameToVal["id"].value, INT64)
+	}
+	return ids
+}
+
+func TestPrimaryKey(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, db.Update("create table bad (id INT64 primary key, no INT64 primary key)"), "multiple primary keys")
+	assert.NotNil(t, db.Update("create table bad (id INT64 primary key, primary key (id))"), "multiple primary keys")
+	assert.NotNil(t, db.Update("create table bad (id INT64 auto_increment)"), "auto_increment must be a primary key")
+	assert.NotNil(t, db.Update("create table bad (id STRING primary key auto_increment)"), "auto_increment must be INT64")
+	assert.NotNil(t, db.Update("create table bad (id INT64, primary key (no))"))
+	assert.Nil(t, db.Update("create table code (name STRING, primary key (name))"))
+	assert.True(t, db.tables["code"].Columns[0].PrimaryKey)
+	assert.True(t, db.tables["code"].Columns[0].NotNull)
+	assert.Nil(t, db.Update("create table man (id INT64 PRIMARY KEY AUTO_INCREMENT, name STRING)"))
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Nil(t, db.Update(`insert into man (name) values ("`+name+`")`))
+	}
+	assert.Nil(t, db.Update(`insert into man (id, name) values (10, "d")`))
+	assert.Nil(t, db.Update(`insert into man (id, name) values (null, "e")`))
+	assertViolation(t, db.Update(`insert into man (id, name) values (2, "x")`), "unique")
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3", "d": "10", "e": "11"}, queryIds(t, db, "select * from man"))
+
+	for i := 0; i < 10; i++ { // 多几个page
+		assert.Nil(t, db.Update(`insert into man (name) values ("f")`))
+	}
+	table := db.tables["man"]
+	assert.True(t, table.cache.pageId > 3)
+	tx := db.Begin()
+	var wg sync.WaitGroup
+	plans, _, _, err := tx.CompileQuery(mustSelect(t, "select * from man where id = 2"), &wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ilp := plans[TableRead].(*IndexLookupPlan)
+	assert.Equal(t, 1, len(ilp.keys))
+	table.cache.lock.Lock()
+	pageIds, err := readPageIds(table, tx.subTxs["man"], ilp.keys)
+	table.cache.lock.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{1}, pageIds, "lookup by primary key should read one page")
+	assert.Equal(t, map[string]string{"b": "2"}, queryIds(t, db, "select * from man where id = 2"))
+	assert.Equal(t, 0, len(queryIds(t, db, "select * from man where id = 99")))
+	assert.Equal(t, 0, len(queryIds(t, db, `select * from man where id = "x"`)))
+	assert.Equal(t, map[string]string{"b": "2"}, queryIds(t, db, "select * from man where id = 2.0"), "literals that do not encode as the key are compared while scanning")
+	assert.Equal(t, map[string]string{"b": "2"}, queryIds(t, db, "select * from man where id = '2'"))
+
+	assert.Nil(t, db.Update(`update man set id = 200 where id = 2`))
+	assert.Equal(t, map[string]string{"b": "200"}, queryIds(t, db, "select * from man where id = 200"))
+	assert.Equal(t, 0, len(queryIds(t, db, "select * from man where id = 2")))
+	assert.Nil(t, db.Update(`delete from man where id = 1`))
+	assert.Equal(t, 0, len(queryIds(t, db, "select * from man where id = 1")))
+	assert.Nil(t, db.Update(`insert into man (id, name) values (1, "g")`), "deleted key can be used again")
+
+	tx = db.Begin()
+	assert.Nil(t, tx.Update(`update man set id = 300 where id = 3`))
+	assert.Equal(t, 1, len(queryTx(t, tx, "select * from man where id = 300")), "transaction sees its own changed key")
+	assertViolation(t, tx.Update(`insert into man (id, name) values (300, "x")`), "unique")
+	assert.Nil(t, tx.Rollback())
+
+	tx1, tx2 := db.Begin(), db.Begin()
+	assert.Nil(t, tx1.Update(`insert into man (id, name) values (40, "h")`))
+	assert.Nil(t, tx2.Update(`insert into man (id, name) values (40, "i")`))
+	assert.Nil(t, tx1.Commit())
+	err = tx2.Commit()
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "duplicate primary key 40 of table man", err.Error())
+	}
+	assert.Nil(t, tx2.Rollback(), "rejected transaction is not committed")
+
+	tx1, tx2 = db.Begin(), db.Begin()
+	assert.Nil(t, tx1.Update(`insert into man (id, name) values (50, "j")`))
+	assert.Nil(t, tx2.Update(`insert into man (id, name) values (50, "k")`))
+	reserved, err := tx1.reserveKeys() // tx1正在提交
+	assert.Nil(t, err)
+	assert.NotNil(t, tx2.Commit(), "key reserved by a committing transaction")
+	assert.Nil(t, tx2.Rollback())
+	tx1.releaseKeys(reserved)
+	assert.Nil(t, tx1.Commit())
+	assert.Equal(t, map[string]string{"j": "50"}, queryIds(t, db, "select * from man where id = 50"))
+
+	assert.NotNil(t, db.Update("alter table man drop column id"))
+	assert.NotNil(t, db.Update("alter table man add column no INT64 primary key"))
+	assert.Nil(t, db.Update("alter table man rename column id to no"))
+	assert.Nil(t, db.Update("alter table man rename column no to id"))
+
+	sequence := table.Sequence
+	assert.Nil(t, db.Close())
+	db, err = UseDatabase("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sequence, db.tables["man"].Sequence, "sequence is saved in the catalog")
+	if assert.NotNil(t, db.tables["man"].Primary, "primary key index is saved in the catalog") {
+		assert.True(t, db.tables["man"].Primary.Root != 0)
+	}
+	assert.Equal(t, map[string]string{"j": "50"}, queryIds(t, db, "select * from man where id = 50"), "index still points to the pages after merge")
+	assertViolation(t, db.Update(`insert into man (id, name) values (50, "x")`), "unique")
+
+	assert.Nil(t, db.Close())
+	dbPath := fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "primary")
+	cata, err := loadCatalog(stdBackend{}, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := cata.Tables["man"]
+	legacy.Primary = nil // 没有主键索引的旧目录
+	cata.Tables["man"] = legacy
+	assert.Nil(t, writeCatalog(stdBackend{}, dbPath, cata))
+	db, err = UseDatabase("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.tables["man"].Primary)
+	assert.Equal(t, map[string]string{"j": "50"}, queryIds(t, db, "select * from man where id = 50"), "index is built when it is missing")
+	assert.NotNil(t, db.tables["man"].Primary)
+	assert.Nil(t, db.Update(`insert into man (name) values ("l")`))
+	assert.Nil(t, db.Update(`insert into man (name) values ("m")`))
+	before := queryIds(t, db, "select * from man where name = \"m\"")
+	crashDatabase(db)
+
+	db, err = UseDatabase("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, before, queryIds(t, db, "select * from man where name = \"m\""), "replay should assign the same key")
+	assert.Nil(t, db.Update(`insert into man (name) values ("n")`))
+	assert.Equal(t, map[string]string{"n": fmt.Sprint(sequence + 3)}, queryIds(t, db, `select * from man where name = "n"`))
+
+	assert.Nil(t, db.Update("truncate table man"))
+	assert.Nil(t, db.Update(`insert into man (name) values ("o")`))
+	assert.Equal(t, map[string]string{"o": "1"}, queryIds(t, db, "select * from man"), "truncate resets the sequence")
+	tx = db.Begin()
+	logged, err := tx.compileUpdate(`insert into man (name) values ("p")`)
+	assert.Nil(t, err)
+	assert.Equal(t, `insert into man (name, id) values ("p", 2)`, logged, "assigned key is written into the wal")
+	assert.Nil(t, tx.Rollback())
+
+	assert.Nil(t, db.Update("create table num (id INT64 primary key, name STRING)"))
+	for i := 1; i <= 20; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into num (id, name) values (%d, "n%d")`, i, i)))
+	}
+	assert.Nil(t, db.Update("alter table num modify column id FLOAT64"))
+	assert.Equal(t, []string{"n7"}, queryNames(t, db, "select * from num where id = 7.0"), "keys are encoded with the new type")
+	assertViolation(t, db.Update(`insert into num (id, name) values (7, "x")`), "unique")
+	assert.Nil(t, db.Update(`insert into num (id, name) values (7.5, "n7.5")`))
+	crashDatabase(db)
+
+	db, err = UseDatabase("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"n7.5"}, queryNames(t, db, "select * from num where id = 7.5"))
+	assertViolation(t, db.Update(`insert into num (id, name) values (20, "x")`), "unique")
+	assert.Nil(t, db.Close())
+}
+
+func queryTx(t *testing.T, tx *Transaction, sql string) []*Line {
+	res, err := tx.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.result
+}
@@ -69,6 +69,20 @@ func printUsage() {
 	fmt.Println("  insert                     ------> insert table")
 	fmt.Println("  update                     ------> update table")
 	fmt.Println("  delete                     ------> delete table")
+	fmt.Println("  checkpoint                 ------> flush dirty pages and truncate wal")
+	fmt.Println("  create database [name]     ------> create a database")
+	fmt.Println("  drop database [name]       ------> drop a database")
+	fmt.Println("  create table [name] (...)  ------> create a table, e.g. create table man (name STRING, age INT64)")
+	fmt.Println("  drop table [name]          ------> drop a table")
+	fmt.Println("  truncate table [name]      ------> delete all records of a table")
+	fmt.Println("  alter table [name] ...     ------> add, drop, rename or modify a column")
+	fmt.Println("  create [unique] index      ------> create an index, e.g. create index idx_age on man (age) [using hash|fulltext]")
+	fmt.Println("  drop index [name]          ------> drop an index, add on [table] when the name is used by more than one table")
+	fmt.Println("  match(col, 'terms')        ------> full-text search in where, match(col) is the relevance, e.g. order by match(col) desc")
+	fmt.Println("  order by                   ------> sort by several keys, e.g. order by city, age desc nulls first")
+	fmt.Println("  aggregates                 ------> count(*), sum, avg, min and max, with or without group by")
+	fmt.Println("  expressions                ------> and or not, + - * / %, in, between, like, case, coalesce, cast(x as type) in where, select and set,")
+	fmt.Println("                                      e.g. update man set age = age + 1 where age > 8 and name like 'j%'")
 }
 
 func NewServer(host string, port int) (*Server, error) {
@@ -167,6 +181,23 @@ func (s *Server) handleConn(conn net.Conn) {
 					logger.Errorf("rmdb write to connect failed: %s\n", err)
 				}
 				continue
+			} else if create, name, ok := ParseDatabaseDDL(cmd); ok { // 不需要先use数据库
+				var echo string
+				if tx != nil {
+					echo = "ddl failed: ddl is not allowed in a transaction"
+				} else if err := ExecDDL(cmd); err != nil {
+					echo = fmt.Sprintf("ddl failed: %s", err)
+				} else {
+					if !create && db != nil && db.dbName == name { // 当前使用的数据库被删掉了
+						db = nil
+					}
+					echo = "Query OK"
+				}
+				_, err = conn.Write([]byte(echo))
+				if err != nil {
+					logger.Errorf("rmdb write to connect failed: %s\n", err)
+				}
+				continue
 			} else if strings.HasPrefix(cmd, "use") {
 				dbName := strings.TrimSpace(strings.Split(cmd, "use")[1])
 				newDB, err := UseDatabase(dbName)
@@ -224,6 +255,33 @@ func (s *Server) handleConn(conn net.Conn) {
 						logger.Errorf("rmdb write to connect failed: %s\n", err)
 					}
 					continue
+				} else if isCheckpoint(cmd) { // 事务中也可以执行
+					err = db.Update(cmd)
+					var echo string
+					if err == nil {
+						echo = "Query OK"
+					} else {
+						echo = fmt.Sprintf("checkpoint failed: %s", err)
+					}
+					_, err = conn.Write([]byte(echo))
+					if err != nil {
+						logger.Errorf("rmdb write to connect failed: %s\n", err)
+					}
+					continue
+				} else if isDDL(cmd) {
+					var echo string
+					if tx != nil {
+						echo = "ddl failed: ddl is not allowed in a transaction"
+					} else if err := db.Update(cmd); err != nil {
+						echo = fmt.Sprintf("ddl failed: %s", err)
+					} else {
+						echo = "Query OK"
+					}
+					_, err = conn.Write([]byte(echo))
+					if err != nil {
+						logger.Errorf("rmdb write to connect failed: %s\n", err)
+					}
+					continue
 				} else if strings.HasPrefix(cmd, "select") {
 
 					var res *ResultSet
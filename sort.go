@@ -0,0 +1,252 @@
+package rmdb
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// order by的外部排序：内存中缓存的行超过GlobalOption.SortBufferSize时，排好序写到数据库目录下的临时文件，
+// 每个文件是一个run，最后k路归并。和limit一起用时只需要前N行，先用大小为N的堆，堆放不下时再退回外部排序
+
+// sortRow seq是读入的顺序，比较的值相等时按seq，保证排序是稳定的
+type sortRow struct {
+	line *Line
+	vals []any
+	seq  uint64
+	size int64
+}
+
+// sorter 外部排序，add之后调用each按顺序取出所有的行，最后close删掉临时文件
+type sorter struct {
+	compare func(a, b []any) int
+	backend Backend
+	dir     string
+	budget  int64 // 小于等于0时不写临时文件
+	limit   uint64
+	rows    []*sortRow
+	size    int64
+	runs    []string
+}
+
+func (s *sorter) less(a, b *sortRow) bool {
+	if cmp := s.compare(a.vals, b.vals); cmp != 0 {
+		return cmp < 0
+	}
+	return a.seq < b.seq
+}
+
+func (s *sorter) add(row *sortRow) error {
+	s.rows = append(s.rows, row)
+	s.size += row.size
+	if s.budget > 0 && s.size > s.budget && s.backend != nil {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *sorter) sortRows() {
+	sort.Slice(s.rows, func(i, j int) bool {
+		return s.less(s.rows[i], s.rows[j])
+	})
+	if s.limit > 0 && uint64(len(s.rows)) > s.limit { // 每个run只有前N行可能在结果中
+		s.rows = s.rows[:s.limit]
+	}
+}
+
+// spill 把内存中的行排好序写成一个run
+func (s *sorter) spill() error {
+	s.sortRows()
+	path := spillPath(s.dir, "sort_")
+	_ = s.backend.Remove(path) // 上次崩溃时留下的同名文件
+	file, err := s.backend.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, path)
+	writer := bufio.NewWriter(file)
+	record := make([]byte, 0, 256)
+	for _, row := range s.rows {
+		record = encodeSortRow(record[:0], row)
+		if _, err = writer.Write(binary.AppendUvarint(nil, uint64(len(record)))); err == nil {
+			_, err = writer.Write(record)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	s.rows, s.size = nil, 0
+	return err
+}
+
+// each 按顺序把行交给emit，没有写过临时文件时直接在内存中排序
+func (s *sorter) each(decode func(line *Line, seq uint64) *sortRow, emit func(line *Line)) error {
+	if len(s.runs) == 0 {
+		s.sortRows()
+		for _, row := range s.rows {
+			emit(row.line)
+		}
+		return nil
+	}
+	if len(s.rows) != 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	merger := &runMerger{sorter: s}
+	defer merger.close()
+	for _, path := range s.runs {
+		cursor, err := openRun(s.backend, path)
+		if err != nil {
+			return err
+		}
+		merger.all = append(merger.all, cursor)
+		if err = merger.push(cursor, decode); err != nil {
+			return err
+		}
+	}
+	emitted := uint64(0)
+	for merger.Len() > 0 && (s.limit == 0 || emitted < s.limit) {
+		cursor := merger.cursors[0]
+		emit(cursor.row.line)
+		emitted++
+		heap.Pop(merger)
+		if err := merger.push(cursor, decode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close 删掉临时文件
+func (s *sorter) close() {
+	for _, path := range s.runs {
+		_ = s.backend.Remove(path)
+	}
+	s.runs, s.rows = nil, nil
+}
+
+// encodeSortRow seq和整行
+func encodeSortRow(record []byte, row *sortRow) []byte {
+	return appendLine(binary.AppendUvarint(record, row.seq), row.line)
+}
+
+func decodeSortRow(record []byte) (*Line, uint64, error) {
+	r := &spillReader{data: record}
+	seq, err := r.uvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, err := r.line()
+	return line, seq, err
+}
+
+// runCursor 一个run中下一行的位置
+type runCursor struct {
+	file   FileIO
+	reader *bufio.Reader
+	row    *sortRow
+}
+
+func openRun(backend Backend, path string) (*runCursor, error) {
+	file, err := backend.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runCursor{file: file, reader: bufio.NewReader(io.NewSectionReader(file, 0, file.Size()))}, nil
+}
+
+// next 读到结尾时row为nil
+func (c *runCursor) next(decode func(line *Line, seq uint64) *sortRow) error {
+	c.row = nil
+	length, err := binary.ReadUvarint(c.reader)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	record := make([]byte, length)
+	if _, err = io.ReadFull(c.reader, record); err != nil {
+		return err
+	}
+	line, seq, err := decodeSortRow(record)
+	if err != nil {
+		return err
+	}
+	c.row = decode(line, seq)
+	return nil
+}
+
+// runMerger 以每个run的下一行组成的小顶堆
+type runMerger struct {
+	sorter  *sorter
+	cursors []*runCursor
+	all     []*runCursor
+}
+
+func (m *runMerger) Len() int           { return len(m.cursors) }
+func (m *runMerger) Less(i, j int) bool { return m.sorter.less(m.cursors[i].row, m.cursors[j].row) }
+func (m *runMerger) Swap(i, j int)      { m.cursors[i], m.cursors[j] = m.cursors[j], m.cursors[i] }
+func (m *runMerger) Push(x any)         { m.cursors = append(m.cursors, x.(*runCursor)) }
+func (m *runMerger) Pop() any {
+	last := m.cursors[len(m.cursors)-1]
+	m.cursors = m.cursors[:len(m.cursors)-1]
+	return last
+}
+
+// push 读出cursor的下一行，没有读完时放回堆中
+func (m *runMerger) push(cursor *runCursor, decode func(line *Line, seq uint64) *sortRow) error {
+	if err := cursor.next(decode); err != nil {
+		return err
+	}
+	if cursor.row != nil {
+		heap.Push(m, cursor)
+	}
+	return nil
+}
+
+func (m *runMerger) close() {
+	for _, cursor := range m.all {
+		_ = cursor.file.Close()
+	}
+}
+
+// topHeap limit的前N行组成的大顶堆，堆顶是目前最靠后的一行
+type topHeap struct {
+	sorter *sorter
+	rows   []*sortRow
+	size   int64
+}
+
+func (h *topHeap) Len() int           { return len(h.rows) }
+func (h *topHeap) Less(i, j int) bool { return h.sorter.less(h.rows[j], h.rows[i]) }
+func (h *topHeap) Swap(i, j int)      { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *topHeap) Push(x any)         { h.rows = append(h.rows, x.(*sortRow)) }
+func (h *topHeap) Pop() any {
+	last := h.rows[len(h.rows)-1]
+	h.rows = h.rows[:len(h.rows)-1]
+	return last
+}
+
+// offer 堆没满时放入，满了并且比堆顶靠前时替换堆顶
+func (h *topHeap) offer(row *sortRow) {
+	if uint64(len(h.rows)) < h.sorter.limit {
+		heap.Push(h, row)
+		h.size += row.size
+		return
+	}
+	if h.sorter.less(row, h.rows[0]) {
+		h.size += row.size - h.rows[0].size
+		h.rows[0] = row
+		heap.Fix(h, 0)
+	}
+}
@@ -0,0 +1,189 @@
+package rmdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// orderedNames 按结果的顺序返回name
+func orderedNames(t *testing.T, db *Database, sql string) []string {
+	res, err := db.Query(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(res.result))
+	for _, line := range res.result {
+		names = append(names, FormatData(line.nameToVal["name"].value, STRING))
+	}
+	return names
+}
+
+// runSorting 把lines按顺序交给plan，返回输出的行
+func runSorting(plan *SortingPlan, wg *sync.WaitGroup, lines []*Line) []*Line {
+	childlines := make(chan *Line, len(lines))
+	for _, line := range lines {
+		childlines <- line
+	}
+	close(childlines)
+	plan.setChild(childlines)
+	wg.Add(1)
+	go plan.process()
+	result := make([]*Line, 0, len(lines))
+	for line := range plan.getParent() {
+		result = append(result, line)
+	}
+	wg.Wait()
+	return result
+}
+
+func TestSortingStable(t *testing.T) {
+	lines := make([]*Line, 0, 6)
+	for i, group := range []int64{2, 1, 2, 1, 2, 1} {
+		groupData, _ := EncodeData(group)
+		idData, _ := EncodeData(int64(i))
+		lines = append(lines, &Line{nameToVal: map[string]ColVal{
+			"group": {column: Column{Name: "group", TypeOf: INT64}, value: groupData},
+			"id":    {column: Column{Name: "id", TypeOf: INT64}, value: idData},
+		}})
+	}
+	var wg sync.WaitGroup
+	plan := &SortingPlan{basePlan: newBasePlan(&wg), keys: []sortKey{{colName: "group", desc: true}}}
+	ids := make([]string, 0, len(lines))
+	for _, line := range runSorting(plan, &wg, lines) {
+		ids = append(ids, FormatData(line.nameToVal["id"].value, INT64))
+	}
+	assert.Equal(t, []string{"0", "2", "4", "1", "3", "5"}, ids, "equal keys keep their order")
+}
+
+func TestSorting(t *testing.T) {
+	setTestOption(t)
+
+	for sql, expected := range map[string]string{
+		"select * from t order by a asc nulls last, b DESC NULLS FIRST, c desc": "select * from t order by a nulls last, b desc nulls first, c desc",
+		"select nulls from t order by nulls desc":                               "select nulls from t order by nulls desc",
+	} {
+		stmt, err := parseStatement(sql)
+		if assert.Nil(t, err, sql) {
+			assert.Equal(t, expected, stmt.String())
+		}
+	}
+	_, err := parseStatement("select * from t order by a nulls")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "syntax error at line 1 column 33: expected first or last", err.Error())
+	}
+
+	db, err := CreateDatabase("sorting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, city STRING, age INT64, score FLOAT64, born DATE)"))
+	for _, sql := range []string{
+		`insert into man (name, city, age, score, born) values ("a", "bj", 9, 2.5, "2001-01-01T00:00:00Z")`,
+		`insert into man (name, city, age, score, born) values ("b", "sh", 10, -1.25, "1999-12-31T00:00:00Z")`,
+		`insert into man (name, city, age, score, born) values ("c", "bj", -3, 10, "2010-06-01T00:00:00Z")`,
+		`insert into man (name, city, score) values ("d", "sh", -20)`,
+		`insert into man (name, city, age, score) values ("e", "gz", 100, 0.5)`,
+	} {
+		assert.Nil(t, db.Update(sql))
+	}
+	assert.Equal(t, []string{"d", "c", "a", "b", "e"}, orderedNames(t, db, "select * from man order by age"), "numbers sort by value, null first")
+	assert.Equal(t, []string{"e", "b", "a", "c", "d"}, orderedNames(t, db, "select * from man order by age desc"), "null last when descending")
+	assert.Equal(t, []string{"c", "a", "b", "e", "d"}, orderedNames(t, db, "select * from man order by age nulls last"))
+	assert.Equal(t, []string{"d", "e", "b", "a", "c"}, orderedNames(t, db, "select * from man order by age desc nulls first"))
+	assert.Equal(t, []string{"d", "b", "e", "a", "c"}, orderedNames(t, db, "select * from man order by score"))
+	assert.Equal(t, []string{"d", "e", "b", "a", "c"}, orderedNames(t, db, "select * from man order by born, name"))
+	assert.Equal(t, []string{"a", "c", "e", "b", "d"}, orderedNames(t, db, "select * from man order by city asc, age desc"), "each key has its own direction")
+	assert.Equal(t, []string{"b", "d", "e", "a", "c"}, orderedNames(t, db, "select * from man order by city desc, name"))
+	assert.Equal(t, []string{"a", "c", "d"}, orderedNames(t, db, "select name, age * -1 as neg from man order by neg nulls last limit 2, 3"), "aliases of expressions are sorted by value")
+	assert.Nil(t, db.Close())
+}
+
+func TestSortingSpill(t *testing.T) {
+	backend := NewMemBackend()
+	assert.Nil(t, backend.MkdirAll("db"))
+	lines := make([]*Line, 0, 100)
+	for i := 0; i < 100; i++ {
+		groupData, _ := EncodeData(int64(i * 7 % 10))
+		idData, _ := EncodeData(int64(i))
+		lines = append(lines, &Line{nameToVal: map[string]ColVal{
+			"group": {column: Column{Name: "group", TypeOf: INT64}, value: groupData},
+			"id":    {column: Column{Name: "id", TypeOf: INT64}, value: idData},
+			"none":  {column: Column{Name: "none", TypeOf: STRING}},
+		}, pageId: uint64(i), lineId: 1})
+	}
+	expected := make([]string, 0, len(lines))
+	for group := 9; group >= 0; group-- {
+		for i := 0; i < 100; i++ {
+			if i*7%10 == group {
+				expected = append(expected, fmt.Sprint(i))
+			}
+		}
+	}
+	for _, topN := range []uint64{0, 15, 1000} {
+		var wg sync.WaitGroup
+		plan := &SortingPlan{basePlan: newBasePlan(&wg), keys: []sortKey{{colName: "group", desc: true}},
+			backend: backend, dir: "db", budget: 2000, topN: topN}
+		ids := make([]string, 0, len(lines))
+		for _, line := range runSorting(plan, &wg, lines) {
+			ids = append(ids, FormatData(line.nameToVal["id"].value, INT64))
+			assert.Nil(t, line.nameToVal["none"].value, "null survives the run file")
+			assert.Equal(t, fmt.Sprint(line.pageId), ids[len(ids)-1], "page id survives the run file")
+		}
+		assert.Nil(t, plan.getErr())
+		want := expected
+		if topN > 0 && topN < uint64(len(want)) {
+			want = want[:topN]
+		}
+		assert.Equal(t, want, ids, "spilled runs merge in a stable order")
+		names, err := backend.ReadDir("db")
+		assert.Nil(t, err)
+		assert.Len(t, names, 0, "run files are removed")
+	}
+}
+
+func TestSortingSpillSql(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.SortBufferSize = 1024
+
+	db, err := CreateDatabase("spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, age INT64)"))
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Update(fmt.Sprintf(`insert into man (name, age) values ("%03d", %d)`, i, i%13)))
+	}
+	expected := make([]string, 0, 200)
+	for age := 12; age >= 0; age-- {
+		for i := age; i < 200; i += 13 {
+			expected = append(expected, fmt.Sprintf("%03d", i))
+		}
+	}
+	assert.Equal(t, expected, orderedNames(t, db, "select * from man order by age desc, name"))
+	assert.Equal(t, []string{"012", "025", "038"}, orderedNames(t, db, "select * from man order by age desc, name limit 3"), "top-n with limit")
+	assert.Equal(t, []string{"038", "051"}, orderedNames(t, db, "select * from man order by age desc, name limit 2, 2"))
+	assert.Len(t, orderedNames(t, db, "select * from man order by name limit 0"), 0)
+
+	dbPath := GlobalOption.Root + string(os.PathSeparator) + "spill"
+	entries, err := os.ReadDir(dbPath)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasSuffix(entry.Name(), spillSuffix), entry.Name())
+	}
+	assert.Nil(t, db.Close())
+
+	stale := dbPath + string(os.PathSeparator) + "sort_0.run"
+	assert.Nil(t, os.WriteFile(stale, []byte("stale"), 0644))
+	db, err = UseDatabase("spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "stale run files are removed on open")
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,144 @@
+package rmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// 排序和聚合超过内存预算时写到数据库目录下的临时文件，文件名是sort_或agg_加序号，查询结束就删除，
+// 崩溃时留下的在打开数据库时删除。每条记录前面是uvarint的长度
+
+const spillSuffix = ".run"
+
+var spillId atomic.Uint64
+
+// spillPath 临时文件的路径，序号在进程内递增
+func spillPath(dir, prefix string) string {
+	return fmt.Sprint(dir, string(os.PathSeparator), prefix, spillId.Add(1), spillSuffix)
+}
+
+// appendLine pageId、lineId和每一列的列名、类型、值，值的写法和appendKey一致
+func appendLine(record []byte, line *Line) []byte {
+	record = binary.AppendUvarint(record, line.pageId)
+	record = binary.AppendUvarint(record, line.lineId)
+	record = binary.AppendUvarint(record, uint64(len(line.nameToVal)))
+	for name, colVal := range line.nameToVal {
+		record = binary.AppendUvarint(record, uint64(len(name)))
+		record = append(record, name...)
+		record = binary.AppendVarint(record, int64(colVal.column.TypeOf))
+		record = appendKey(record, colVal.value)
+	}
+	return record
+}
+
+var errSpill = errors.New("invalid spill record")
+
+type spillReader struct {
+	data []byte
+}
+
+func (r *spillReader) uvarint() (uint64, error) {
+	val, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errSpill
+	}
+	r.data = r.data[n:]
+	return val, nil
+}
+
+func (r *spillReader) varint() (int64, error) {
+	val, n := binary.Varint(r.data)
+	if n <= 0 {
+		return 0, errSpill
+	}
+	r.data = r.data[n:]
+	return val, nil
+}
+
+func (r *spillReader) bytes(n uint64) ([]byte, error) {
+	if uint64(len(r.data)) < n {
+		return nil, errSpill
+	}
+	val := r.data[:n:n]
+	r.data = r.data[n:]
+	return val, nil
+}
+
+// value 和appendKey对应，NULL还原成nil
+func (r *spillReader) value() ([]byte, error) {
+	if len(r.data) == 0 {
+		return nil, errSpill
+	}
+	isNull := r.data[0] == 0
+	r.data = r.data[1:]
+	if isNull {
+		return nil, nil
+	}
+	length, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	return r.bytes(length)
+}
+
+// line 和appendLine对应，列只还原了列名和类型
+func (r *spillReader) line() (*Line, error) {
+	var header [3]uint64
+	for i := range header {
+		val, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		header[i] = val
+	}
+	line := &Line{nameToVal: make(map[string]ColVal, header[2]), pageId: header[0], lineId: header[1]}
+	for i := uint64(0); i < header[2]; i++ {
+		length, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		name, err := r.bytes(length)
+		if err != nil {
+			return nil, err
+		}
+		typeOf, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		colVal := ColVal{column: Column{Name: string(name), TypeOf: int(typeOf)}}
+		if colVal.value, err = r.value(); err != nil {
+			return nil, err
+		}
+		line.nameToVal[colVal.column.Name] = colVal
+	}
+	return line, nil
+}
+
+// lineSize 估算一行占用的内存
+func lineSize(line *Line) int64 {
+	size := int64(64)
+	for name, colVal := range line.nameToVal {
+		size += int64(len(name)+len(colVal.value)) + 64
+	}
+	return size
+}
+
+// removeSpillFiles 打开数据库时删掉上次没有删掉的临时文件
+func removeSpillFiles(backend Backend, dbPath string) error {
+	names, err := backend.ReadDir(dbPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if (strings.HasPrefix(name, "sort_") || strings.HasPrefix(name, "agg_")) && strings.HasSuffix(name, spillSuffix) {
+			if err = backend.Remove(fmt.Sprint(dbPath, string(os.PathSeparator), name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
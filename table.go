@@ -8,24 +8,41 @@ import (
 )
 
 type Table struct {
-	Name    string
-	file    FileIO
-	Columns []Column
-	cache   *LruCache
-	Catalog map[uint64]Page
-	txs     map[uint64]*Transaction
-	txId    uint64
-	updated bool
+	Name     string
+	db       *Database
+	file     FileIO
+	Columns  []Column
+	Version  uint64              `json:",omitempty"` // schema版本，删列和改类型时加一，加列和改名不需要
+	Schemas  map[uint64][]Column `json:",omitempty"` // 之前每个版本的列，旧的行按写入时的版本解码
+	ColumnId uint64              `json:",omitempty"` // 最后分配的列id
+	Sequence uint64              `json:",omitempty"` // auto_increment最后分配的值
+	Legacy   bool                `json:",omitempty"` // 页校验之前创建的表，可能还有没有页头的旧page
+	cache    *LruCache
+	Catalog  map[uint64]Page
+	txs      map[uint64]*Transaction
+	txId     uint64
+	updated  bool
+	merging  bool              // merge后的.tmp文件已经写好，等待改名为.data
+	Indexes  map[string]*Index `json:",omitempty"` // 索引名到B+tree索引
+	Primary  *Index            `json:",omitempty"` // 主键索引，目录中没有时用到才建立
+	reserved map[string]bool   // 正在提交的事务占用的主键和唯一索引的键
 }
 
 func (d *Database) CreateTable(name string) (*Table, error) {
+	return d.createTable(name, nil)
+}
+
+// createTable 建表和列在同一次checkpoint中落盘，列id从1开始
+func (d *Database) createTable(name string, columns []Column) (*Table, error) {
 	GlobalOption.lock.Lock()
 	defer GlobalOption.lock.Unlock()
+	d.ckptLock.Lock()
+	defer d.ckptLock.Unlock()
 	if _, ok := d.tables[name]; ok {
 		return nil, errors.New("table is exists")
 	}
 	tabPath := fmt.Sprint(d.dbPath, string(os.PathSeparator), name, ".data")
-	tabFile, err := OpenFile(tabPath)
+	tabFile, err := d.backend.OpenFile(tabPath)
 	if err != nil {
 		return nil, err
 	}
@@ -38,20 +55,25 @@ func (d *Database) CreateTable(name string) (*Table, error) {
 		maxLine:  GlobalOption.MaxLine,
 	}
 	table := &Table{
-		Name:    name,
-		file:    tabFile,
-		Columns: make([]Column, 0, 64),
-		cache:   cache,
-		Catalog: make(map[uint64]Page, 64),
+		Name:     name,
+		db:       d,
+		file:     tabFile,
+		Columns:  append(make([]Column, 0, 64), columns...),
+		ColumnId: uint64(len(columns)),
+		cache:    cache,
+		Catalog:  make(map[uint64]Page, 64),
 	}
 	cache.table = table
 	d.tables[name] = table
+	err = d.checkpoint() // ddl通过checkpoint持久化目录
+	if err != nil {
+		delete(d.tables, name)
+		return nil, err
+	}
 	return table, nil
 }
 
 func (t *Table) SetColumn(name string, typeOf int) error {
-	GlobalOption.lock.Lock()
-	defer GlobalOption.lock.Unlock()
 	if typeOf < BOOL || typeOf > DATE {
 		return errors.New("unsupported type")
 	}
@@ -59,25 +81,223 @@ func (t *Table) SetColumn(name string, typeOf int) error {
 	if err != nil {
 		return err
 	}
-	column := Column{
+	return t.AddColumn(name, typeOf, defVal)
+}
+
+// AddColumn 在最后加一列，之前写入的行这一列的值是defVal，defVal为nil时是NULL
+func (t *Table) AddColumn(name string, typeOf int, defVal []byte) error {
+	return t.addColumn(Column{
 		Name:   name,
 		TypeOf: typeOf,
 		DefVal: defVal,
+	})
+}
+
+// addColumn 加一列，带约束时先检查已有的行
+func (t *Table) addColumn(column Column) error {
+	if column.TypeOf < BOOL || column.TypeOf > DATE {
+		return errors.New("unsupported type")
+	}
+	if _, err := DecodeData(column.DefVal, column.TypeOf); err != nil {
+		return fmt.Errorf("invalid default value: %w", err)
+	}
+	var check func(columns []Column) error
+	if column.NotNull || column.Unique || column.Check != "" {
+		check = func(columns []Column) error {
+			return t.checkNewColumn(column)
+		}
+	}
+	return t.alter(false, check, func(columns []Column) ([]Column, error) {
+		if columnIndex(columns, column.Name) >= 0 {
+			return nil, errors.New("column is exists")
+		}
+		column.Id = t.ColumnId + 1
+		return append(columns, column), nil
+	})
+}
+
+// DropColumn 删除一列，旧的行不重写，读取时丢弃这一列的值
+func (t *Table) DropColumn(name string) error {
+	return t.alter(true, nil, func(columns []Column) ([]Column, error) {
+		index := columnIndex(columns, name)
+		if index < 0 {
+			return nil, errors.New("column not exists")
+		}
+		if len(columns) == 1 {
+			return nil, errors.New("cannot drop the only column")
+		}
+		if columns[index].PrimaryKey {
+			return nil, errors.New("cannot drop the primary key column")
+		}
+		if indexName := t.indexOn(columns[index]); indexName != "" {
+			return nil, fmt.Errorf("column is used by index %s", indexName)
+		}
+		return append(columns[:index], columns[index+1:]...), nil
+	})
+}
+
+func (t *Table) RenameColumn(oldName, newName string) error {
+	if !identReg.MatchString(newName) {
+		return fmt.Errorf("invalid column name %s", newName)
+	}
+	return t.alter(false, nil, func(columns []Column) ([]Column, error) {
+		index := columnIndex(columns, oldName)
+		if index < 0 {
+			return nil, errors.New("column not exists")
+		}
+		if columnIndex(columns, newName) >= 0 {
+			return nil, errors.New("column is exists")
+		}
+		columns[index].Name = newName
+		return columns, nil
+	})
+}
+
+// ModifyColumn 修改列的类型，已有的值都要能转换，否则不做修改
+func (t *Table) ModifyColumn(name string, typeOf int) error {
+	if typeOf < BOOL || typeOf > DATE {
+		return errors.New("unsupported type")
+	}
+	var old Column
+	check := func(columns []Column) error { // 调用方持有cache锁
+		for i := uint64(1); i < t.cache.pageId; i++ {
+			page, err := t.cache.GetPage(i)
+			if err != nil {
+				return err
+			}
+			if page == nil {
+				continue
+			}
+			for _, line := range page.lines {
+				if _, err := convertData(line.nameToVal[name].value, old.TypeOf, typeOf); err != nil {
+					return fmt.Errorf("column %s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	}
+	return t.alter(true, check, func(columns []Column) ([]Column, error) {
+		index := columnIndex(columns, name)
+		if index < 0 {
+			return nil, errors.New("column not exists")
+		}
+		old = columns[index]
+		if old.AutoIncrement && typeOf != INT64 {
+			return nil, errors.New("auto_increment column must be INT64")
+		}
+		if indexName := t.indexOn(old); indexName != "" && typeOf != old.TypeOf { // 索引中的键按类型编码
+			return nil, fmt.Errorf("column is used by index %s", indexName)
+		}
+		defVal, err := convertData(old.DefVal, old.TypeOf, typeOf)
+		if err != nil { // 新版本的行都有这一列，默认值用不到
+			defVal = nil
+		}
+		if old.HasDefault {
+			columns[index].Default, err = convertData(old.Default, old.TypeOf, typeOf)
+			if err != nil {
+				return nil, fmt.Errorf("default of column %s: %w", name, err)
+			}
+		}
+		columns[index].TypeOf = typeOf
+		columns[index].DefVal = defVal
+		return columns, nil
+	})
+}
+
+func columnIndex(columns []Column, name string) int {
+	for i, column := range columns {
+		if column.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// alter 修改表结构。先checkpoint让已提交的修改都按旧结构写入page，清空缓存后换成新结构，之后的page按新结构解码，
+// 最后checkpoint把目录落盘。bump为true时旧的列记入Schemas，版本加一
+func (t *Table) alter(bump bool, check func(columns []Column) error, change func(columns []Column) ([]Column, error)) error {
+	GlobalOption.lock.Lock()
+	defer GlobalOption.lock.Unlock()
+	t.db.ckptLock.Lock()
+	defer t.db.ckptLock.Unlock()
+	columns, err := change(append(make([]Column, 0, len(t.Columns)+1), t.Columns...))
+	if err != nil {
+		return err
+	}
+	err = t.db.checkpoint()
+	if err != nil {
+		return err
+	}
+	oldColumns, oldVersion, oldSchemas, oldColumnId := t.Columns, t.Version, t.Schemas, t.ColumnId
+	t.cache.lock.Lock()
+	if check != nil {
+		err = check(columns)
+	}
+	if err == nil {
+		err = t.Close()
+	}
+	if err != nil {
+		t.cache.lock.Unlock()
+		return err
+	}
+	if bump {
+		t.Schemas = make(map[uint64][]Column, len(oldSchemas)+1)
+		for version, columns := range oldSchemas {
+			t.Schemas[version] = columns
+		}
+		t.Schemas[t.Version] = oldColumns
+		t.Version++
+	}
+	t.Columns = columns
+	for _, column := range columns {
+		if column.Id > t.ColumnId {
+			t.ColumnId = column.Id
+		}
+	}
+	oldPrimary, err := t.rebuildPrimary(oldColumns)
+	t.cache.lock.Unlock()
+	if err == nil {
+		err = t.db.checkpoint()
+	}
+	if err != nil {
+		t.cache.lock.Lock()
+		t.Columns, t.Version, t.Schemas, t.ColumnId = oldColumns, oldVersion, oldSchemas, oldColumnId
+		if oldPrimary != nil {
+			t.Primary.restore(*oldPrimary)
+		}
+		_ = t.Close() // 都是干净的page，按旧结构重新读
+		t.cache.lock.Unlock()
+		return err
 	}
-	t.Columns = append(t.Columns, column)
 	return nil
 }
 
 func (d *Database) DropTable(name string) error {
 	GlobalOption.lock.Lock()
 	defer GlobalOption.lock.Unlock()
+	d.ckptLock.Lock()
+	defer d.ckptLock.Unlock()
 	if table, ok := d.tables[name]; ok {
 		delete(d.tables, name)
-		err := table.file.Close()
+		err := d.checkpoint() // 先把不含这张表的目录落盘再删文件
+		if err != nil {
+			d.tables[name] = table
+			return err
+		}
+		err = table.file.Close()
+		if err == nil {
+			err = table.closeIndexes()
+		}
 		if err != nil {
 			return err
 		}
-		return os.Remove(table.file.Name())
+		for _, index := range table.allIndexes() {
+			err = d.backend.Remove(index.cache.file.Name())
+			if err != nil {
+				return err
+			}
+		}
+		return d.backend.Remove(table.file.Name())
 	} else {
 		return errors.New("table not exists")
 	}
@@ -93,12 +313,16 @@ func (t *Table) Close() error {
 	return nil
 }
 
+// Merge 把有效的page紧凑地写入.tmp文件，先落盘并记入目录再改名覆盖.data，任何时候崩溃目录和数据文件都是一致的
 func (t *Table) Merge(dbPath string) error {
+	backend := t.db.backend
 	tabPath := fmt.Sprint(dbPath, string(os.PathSeparator), t.Name, ".tmp")
-	tabFile, err := OpenFile(tabPath)
+	_ = backend.Remove(tabPath) // 上次merge失败留下的
+	tabFile, err := backend.OpenFile(tabPath)
 	if err != nil {
 		return err
 	}
+	pages := make(map[uint64]Page, len(t.Catalog))
 	offset := uint64(0)
 	for id, page := range t.Catalog {
 		if page.Length > 0 {
@@ -106,39 +330,60 @@ func (t *Table) Merge(dbPath string) error {
 			data := make([]byte, page.Length)
 			_, err = t.file.ReadAt(data, int64(page.Offset))
 			if err != nil {
-				return err
+				break
 			}
 			_, err = tabFile.Write(data)
 			if err != nil {
-				return err
+				break
 			}
-			t.Catalog[id] = Page{
+			pages[id] = Page{
 				Id:     page.Id,
 				Offset: offset,
 				Length: page.Length,
 			}
 			offset += page.Length
 
-		} else {
-			delete(t.Catalog, id)
 		}
 	}
-	err = tabFile.Close()
+	if err == nil {
+		err = tabFile.Sync()
+	}
+	if closeErr := tabFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		_ = backend.Remove(tabPath)
+		return err
+	}
+
+	t.Catalog = pages
+	t.merging = true
+	err = t.db.saveCatalog() // 目录中记下merging，改名前崩溃时打开数据库会完成改名
+	if err != nil {          // 不确定新目录是否已经生效，保留.tmp，打开数据库时根据目录决定改名还是删除
 		return err
 	}
 	err = t.file.Close()
 	if err != nil {
 		return err
 	}
-	oldPath := t.file.Name()
-	err = os.Remove(oldPath)
+	err = finishMerge(backend, dbPath, t.Name)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tabPath, oldPath)
+	t.merging = false
+	return t.db.saveCatalog()
+}
+
+func finishMerge(backend Backend, dbPath, name string) error {
+	tabPath := fmt.Sprint(dbPath, string(os.PathSeparator), name, ".tmp")
+	oldPath := fmt.Sprint(dbPath, string(os.PathSeparator), name, ".data")
+	err := backend.Remove(oldPath) // windows不能rename覆盖已有文件
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = backend.Rename(tabPath, oldPath)
 	if err != nil {
 		return err
 	}
-	return nil
+	return backend.SyncDir(dbPath)
 }
@@ -2,14 +2,16 @@ package rmdb
 
 import (
 	"errors"
-	"strings"
 	"sync"
 )
 
 type Transaction struct { // 事务中不允许create drop use table database的操作
-	db       *Database
-	subTxs   map[string]*SubTx
-	isUpdate bool
+	db        *Database
+	subTxs    map[string]*SubTx
+	txId      uint64 // wal中的事务id，第一次写wal时分配
+	isUpdate  bool
+	isReplay  bool // 重放wal时不再重复写wal
+	committed bool // commit记录已经写入wal，不能再回滚
 }
 
 type SubTx struct {
@@ -38,132 +40,153 @@ func (d *Database) Begin() *Transaction {
 }
 
 func (t *Transaction) Commit() error {
+	t.db.ckptLock.RLock()
+	defer t.db.ckptLock.RUnlock()
+	if err := t.db.checkBroken(); err != nil {
+		return err
+	}
 	if t.isUpdate {
+		reserved, err := t.reserveKeys() // 键重复时事务还没有提交，可以回滚
+		if err != nil {
+			return err
+		}
+		defer t.releaseKeys(reserved)
+		lsn, err := t.logCommit()
+		if err != nil {
+			return t.db.setBroken(err)
+		}
+		t.committed = true
+		err = t.db.wal.sync(lsn) // 按数据库的持久化模式等待commit记录落盘
+		if err != nil {
+			return t.db.setBroken(err)
+		}
 		for tableName, subTx := range t.subTxs {
-			table := t.db.tables[tableName]
-
-			table.cache.lock.Lock()
-
-			for pageId, memTable := range subTx.memTables {
-				if pageId != 0 && !memTable.isOrigin {
-					page, err := table.cache.GetPage(pageId)
-					if err != nil {
-						return err
-					}
-					tmp := page.lines // 交换page和memtable的lines
-					page.lines = memTable.lines
-					memTable.lines = tmp
-					page.isDirty = true
-					memTable.isSwap = true
-				}
-			}
-			// 先update和delete再insert
-			for _, line := range subTx.memTables[0].lines {
-				if table.cache.pageId == 1 { //cache.pageid是下一个page的id
-					page, err := table.cache.NewPage()
-					if err != nil {
-						return err
-					}
-					page.InsertLine(line)
-				} else {
-					page, err := table.cache.GetPage(table.cache.pageId - 1)
-					if err != nil {
-						return err
-					}
-					inserted := page.InsertLine(line)
-					if !inserted {
-						page, err = table.cache.NewPage()
-						if err != nil {
-							return err
-						}
-						page.InsertLine(line)
-					}
-				}
+			err = t.apply(t.db.tables[tableName], subTx)
+			if err != nil { // commit记录已经写入wal，只能重新打开数据库从wal恢复
+				return t.db.setBroken(err)
 			}
-
-			table.cache.lock.Unlock()
-
 		}
 	}
 	return nil
 }
 
-func (t *Transaction) Rollback() error {
-	for tableName, subTx := range t.subTxs {
-		table := t.db.tables[tableName]
-
-		table.cache.lock.Lock()
+func (t *Transaction) apply(table *Table, subTx *SubTx) error {
+	table.cache.lock.Lock()
+	defer table.cache.lock.Unlock()
 
-		for i := uint64(1); i < uint64(len(subTx.memTables)); i++ {
-			if memTable, ok := subTx.memTables[i]; ok && memTable.isSwap {
-				page, err := table.cache.GetPage(i)
-				if err != nil {
-					return err
-				}
-				tmp := page.lines
-				page.lines = memTable.lines
-				memTable.lines = tmp
+	for pageId, memTable := range subTx.memTables {
+		if pageId != 0 && !memTable.isOrigin {
+			page, err := table.cache.GetPage(pageId)
+			if err != nil {
+				return err
 			}
+			tmp := page.lines // 交换page和memtable的lines
+			if err = table.updateIndexes(pageId, tmp, memTable.lines); err != nil {
+				return err
+			}
+			page.lines = memTable.lines
+			memTable.lines = tmp
+			page.isDirty = true
+			memTable.isSwap = true
 		}
-
-		for _, line := range subTx.memTables[0].lines {
-			page, err := table.cache.GetPage(line.pageId)
+	}
+	// 先update和delete再insert
+	for _, line := range subTx.memTables[0].lines {
+		var page *Page
+		var err error
+		if table.cache.pageId == 1 { //cache.pageid是下一个page的id
+			page, err = table.cache.NewPage()
 			if err != nil {
 				return err
 			}
-			delete(page.lines, line.lineId)
-			page.isDirty = true
+			page.InsertLine(line)
+		} else {
+			page, err = table.cache.GetPage(table.cache.pageId - 1)
+			if err != nil {
+				return err
+			}
+			inserted := page.InsertLine(line)
+			if !inserted {
+				page, err = table.cache.NewPage()
+				if err != nil {
+					return err
+				}
+				page.InsertLine(line)
+			}
 		}
+		line.pageId = page.Id
+		if err = table.updateIndexes(page.Id, nil, map[uint64]Line{line.lineId: line}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		table.cache.lock.Unlock()
-
+// Rollback 放弃还没有提交的事务，修改都在memtable中，丢掉即可
+func (t *Transaction) Rollback() error {
+	t.db.ckptLock.RLock()
+	defer t.db.ckptLock.RUnlock()
+	if t.committed {
+		return errors.New("transaction has been committed")
+	}
+	for tableName, subTx := range t.subTxs {
+		subTx.memTables = map[uint64]*Memtable{0: {lines: make(map[uint64]Line)}}
+		t.subTxs[tableName] = subTx
+	}
+	t.isUpdate = false
+	err := t.logAbort()
+	if err != nil {
+		return t.db.setBroken(err)
 	}
 	return nil
 }
 
 func (t *Transaction) Update(sql string) error {
+	if err := t.db.checkBroken(); err != nil {
+		return err
+	}
+	if isDDL(sql) {
+		return errors.New("ddl is not allowed in a transaction")
+	}
 	t.isUpdate = true
-	sqlBytes := []byte(sql + "\n")
-
-	t.db.walLock.Lock()
-	_, err := t.db.wal.Write(sqlBytes)
-	t.db.walLock.Unlock()
-
+	stmts, err := Parse(sql)
 	if err != nil {
 		return err
 	}
-	sql = strings.Trim(sql, "; ")
-	success := CheckParentheses(sql)
-	if !success {
-		return errors.New("invaild parentheses")
-	}
-	sqls := strings.Split(sql, ";")
-	for _, uni := range sqls {
-		uni = strings.Trim(uni, "\n\t ")
-		if len(uni) == 0 {
-			continue
-		}
-		err = t.CompileUpdate(uni)
+	for _, stmt := range stmts {
+		logged, err := t.compileStatement(stmt)
 		if err != nil {
 			return err
 		}
+		err = t.logUpdate(logged)
+		if err != nil {
+			return t.db.setBroken(err)
+		}
 	}
 	return nil
 }
 
 func (t *Transaction) Query(sql string) (*ResultSet, error) {
+	if err := t.db.checkBroken(); err != nil {
+		return nil, err
+	}
 	var wg sync.WaitGroup
-	sql = strings.Trim(sql, "; ")
-	success := CheckParentheses(sql)
-	if !success {
-		return nil, errors.New("invaild parentheses")
+	stmt, err := parseStatement(sql)
+	if err != nil {
+		return nil, err
+	}
+	query, ok := stmt.(*SelectStmt)
+	if !ok {
+		return nil, errors.New("not a query")
+	}
+	logicalPlans, outOuder, tableName, err := t.CompileQuery(query, &wg)
+	if err != nil {
+		return nil, err
 	}
-	slice := ConvertQuery(sql)
-	logicalPlans, outOuder, tableName, err := t.CompileQuery(slice, &wg)
+	resultSet, err := execute(logicalPlans, outOuder, &wg)
 	if err != nil {
 		return nil, err
 	}
-	resultSet := execute(logicalPlans, outOuder, &wg)
 
 	table := t.db.tables[tableName]
 	subTx := t.subTxs[tableName]
@@ -172,6 +195,7 @@ func (t *Transaction) Query(sql string) (*ResultSet, error) {
 		if _, ok := subTx.memTables[line.pageId]; !ok {
 			memTable, err := table.cache.CopyPage(line.pageId)
 			if err != nil {
+				table.cache.lock.Unlock()
 				return nil, err
 			}
 			subTx.memTables[line.pageId] = memTable
@@ -1,7 +1,6 @@
 package rmdb
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"sync"
@@ -467,22 +466,14 @@ func TestCurCorrect(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 20000, len(res.result), "result should be 20000 line")
 	for _, line := range res.result {
-		nameData := line.nameToVal["name"].value
-		ageData := line.nameToVal["age"].value
-		idData := line.nameToVal["id"].value
-		priceData := line.nameToVal["price"].value
-		var num int
-		var dst int64
-		_ = json.Unmarshal(ageData, &dst)
-		num = int(dst)
-		nameStr, _ := json.Marshal(fmt.Sprint("iam", num))
-		ageStr, _ := json.Marshal(int64(num))
-		idStr, _ := json.Marshal(int64(num + 1))
-		priceStr, _ := json.Marshal(float64(num) * 0.01)
-		assert.Equal(t, string(nameStr), string(nameData), "name should equal")
-		assert.Equal(t, string(ageStr), string(ageData), "age should equal")
-		assert.Equal(t, string(idStr), string(idData), "id should equal")
-		assert.Equal(t, string(priceStr), string(priceData), "price should equal")
+		nameData, _ := DecodeData(line.nameToVal["name"].value, STRING)
+		ageData, _ := DecodeData(line.nameToVal["age"].value, INT64)
+		idData, _ := DecodeData(line.nameToVal["id"].value, INT64)
+		priceData, _ := DecodeData(line.nameToVal["price"].value, FLOAT64)
+		num := ageData.(int64)
+		assert.Equal(t, fmt.Sprint("iam", num), nameData, "name should equal")
+		assert.Equal(t, num+1, idData, "id should equal")
+		assert.Equal(t, float64(num)*0.01, priceData, "price should equal")
 	}
 	err = db.Close()
 	assert.Nil(t, err)
@@ -550,14 +541,14 @@ func TestRepeatedRead(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, 1, len(res.result), "result should be 1 line")
 		line := res.result[0]
-		nameData := line.nameToVal["name"].value
-		ageData := line.nameToVal["age"].value
-		idData := line.nameToVal["id"].value
-		priceData := line.nameToVal["price"].value
-		assert.Equal(t, "\"kaguoka\"", string(nameData), "name should equal")
-		assert.Equal(t, "5", string(ageData), "age should equal")
-		assert.Equal(t, "1", string(idData), "id should equal")
-		assert.Equal(t, "6.66", string(priceData), "price should equal")
+		nameData := FormatData(line.nameToVal["name"].value, STRING)
+		ageData := FormatData(line.nameToVal["age"].value, INT64)
+		idData := FormatData(line.nameToVal["id"].value, INT64)
+		priceData := FormatData(line.nameToVal["price"].value, FLOAT64)
+		assert.Equal(t, "kaguoka", nameData, "name should equal")
+		assert.Equal(t, "5", ageData, "age should equal")
+		assert.Equal(t, "1", idData, "id should equal")
+		assert.Equal(t, "6.66", priceData, "price should equal")
 
 	}
 
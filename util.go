@@ -2,17 +2,184 @@ package rmdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// 值在内存和page中的编码：BOOL 1字节，INT64 zigzag varint，FLOAT64 8字节小端，STRING 原始utf-8，DATE unix纳秒的varint
+// 零值时间超出了纳秒能表示的范围，用zeroDate表示
+// NULL编码为nil，空字符串是长度为0但不为nil的切片，两者不能混用
+
+const zeroDate = math.MinInt64
+
 func EncodeData(data any) ([]byte, error) {
-	return json.Marshal(data)
+	switch val := data.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if val {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case int64:
+		return binary.AppendVarint(nil, val), nil
+	case int:
+		return binary.AppendVarint(nil, int64(val)), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(val)), nil
+	case string:
+		return []byte(val), nil
+	case time.Time:
+		if val.IsZero() {
+			return binary.AppendVarint(nil, zeroDate), nil
+		}
+		return binary.AppendVarint(nil, val.UnixNano()), nil
+	case *time.Time:
+		if val == nil {
+			return nil, nil
+		}
+		return EncodeData(*val)
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", data)
+	}
 }
 
+// DecodeData NULL解码为nil
 func DecodeData(data []byte, typeOf int) (any, error) {
+	if data == nil {
+		return nil, nil
+	}
+	switch typeOf {
+	case BOOL:
+		if len(data) != 1 || data[0] > 1 {
+			return false, errors.New("invalid bool value")
+		}
+		return data[0] == 1, nil
+	case INT64:
+		val, n := binary.Varint(data)
+		if n <= 0 || n != len(data) {
+			return int64(0), errors.New("invalid int64 value")
+		}
+		return val, nil
+	case FLOAT64:
+		if len(data) != 8 {
+			return float64(0), errors.New("invalid float64 value")
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case STRING:
+		if !utf8.Valid(data) {
+			return "", errors.New("invalid utf-8 string value")
+		}
+		return string(data), nil
+	case DATE:
+		val, n := binary.Varint(data)
+		if n <= 0 || n != len(data) {
+			return time.Time{}, errors.New("invalid date value")
+		}
+		if val == zeroDate {
+			return time.Time{}, nil
+		}
+		return time.Unix(0, val), nil
+	default:
+		return nil, nil
+	}
+}
+
+// ParseLiteral 把sql中的字面量转换成列类型的编码，字面量沿用json的写法，字符串和日期要加双引号，null不区分大小写
+func ParseLiteral(text string, typeOf int) ([]byte, error) {
+	if strings.EqualFold(text, "null") {
+		return nil, nil
+	}
+	val, err := decodeJSON([]byte(text), typeOf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %s: %w", text, err)
+	}
+	return EncodeData(val)
+}
+
+// FormatData 把编码后的值转换成展示用的字符串
+func FormatData(data []byte, typeOf int) string {
+	if data == nil {
+		return "NULL"
+	}
+	val, err := DecodeData(data, typeOf)
+	if err != nil {
+		return string(data)
+	}
+	switch val := val.(type) {
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// convertData 修改列类型时转换旧的值，不能无损转换的返回错误
+func convertData(data []byte, from, to int) ([]byte, error) {
+	if data == nil || from == to {
+		return data, nil
+	}
+	val, err := DecodeData(data, from)
+	if err != nil {
+		return nil, err
+	}
+	if to == STRING {
+		return EncodeData(FormatData(data, from))
+	}
+	var converted any
+	switch val := val.(type) {
+	case bool:
+		if to == INT64 {
+			converted = int64(0)
+			if val {
+				converted = int64(1)
+			}
+		}
+	case int64:
+		switch to {
+		case BOOL:
+			if val == 0 || val == 1 {
+				converted = val == 1
+			}
+		case FLOAT64:
+			if val >= -1<<53 && val <= 1<<53 { // 超出这个范围float64不能精确表示
+				converted = float64(val)
+			}
+		}
+	case float64:
+		if to == INT64 && val == math.Trunc(val) && val >= math.MinInt64 && val < math.MaxInt64 {
+			converted = int64(val)
+		}
+	case string:
+		switch to {
+		case BOOL:
+			converted, err = strconv.ParseBool(val)
+		case INT64:
+			converted, err = strconv.ParseInt(val, 10, 64)
+		case FLOAT64:
+			converted, err = strconv.ParseFloat(val, 64)
+		case DATE:
+			converted, err = time.Parse(time.RFC3339Nano, val)
+		}
+		if err != nil {
+			converted = nil
+		}
+	}
+	if converted == nil {
+		return nil, fmt.Errorf("cannot convert %s to %s", FormatData(data, from), typeName(to))
+	}
+	return EncodeData(converted)
+}
+
+func decodeJSON(data []byte, typeOf int) (any, error) { // 格式版本2之前page中的值是json
 	switch typeOf {
 	case BOOL:
 		var dst bool
@@ -35,7 +202,7 @@ func DecodeData(data []byte, typeOf int) (any, error) {
 		err := json.Unmarshal(data, &dst)
 		return dst, err
 	default:
-		return nil, nil
+		return nil, errors.New("unsupported type")
 	}
 }
 
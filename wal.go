@@ -0,0 +1,501 @@
+package rmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wal记录格式，小端序：
+// | crc32 (4) | length (4) | lsn (8) | txId (8) | type (1) | data (length) |
+// crc32覆盖length到data结尾，update记录的data是一条编译成功的sql（逻辑redo）
+
+const (
+	walBegin = iota + 1
+	walUpdate
+	walCommit
+	walAbort
+)
+
+const walHeaderSize = 25
+
+var ErrTornRecord = errors.New("torn wal record")
+
+type Wal struct {
+	file       FileIO
+	backend    Backend
+	path       string
+	lsn        uint64            // 下一条记录的lsn，从1开始
+	txId       uint64            // 最后分配的事务id
+	flushed    uint64            // 已经fsync的最大lsn
+	active     map[uint64]uint64 // 未结束的事务id到begin记录lsn，截断wal时要保留它们的记录
+	durability int
+	err        error      // 写入或fsync失败后wal末尾的状态未知，之后的写入全部拒绝
+	syncing    bool       // group commit时是否已经有leader在fsync
+	cond       *sync.Cond // 等待leader fsync完成
+	stop       chan struct{}
+	done       sync.WaitGroup
+	lock       sync.Mutex
+}
+
+type WalRecord struct {
+	Lsn, TxId uint64
+	Type      byte
+	Data      []byte
+}
+
+func OpenWal(backend Backend, path string) (*Wal, error) {
+	file, err := backend.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &Wal{
+		file:       file,
+		backend:    backend,
+		path:       path,
+		lsn:        1,
+		durability: SyncCommit,
+		active:     make(map[uint64]uint64, 64),
+	}
+	w.cond = sync.NewCond(&w.lock)
+	return w, nil
+}
+
+func EncodeRecord(record WalRecord) []byte {
+	buf := make([]byte, walHeaderSize+len(record.Data))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(record.Data)))
+	binary.LittleEndian.PutUint64(buf[8:16], record.Lsn)
+	binary.LittleEndian.PutUint64(buf[16:24], record.TxId)
+	buf[24] = record.Type
+	copy(buf[walHeaderSize:], record.Data)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func DecodeRecord(data []byte) (WalRecord, int, error) {
+	if len(data) < walHeaderSize {
+		return WalRecord{}, 0, ErrTornRecord
+	}
+	length := int(binary.LittleEndian.Uint32(data[4:8]))
+	if length > len(data)-walHeaderSize {
+		return WalRecord{}, 0, ErrTornRecord
+	}
+	end := walHeaderSize + length
+	if crc32.ChecksumIEEE(data[4:end]) != binary.LittleEndian.Uint32(data[0:4]) {
+		return WalRecord{}, 0, ErrTornRecord
+	}
+	record := WalRecord{
+		Lsn:  binary.LittleEndian.Uint64(data[8:16]),
+		TxId: binary.LittleEndian.Uint64(data[16:24]),
+		Type: data[24],
+		Data: data[walHeaderSize:end],
+	}
+	if record.Lsn == 0 || record.Type < walBegin || record.Type > walAbort {
+		return WalRecord{}, 0, ErrTornRecord
+	}
+	return record, end, nil
+}
+
+// DecodeRecords 解析到第一条损坏的记录为止，返回有效记录和有效数据的长度
+func DecodeRecords(data []byte) ([]WalRecord, int) {
+	records := make([]WalRecord, 0, 64)
+	offset := 0
+	for offset < len(data) {
+		record, n, err := DecodeRecord(data[offset:])
+		if err != nil {
+			break
+		}
+		records = append(records, record)
+		offset += n
+	}
+	return records, offset
+}
+
+func (w *Wal) append(txId uint64, typeOf byte, data []byte) (uint64, error) { // 调用方持有w.lock
+	if w.err != nil {
+		return 0, w.err
+	}
+	record := WalRecord{
+		Lsn:  w.lsn,
+		TxId: txId,
+		Type: typeOf,
+		Data: data,
+	}
+	_, err := w.file.Write(EncodeRecord(record))
+	if err != nil { // 可能写了半条记录，后面的记录接在它后面恢复时会被丢掉
+		w.err = err
+		return 0, err
+	}
+	w.lsn++
+	return record.Lsn, nil
+}
+
+func (w *Wal) Name() string {
+	return w.path
+}
+
+func (w *Wal) Close() error {
+	w.stopFlusher()
+	return w.file.Close()
+}
+
+func (w *Wal) setDurability(durability int) {
+	w.lock.Lock()
+	old := w.durability
+	w.durability = durability
+	w.lock.Unlock()
+	if old == durability {
+		return
+	}
+	if old == AsyncCommit {
+		w.stopFlusher()
+	}
+	if durability == AsyncCommit {
+		w.stop = make(chan struct{})
+		w.done.Add(1)
+		go w.runFlusher(w.stop)
+	}
+}
+
+// sync 在commit记录写入后调用，按持久化模式决定是否等待fsync
+func (w *Wal) sync(lsn uint64) error {
+	if lsn == 0 {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	switch w.durability {
+	case SyncCommit:
+		if w.flushed >= lsn {
+			return nil
+		}
+		target := w.lsn - 1
+		err := w.file.Sync()
+		if err != nil { // fsync失败后不能确定哪些数据已经落盘
+			w.err = err
+			return err
+		}
+		w.flushed = target
+	case GroupCommit:
+		for w.flushed < lsn {
+			if w.err != nil { // leader的fsync失败了
+				return w.err
+			}
+			if w.syncing { // 已经有leader，等它把自己的记录一起刷下去
+				w.cond.Wait()
+				continue
+			}
+			w.syncing = true // 成为leader，等一个窗口让并发的事务写入commit记录
+			w.lock.Unlock()
+			time.Sleep(GlobalOption.GroupCommitWindow)
+			w.lock.Lock()
+			target := w.lsn - 1
+			file := w.file
+			w.lock.Unlock() // fsync时不阻塞其它事务写wal
+			err := file.Sync()
+			w.lock.Lock()
+			w.syncing = false
+			if err == nil && target > w.flushed {
+				w.flushed = target
+			}
+			if err != nil {
+				w.err = err
+			}
+			w.cond.Broadcast()
+			if w.err != nil {
+				return w.err
+			}
+		}
+	case AsyncCommit: // 由后台flusher定期fsync
+	}
+	return nil
+}
+
+func (w *Wal) runFlusher(stop chan struct{}) {
+	ticker := time.NewTicker(GlobalOption.FlushInterval)
+	defer func() {
+		ticker.Stop()
+		w.done.Done()
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.lock.Lock()
+			if w.err == nil && w.flushed < w.lsn-1 {
+				target := w.lsn - 1
+				err := w.file.Sync()
+				if err != nil {
+					w.err = err
+					logger.Errorf("rmdb: flush wal %s failed: %s\n", w.path, err)
+				} else {
+					w.flushed = target
+				}
+			}
+			w.lock.Unlock()
+		}
+	}
+}
+
+func (w *Wal) stopFlusher() {
+	w.lock.Lock()
+	stop := w.stop
+	w.stop = nil
+	w.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		w.done.Wait()
+	}
+}
+
+func (w *Wal) reset() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.file.Close()
+	if err != nil {
+		return err
+	}
+	err = w.backend.Remove(w.path)
+	if err != nil {
+		return err
+	}
+	w.file, err = w.backend.OpenFile(w.path)
+	return err
+}
+
+// truncate 删除checkpoint lsn之前的记录，还没结束的事务从begin记录开始保留
+func (w *Wal) truncate(lsn uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	keep := lsn + 1
+	for _, begin := range w.active {
+		if begin < keep {
+			keep = begin
+		}
+	}
+	data, err := w.backend.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	records, end := DecodeRecords(data)
+	offset := 0
+	for _, record := range records {
+		if record.Lsn >= keep {
+			break
+		}
+		offset += walHeaderSize + len(record.Data)
+	}
+	tmpPath := w.path + ".tmp"
+	_ = w.backend.Remove(tmpPath)
+	tmpFile, err := w.backend.OpenFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if offset < end {
+		_, err = tmpFile.Write(data[offset:end])
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = w.file.Close()
+	if err == nil {
+		err = w.backend.Rename(tmpPath, w.path)
+	}
+	if err == nil {
+		w.file, err = w.backend.OpenFile(w.path)
+	}
+	if err != nil { // 旧的wal已经关闭，不能再写了
+		w.err = err
+		return err
+	}
+	w.flushed = w.lsn - 1 // 保留下来的记录在临时文件中已经fsync
+	return nil
+}
+
+func (t *Transaction) logUpdate(sql string) error {
+	if t.isReplay {
+		return nil
+	}
+	w := t.db.wal
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if t.txId == 0 { // 第一条更新语句时才写begin，只读事务不写wal
+		w.txId++
+		t.txId = w.txId
+		lsn, err := w.append(t.txId, walBegin, nil)
+		if err != nil {
+			return err
+		}
+		w.active[t.txId] = lsn
+	}
+	_, err := w.append(t.txId, walUpdate, []byte(sql))
+	return err
+}
+
+func (t *Transaction) logCommit() (uint64, error) {
+	if t.isReplay || t.txId == 0 {
+		return 0, nil
+	}
+	w := t.db.wal
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.active, t.txId)
+	return w.append(t.txId, walCommit, nil)
+}
+
+func (t *Transaction) logAbort() error {
+	if t.isReplay || t.txId == 0 {
+		return nil
+	}
+	w := t.db.wal
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.active, t.txId)
+	_, err := w.append(t.txId, walAbort, nil)
+	return err
+}
+
+func (d *Database) recover() error {
+	replayed, err := d.recoverLegacy()
+	if err != nil {
+		return err
+	}
+	data, err := d.backend.ReadFile(d.wal.Name())
+	if err != nil {
+		return err
+	}
+	records, end := DecodeRecords(data)
+	stmts := make(map[uint64][]string, 64)
+	committed := make([]uint64, 0, 64) // 按commit记录的顺序重放
+	status := make(map[uint64]byte, 64)
+	commitLsn := make(map[uint64]uint64, 64)
+	for _, record := range records {
+		switch record.Type {
+		case walUpdate:
+			stmts[record.TxId] = append(stmts[record.TxId], string(record.Data))
+		case walCommit:
+			committed = append(committed, record.TxId)
+			status[record.TxId] = walCommit
+			commitLsn[record.TxId] = record.Lsn
+		case walAbort: // commit之后应用失败的事务会再写一条abort
+			status[record.TxId] = walAbort
+		}
+		if record.TxId > d.wal.txId {
+			d.wal.txId = record.TxId
+		}
+		if record.Lsn >= d.wal.lsn {
+			d.wal.lsn = record.Lsn + 1
+		}
+	}
+	if len(bytes.Trim(data[end:], "\x00")) != 0 { // mmap模式下文件尾部是预分配的0，不算损坏
+		logger.Warnf("rmdb: wal of database %s has %d torn bytes after lsn %d\n", d.dbName, len(data)-end, d.wal.lsn-1)
+	}
+	for _, txId := range committed {
+		if status[txId] != walCommit || commitLsn[txId] <= d.checkpointLsn { // checkpoint之前提交的事务已经在数据文件中
+			continue
+		}
+		err = d.replay(stmts[txId])
+		if err != nil {
+			return err
+		}
+		replayed++
+	}
+	if len(data) == 0 && replayed == 0 {
+		return nil
+	}
+	if replayed != 0 {
+		logger.Infof("rmdb: database %s replayed %d transactions from wal\n", d.dbName, replayed)
+		for _, table := range d.tables { // 重放的数据全部落盘后才能清空wal
+			err = table.Close()
+			if err != nil {
+				return err
+			}
+			err = table.file.Sync()
+			if err != nil {
+				return err
+			}
+		}
+		d.checkpointLsn = d.wal.lsn - 1
+		err = d.saveCatalog()
+		if err != nil {
+			return err
+		}
+	}
+	return d.wal.reset()
+}
+
+func (d *Database) replay(stmts []string) error {
+	tx := d.Begin()
+	tx.isReplay = true
+	for _, stmt := range stmts {
+		err := tx.CompileUpdate(stmt) // 跳过会丢掉已提交的数据，只能报错，注册好用到的函数之后再打开
+		if err != nil {
+			return fmt.Errorf("replay wal of database %s: %w", d.dbName, err)
+		}
+	}
+	tx.isUpdate = len(stmts) != 0
+	err := tx.Commit()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func (d *Database) recoverLegacy() (int, error) { // 旧版本的wal.txt每一行是一个已提交事务
+	legacyPath := fmt.Sprint(d.dbPath, string(os.PathSeparator), "wal.txt")
+	data, err := d.backend.ReadFile(legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	data = bytes.TrimRight(data, "\x00")
+	lines := bytes.Split(data, []byte("\n"))
+	replayed := 0
+	for i := 0; i < len(lines)-1; i++ { // 最后一段没有换行符，说明写入时崩溃了，直接丢弃
+		sql := strings.TrimSpace(string(lines[i]))
+		if len(sql) == 0 {
+			continue
+		}
+		err = d.replay(strings.Split(sql, ";"))
+		if err != nil {
+			return 0, err
+		}
+		replayed++
+	}
+	if replayed != 0 { // 必须先落盘再删除wal.txt
+		for _, table := range d.tables {
+			err = table.Close()
+			if err != nil {
+				return 0, err
+			}
+		}
+		d.checkpointLsn = d.wal.lsn - 1
+		err = d.saveCatalog()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return replayed, d.backend.Remove(legacyPath)
+}
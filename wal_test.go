@@ -0,0 +1,424 @@
+package rmdb
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const crashRootEnv = "RMDB_CRASH_ROOT"
+
+func TestCrashRecovery(t *testing.T) {
+	if root := os.Getenv(crashRootEnv); root != "" { // 子进程：不停地插入，直到被父进程kill
+		crashWorkload(root)
+		return
+	}
+
+	setTestOption(t)
+
+	db, err := CreateDatabase("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []struct {
+		name   string
+		typeOf int
+	}{{"name", STRING}, {"age", INT64}, {"id", INT64}, {"price", FLOAT64}} {
+		err = table.SetColumn(column.name, column.typeOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashRecovery$")
+	cmd.Env = append(os.Environ(), crashRootEnv+"="+GlobalOption.Root)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := 0
+	scanner := bufio.NewScanner(stdout)
+	for committed < 300 && scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "committed ") {
+			committed++
+		}
+	}
+	_ = cmd.Process.Kill() // 相当于kill -9，脏页和cata.log都来不及写
+	_ = cmd.Wait()
+	assert.Equal(t, 300, committed, "workload should commit 300 transactions before kill")
+
+	db, err = UseDatabase("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages := make(map[int64]struct{}, len(res.result))
+	for _, line := range res.result {
+		val, err := DecodeData(line.nameToVal["age"].value, INT64)
+		assert.Nil(t, err)
+		age, _ := val.(int64)
+		_, dup := ages[age]
+		assert.False(t, dup, "line should not be replayed twice")
+		ages[age] = struct{}{}
+	}
+	for i := 0; i < committed; i++ {
+		_, ok := ages[int64(i)]
+		assert.True(t, ok, fmt.Sprintf("committed line %d should be recovered", i))
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = UseDatabase("crash") // 正常关闭后wal已经清空，数据不能重复
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = db.Query("select * from test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(ages), len(res.result))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestWalRecord(t *testing.T) {
+	data := make([]byte, 0, 256)
+	data = append(data, EncodeRecord(WalRecord{Lsn: 1, TxId: 1, Type: walBegin})...)
+	data = append(data, EncodeRecord(WalRecord{Lsn: 2, TxId: 1, Type: walUpdate, Data: []byte(`insert into test (name) values ("john")`)})...)
+	data = append(data, EncodeRecord(WalRecord{Lsn: 3, TxId: 1, Type: walCommit})...)
+	records, end := DecodeRecords(data)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, len(data), end)
+	assert.Equal(t, `insert into test (name) values ("john")`, string(records[1].Data))
+
+	torn := append([]byte{}, data[:len(data)-3]...) // 最后一条记录只写了一半
+	records, _ = DecodeRecords(torn)
+	assert.Equal(t, 2, len(records))
+
+	corrupt := append([]byte{}, data...)
+	corrupt[walHeaderSize+walHeaderSize+3] ^= 0xff // 第二条记录的数据被改写
+	records, end = DecodeRecords(corrupt)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, walHeaderSize, end)
+
+	records, _ = DecodeRecords(make([]byte, 64)) // mmap预分配的0
+	assert.Equal(t, 0, len(records))
+}
+
+func TestWalUncommitted(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("uncommitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = UseDatabase("uncommitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(`insert into test (name) values ("committed")`)
+	assert.Nil(t, err)
+	tx := db.Begin()
+	err = tx.Update(`insert into test (name) values ("pending")`) // 没有commit
+	assert.Nil(t, err)
+	err = db.Update(`insert into test (name) values ("failed"); insert into nothing (name) values ("x")`)
+	assert.NotNil(t, err)
+	crashDatabase(db)
+
+	db, err = UseDatabase("uncommitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.result), "only committed transaction should be replayed")
+	if len(res.result) == 1 {
+		assert.Equal(t, "committed", string(res.result[0].nameToVal["name"].value))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestWalKeywordColumn(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("keyword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, desc STRING, order INT64)"))
+	stmt, err := parseStatement("update man set `desc` = `order` + 1 where `order` between 1 and 2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "update man set `desc` = `order` + 1 where `order` between 1 and 2", stmt.String(), "keywords are quoted in the redo record")
+	}
+	assert.Nil(t, db.Update("insert into man (name, `desc`, `order`) values ('a', 'first', 1)"))
+	assert.Nil(t, db.Update("insert into man (name, `desc`, `order`) values ('b', 'second', 2)"))
+	assert.Nil(t, db.Update("update man set `desc` = 'changed' where `order` = 2"))
+	crashDatabase(db)
+
+	db, err = UseDatabase("keyword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "b"}, orderedNames(t, db, "select name, `desc` from man order by `order`"), "committed rows survive replay")
+	assert.Equal(t, []string{"b"}, queryNames(t, db, "select * from man where `desc` = 'changed'"))
+	assert.Nil(t, db.Close())
+}
+
+func TestWalReplayFailure(t *testing.T) {
+	setTestOption(t)
+	defer delete(GlobalOption.CondiFuncs, "isB")
+
+	db, err := CreateDatabase("replayfail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, db.Update("create table man (name STRING, age INT64)"))
+	isB := func(vals []any) bool {
+		return vals[0] == "b"
+	}
+	db.CondiFuncs["isB"] = isB // 只注册在这个数据库上，重新打开之后就没有了
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("a", 1)`))
+	assert.Nil(t, db.Update(`insert into man (name, age) values ("b", 2)`))
+	assert.Nil(t, db.Update(`update man set age = 20 where isB(name)`))
+	crashDatabase(db)
+
+	_, err = UseDatabase("replayfail")
+	if assert.NotNil(t, err, "a committed transaction that cannot replay fails recovery") {
+		assert.Equal(t, "replay wal of database replayfail: invalid function name isB", err.Error())
+	}
+	GlobalOption.CondiFuncs["isB"] = isB
+	db, err = UseDatabase("replayfail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from man where age = 20")
+	assert.Nil(t, err)
+	assert.Len(t, res.result, 1)
+	assert.Equal(t, []string{"a", "b"}, queryNames(t, db, "select * from man"), "transactions before the failure are not replayed twice")
+	assert.Nil(t, db.Close())
+}
+
+func TestCheckpoint(t *testing.T) {
+	setTestOption(t)
+
+	db, err := CreateDatabase("checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Update(fmt.Sprintf(`insert into test (name) values ("before%d")`, i))
+		assert.Nil(t, err)
+	}
+	err = db.Checkpoint()
+	assert.Nil(t, err)
+	info, err := os.Stat(db.wal.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size(), "wal should be empty after checkpoint")
+	for _, page := range table.cache.pageMap {
+		assert.False(t, page.Value.(*Page).isDirty, "dirty page should be flushed by checkpoint")
+	}
+
+	tx := db.Begin()
+	err = tx.Update(`insert into test (name) values ("active")`) // checkpoint时还没提交
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		err = db.Update(fmt.Sprintf(`insert into test (name) values ("after%d")`, i))
+		assert.Nil(t, err)
+	}
+	err = tx.Update("checkpoint")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "ddl is not allowed in a transaction", err.Error())
+	}
+	err = db.Update(" CheckPoint; ")
+	assert.Nil(t, err)
+	data, err := os.ReadFile(db.wal.Name())
+	assert.Nil(t, err)
+	records, _ := DecodeRecords(data)
+	if assert.True(t, len(records) > 0, "records of active transaction should be kept") {
+		assert.Equal(t, uint64(walBegin), uint64(records[0].Type))
+		assert.Equal(t, tx.txId, records[0].TxId)
+	}
+	err = tx.Commit()
+	assert.Nil(t, err)
+	crashDatabase(db)
+
+	cata, err := loadCatalog(stdBackend{}, fmt.Sprint(GlobalOption.Root, string(os.PathSeparator), "checkpoint"))
+	assert.Nil(t, err)
+	assert.True(t, cata.Lsn > 0, "checkpoint lsn should be saved in catalog")
+
+	db, err = UseDatabase("checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Query("select * from test")
+	assert.Nil(t, err)
+	names := make(map[string]int, 16)
+	for _, line := range res.result {
+		names[string(line.nameToVal["name"].value)]++
+	}
+	assert.Equal(t, 16, len(names))
+	assert.Equal(t, 16, len(res.result), "transactions before checkpoint should not be replayed")
+	assert.Equal(t, 1, names["active"])
+
+	GlobalOption.CheckpointInterval = 20 * time.Millisecond
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = UseDatabase("checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(`insert into test (name) values ("background")`)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	db.ckptLock.RLock()
+	lsn := db.checkpointLsn
+	db.ckptLock.RUnlock()
+	assert.Equal(t, db.wal.lsn-1, lsn, "background checkpointer should advance checkpoint lsn")
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+type syncCounter struct {
+	FileIO
+	syncs int64
+}
+
+func (s *syncCounter) Sync() error {
+	atomic.AddInt64(&s.syncs, 1)
+	return s.FileIO.Sync()
+}
+
+func TestDurability(t *testing.T) {
+	setTestOption(t)
+	GlobalOption.GroupCommitWindow = 20 * time.Millisecond
+
+	db, err := CreateDatabase("durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := db.CreateTable("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.SetColumn("name", STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &syncCounter{FileIO: db.wal.file}
+	db.wal.file = counter
+
+	commit := func(n int) {
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				defer wg.Done()
+				err := db.Update(fmt.Sprintf(`insert into test (name) values ("%d")`, i))
+				assert.Nil(t, err)
+			}(i)
+		}
+		wg.Wait()
+	}
+	durable := func() bool {
+		db.wal.lock.Lock()
+		defer db.wal.lock.Unlock()
+		return db.wal.flushed == db.wal.lsn-1
+	}
+
+	assert.NotNil(t, db.SetDurability(42))
+
+	assert.Nil(t, db.SetDurability(SyncCommit))
+	commit(32)
+	assert.True(t, durable(), "sync commit should fsync before returning")
+	assert.True(t, atomic.LoadInt64(&counter.syncs) > 0)
+
+	assert.Nil(t, db.SetDurability(GroupCommit))
+	atomic.StoreInt64(&counter.syncs, 0)
+	commit(32)
+	assert.True(t, durable(), "group commit should fsync before returning")
+	syncs := atomic.LoadInt64(&counter.syncs)
+	assert.True(t, syncs > 0 && syncs < 32, fmt.Sprintf("group commit should batch fsync, got %d", syncs))
+
+	assert.Nil(t, db.SetDurability(AsyncCommit))
+	atomic.StoreInt64(&counter.syncs, 0)
+	commit(32)
+	time.Sleep(3 * GlobalOption.FlushInterval)
+	assert.True(t, durable(), "async commit should be flushed in background")
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func crashDatabase(db *Database) { // 模拟进程崩溃：只释放文件句柄，不刷脏页也不写cata.log
+	GlobalOption.lock.Lock()
+	defer GlobalOption.lock.Unlock()
+	db.stopCheckpointer()
+	for _, table := range db.tables {
+		_ = table.file.Close()
+		_ = table.closeIndexes()
+	}
+	_ = db.wal.Close()
+	delete(databases, db.dbName)
+}
+
+func crashWorkload(root string) {
+	GlobalOption.Root = root
+	GlobalOption.IOMode = Standard
+	db, err := UseDatabase("crash")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for i := 0; ; i++ {
+		err = db.Update(GetNumSql(i))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("committed %d\n", i)
+	}
+}